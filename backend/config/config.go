@@ -40,6 +40,18 @@ type Config struct {
 	EmailInvitationMaxValid time.Duration
 	EmailInvitationURL      string
 
+	EmailVerificationMaxValid time.Duration
+	EmailVerificationURL      string
+	PasswordResetMaxValid     time.Duration
+	PasswordResetURL          string
+
+	LoginMaxAttempts   int
+	LoginAttemptWindow time.Duration
+
+	// TrustedProxies are the comma separated IPs or CIDRs of proxies whose X-Forwarded-For header determines the
+	// client IP, e.g. for login limits and audit events. Without them the remote address is used
+	TrustedProxies string
+
 	DBPath           string
 	DBMigrationsPath string
 
@@ -49,10 +61,38 @@ type Config struct {
 	DockerContainerLimits   *ComposeLimitConfig
 	DockerContainerReplicas int
 
+	BackupsDir              string
+	BackupSchedulerInterval time.Duration
+
+	DiskUsageScanInterval time.Duration
+
+	ImageUpdateCheckInterval time.Duration
+
+	// ImagePullConcurrency is how many images of a project are pulled at once, ImagePullRetries how often failed
+	// pulls are retried
+	ImagePullConcurrency int
+	ImagePullRetries     int
+
+	BuildsDir     string
+	BuildRegistry string
+	BuildTimeout  time.Duration
+
+	PreviewTTL             time.Duration
+	PreviewCleanupInterval time.Duration
+
+	GitOpsPollInterval time.Duration
+
+	// SecretKeys are the master keys secrets are encrypted with, see secrets.NewKeyring
+	SecretKeys string
+
+	// RegistryCredentialHelpers are the comma separated credential helpers registry credentials may use
+	RegistryCredentialHelpers string
+
 	// Statics
 	PersistentVolumeDirectoryName string
+	SharedVolumeDirectoryName     string
+	EnvFileDirectoryName          string
 	DockerComposeFileName         string
-	DockerConfigFileName          string
 }
 
 func GetConfig() Config {
@@ -73,6 +113,16 @@ func GetConfig() Config {
 		EmailInvitationMaxValid: 7 * 24 * time.Hour,
 		EmailInvitationURL:      getEnv("EMAIL_INVITATION_URL", ""),
 
+		EmailVerificationMaxValid: 24 * time.Hour,
+		EmailVerificationURL:      getEnv("EMAIL_VERIFICATION_URL", ""),
+		PasswordResetMaxValid:     time.Hour,
+		PasswordResetURL:          getEnv("PASSWORD_RESET_URL", ""),
+
+		LoginMaxAttempts:   getEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LoginAttemptWindow: getEnvDuration("LOGIN_ATTEMPT_WINDOW", 15*time.Minute),
+
+		TrustedProxies: getEnv("TRUSTED_PROXIES", ""),
+
 		DBPath:           getEnv("DATABASE_PATH", "./database/database.sqlite"),
 		DBMigrationsPath: getEnv("DATABASE_MIGRATIONS_PATH", "./database/migrations/"),
 
@@ -94,9 +144,33 @@ func GetConfig() Config {
 		},
 		DockerContainerReplicas: getEnvInt("DOCKER_CONTAINER_MAX_REPLICAS", 1),
 
+		BackupsDir:              getEnv("BACKUPS_DIR", "./backups"),
+		BackupSchedulerInterval: time.Minute,
+
+		DiskUsageScanInterval: getEnvDuration("DISK_USAGE_SCAN_INTERVAL", 15*time.Minute),
+
+		ImageUpdateCheckInterval: getEnvDuration("IMAGE_UPDATE_CHECK_INTERVAL", 5*time.Minute),
+
+		ImagePullConcurrency: getEnvInt("IMAGE_PULL_CONCURRENCY", 4),
+		ImagePullRetries:     getEnvInt("IMAGE_PULL_RETRIES", 2),
+
+		BuildsDir:     getEnv("BUILDS_DIR", "./builds"),
+		BuildRegistry: getEnv("BUILD_REGISTRY", ""),
+		BuildTimeout:  getEnvDuration("BUILD_TIMEOUT", 30*time.Minute),
+
+		PreviewTTL:             getEnvDuration("PREVIEW_TTL", 72*time.Hour),
+		PreviewCleanupInterval: time.Minute,
+
+		GitOpsPollInterval: getEnvDuration("GITOPS_POLL_INTERVAL", time.Minute),
+
+		SecretKeys: getEnv("SECRET_KEYS", ""),
+
+		RegistryCredentialHelpers: getEnv("REGISTRY_CREDENTIAL_HELPERS", ""),
+
 		PersistentVolumeDirectoryName: "data",
+		SharedVolumeDirectoryName:     "shared",
+		EnvFileDirectoryName:          "env",
 		DockerComposeFileName:         "docker-compose.yml",
-		DockerConfigFileName:          "config.json",
 	}
 }
 
@@ -117,3 +191,14 @@ func getEnvInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if stringValue, exists := os.LookupEnv(key); exists {
+		value, err := time.ParseDuration(stringValue)
+		if err != nil || value <= 0 {
+			return fallback
+		}
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func bearerToken(req *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	return token, ok && token != ""
+}
+
+// authenticateAPIToken assigns the user of the token for the current request, like AuthMiddleware does for sessions.
+func (h *Handler) authenticateAPIToken(ctx *gin.Context, token string) {
+	identity, err := h.service.AuthenticateAPIToken(token, services.ScopeForMethod(ctx.Request.Method))
+	switch {
+	case errors.Is(err, services.ErrInvalidToken):
+		h.abortWithError(ctx, http.StatusUnauthorized, "invalid api token", err)
+		return
+	case errors.Is(err, services.ErrMissingScope):
+		h.abortWithError(ctx, http.StatusForbidden, "insufficient scope", err)
+		return
+	case err != nil:
+		h.abortWithError(ctx, http.StatusUnauthorized, "unable to authenticate api token", err)
+		return
+	}
+
+	ctx.Set(UserSessionKey, identity.UserID)
+	ctx.Set(UserCurrentOrganisationIDKey, identity.OrganisationID)
+	ctx.Set(APITokenKey, identity)
+	ctx.Next()
+}
+
+func apiTokenFromRequest(ctx *gin.Context) (*services.APITokenIdentity, bool) {
+	identity, ok := ctx.Get(APITokenKey)
+	if !ok {
+		return nil, false
+	}
+	return identity.(*services.APITokenIdentity), true
+}
+
+// SessionOnlyMiddleware rejects requests authenticated by an API token, e.g. to prevent tokens from creating tokens.
+// It must be chained after the AuthMiddleware.
+func (h *Handler) SessionOnlyMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if _, ok := apiTokenFromRequest(ctx); ok {
+			h.abortWithError(ctx, http.StatusForbidden, "not allowed with api tokens", nil)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// APITokenScopeMiddleware requires the scope from requests authenticated by an API token, in addition to the
+// scope of the request method. Requests with a session are passed. It must be chained after the AuthMiddleware.
+func (h *Handler) APITokenScopeMiddleware(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if identity, ok := apiTokenFromRequest(ctx); ok && !identity.HasScope(scope) {
+			h.abortWithError(ctx, http.StatusForbidden, "insufficient scope", services.ErrMissingScope)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func (h *Handler) HandleGETUserTokens(ctx *gin.Context) {
+	tokens, err := h.service.SelectPersonalAPITokens(userIDFromSession(ctx))
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get api tokens", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+func (h *Handler) HandlePOSTUserToken(ctx *gin.Context) {
+	var t services.APIToken
+	if err := ctx.BindJSON(&t); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	if err := t.Validate(); err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid api token", err)
+		return
+	}
+	userID, err := strconv.Atoi(userIDFromSession(ctx))
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "invalid user id", err)
+		return
+	}
+	t.UserID = userID
+	// Tokens act in the organisation of the request, the current one of the user by default
+	if t.OrganisationID == nil {
+		organisationID, err := strconv.Atoi(currentOrganisationIDFromSession(ctx))
+		if err != nil {
+			HandleError(ctx, http.StatusBadRequest, "invalid organisation id", err)
+			return
+		}
+		t.OrganisationID = &organisationID
+	}
+	if !h.authorize(ctx, *t.OrganisationID, services.PermissionOrganisationView) {
+		return
+	}
+	if err := h.service.SavePersonalAPIToken(&t); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save api token", err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, t)
+}
+
+func (h *Handler) HandleDELETEUserToken(ctx *gin.Context) {
+	tokenID, err := strconv.Atoi(ctx.Param("token_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid api token id", err)
+		return
+	}
+	err = h.service.DeletePersonalAPIToken(userIDFromSession(ctx), tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find api token", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to revoke api token", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+func (h *Handler) HandleGETOrganisationTokens(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	tokens, err := h.service.SelectOrganisationAPITokens(organisationID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get api tokens", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+func (h *Handler) HandlePOSTOrganisationToken(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	var t services.APIToken
+	if err := ctx.BindJSON(&t); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	if err := t.Validate(); err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid api token", err)
+		return
+	}
+	if err := h.service.SaveOrganisationAPIToken(&t, organisationID); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save api token", err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, t)
+}
+
+func (h *Handler) HandleDELETEOrganisationToken(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	tokenID, err := strconv.Atoi(ctx.Param("token_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid api token id", err)
+		return
+	}
+	err = h.service.DeleteOrganisationAPIToken(organisationID, tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find api token", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to revoke api token", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
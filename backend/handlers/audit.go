@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// ProjectTokenKey is the project token a request is authenticated with, set by projectFromToken.
+const ProjectTokenKey = "projectToken"
+
+// HookProviderKey is the provider of a verified hook delivery, e.g. "github".
+const HookProviderKey = "hookProvider"
+
+// actorFromRequest returns who causes the mutations of the request, see services.S.As.
+func actorFromRequest(ctx *gin.Context) services.Actor {
+	actor := services.Actor{Type: services.ActorTypeUser, IP: ctx.ClientIP(), UserAgent: ctx.Request.UserAgent()}
+	if provider, ok := ctx.Get(HookProviderKey); ok {
+		actor.Type = services.ActorTypeHook
+		actor.Name = fmt.Sprintf("%v", provider)
+		return actor
+	}
+	if token, ok := ctx.Get(ProjectTokenKey); ok {
+		actor.Type = services.ActorTypeProjectToken
+		actor.TokenID = token.(*services.ProjectToken).ID
+		return actor
+	}
+	if identity, ok := apiTokenFromRequest(ctx); ok {
+		actor.Type = services.ActorTypeAPIToken
+		actor.TokenID = identity.TokenID
+	}
+	actor.UserID, _ = strconv.Atoi(userIDFromSession(ctx))
+	return actor
+}
+
+// withActor returns a copy of the handler whose service records the actor of the request with audit events.
+// Handlers of hooks call it once the request is verified, the ones behind AuthMiddleware get it by audited.
+func (h *Handler) withActor(ctx *gin.Context) *Handler {
+	c := *h
+	c.service = h.service.As(actorFromRequest(ctx))
+	return &c
+}
+
+// audited runs the handler of a route behind AuthMiddleware with the actor of the request, after the middlewares
+// authenticated it, so that none of its audit events is recorded as done by the system.
+func (h *Handler) audited(handle func(*Handler, *gin.Context)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		handle(h.withActor(ctx), ctx)
+	}
+}
+
+// HandleGETAuditEvents lists the audit events of the organisation, filtered by the "action", "actor_type",
+// "actor_user_id", "project_id", "from" and "to" (RFC 3339) query parameters. With "?format=csv" or "?format=json"
+// the events are downloaded as file.
+func (h *Handler) HandleGETAuditEvents(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionAuditView)
+	if !ok {
+		return
+	}
+	filter, err := auditFilterFromQuery(ctx)
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	format := ctx.Query("format")
+	if format != "" && filter.Limit == 0 {
+		filter.Limit = services.MaxAuditLimit
+	}
+	events, err := h.service.SelectAuditEvents(organisationID, filter)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get audit events", err)
+		return
+	}
+
+	filename := fmt.Sprintf("audit-%d-%s", organisationID, time.Now().UTC().Format("20060102-150405"))
+	switch format {
+	case "":
+		ctx.JSON(http.StatusOK, events)
+	case "json":
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+		ctx.JSON(http.StatusOK, events)
+	case "csv":
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+		ctx.Header("Content-Type", "text/csv; charset=utf-8")
+		ctx.Status(http.StatusOK)
+		writeAuditCSV(ctx.Writer, events)
+	default:
+		HandleError(ctx, http.StatusBadRequest, "unsupported format", fmt.Errorf("unsupported format %q", format))
+	}
+}
+
+func auditFilterFromQuery(ctx *gin.Context) (services.AuditFilter, error) {
+	filter := services.AuditFilter{
+		Action:    ctx.Query("action"),
+		ActorType: ctx.Query("actor_type"),
+	}
+	ints := map[string]*int{
+		"actor_user_id": &filter.ActorUserID,
+		"project_id":    &filter.ProjectID,
+		"limit":         &filter.Limit,
+		"offset":        &filter.Offset,
+	}
+	for key, value := range ints {
+		if q := ctx.Query(key); q != "" {
+			v, err := strconv.Atoi(q)
+			if err != nil || v < 0 {
+				return filter, fmt.Errorf("invalid %s %q", key, q)
+			}
+			*value = v
+		}
+	}
+	times := map[string]**time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	}
+	for key, value := range times {
+		if q := ctx.Query(key); q != "" {
+			t, err := time.Parse(time.RFC3339, q)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %q, expected RFC 3339", key, q)
+			}
+			*value = &t
+		}
+	}
+	return filter, nil
+}
+
+func writeAuditCSV(w http.ResponseWriter, events []services.AuditEvent) {
+	optional := func(v *int) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.Itoa(*v)
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{
+		"id", "created_at", "actor_type", "actor_user_id", "actor_token_id", "actor_name", "action", "target",
+		"project_id", "project_name", "before", "after", "ip", "user_agent",
+	})
+	for _, e := range events {
+		_ = cw.Write([]string{
+			strconv.Itoa(e.ID), e.CreatedAt.UTC().Format(time.RFC3339), e.ActorType, optional(e.ActorUserID),
+			optional(e.ActorTokenID), csvText(e.ActorName), e.Action, csvText(e.Target), optional(e.ProjectID),
+			csvText(e.ProjectName), string(e.Before), string(e.After), e.IP, csvText(e.UserAgent),
+		})
+	}
+	cw.Flush()
+}
+
+// csvText prefixes text starting like a formula with "'", so that spreadsheets show it as text.
+func csvText(v string) string {
+	if v != "" && strings.ContainsAny(v[:1], "=+-@\t\r") {
+		return "'" + v
+	}
+	return v
+}
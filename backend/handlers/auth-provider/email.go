@@ -0,0 +1,215 @@
+package authprovider
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/email"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// EmailProvider logs in local accounts with their email and password. The callback expects them as JSON in the body
+// of a POST request. Next to the AuthProvider methods it handles sign-ups, email verification and password resets.
+type EmailProvider struct {
+	Request *http.Request
+}
+
+type emailCredentials struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Username string `json:"username"`
+}
+
+type emailTokenRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password"`
+}
+
+type emailRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+func (p *EmailProvider) SetRequest(req *http.Request) error {
+	p.Request = req
+	return nil
+}
+
+// HandleGETAuthenticate responds with the user of the session if it was logged in with a password.
+func (p *EmailProvider) HandleGETAuthenticate(c *gin.Context) error {
+	session, err := GetUserSession(c.Request)
+	if err != nil || session.GothUser.Provider != services.AuthMethodEmailPassword {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil
+	}
+	c.JSON(http.StatusOK, CreateUserResponse(session))
+	return nil
+}
+
+func (p *EmailProvider) HandleGETAuthenticateCallback(tx *sqlx.Tx, c *gin.Context) (int, error) {
+	var credentials emailCredentials
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		return http.StatusBadRequest, err
+	}
+	user, err := services.AuthenticatePassword(credentials.Email, credentials.Password, c.ClientIP(), tx)
+	if err != nil {
+		return statusFromEmailError(c, err), err
+	}
+
+	// Local accounts have no social ID, the AuthMiddleware matches their auth method by the user ID instead
+	u := &goth.User{Provider: services.AuthMethodEmailPassword, Email: *user.Email}
+	if user.UserName != nil {
+		u.NickName = *user.UserName
+	}
+	session, err := StoreUserInSession(user.UserID, user.CurrentOrganisationID, u, c.Request, c.Writer)
+	if err != nil {
+		slog.Error("unable to store user data in session", "err", err)
+		return http.StatusInternalServerError, err
+	}
+	c.JSON(http.StatusOK, CreateUserResponse(session))
+	return http.StatusOK, nil
+}
+
+func (p *EmailProvider) HandleLogout(c *gin.Context) error {
+	err := gothic.Logout(c.Writer, c.Request)
+	if err != nil {
+		slog.Error("unable to logout user", "err", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "logged out",
+	})
+	return nil
+}
+
+// HandlePOSTSignUp creates a local account and sends the link to verify its email. Sign-ups of registered emails get
+// the same response, so it doesn't tell which emails are registered, their owner gets a link to choose a password.
+func (p *EmailProvider) HandlePOSTSignUp(tx *sqlx.Tx, c *gin.Context) (int, error) {
+	var credentials emailCredentials
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		return http.StatusBadRequest, err
+	}
+	user, token, err := services.SignUpWithPassword(credentials.Email, credentials.Username, credentials.Password, tx)
+	switch {
+	case errors.Is(err, services.ErrEmailTaken):
+		if err := sendAccountExistsMail(credentials.Email, tx); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case err != nil:
+		return statusFromEmailError(c, err), err
+	default:
+		if err := email.SendVerificationMail(config.GetConfig().EmailVerificationURL, token, *user.Email); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "verification email sent"})
+	return http.StatusCreated, nil
+}
+
+// sendAccountExistsMail sends the owner of a registered email a link to choose a password. Like password resets the
+// emails are rate limited, limited ones are skipped silently.
+func sendAccountExistsMail(address string, tx *sqlx.Tx) error {
+	user, token, err := services.CreatePasswordReset(address, tx)
+	var rateLimited *services.LoginRateLimitError
+	if errors.As(err, &rateLimited) || (err == nil && user == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return email.SendAccountExistsMail(config.GetConfig().PasswordResetURL, token, *user.Email)
+}
+
+// HandlePOSTVerifyEmail verifies the email of a local account with the token of the verification link.
+func (p *EmailProvider) HandlePOSTVerifyEmail(tx *sqlx.Tx, c *gin.Context) (int, error) {
+	var req emailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if _, err := services.VerifyEmail(req.Token, tx); err != nil {
+		return statusFromEmailError(c, err), err
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "email verified"})
+	return http.StatusOK, nil
+}
+
+// HandlePOSTResendVerification sends a new verification link. It responds the same whether the email has an
+// unverified account or not, so the response doesn't tell which emails are registered.
+func (p *EmailProvider) HandlePOSTResendVerification(tx *sqlx.Tx, c *gin.Context) (int, error) {
+	var req emailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	user, token, err := services.CreateEmailVerification(req.Email, tx)
+	if err != nil {
+		return statusFromEmailError(c, err), err
+	}
+	if user != nil {
+		if err := email.SendVerificationMail(config.GetConfig().EmailVerificationURL, token, *user.Email); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "verification email sent if the account exists"})
+	return http.StatusAccepted, nil
+}
+
+// HandlePOSTPasswordResetRequest sends a link to set a new password. Like HandlePOSTResendVerification it doesn't
+// tell whether the email is registered.
+func (p *EmailProvider) HandlePOSTPasswordResetRequest(tx *sqlx.Tx, c *gin.Context) (int, error) {
+	var req emailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	user, token, err := services.CreatePasswordReset(req.Email, tx)
+	if err != nil {
+		return statusFromEmailError(c, err), err
+	}
+	if user != nil {
+		if err := email.SendPasswordResetMail(config.GetConfig().PasswordResetURL, token, *user.Email); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "password reset email sent if the account exists"})
+	return http.StatusAccepted, nil
+}
+
+// HandlePOSTPasswordReset sets the password with the token of the reset link.
+func (p *EmailProvider) HandlePOSTPasswordReset(tx *sqlx.Tx, c *gin.Context) (int, error) {
+	var req emailTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if _, err := services.ResetPassword(req.Token, req.Password, tx); err != nil {
+		return statusFromEmailError(c, err), err
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password changed"})
+	return http.StatusOK, nil
+}
+
+// statusFromEmailError maps errors of local accounts to a status, rate limited requests get a "Retry-After" header.
+func statusFromEmailError(c *gin.Context, err error) int {
+	var rateLimited *services.LoginRateLimitError
+	switch {
+	case errors.As(err, &rateLimited):
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.RetryAfter.Seconds()))))
+		return http.StatusTooManyRequests
+	case errors.Is(err, services.ErrInvalidCredentials):
+		return http.StatusUnauthorized
+	case errors.Is(err, services.ErrEmailNotVerified):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrInvalidEmail), errors.Is(err, services.ErrInvalidPassword),
+		errors.Is(err, services.ErrInvalidToken):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
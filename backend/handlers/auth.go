@@ -15,6 +15,7 @@ import (
 
 const UserSessionKey = "user"
 const UserCurrentOrganisationIDKey = "currentOrganisationID"
+const APITokenKey = "apiToken"
 
 type AuthProvider interface {
 	SetRequest(req *http.Request) error
@@ -23,9 +24,13 @@ type AuthProvider interface {
 	HandleLogout(c *gin.Context) error
 }
 
+// emailProvider logs in local accounts, its callback is the POST route with the credentials.
+var emailProvider = &authprovider.EmailProvider{}
+
 var providers = map[string]AuthProvider{
 	"github": &authprovider.GitHubProvider{},
 	"google": &authprovider.GoogleProvider{},
+	"email":  emailProvider,
 }
 
 func assignProvider(c *gin.Context) *AuthProvider {
@@ -91,6 +96,41 @@ func (h *Handler) HandleGETAuthenticateCallback(c *gin.Context) {
 	}
 }
 
+func (h *Handler) HandlePOSTSignUp(c *gin.Context) {
+	enableCors(c.Writer)
+	h.WithTransaction(c, func(tx *sqlx.Tx) (int, error) {
+		return emailProvider.HandlePOSTSignUp(tx, c)
+	})
+}
+
+func (h *Handler) HandlePOSTVerifyEmail(c *gin.Context) {
+	enableCors(c.Writer)
+	h.WithTransaction(c, func(tx *sqlx.Tx) (int, error) {
+		return emailProvider.HandlePOSTVerifyEmail(tx, c)
+	})
+}
+
+func (h *Handler) HandlePOSTResendVerification(c *gin.Context) {
+	enableCors(c.Writer)
+	h.WithTransaction(c, func(tx *sqlx.Tx) (int, error) {
+		return emailProvider.HandlePOSTResendVerification(tx, c)
+	})
+}
+
+func (h *Handler) HandlePOSTPasswordResetRequest(c *gin.Context) {
+	enableCors(c.Writer)
+	h.WithTransaction(c, func(tx *sqlx.Tx) (int, error) {
+		return emailProvider.HandlePOSTPasswordResetRequest(tx, c)
+	})
+}
+
+func (h *Handler) HandlePOSTPasswordReset(c *gin.Context) {
+	enableCors(c.Writer)
+	h.WithTransaction(c, func(tx *sqlx.Tx) (int, error) {
+		return emailProvider.HandlePOSTPasswordReset(tx, c)
+	})
+}
+
 func (h *Handler) HandleGETLogout(c *gin.Context) {
 	p := assignProvider(c)
 	if p != nil {
@@ -103,7 +143,9 @@ func (h *Handler) HandleGETLogout(c *gin.Context) {
 
 // AuthMiddleware retrieves the user from the current Goth session storage.
 // If a user exists with a matching social ID and provider combination, their user ID is fetched
-// and assigned for the current session.
+// and assigned for the current session. Local accounts have no social ID and are matched by their user ID.
+// Requests with an "Authorization: Bearer" header are authenticated by their API token instead,
+// which needs the scope matching the request method.
 //
 // Important: Avoid changing the user ID elsewhere as this could disrupt SQL relationships
 // in tables such as `organisations` and `projects`.
@@ -116,6 +158,11 @@ func (h *Handler) HandleGETLogout(c *gin.Context) {
 //   - A Gin HandlerFunc that manages the request authentication.
 func (h *Handler) AuthMiddleware() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		if token, ok := bearerToken(ctx.Request); ok {
+			h.authenticateAPIToken(ctx, token)
+			return
+		}
+
 		u, err := authprovider.GetUserSession(ctx.Request)
 		if err != nil {
 			ctx.AbortWithStatus(http.StatusUnauthorized)
@@ -127,9 +174,9 @@ func (h *Handler) AuthMiddleware() gin.HandlerFunc {
 		query := `
 			SELECT true
 			FROM auth_methods
-			WHERE social_id = ?
+			WHERE social_id = ? OR (social_id IS NULL AND method_type = ? AND user_id = ?)
 		`
-		err = h.dbService.GetConn().Get(&hasAuthMethod, query, u.GothUser.UserID)
+		err = h.dbService.GetConn().Get(&hasAuthMethod, query, u.GothUser.UserID, u.GothUser.Provider, u.BackendUserID)
 
 		if !hasAuthMethod {
 			ctx.AbortWithStatus(http.StatusUnauthorized)
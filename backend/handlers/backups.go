@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func (h *Handler) HandleGETBackupSchedules(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	schedules, err := h.service.SelectBackupSchedules(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get backup schedules", err)
+		return
+	}
+	for i := range schedules {
+		schedules[i].MaskSecrets()
+	}
+	ctx.JSON(http.StatusOK, schedules)
+}
+
+func (h *Handler) HandlePOSTBackupSchedule(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	var bs services.BackupSchedule
+	if err := ctx.BindJSON(&bs); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	bs.ProjectID = p.ID
+	if err := bs.Validate(p); err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid backup schedule", err)
+		return
+	}
+	if err := h.service.SaveBackupSchedule(&bs); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save backup schedule", err)
+		return
+	}
+	bs.MaskSecrets()
+	ctx.JSON(http.StatusCreated, bs)
+}
+
+func (h *Handler) HandlePUTBackupSchedule(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	scheduleID, err := strconv.Atoi(ctx.Param("schedule_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid backup schedule id", err)
+		return
+	}
+	var bs services.BackupSchedule
+	if err := ctx.BindJSON(&bs); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	bs.ID = scheduleID
+	bs.ProjectID = p.ID
+	if err := bs.Validate(p); err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid backup schedule", err)
+		return
+	}
+	if err := h.service.UpdateBackupSchedule(&bs); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to update backup schedule", err)
+		return
+	}
+	bs.MaskSecrets()
+	ctx.JSON(http.StatusOK, bs)
+}
+
+func (h *Handler) HandleDELETEBackupSchedule(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	scheduleID, err := strconv.Atoi(ctx.Param("schedule_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid backup schedule id", err)
+		return
+	}
+	if err := h.service.DeleteBackupSchedule(ctx, p.ID, scheduleID); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to delete backup schedule", err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// HandlePOSTRunBackupSchedule triggers a backup outside of its schedule. The backup runs in the background,
+// its progress is visible in the list of backups. Only one backup of a schedule runs at a time.
+func (h *Handler) HandlePOSTRunBackupSchedule(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	scheduleID, err := strconv.Atoi(ctx.Param("schedule_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid backup schedule id", err)
+		return
+	}
+	bs, err := h.service.SelectBackupSchedule(p.ID, scheduleID)
+	if err != nil {
+		HandleError(ctx, http.StatusNotFound, "unable to find backup schedule", err)
+		return
+	}
+
+	err = h.service.StartBackupSchedule(context.Background(), bs)
+	if errors.Is(err, services.ErrBackupRunning) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to start backup", err)
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+func (h *Handler) HandleGETBackups(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	runs, err := h.service.SelectBackupRuns(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get backups", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, runs)
+}
+
+func (h *Handler) HandlePOSTRestoreBackup(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	runID, err := strconv.Atoi(ctx.Param("backup_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid backup id", err)
+		return
+	}
+	run, err := h.service.SelectBackupRun(p.ID, runID)
+	if err != nil {
+		HandleError(ctx, http.StatusNotFound, "unable to find backup", err)
+		return
+	}
+	if err := h.service.RestoreBackupRun(ctx, p, run); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to restore backup", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
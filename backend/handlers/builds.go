@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// HandlePOSTServiceBuild builds the image of a service from its repository and deploys it afterward.
+// The build runs in the background, its log can be followed with HandleStreamBuildLog.
+func (h *Handler) HandlePOSTServiceBuild(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	service, ok := h.serviceFromRequest(ctx, p)
+	if !ok {
+		return
+	}
+
+	b, err := h.service.StartBuild(p, service, h.redeployServices)
+	switch {
+	case errors.Is(err, services.ErrBuildRunning):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrNoBuildSource):
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	case err != nil:
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to start build", err)
+		return
+	}
+	ctx.JSON(http.StatusAccepted, b)
+}
+
+func (h *Handler) HandleGETServiceBuilds(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	builds, err := h.service.SelectServiceBuilds(p.ID, ctx.Param("usn"))
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get builds", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, builds)
+}
+
+func (h *Handler) buildFromRequest(ctx *gin.Context) (*services.ServiceBuild, bool) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return nil, false
+	}
+	buildID, err := strconv.Atoi(ctx.Param("build_id"))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+	b, err := h.service.SelectServiceBuild(p.ID, buildID)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find build", err)
+		return nil, false
+	}
+	return b, true
+}
+
+// HandleGETServiceBuild returns a build including its log, which is complete once the build finished.
+func (h *Handler) HandleGETServiceBuild(ctx *gin.Context) {
+	b, ok := h.buildFromRequest(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, b)
+}
+
+// HandleStreamBuildLog sends the log of a build and follows it until the build finished.
+func (h *Handler) HandleStreamBuildLog(ctx *gin.Context) {
+	b, ok := h.buildFromRequest(ctx)
+	if !ok {
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to upgrade http to ws", err)
+		return
+	}
+	defer conn.Close()
+
+	// Stop following when the client goes away
+	c, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	if err := h.service.StreamBuildLog(c, b, wsWriter{conn}); err != nil && c.Err() == nil {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// wsWriter sends everything written as text message.
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (w wsWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
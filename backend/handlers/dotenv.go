@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+const maxDotenvSize = 1 << 20
+
+// HandleGETServiceEnv downloads the env vars of the service as dotenv file, secret values are masked.
+func (h *Handler) HandleGETServiceEnv(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	service, ok := h.serviceFromRequest(ctx, p)
+	if !ok {
+		return
+	}
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.env"`, service.Name))
+	ctx.Data(http.StatusOK, "text/plain; charset=utf-8", service.ExportEnv())
+}
+
+// HandlePOSTServiceEnv lists the changes a dotenv file makes to the env vars of the service, with "?confirm=true"
+// they're imported and the service is redeployed. The file is either the body or the "file" field of a multipart
+// form of at most 1 MiB. With "?merge=true" env vars which aren't part of the file are kept.
+func (h *Handler) HandlePOSTServiceEnv(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	service, ok := h.serviceFromRequest(ctx, p)
+	if !ok {
+		return
+	}
+
+	body := io.Reader(ctx.Request.Body)
+	if strings.HasPrefix(ctx.ContentType(), "multipart/") {
+		fh, err := ctx.FormFile("file")
+		if err != nil {
+			HandleError(ctx, http.StatusBadRequest, "missing dotenv file", err)
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			HandleError(ctx, http.StatusBadRequest, "unable to read dotenv file", err)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	content, err := io.ReadAll(io.LimitReader(body, maxDotenvSize+1))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "unable to read dotenv file", err)
+		return
+	}
+	if len(content) > maxDotenvSize {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "dotenv file exceeds 1 MiB"})
+		return
+	}
+
+	result, err := service.ImportEnv(string(content), ctx.Query("merge") == "true")
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if ctx.Query("confirm") != "true" {
+		ctx.JSON(http.StatusOK, result)
+		return
+	}
+	err = h.redeployServices(p, []string{service.Usn})
+	if errors.Is(err, services.ErrServicesHeld) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": services.ErrServicesHeld.Error()})
+		return
+	}
+	if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to deploy service", err)
+		return
+	}
+	result.Applied = true
+	ctx.JSON(http.StatusOK, result)
+}
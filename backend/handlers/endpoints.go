@@ -1,45 +1,121 @@
 package handlers
 
-import "github.com/gin-gonic/gin"
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/devs-group/sloth/backend/services"
+)
 
 func (h *Handler) RegisterEndpoints(r *gin.RouterGroup) {
 	// Organisation
-	r.POST("organisation", h.AuthMiddleware(), h.HandleCreateOrganisation)
-	r.DELETE("organisation/:id", h.AuthMiddleware(), h.HandleDeleteOrganisation)
-	r.GET("organisations", h.AuthMiddleware(), h.HandleListOrganisations)
-	r.GET("organisation/:id", h.AuthMiddleware(), h.HandleGetOrganisation)
-	r.DELETE("organisation/member/:id/:member_id", h.AuthMiddleware(), h.HandleDeleteOrganisationMember)
-	r.PUT("organisation/member/:id/:member_id", h.AuthMiddleware(), h.HandlePUTMember)
-	r.PUT("organisation/member", h.AuthMiddleware(), h.HandleCreateOrganisationInvitation)
-	r.POST("organisation/accept_invitation", h.AuthMiddleware(), h.HandlePOSTAcceptInvitation)
-	r.DELETE("organisation/withdraw_invitation", h.AuthMiddleware(), h.HandleDELETEWithdrawInvitation)
-	r.GET("organisation/:id/projects", h.AuthMiddleware(), h.HandleGETOrganisationProjects)
-	r.PUT("organisation/project", h.AuthMiddleware(), h.HandlePUTOrganisationProject)
-	r.DELETE("organisation/project", h.AuthMiddleware(), h.HandleRemoveProjectFromOrganisation)
-	r.GET("organisation/:id/invitations", h.AuthMiddleware(), h.HandleGETInvitations)
+	r.POST("organisation", h.AuthMiddleware(), h.audited((*Handler).HandleCreateOrganisation))
+	r.DELETE("organisation/:id", h.AuthMiddleware(), h.audited((*Handler).HandleDeleteOrganisation))
+	r.GET("organisations", h.AuthMiddleware(), h.audited((*Handler).HandleListOrganisations))
+	r.GET("organisation/:id", h.AuthMiddleware(), h.audited((*Handler).HandleGetOrganisation))
+	r.DELETE("organisation/member/:id/:member_id", h.AuthMiddleware(), h.audited((*Handler).HandleDeleteOrganisationMember))
+	r.PUT("organisation/member/:id/:member_id", h.AuthMiddleware(), h.audited((*Handler).HandlePUTMember))
+	r.POST("organisation/:id/leave", h.AuthMiddleware(), h.audited((*Handler).HandlePOSTLeaveOrganisation))
+	r.PUT("organisation/:id/members/:member_id/role", h.AuthMiddleware(), h.audited((*Handler).HandlePUTMemberRole))
+	r.PUT("organisation/member", h.AuthMiddleware(), h.audited((*Handler).HandleCreateOrganisationInvitation))
+	r.POST("organisation/accept_invitation", h.AuthMiddleware(), h.audited((*Handler).HandlePOSTAcceptInvitation))
+	r.DELETE("organisation/withdraw_invitation", h.AuthMiddleware(), h.audited((*Handler).HandleDELETEWithdrawInvitation))
+	r.GET("organisation/:id/projects", h.AuthMiddleware(), h.audited((*Handler).HandleGETOrganisationProjects))
+	r.PUT("organisation/project", h.AuthMiddleware(), h.audited((*Handler).HandlePUTOrganisationProject))
+	r.DELETE("organisation/project", h.AuthMiddleware(), h.audited((*Handler).HandleRemoveProjectFromOrganisation))
+	r.GET("organisation/:id/invitations", h.AuthMiddleware(), h.audited((*Handler).HandleGETInvitations))
+	r.GET("organisation/:id/usage", h.AuthMiddleware(), h.audited((*Handler).HandleGETOrganisationUsage))
+	r.GET("organisation/:id/audit", h.AuthMiddleware(), h.audited((*Handler).HandleGETAuditEvents))
+	r.GET("organisation/:id/tokens", h.AuthMiddleware(), h.SessionOnlyMiddleware(), h.audited((*Handler).HandleGETOrganisationTokens))
+	r.POST("organisation/:id/tokens", h.AuthMiddleware(), h.SessionOnlyMiddleware(), h.audited((*Handler).HandlePOSTOrganisationToken))
+	r.DELETE("organisation/:id/tokens/:token_id", h.AuthMiddleware(), h.SessionOnlyMiddleware(), h.audited((*Handler).HandleDELETEOrganisationToken))
+	r.GET("organisation/:id/env-groups", h.AuthMiddleware(), h.audited((*Handler).HandleGETEnvGroups))
+	r.PUT("organisation/:id/env-groups/:name", h.AuthMiddleware(), h.audited((*Handler).HandlePUTEnvGroup))
+	r.DELETE("organisation/:id/env-groups/:name", h.AuthMiddleware(), h.audited((*Handler).HandleDELETEEnvGroup))
+	r.GET("organisation/:id/env-groups/:name/projects", h.AuthMiddleware(), h.audited((*Handler).HandleGETEnvGroupProjects))
+	r.GET("organisation/:id/registry-credentials", h.AuthMiddleware(), h.audited((*Handler).HandleGETRegistryCredentials))
+	r.PUT("organisation/:id/registry-credentials/:name", h.AuthMiddleware(), h.audited((*Handler).HandlePUTRegistryCredential))
+	r.DELETE("organisation/:id/registry-credentials/:name", h.AuthMiddleware(), h.audited((*Handler).HandleDELETERegistryCredential))
+	r.GET("organisation/:id/registry-credentials/:name/projects", h.AuthMiddleware(), h.audited((*Handler).HandleGETRegistryCredentialProjects))
+	r.POST("organisation/:id/registry-credentials/:name/test", h.AuthMiddleware(), h.audited((*Handler).HandlePOSTRegistryCredentialTest))
 
 	// Projects
-	r.POST("project", h.AuthMiddleware(), h.HandleCreateProject)
-	r.PUT("project/:id", h.AuthMiddleware(), h.HandleUpdateProject)
-	r.GET("project/:id", h.AuthMiddleware(), h.HandleGetProject)
-	r.GET("projects", h.AuthMiddleware(), h.HandleListProjects)
-	r.DELETE("project/:id", h.AuthMiddleware(), h.HandleDeleteProject)
-	r.GET("project/state/:id", h.AuthMiddleware(), h.HandleGetProjectState)
-	r.GET("ws/project/logs/:upn/:usn", h.AuthMiddleware(), h.HandleStreamServiceLogs) // using upn and usn because depends on docker compose logs which is using the service name
-	r.GET("ws/project/shell/:usn/:projectID", h.AuthMiddleware(), h.HandleStreamShell)
+	r.POST("project", h.AuthMiddleware(), h.PermissionMiddleware(services.PermissionProjectCreate), h.audited((*Handler).HandleCreateProject))
+	r.PUT("project/:id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandleUpdateProject))
+	r.GET("project/:id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGetProject))
+	r.GET("projects", h.AuthMiddleware(), h.PermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleListProjects))
+	r.DELETE("project/:id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectCreate), h.audited((*Handler).HandleDeleteProject))
+	r.GET("project/:id/members", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETProjectMembers))
+	r.PUT("project/:id/members", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionMembersManage), h.audited((*Handler).HandlePUTProjectMember))
+	r.DELETE("project/:id/members/:user_id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionMembersManage), h.audited((*Handler).HandleDELETEProjectMember))
+	r.POST("project/:id/clone", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectCreate), h.audited((*Handler).HandlePOSTCloneProject))
+	r.POST("project/:id/plan", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTProjectPlan))
+	r.GET("project/state/:id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGetProjectState))
+	r.GET("ws/project/logs/:upn/:usn", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleStreamServiceLogs)) // using upn and usn because depends on docker compose logs which is using the service name
+	r.GET("ws/project/shell/:usn/:projectID", h.AuthMiddleware(), h.APITokenScopeMiddleware(services.APITokenScopeWrite), h.ProjectPermissionMiddleware(services.PermissionProjectShell), h.audited((*Handler).HandleStreamShell))
+	r.GET("project/:id/backup-schedules", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETBackupSchedules))
+	r.POST("project/:id/backup-schedules", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePOSTBackupSchedule))
+	r.PUT("project/:id/backup-schedules/:schedule_id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePUTBackupSchedule))
+	r.DELETE("project/:id/backup-schedules/:schedule_id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandleDELETEBackupSchedule))
+	r.POST("project/:id/backup-schedules/:schedule_id/run", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTRunBackupSchedule))
+	r.GET("project/:id/backups", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETBackups))
+	r.POST("project/:id/backups/:backup_id/restore", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePOSTRestoreBackup))
+	r.GET("project/:id/hook-deliveries", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETHookDeliveries))
+	r.GET("project/:id/hook-secret", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandleGETHookSecret))
+	r.POST("project/:id/hook-secret/rotate", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePOSTRotateHookSecret))
+	r.POST("project/:id/image-updates", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTImageUpdates))
+	r.GET("project/:id/services/:usn/image-updates", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETImageUpdateChecks))
+	r.POST("project/:id/services/:usn/builds", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTServiceBuild))
+	r.GET("project/:id/services/:usn/builds", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETServiceBuilds))
+	r.GET("project/:id/services/:usn/env", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETServiceEnv))
+	r.POST("project/:id/services/:usn/env", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTServiceEnv))
+	r.GET("project/:id/builds/:build_id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETServiceBuild))
+	r.GET("ws/project/builds/:id/:build_id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleStreamBuildLog))
+	r.GET("project/:id/tokens", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETProjectTokens))
+	r.POST("project/:id/tokens", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePOSTProjectToken))
+	r.POST("project/:id/tokens/:token_id/rotate", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePOSTRotateProjectToken))
+	r.DELETE("project/:id/tokens/:token_id", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandleDELETEProjectToken))
+	r.GET("project/:id/previews", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETPreviews))
+	r.PUT("project/:id/previews", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePUTPreview))
+	r.DELETE("project/:id/previews/:branch", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandleDELETEPreview))
+	r.GET("project/:id/environments", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETEnvironments))
+	r.PUT("project/:id/environments/:name", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePUTEnvironment))
+	r.DELETE("project/:id/environments/:name", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandleDELETEEnvironment))
+	r.POST("project/:id/environments/:name/promote", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTPromoteEnvironment))
+	r.GET("project/:id/deployments", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETDeployments))
+	r.GET("project/:id/gitops", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectView), h.audited((*Handler).HandleGETGitOpsSource))
+	r.PUT("project/:id/gitops", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandlePUTGitOpsSource))
+	r.DELETE("project/:id/gitops", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectManage), h.audited((*Handler).HandleDELETEGitOpsSource))
+	r.POST("project/:id/gitops/sync", h.AuthMiddleware(), h.ProjectPermissionMiddleware(services.PermissionProjectDeploy), h.audited((*Handler).HandlePOSTGitOpsSync))
 	// Secured by access token - don't need to chain auth-middleware
 	r.GET("hook/:id", h.HandleGetProjectHook)
+	r.GET("hook/:id/state", h.HandleGETProjectHookState)
+	r.POST("hook/:id/exec/:usn", h.HandlePOSTProjectHookExec)
+	r.PUT("hook/:id/previews", h.HandlePUTHookPreview)
+	r.DELETE("hook/:id/previews/:branch", h.HandleDELETEHookPreview)
+	r.POST("hook/:id/environments/:name/promote", h.HandlePOSTHookPromoteEnvironment)
+	r.POST("hook/:id/gitops/sync", h.HandlePOSTHookGitOpsSync)
+	// Secured by the signature of the delivery
+	r.POST("hook/:id", h.HandlePOSTProjectHook)
 
 	// Notifications
-	r.PUT("notifications", h.AuthMiddleware(), h.HandlePUTNotification)
-	r.GET("notifications", h.AuthMiddleware(), h.HandleGETNotifications)
+	r.PUT("notifications", h.AuthMiddleware(), h.audited((*Handler).HandlePUTNotification))
+	r.GET("notifications", h.AuthMiddleware(), h.audited((*Handler).HandleGETNotifications))
 
-	r.PUT("user/set-current-organisation", h.AuthMiddleware(), h.SetCurrentOrganisation)
+	r.PUT("user/set-current-organisation", h.AuthMiddleware(), h.audited((*Handler).SetCurrentOrganisation))
+	r.GET("user/tokens", h.AuthMiddleware(), h.SessionOnlyMiddleware(), h.audited((*Handler).HandleGETUserTokens))
+	r.POST("user/tokens", h.AuthMiddleware(), h.SessionOnlyMiddleware(), h.audited((*Handler).HandlePOSTUserToken))
+	r.DELETE("user/tokens/:token_id", h.AuthMiddleware(), h.SessionOnlyMiddleware(), h.audited((*Handler).HandleDELETEUserToken))
 
 	rAuth := r.Group("auth")
 	rAuth.GET(":provider", h.HandleGETAuthenticate)
 	rAuth.GET(":provider/callback", h.HandleGETAuthenticateCallback)
+	rAuth.POST(":provider/callback", h.HandleGETAuthenticateCallback)
+	rAuth.POST("email/signup", h.HandlePOSTSignUp)
+	rAuth.POST("email/verify", h.HandlePOSTVerifyEmail)
+	rAuth.POST("email/verify/resend", h.HandlePOSTResendVerification)
+	rAuth.POST("email/password-reset", h.HandlePOSTPasswordResetRequest)
+	rAuth.POST("email/password-reset/confirm", h.HandlePOSTPasswordReset)
 	rAuth.GET("logout/:provider", h.HandleGETLogout)
 	rAuth.GET("user", h.GetUser)
-	rAuth.GET("verify-session", h.AuthMiddleware(), h.VerifyUserSession)
+	rAuth.GET("verify-session", h.AuthMiddleware(), h.audited((*Handler).VerifyUserSession))
 }
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/models"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func (h *Handler) HandleGETEnvGroups(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	groups, err := h.service.SelectEnvGroups(organisationID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get env groups", err)
+		return
+	}
+	for i := range groups {
+		groups[i].MaskSecrets()
+	}
+	ctx.JSON(http.StatusOK, groups)
+}
+
+// HandleGETEnvGroupProjects lists the projects which are affected by changes of the env group.
+func (h *Handler) HandleGETEnvGroupProjects(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	projects, err := h.service.SelectEnvGroupProjects(organisationID, ctx.Param("name"))
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get projects of env group", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, projects)
+}
+
+// HandlePUTEnvGroup creates or replaces the env group and lists the projects using it. With "?redeploy=true"
+// those projects are redeployed, so that they get the changed env vars.
+func (h *Handler) HandlePUTEnvGroup(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	var g services.EnvGroup
+	if err := ctx.BindJSON(&g); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	g.Name = ctx.Param("name")
+	g.OrganisationID = organisationID
+	if err := g.Validate(); err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if err := h.service.SaveEnvGroup(&g); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save env group", err)
+		return
+	}
+
+	projects, err := h.service.SelectEnvGroupProjects(organisationID, g.Name)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get projects of env group", err)
+		return
+	}
+	redeployed, failed := []string{}, []string{}
+	if ctx.Query("redeploy") == "true" {
+		redeployed, failed = h.redeployProjects(ctx, projects)
+	}
+
+	g.MaskSecrets()
+	ctx.JSON(http.StatusOK, gin.H{
+		"group":      g,
+		"projects":   projects,
+		"redeployed": redeployed,
+		"failed":     failed,
+	})
+}
+
+func (h *Handler) HandleDELETEEnvGroup(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	err := h.service.DeleteEnvGroup(organisationID, ctx.Param("name"))
+	if errors.Is(err, services.ErrEnvGroupInUse) {
+		projects, err := h.service.SelectEnvGroupProjects(organisationID, ctx.Param("name"))
+		if err != nil {
+			HandleError(ctx, http.StatusInternalServerError, "unable to get projects of env group", err)
+			return
+		}
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "env group is used by projects", "projects": projects})
+		return
+	} else if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find env group", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to delete env group", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// redeployProjects redeploys the projects one after another and returns the UPNs of the redeployed projects and
+// of the ones which failed.
+func (h *Handler) redeployProjects(ctx *gin.Context, projects []models.OrganisationProjects) ([]string, []string) {
+	redeployed, failed := []string{}, []string{}
+	for _, op := range projects {
+		p, err := h.service.SelectProjectByID(op.ID)
+		if err == nil {
+			err = h.updateAndRestartContainers(ctx, p)
+		}
+		if err != nil {
+			slog.Error("unable to redeploy project", "upn", op.UniqueName, "err", err)
+			failed = append(failed, op.UniqueName)
+			continue
+		}
+		redeployed = append(redeployed, op.UniqueName)
+	}
+	return redeployed, failed
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func (h *Handler) HandleGETEnvironments(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	environments, err := h.service.SelectEnvironments(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get environments", err)
+		return
+	}
+	for i := range environments {
+		environments[i].MaskSecrets()
+	}
+	ctx.JSON(http.StatusOK, environments)
+}
+
+// HandlePUTEnvironment creates the environment with the overrides of the request or replaces the overrides of
+// an existing one, and deploys it.
+func (h *Handler) HandlePUTEnvironment(ctx *gin.Context) {
+	parent, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	var overrides services.EnvironmentOverrides
+	if err := ctx.BindJSON(&overrides); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+
+	p, environment, err := h.service.EnvironmentProject(parent, ctx.Param("name"), overrides)
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	h.deployEnvironment(ctx, p, environment, services.DeploymentKindDeploy, "")
+}
+
+func (h *Handler) HandleDELETEEnvironment(ctx *gin.Context) {
+	parent, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	environment, err := h.service.SelectEnvironment(parent.ID, ctx.Param("name"))
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find environment", err)
+		return
+	} else if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to get environment", err)
+		return
+	}
+	if err := h.teardownProject(environment.ProjectID); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to tear down environment", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// HandlePOSTPromoteEnvironment deploys the images of another environment to the environment.
+func (h *Handler) HandlePOSTPromoteEnvironment(ctx *gin.Context) {
+	parent, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	h.promote(ctx, parent)
+}
+
+// HandlePOSTHookPromoteEnvironment is HandlePOSTPromoteEnvironment for pipelines, authenticated by a project token
+// with the deploy scope.
+func (h *Handler) HandlePOSTHookPromoteEnvironment(ctx *gin.Context) {
+	parent, ok := h.projectFromToken(ctx, services.ProjectTokenScopeDeploy)
+	if !ok {
+		return
+	}
+	h = h.withActor(ctx)
+	h.promote(ctx, parent)
+}
+
+func (h *Handler) HandleGETDeployments(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	deployments, err := h.service.SelectDeployments(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get deployments", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, deployments)
+}
+
+func (h *Handler) promote(ctx *gin.Context, parent *services.Project) {
+	var req services.PromotionRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+
+	p, environment, err := h.service.Promote(parent, req.From, ctx.Param("name"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	h.deployEnvironment(ctx, p, environment, services.DeploymentKindPromotion, req.From)
+}
+
+// deployEnvironment deploys the project of the environment, the deployment is recorded in its history. The
+// environment is only saved once the deployment succeeded, new environments which fail are torn down.
+func (h *Handler) deployEnvironment(ctx *gin.Context, p *services.Project, environment *services.Environment, kind, source string) {
+	isNew := environment.ID == 0
+	if err := h.service.SaveEnvironmentProject(p, environment); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to save environment", err)
+		return
+	}
+
+	var err error
+	if isNew {
+		err = h.startContainers(ctx, p)
+	} else {
+		err = h.restartContainers(ctx, p)
+	}
+	h.recordDeployment(p, kind, source, err)
+	if err == nil {
+		err = h.service.SaveEnvironment(p, environment)
+	}
+	if err != nil {
+		if isNew {
+			// Don't leave a project behind which isn't known as environment
+			if teardownErr := h.teardownProject(p.ID); teardownErr != nil {
+				slog.Error("unable to tear down failed environment", "upn", p.UPN, "err", teardownErr)
+			}
+		}
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to deploy environment", err)
+		return
+	}
+	environment.MaskSecrets()
+	ctx.JSON(http.StatusOK, environment)
+}
+
+// teardownEnvironments tears down all environments of a project, e.g. before it gets deleted.
+func (h *Handler) teardownEnvironments(parentID int) error {
+	environments, err := h.service.SelectEnvironments(parentID)
+	if err != nil {
+		return err
+	}
+	for _, environment := range environments {
+		if err := h.teardownProject(environment.ProjectID); err != nil {
+			return errors.Wrapf(err, "unable to tear down environment %s", environment.Name)
+		}
+	}
+	return nil
+}
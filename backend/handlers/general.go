@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"embed"
 	"log/slog"
 	"net/http"
@@ -14,7 +15,7 @@ import (
 	"github.com/devs-group/sloth/backend/services"
 )
 
-const accessTokenLen = 12
+const hookSecretLen = 32
 const uniqueProjectSuffixLen = 10
 
 type Handler struct {
@@ -41,6 +42,27 @@ func New(dbService database.IDatabaseService, vueFiles embed.FS) Handler {
 	}
 }
 
+// MigrateData migrates data which can't be migrated by SQL, e.g. because it needs to be hashed.
+func (h *Handler) MigrateData() error {
+	if err := h.service.MigrateProjectAccessTokens(); err != nil {
+		return err
+	}
+	return h.service.MigrateSecrets()
+}
+
+// StartBackgroundJobs starts the schedulers running next to the HTTP server until the context is canceled.
+func (h *Handler) StartBackgroundJobs(ctx context.Context) {
+	if err := h.service.FailInterruptedBuilds(); err != nil {
+		slog.Error("unable to fail interrupted builds", "err", err)
+	}
+	h.service.StartBackupScheduler(ctx)
+	h.service.StartDiskUsageScanner(ctx)
+	h.service.StartImageUpdateScheduler(ctx, h.redeployServices)
+	h.service.StartPreviewReaper(ctx, h.teardownPreview)
+	h.service.StartGitOpsPoller(ctx, h.applyManifest)
+	services.StartLoginAttemptEviction(ctx)
+}
+
 func (h *Handler) abortWithError(c *gin.Context, statusCode int, message string, err error) {
 	slog.Error(message, "err", err)
 	c.AbortWithStatus(statusCode)
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func (h *Handler) HandleGETGitOpsSource(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	g, err := h.service.SelectGitOpsSource(p.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "project isn't synced from a repository", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get gitops source", err)
+		return
+	}
+	g.MaskSecrets()
+	ctx.JSON(http.StatusOK, g)
+}
+
+// HandlePUTGitOpsSource configures the repository the project is synced from, the next poll syncs it.
+func (h *Handler) HandlePUTGitOpsSource(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	var g services.GitOpsSource
+	if err := ctx.BindJSON(&g); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	g.ProjectID = p.ID
+	if err := g.Validate(); err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if err := h.service.SaveGitOpsSource(&g); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save gitops source", err)
+		return
+	}
+	g.MaskSecrets()
+	ctx.JSON(http.StatusOK, g)
+}
+
+func (h *Handler) HandleDELETEGitOpsSource(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	if err := h.service.DeleteGitOpsSource(p.ID); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to delete gitops source", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// HandlePOSTGitOpsSync syncs the project from its repository right away. With "dry_run=true" only the diff
+// is returned.
+func (h *Handler) HandlePOSTGitOpsSync(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	h.syncProject(ctx, p)
+}
+
+// HandlePOSTHookGitOpsSync is HandlePOSTGitOpsSync for pipelines, authenticated by a project token with the deploy scope.
+func (h *Handler) HandlePOSTHookGitOpsSync(ctx *gin.Context) {
+	p, ok := h.projectFromToken(ctx, services.ProjectTokenScopeDeploy)
+	if !ok {
+		return
+	}
+	h = h.withActor(ctx)
+	h.syncProject(ctx, p)
+}
+
+func (h *Handler) syncProject(ctx *gin.Context, p *services.Project) {
+	opts := services.SyncOptions{DryRun: ctx.Query("dry_run") == "true"}
+	g, err := h.service.SyncProject(ctx, p, h.applyManifest, opts)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.abortWithError(ctx, http.StatusNotFound, "project isn't synced from a repository", err)
+		return
+	case errors.Is(err, services.ErrInvalidManifest):
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	case err != nil:
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to sync project", err)
+		return
+	}
+	g.MaskSecrets()
+	ctx.JSON(http.StatusOK, g)
+}
+
+// applyManifest deploys a project rendered from its manifest.
+func (h *Handler) applyManifest(p *services.Project) error {
+	return h.updateAndRestartContainers(context.Background(), p)
+}
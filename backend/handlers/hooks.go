@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/pkg/webhook"
+	"github.com/devs-group/sloth/backend/services"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+const maxHookPayloadSize = 1 << 20
+
+// HandlePOSTProjectHook redeploys the services using the image of a registry push.
+// The delivery must be signed with the hook secret of the project, see webhook.Verify.
+func (h *Handler) HandlePOSTProjectHook(ctx *gin.Context) {
+	projectID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		h.abortWithError(ctx, http.StatusBadRequest, "invalid type", err)
+		return
+	}
+
+	project, err := h.service.SelectProjectByID(projectID)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusNotFound, "unable find project", err)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxHookPayloadSize))
+	if err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+
+	header := ctx.Request.Header
+	delivery := &services.HookDelivery{
+		Event:     header.Get("X-GitHub-Event") + header.Get("X-Gitlab-Event"),
+		ProjectID: project.ID,
+	}
+
+	// Unverified deliveries aren't saved, otherwise anyone could flush the history of the project
+	delivery.Provider, err = webhook.Verify(header, body, project.HookSecret)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusUnauthorized, "unable to verify hook delivery", err)
+		return
+	}
+	ctx.Set(HookProviderKey, delivery.Provider)
+	h = h.withActor(ctx)
+
+	// Previews of closed pull requests aren't needed anymore
+	branch, err := webhook.ClosedPullRequest(header, body)
+	if err != nil {
+		h.finishHookDelivery(ctx, delivery, http.StatusBadRequest, services.HookDeliveryStatusFailed, err)
+		return
+	}
+	if branch != "" {
+		h.closePreview(ctx, project, delivery, branch)
+		return
+	}
+
+	pushes, err := webhook.ParsePushes(header, body)
+	if err != nil {
+		h.finishHookDelivery(ctx, delivery, http.StatusBadRequest, services.HookDeliveryStatusFailed, err)
+		return
+	}
+	if len(pushes) > 0 {
+		delivery.Image = pushes[0].Image
+		delivery.Tag = pushes[0].Tag
+	}
+
+	delivery.Services = project.ApplyPushes(pushes)
+	if len(delivery.Services) == 0 {
+		h.finishHookDelivery(ctx, delivery, http.StatusOK, services.HookDeliveryStatusIgnored, nil)
+		return
+	}
+
+	err = h.redeployServices(project, delivery.Services)
+	if errors.Is(err, services.ErrServicesHeld) {
+		h.finishHookDelivery(ctx, delivery, http.StatusConflict, services.HookDeliveryStatusFailed, err)
+		return
+	}
+	if err != nil {
+		h.finishHookDelivery(ctx, delivery, http.StatusInternalServerError, services.HookDeliveryStatusFailed, err)
+		return
+	}
+	h.finishHookDelivery(ctx, delivery, http.StatusOK, services.HookDeliveryStatusSucceeded, nil)
+}
+
+func (h *Handler) closePreview(ctx *gin.Context, project *services.Project, d *services.HookDelivery, branch string) {
+	preview, err := h.service.SelectPreview(project.ID, branch)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.finishHookDelivery(ctx, d, http.StatusOK, services.HookDeliveryStatusIgnored, nil)
+		return
+	} else if err != nil {
+		h.finishHookDelivery(ctx, d, http.StatusInternalServerError, services.HookDeliveryStatusFailed, err)
+		return
+	}
+	if err := h.teardownPreview(*preview); err != nil {
+		h.finishHookDelivery(ctx, d, http.StatusInternalServerError, services.HookDeliveryStatusFailed, err)
+		return
+	}
+	h.finishHookDelivery(ctx, d, http.StatusOK, services.HookDeliveryStatusSucceeded, nil)
+}
+
+func (h *Handler) finishHookDelivery(ctx *gin.Context, d *services.HookDelivery, code int, status string, err error) {
+	d.Status = status
+	if err != nil {
+		d.Message = err.Error()
+		slog.Error("hook delivery "+status, "project_id", d.ProjectID, "err", err)
+	}
+	if err := h.service.SaveHookDelivery(d); err != nil {
+		slog.Error("unable to save hook delivery", "err", err)
+	}
+	ctx.JSON(code, d)
+}
+
+// HandleGETHookSecret reveals the secret deliveries of the project's hook are signed with.
+func (h *Handler) HandleGETHookSecret(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"hook_secret": p.HookSecret})
+}
+
+// HandlePOSTRotateHookSecret replaces the hook secret of the project and responds with the new one.
+func (h *Handler) HandlePOSTRotateHookSecret(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	secret, err := utils.RandStringRunes(hookSecretLen)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to generate hook secret", err)
+		return
+	}
+	if err := h.service.UpdateHookSecret(p.ID, secret); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to rotate hook secret", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"hook_secret": secret})
+}
+
+func (h *Handler) HandleGETHookDeliveries(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	deliveries, err := h.service.SelectHookDeliveries(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get hook deliveries", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, deliveries)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// HandlePOSTImageUpdates checks the registries for new images of the project right away,
+// instead of waiting for the scheduler, and returns the checks.
+func (h *Handler) HandlePOSTImageUpdates(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	checks, err := h.service.UpdateProjectImages(ctx, p, h.redeployServices)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to check image updates", err)
+		return
+	}
+	if checks == nil {
+		checks = make([]*services.ImageUpdateCheck, 0)
+	}
+	ctx.JSON(http.StatusOK, checks)
+}
+
+func (h *Handler) HandleGETImageUpdateChecks(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	checks, err := h.service.SelectImageUpdateChecks(p.ID, ctx.Param("usn"))
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get image update checks", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, checks)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"database/sql"
 	"errors"
 	"net/http"
 	"strconv"
@@ -8,6 +9,7 @@ import (
 	"github.com/devs-group/sloth/backend/config"
 	"github.com/devs-group/sloth/backend/models"
 	"github.com/devs-group/sloth/backend/pkg/email"
+	"github.com/devs-group/sloth/backend/services"
 	"github.com/devs-group/sloth/backend/utils"
 	"github.com/gin-gonic/gin"
 )
@@ -30,13 +32,11 @@ func (h *Handler) HandleCreateOrganisation(ctx *gin.Context) {
 
 func (h *Handler) HandleDeleteOrganisation(ctx *gin.Context) {
 	userID := userIDFromSession(ctx)
-	idParam := ctx.Param("id")
-	organisationID, err := strconv.Atoi(idParam)
-	if err != nil {
-		HandleError(ctx, http.StatusInternalServerError, "invalid organisation id", err)
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationDelete)
+	if !ok {
 		return
 	}
-	err = h.service.DeleteOrganisation(userID, organisationID)
+	err := h.service.DeleteOrganisation(userID, organisationID)
 	if err != nil {
 		HandleError(ctx, http.StatusInternalServerError, "unable to delete organisation", err)
 		return
@@ -56,10 +56,8 @@ func (h *Handler) HandleListOrganisations(ctx *gin.Context) {
 
 func (h *Handler) HandleGetOrganisation(ctx *gin.Context) {
 	userID := userIDFromSession(ctx)
-	idParam := ctx.Param("id")
-	organisationID, err := strconv.Atoi(idParam)
-	if err != nil {
-		HandleError(ctx, http.StatusInternalServerError, "invalid organisation id", err)
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
 		return
 	}
 	organisation, err := h.service.GetOrganisation(organisationID, userID)
@@ -72,9 +70,15 @@ func (h *Handler) HandleGetOrganisation(ctx *gin.Context) {
 
 func (h *Handler) HandleDeleteOrganisationMember(ctx *gin.Context) {
 	userID := userIDFromSession(ctx)
-	organisationID := ctx.Param("id")
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionMembersManage)
+	if !ok {
+		return
+	}
 	memberID := ctx.Param("member_id")
 	err := h.service.DeleteMember(userID, memberID, organisationID)
+	if h.handleRoleChangeError(ctx, err) {
+		return
+	}
 	if err != nil {
 		HandleError(ctx, http.StatusInternalServerError, "unable to delete member", err)
 		return
@@ -91,6 +95,10 @@ func (h *Handler) HandleCreateOrganisationInvitation(ctx *gin.Context) {
 		return
 	}
 
+	if !h.authorize(ctx, invite.OrganisationID, services.PermissionMembersManage) {
+		return
+	}
+
 	// Create the invitation token
 	invitationToken, err := utils.RandStringRunes(256)
 	if err != nil {
@@ -115,20 +123,24 @@ func (h *Handler) HandleCreateOrganisationInvitation(ctx *gin.Context) {
 	ctx.Status(http.StatusOK)
 }
 
+// HandlePUTMember adds the user to the organisation, which requires a valid invitation for the email of the user.
 func (h *Handler) HandlePUTMember(ctx *gin.Context) {
 	userID := userIDFromSession(ctx)
 	memberID := ctx.Param("member_id")
-
-	var invite models.Invitation
-	if err := ctx.BindJSON(&invite); err != nil {
-		UnableToParseRequestBody(ctx, err)
+	organisationID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid organisation id", err)
 		return
 	}
 	if userID != memberID {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "you don't have permissions to add this user"})
+		h.abortWithError(ctx, http.StatusForbidden, "you don't have permissions to add this user", errors.New("requested member id is not equal to logged in user id"))
+		return
+	}
+	err = h.service.PutMember(memberID, organisationID)
+	if errors.Is(err, services.ErrNoInvitation) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find invitation", err)
 		return
 	}
-	err := h.service.PutMember(memberID, invite.OrganisationID)
 	if err != nil {
 		HandleError(ctx, http.StatusInternalServerError, "unable to add member", err)
 		return
@@ -137,9 +149,8 @@ func (h *Handler) HandlePUTMember(ctx *gin.Context) {
 }
 
 func (h *Handler) HandleGETInvitations(ctx *gin.Context) {
-	organisationID, err := strconv.Atoi(ctx.Param("id"))
-	if err != nil {
-		HandleError(ctx, http.StatusInternalServerError, "unable to parse id param", err)
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
 		return
 	}
 	invites, err := h.service.GetInvitations(organisationID)
@@ -161,6 +172,9 @@ func (h *Handler) HandleDELETEWithdrawInvitation(ctx *gin.Context) {
 		UnableToParseRequestBody(ctx, err)
 		return
 	}
+	if !h.authorize(ctx, withdrawInvitation.OrganisationID, services.PermissionMembersManage) {
+		return
+	}
 	err := h.service.WithdrawInvitation(withdrawInvitation.Email, withdrawInvitation.OrganisationID)
 	if err != nil {
 		HandleError(ctx, http.StatusInternalServerError, "unable to withdraw invitation", err)
@@ -208,14 +222,27 @@ func (h *Handler) HandlePOSTAcceptInvitation(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"accepted": accepted})
 }
 
-func (h *Handler) HandleGETLeaveOrganisation(ctx *gin.Context) {
-	// TODO
+// HandlePOSTLeaveOrganisation removes the user from the organisation, the last owner can't leave it.
+func (h *Handler) HandlePOSTLeaveOrganisation(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	err := h.service.LeaveOrganisation(userIDFromSession(ctx), organisationID)
+	if h.handleRoleChangeError(ctx, err) {
+		return
+	}
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to leave organisation", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
 }
 
 func (h *Handler) HandleGETOrganisationProjects(ctx *gin.Context) {
-	organisationID, err := strconv.Atoi(ctx.Param("id"))
-	if err != nil {
-		ctx.Status(http.StatusBadRequest)
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionProjectView)
+	if !ok {
+		return
 	}
 	projects, err := h.service.GetProjectsByOrganisationID(organisationID)
 	if err != nil {
@@ -235,7 +262,17 @@ func (h *Handler) HandlePUTOrganisationProject(ctx *gin.Context) {
 		UnableToParseRequestBody(ctx, err)
 		return
 	}
-	err := h.service.AddProjectToOrganisationByUPN(g.OrganisationID, g.UPN)
+	if !h.authorize(ctx, g.OrganisationID, services.PermissionProjectCreate) {
+		return
+	}
+	err := h.service.AddProjectToOrganisationByUPN(userIDFromSession(ctx), g.OrganisationID, g.UPN)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find project", err)
+		return
+	} else if errors.Is(err, services.ErrForbidden) {
+		h.abortWithError(ctx, http.StatusForbidden, "insufficient organisation role", err)
+		return
+	}
 	if err != nil {
 		HandleError(ctx, http.StatusInternalServerError, "unable to add project to organisation", err)
 		return
@@ -253,6 +290,9 @@ func (h *Handler) HandleRemoveProjectFromOrganisation(ctx *gin.Context) {
 		h.abortWithError(ctx, http.StatusBadRequest, "unable to parse request body", err)
 		return
 	}
+	if !h.authorize(ctx, g.OrganisationID, services.PermissionProjectCreate) {
+		return
+	}
 
 	err := h.service.RemoveProjectFromOrganisation(g.OrganisationID, g.UPN)
 	if err != nil {
@@ -261,3 +301,60 @@ func (h *Handler) HandleRemoveProjectFromOrganisation(ctx *gin.Context) {
 	}
 	ctx.Status(http.StatusOK)
 }
+
+func (h *Handler) HandleGETOrganisationUsage(ctx *gin.Context) {
+	userID := userIDFromSession(ctx)
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	usage, err := h.service.SelectOrganisationDiskUsage(organisationID, userID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get organisation usage", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, usage)
+}
+
+// HandlePUTMemberRole changes the role of a member. Only owners can grant or revoke the owner role, the last owner
+// of an organisation can't be demoted.
+func (h *Handler) HandlePUTMemberRole(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionMembersManage)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := ctx.BindJSON(&payload); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	err := h.service.ChangeMemberRole(organisationID, userIDFromSession(ctx), ctx.Param("member_id"), payload.Role)
+	if h.handleRoleChangeError(ctx, err) {
+		return
+	}
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to change role of member", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// handleRoleChangeError aborts the request with the status of errors changing or removing members, in that case
+// true is returned.
+func (h *Handler) handleRoleChangeError(ctx *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find member", err)
+	case errors.Is(err, services.ErrForbidden):
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only owners can change owners"})
+	case errors.Is(err, services.ErrInvalidRole):
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, services.ErrLastOwner):
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
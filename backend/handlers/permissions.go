@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// ProjectOrganisationIDKey is the organisation of the project a request acts on, set by the ProjectPermissionMiddleware.
+const ProjectOrganisationIDKey = "projectOrganisationID"
+
+// authorize aborts the request if the user doesn't have the permission in the organisation, in that case false
+// is returned.
+func (h *Handler) authorize(ctx *gin.Context, organisationID int, p services.Permission) bool {
+	err := h.service.Authorize(organisationID, userIDFromSession(ctx), p)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find organisation", err)
+		return false
+	} else if errors.Is(err, services.ErrForbidden) {
+		h.abortWithError(ctx, http.StatusForbidden, "insufficient organisation role", err)
+		return false
+	} else if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to get organisation role", err)
+		return false
+	}
+	return true
+}
+
+// organisationFromRequest returns the organisation of the ":id" parameter if the user has the permission in it.
+// The request is aborted otherwise, in that case false is returned.
+func (h *Handler) organisationFromRequest(ctx *gin.Context, p services.Permission) (int, bool) {
+	organisationID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		h.abortWithError(ctx, http.StatusBadRequest, "invalid organisation id", err)
+		return 0, false
+	}
+	if !h.authorize(ctx, organisationID, p) {
+		return 0, false
+	}
+	return organisationID, true
+}
+
+// PermissionMiddleware requires the permission in the current organisation of the user, which is the organisation
+// projects are looked up in. It must be chained after the AuthMiddleware.
+func (h *Handler) PermissionMiddleware(p services.Permission) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		organisationID, err := strconv.Atoi(currentOrganisationIDFromSession(ctx))
+		if err != nil {
+			h.abortWithError(ctx, http.StatusNotFound, "unable to find organisation", err)
+			return
+		}
+		if !h.authorize(ctx, organisationID, p) {
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// ProjectPermissionMiddleware requires the permission in the project of the ":id", ":projectID" or ":upn" parameter.
+// Either the role of the user in the organisation of the project or their role as member of the project has to
+// allow it. It must be chained after the AuthMiddleware.
+func (h *Handler) ProjectPermissionMiddleware(p services.Permission) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		projectID, err := h.projectIDFromParams(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			h.abortWithError(ctx, http.StatusNotFound, "unable to find project", err)
+			return
+		} else if err != nil {
+			h.abortWithError(ctx, http.StatusBadRequest, "invalid project id", err)
+			return
+		}
+		organisationID, err := h.service.AuthorizeProject(projectID, userIDFromSession(ctx), p)
+		if errors.Is(err, sql.ErrNoRows) {
+			h.abortWithError(ctx, http.StatusNotFound, "unable to find project", err)
+			return
+		} else if errors.Is(err, services.ErrForbidden) {
+			h.abortWithError(ctx, http.StatusForbidden, "insufficient project role", err)
+			return
+		} else if err != nil {
+			h.abortWithError(ctx, http.StatusInternalServerError, "unable to get project role", err)
+			return
+		}
+		ctx.Set(ProjectOrganisationIDKey, organisationID)
+		ctx.Next()
+	}
+}
+
+func (h *Handler) projectIDFromParams(ctx *gin.Context) (int, error) {
+	if upn := ctx.Param("upn"); upn != "" {
+		return h.service.SelectProjectIDByUPN(services.UPN(upn))
+	}
+	if id := ctx.Param("projectID"); id != "" {
+		return strconv.Atoi(id)
+	}
+	return strconv.Atoi(ctx.Param("id"))
+}
+
+// projectOrganisationIDFromRequest returns the organisation projects of the request are looked up in. That's the
+// organisation of the project authorized by the ProjectPermissionMiddleware, otherwise the current one of the user.
+func projectOrganisationIDFromRequest(ctx *gin.Context) string {
+	if organisationID, ok := ctx.Get(ProjectOrganisationIDKey); ok {
+		return strconv.Itoa(organisationID.(int))
+	}
+	return currentOrganisationIDFromSession(ctx)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+func (h *Handler) HandleGETPreviews(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	previews, err := h.service.SelectPreviews(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get previews", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, previews)
+}
+
+// HandlePUTPreview creates the preview of a branch or updates it with new tags.
+func (h *Handler) HandlePUTPreview(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	h.putPreview(ctx, p)
+}
+
+func (h *Handler) HandleDELETEPreview(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	h.deletePreview(ctx, p)
+}
+
+// HandlePUTHookPreview is HandlePUTPreview for pipelines, authenticated by a project token with the deploy scope.
+func (h *Handler) HandlePUTHookPreview(ctx *gin.Context) {
+	p, ok := h.projectFromToken(ctx, services.ProjectTokenScopeDeploy)
+	if !ok {
+		return
+	}
+	h = h.withActor(ctx)
+	h.putPreview(ctx, p)
+}
+
+func (h *Handler) HandleDELETEHookPreview(ctx *gin.Context) {
+	p, ok := h.projectFromToken(ctx, services.ProjectTokenScopeDeploy)
+	if !ok {
+		return
+	}
+	h = h.withActor(ctx)
+	h.deletePreview(ctx, p)
+}
+
+func (h *Handler) putPreview(ctx *gin.Context, parent *services.Project) {
+	var req services.PreviewRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+
+	p, preview, err := h.service.PreviewProject(parent, req)
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	isNew := preview.ID == 0
+	if err := h.service.SavePreview(p, preview); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to save preview", err)
+		return
+	}
+
+	if isNew {
+		err = h.startProject(ctx, p)
+	} else {
+		err = h.updateAndRestartContainers(ctx, p)
+	}
+	if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to deploy preview", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, preview)
+}
+
+// startProject starts the containers of a new preview or environment.
+func (h *Handler) startProject(ctx *gin.Context, p *services.Project) error {
+	err := h.startContainers(ctx, p)
+	h.recordDeployment(p, services.DeploymentKindDeploy, "", err)
+	return err
+}
+
+func (h *Handler) startContainers(ctx *gin.Context, p *services.Project) error {
+	if err := h.service.PrepareProject(p); err != nil {
+		return errors.Wrap(err, "unable to prepare project")
+	}
+	if err := p.UPN.StartContainers(p.ComposeServices, p.DockerCredentials); err != nil {
+		return errors.Wrap(err, "unable to start containers")
+	}
+	if err := h.service.RecordImageDigests(ctx, p); err != nil {
+		slog.Error("unable to record image digests", "upn", p.UPN, "err", err)
+	}
+	return nil
+}
+
+func (h *Handler) deletePreview(ctx *gin.Context, parent *services.Project) {
+	preview, err := h.service.SelectPreview(parent.ID, ctx.Param("branch"))
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find preview", err)
+		return
+	} else if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to get preview", err)
+		return
+	}
+	if err := h.teardownPreview(*preview); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to tear down preview", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// teardownPreview stops the containers of the preview and deletes its project.
+func (h *Handler) teardownPreview(preview services.Preview) error {
+	return h.teardownProject(preview.ProjectID)
+}
+
+// teardownProject stops the containers of a preview or environment and deletes its project.
+func (h *Handler) teardownProject(projectID int) error {
+	p, err := h.service.SelectProjectByID(projectID)
+	if err != nil {
+		return err
+	}
+	// Projects which failed to start might not have a project directory
+	if _, err := os.Stat(p.UPN.GetProjectPath()); err == nil {
+		if err := p.UPN.StopContainers(); err != nil {
+			return err
+		}
+	}
+	if err := h.service.DeleteProjectByIDAndOrganisationID(p.ID, p.OrganisationID); err != nil {
+		return err
+	}
+	return utils.DeleteFolder(p.UPN.GetProjectPath())
+}
+
+// teardownPreviews tears down all previews of a project, e.g. before it gets deleted.
+func (h *Handler) teardownPreviews(parentID int) error {
+	previews, err := h.service.SelectPreviews(parentID)
+	if err != nil {
+		return err
+	}
+	for _, preview := range previews {
+		if err := h.teardownPreview(preview); err != nil {
+			return errors.Wrapf(err, "unable to tear down preview %s", preview.Branch)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// HandleGETProjectMembers lists the users which are granted access to the project, in addition to the members
+// of its organisation.
+func (h *Handler) HandleGETProjectMembers(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	members, err := h.service.SelectProjectMembers(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get project members", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, members)
+}
+
+// HandlePUTProjectMember grants the user of the email a role in the project, or changes the role of an existing grant.
+func (h *Handler) HandlePUTProjectMember(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Email string `json:"email" binding:"required"`
+		Role  string `json:"role" binding:"required"`
+	}
+	if err := ctx.BindJSON(&payload); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	member, err := h.service.SaveProjectMember(p.ID, payload.Email, payload.Role)
+	if errors.Is(err, services.ErrInvalidProjectRole) {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	} else if errors.Is(err, sql.ErrNoRows) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unable to find user"})
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save project member", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, member)
+}
+
+func (h *Handler) HandleDELETEProjectMember(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	err := h.service.DeleteProjectMember(p.ID, ctx.Param("user_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find project member", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to delete project member", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/pkg/docker"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// projectFromToken loads the project of the ":id" parameter with the project token of the X-Access-Token header,
+// which must have the given scope. The request is aborted otherwise, in that case false is returned.
+func (h *Handler) projectFromToken(ctx *gin.Context, scope string) (*services.Project, bool) {
+	token := ctx.GetHeader("X-Access-Token")
+	if token == "" {
+		h.abortWithError(ctx, http.StatusUnauthorized, "X-Access-Token header is required", nil)
+		return nil, false
+	}
+
+	projectID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		h.abortWithError(ctx, http.StatusBadRequest, "invalid type", err)
+		return nil, false
+	}
+
+	t, err := h.service.AuthenticateProjectToken(projectID, token, scope)
+	switch {
+	case errors.Is(err, services.ErrInvalidToken):
+		h.abortWithError(ctx, http.StatusUnauthorized, "invalid project token", err)
+		return nil, false
+	case errors.Is(err, services.ErrMissingScope):
+		h.abortWithError(ctx, http.StatusForbidden, "insufficient scope", err)
+		return nil, false
+	case err != nil:
+		h.abortWithError(ctx, http.StatusNotFound, "unable find project", err)
+		return nil, false
+	}
+	project, err := h.service.SelectProjectByID(projectID)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusNotFound, "unable find project", err)
+		return nil, false
+	}
+	ctx.Set(ProjectTokenKey, t)
+	return project, true
+}
+
+func (h *Handler) HandleGETProjectTokens(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	tokens, err := h.service.SelectProjectTokens(p.ID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get project tokens", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+func (h *Handler) HandlePOSTProjectToken(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	var t services.ProjectToken
+	if err := ctx.BindJSON(&t); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	t.ProjectID = p.ID
+	if err := t.Validate(); err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid project token", err)
+		return
+	}
+	if err := h.service.SaveProjectToken(&t); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save project token", err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, t)
+}
+
+func (h *Handler) HandlePOSTRotateProjectToken(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	tokenID, err := strconv.Atoi(ctx.Param("token_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid project token id", err)
+		return
+	}
+	t, err := h.service.RotateProjectToken(p.ID, tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find project token", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to rotate project token", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, t)
+}
+
+func (h *Handler) HandleDELETEProjectToken(ctx *gin.Context) {
+	p, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	tokenID, err := strconv.Atoi(ctx.Param("token_id"))
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, "invalid project token id", err)
+		return
+	}
+	err = h.service.DeleteProjectToken(p.ID, tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find project token", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to revoke project token", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// HandleGETProjectHookState returns the container states of the project for tokens with the read-state scope.
+func (h *Handler) HandleGETProjectHookState(ctx *gin.Context) {
+	project, ok := h.projectFromToken(ctx, services.ProjectTokenScopeReadState)
+	if !ok {
+		return
+	}
+	state, err := h.service.ProjectState(ctx, project)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to get container state", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, state)
+}
+
+// HandlePOSTProjectHookExec runs a command in a service for tokens with the exec scope and returns its output.
+func (h *Handler) HandlePOSTProjectHookExec(ctx *gin.Context) {
+	project, ok := h.projectFromToken(ctx, services.ProjectTokenScopeExec)
+	if !ok {
+		return
+	}
+	var req struct {
+		Cmd []string `json:"cmd" binding:"required,min=1"`
+	}
+	if err := ctx.BindJSON(&req); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+
+	containerID, err := docker.GetContainerIDByService(string(project.UPN), ctx.Param("usn"))
+	if err != nil {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find container of service", err)
+		return
+	}
+
+	var out bytes.Buffer
+	err = docker.Exec(ctx, containerID, req.Cmd, nil, nil, &out)
+	result := gin.H{"output": out.String()}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	ctx.JSON(http.StatusOK, result)
+}
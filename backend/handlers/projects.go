@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -14,10 +17,40 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// projectFromRequest loads the project of the ":id" parameter within the organisation of the request.
+// The request is aborted when the project can't be found, in that case false is returned.
+func (h *Handler) projectFromRequest(ctx *gin.Context) (*services.Project, bool) {
+	organisationID := projectOrganisationIDFromRequest(ctx)
+	projectID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+
+	project, err := h.service.SelectProjectByIDAndOrganisationID(projectID, organisationID)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find project", err)
+		return nil, false
+	}
+	return project, true
+}
+
+// serviceFromRequest returns the service of the ":usn" parameter. The request is aborted when the project has no
+// such service, in that case false is returned.
+func (h *Handler) serviceFromRequest(ctx *gin.Context, p *services.Project) (*services.Service, bool) {
+	for _, service := range p.Services {
+		if service.Usn == ctx.Param("usn") {
+			return service, true
+		}
+	}
+	h.abortWithError(ctx, http.StatusNotFound, "unable to find service", nil)
+	return nil, false
+}
+
 func (h *Handler) HandleGetProjectState(ctx *gin.Context) {
 	cfg := config.GetConfig()
 
-	organisationID := currentOrganisationIDFromSession(ctx)
+	organisationID := projectOrganisationIDFromRequest(ctx)
 	idParam := ctx.Param("id")
 
 	projectID, err := strconv.Atoi(idParam)
@@ -33,7 +66,7 @@ func (h *Handler) HandleGetProjectState(ctx *gin.Context) {
 	}
 	project.Hook = fmt.Sprintf("%s/v1/hook/%d", cfg.BackendUrl, project.ID)
 
-	state, err := project.UPN.GetContainersState()
+	state, err := h.service.ProjectState(ctx, project)
 	if err != nil {
 		h.abortWithError(ctx, http.StatusInternalServerError, "unable to get container state", err)
 		return
@@ -62,7 +95,7 @@ func (h *Handler) HandleListProjects(ctx *gin.Context) {
 func (h *Handler) HandleGetProject(ctx *gin.Context) {
 	cfg := config.GetConfig()
 
-	organisationID := currentOrganisationIDFromSession(ctx)
+	organisationID := projectOrganisationIDFromRequest(ctx)
 	idParam := ctx.Param("id")
 
 	projectID, err := strconv.Atoi(idParam)
@@ -77,6 +110,7 @@ func (h *Handler) HandleGetProject(ctx *gin.Context) {
 		return
 	}
 	project.Hook = fmt.Sprintf("%s/v1/hook/%d", cfg.BackendUrl, project.ID)
+	project.MaskSecrets()
 
 	slog.Info("services", "project.Services", project.Services)
 	ctx.JSON(http.StatusOK, project)
@@ -84,7 +118,7 @@ func (h *Handler) HandleGetProject(ctx *gin.Context) {
 }
 
 func (h *Handler) HandleDeleteProject(ctx *gin.Context) {
-	organisationID := currentOrganisationIDFromSession(ctx)
+	organisationID := projectOrganisationIDFromRequest(ctx)
 	idParam := ctx.Param("id")
 
 	projectID, err := strconv.Atoi(idParam)
@@ -101,6 +135,16 @@ func (h *Handler) HandleDeleteProject(ctx *gin.Context) {
 
 	pPath := project.UPN.GetProjectPath()
 
+	if err := h.teardownPreviews(project.ID); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to tear down previews", err)
+		return
+	}
+
+	if err := h.teardownEnvironments(project.ID); err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to tear down environments", err)
+		return
+	}
+
 	err = h.service.DeleteProjectByIDAndOrganisationID(projectID, organisationID)
 	if err != nil {
 		h.abortWithError(ctx, http.StatusInternalServerError, "unable to delete project", err)
@@ -129,23 +173,21 @@ func (h *Handler) HandleCreateProject(c *gin.Context) {
 		return
 	}
 
-	accessToken, err := utils.RandStringRunes(accessTokenLen)
+	upn, hookSecret, err := newProjectIdentity()
 	if err != nil {
-		h.abortWithError(c, http.StatusInternalServerError, "unable to generate access token", err)
+		h.abortWithError(c, http.StatusInternalServerError, "unable to generate project identity", err)
 		return
 	}
 
-	upnSuffix, err := utils.RandStringRunes(uniqueProjectSuffixLen)
-	if err != nil {
-		h.abortWithError(c, http.StatusInternalServerError, "unable to generate unique project name suffix", err)
-		return
-	}
-
-	p.AccessToken = accessToken
-	p.UPN = services.UPN(fmt.Sprintf("%s-%s", utils.GenerateRandomName(), upnSuffix))
+	p.HookSecret = hookSecret
+	p.UPN = upn
 	p.Path = p.UPN.GetProjectPath()
 
 	err = h.service.SaveProject(&p, currentOrganisationID)
+	if errors.Is(err, services.ErrInvalidRegistryCredentials) {
+		HandleError(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
 	if err != nil {
 		slog.Error("unable to save project", "err", err)
 		h.abortWithError(c, http.StatusInternalServerError, "unable to save project", err)
@@ -162,47 +204,164 @@ func (h *Handler) HandleCreateProject(c *gin.Context) {
 		return
 	}
 
+	token, err := h.createDeployToken(p.ID)
+	if err != nil {
+		h.abortWithError(c, http.StatusInternalServerError, "unable to create deploy token", err)
+		return
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
-		"id": p.ID,
+		"id":    p.ID,
+		"token": token,
 	})
 }
 
+// HandlePOSTCloneProject copies the project with its configuration into a new project, which isn't started.
+func (h *Handler) HandlePOSTCloneProject(ctx *gin.Context) {
+	source, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	// The body is optional
+	var req services.CloneRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+
+	upn, hookSecret, err := newProjectIdentity()
+	if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to generate project identity", err)
+		return
+	}
+	p, usns, err := h.service.CloneProject(source, req, upn, hookSecret)
+	if err != nil {
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to save project", err)
+		return
+	}
+
+	if req.Data {
+		if err := services.CopyProjectData(source, p, usns); err != nil {
+			h.discardClone(p)
+			h.abortWithError(ctx, http.StatusInternalServerError, "unable to copy project data", err)
+			return
+		}
+	}
+	if err := h.service.PrepareProject(p); err != nil {
+		h.discardClone(p)
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to prepare project", err)
+		return
+	}
+
+	token, err := h.createDeployToken(p.ID)
+	if err != nil {
+		h.discardClone(p)
+		h.abortWithError(ctx, http.StatusInternalServerError, "unable to create deploy token", err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"id":    p.ID,
+		"token": token,
+	})
+}
+
+// discardClone deletes a clone whose setup failed together with its folder, so that no half copied project is left.
+func (h *Handler) discardClone(p *services.Project) {
+	if err := h.service.DeleteProjectByIDAndOrganisationID(p.ID, p.OrganisationID); err != nil {
+		slog.Error("unable to delete failed clone", "upn", p.UPN, "err", err)
+	}
+	if err := utils.DeleteFolder(p.UPN.GetProjectPath()); err != nil {
+		slog.Error("unable to delete folder of failed clone", "upn", p.UPN, "err", err)
+	}
+}
+
+// HandlePOSTProjectPlan shows how the project of the request body would be deployed, including the resolved env
+// vars of its services. Without a body the stored project is planned.
+func (h *Handler) HandlePOSTProjectPlan(ctx *gin.Context) {
+	stored, ok := h.projectFromRequest(ctx)
+	if !ok {
+		return
+	}
+	p := *stored
+	if err := ctx.ShouldBindJSON(&p); err != nil && !errors.Is(err, io.EOF) {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	p.ID, p.UPN, p.OrganisationID = stored.ID, stored.UPN, stored.OrganisationID
+
+	plan, err := h.service.PlanProject(&p)
+	if err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	ctx.JSON(http.StatusOK, plan)
+}
+
+// newProjectIdentity generates the UPN and hook secret of a new project.
+func newProjectIdentity() (services.UPN, string, error) {
+	hookSecret, err := utils.RandStringRunes(hookSecretLen)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to generate hook secret")
+	}
+	upnSuffix, err := utils.RandStringRunes(uniqueProjectSuffixLen)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to generate unique project name suffix")
+	}
+	return services.UPN(fmt.Sprintf("%s-%s", utils.GenerateRandomName(), upnSuffix)), hookSecret, nil
+}
+
+// createDeployToken creates the project token new projects get for their pipelines.
+func (h *Handler) createDeployToken(projectID int) (*services.ProjectToken, error) {
+	token := services.ProjectToken{
+		Name:      "Deploy token",
+		Scopes:    services.StringList{services.ProjectTokenScopeDeploy},
+		ProjectID: projectID,
+	}
+	if err := h.service.SaveProjectToken(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
 func (h *Handler) HandleUpdateProject(c *gin.Context) {
-	currentOrganisationID := currentOrganisationIDFromSession(c)
+	stored, ok := h.projectFromRequest(c)
+	if !ok {
+		return
+	}
 	var p services.Project
 	if err := c.BindJSON(&p); err != nil {
 		h.abortWithError(c, http.StatusBadRequest, "failed to parse request body", err)
 		return
 	}
-	p.OrganisationID = currentOrganisationID
+	// The project is the authorized one of the ":id" parameter, regardless of the body
+	p.ID = stored.ID
+	p.UPN = stored.UPN
+	p.OrganisationID = stored.OrganisationID
+	if err := p.AssignServiceUsns(stored); err != nil {
+		HandleError(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
 	if err := h.updateAndRestartContainers(c, &p); err != nil {
+		if errors.Is(err, services.ErrInvalidEnvReference) || errors.Is(err, services.ErrInvalidRegistryCredentials) {
+			HandleError(c, http.StatusBadRequest, err.Error(), err)
+			return
+		}
 	  slog.Error("unable to update and restart containers", "err", err)
 		h.abortWithError(c, http.StatusInternalServerError, "", err)
 		return
 	}
 
+	p.MaskSecrets()
 	c.JSON(http.StatusOK, p)
 }
 
 func (h *Handler) HandleGetProjectHook(ctx *gin.Context) {
-	accessToken := ctx.GetHeader("X-Access-Token")
-	if accessToken == "" {
-		h.abortWithError(ctx, http.StatusUnauthorized, "X-Access-Token header is required", nil)
-		return
-	}
-	idParam := ctx.Param("id")
-
-	projectID, err := strconv.Atoi(idParam)
-	if err != nil {
-		h.abortWithError(ctx, http.StatusBadRequest, "invalid type", err)
-		return
-	}
-
-	project, err := h.service.SelectProjectByIDAndAccessToken(projectID, accessToken)
-	if err != nil {
-		h.abortWithError(ctx, http.StatusNotFound, "unable find project", err)
+	project, ok := h.projectFromToken(ctx, services.ProjectTokenScopeDeploy)
+	if !ok {
 		return
 	}
+	h = h.withActor(ctx)
 
 	queryParams := ctx.Request.URL.Query()
 
@@ -224,7 +383,30 @@ func (h *Handler) HandleGetProjectHook(ctx *gin.Context) {
 	})
 }
 
-func (h *Handler) updateAndRestartContainers(c *gin.Context, p *services.Project) error {
+// holdServicesOverVolumeLimit keeps the current configuration of services whose volumes exceed a limit which blocks
+// deployments, the other services of the project are deployed. It returns the USNs of the held services.
+func (h *Handler) holdServicesOverVolumeLimit(p *services.Project) ([]string, error) {
+	held, err := h.service.HoldServicesOverVolumeLimit(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to check volume limits")
+	}
+	if len(held) > 0 {
+		slog.Warn("deployment of services blocked, volumes exceed their limit", "upn", p.UPN, "usns", held)
+	}
+	return held, nil
+}
+
+func (h *Handler) updateAndRestartContainers(c context.Context, p *services.Project) error {
+	err := h.restartContainers(c, p)
+	h.recordDeployment(p, services.DeploymentKindDeploy, "", err)
+	return err
+}
+
+func (h *Handler) restartContainers(c context.Context, p *services.Project) error {
+	if _, err := h.holdServicesOverVolumeLimit(p); err != nil {
+		return err
+	}
+
 	if isRunning, err := p.UPN.IsOneContainerRunning(); err != nil || isRunning {
 		if err != nil {
 			return errors.Wrap(err, "unable to receive container states")
@@ -256,5 +438,70 @@ func (h *Handler) updateAndRestartContainers(c *gin.Context, p *services.Project
 		return errors.Wrap(err, "unable to start containers")
 	}
 
+	if err := h.service.RecordImageDigests(c, p); err != nil {
+		slog.Error("unable to record image digests", "upn", p.UPN, "err", err)
+	}
+
+	return nil
+}
+
+// redeployServices updates the project and recreates only the services with the given usns,
+// the other services of the project keep running.
+func (h *Handler) redeployServices(p *services.Project, usns []string) error {
+	err := h.startServices(p, usns)
+	h.recordDeployment(p, services.DeploymentKindDeploy, "", err)
+	return err
+}
+
+// startServices updates the project and recreates the services with the given usns. It fails with
+// services.ErrServicesHeld if all of them are held over their volume limit.
+func (h *Handler) startServices(p *services.Project, usns []string) error {
+	held, err := h.holdServicesOverVolumeLimit(p)
+	if err != nil {
+		return err
+	}
+	usns = slices.DeleteFunc(slices.Clone(usns), func(usn string) bool {
+		return slices.Contains(held, usn)
+	})
+	if len(usns) == 0 {
+		return errors.Wrapf(services.ErrServicesHeld, "usns %v", held)
+	}
+
+	if err := p.UPN.BackupCurrentFiles(); err != nil {
+		return errors.Wrap(err, "unable to backup current files")
+	}
+	defer p.UPN.DeleteBackupFiles()
+
+	if err := h.service.UpdateProject(p); err != nil {
+		p.UPN.RollbackToPreviousState()
+		return errors.Wrap(err, "unable to update project")
+	}
+
+	if err := h.service.PrepareProject(p); err != nil {
+		p.UPN.RollbackToPreviousState()
+		return errors.Wrap(err, "unable to prepare project")
+	}
+
+	if err := p.UPN.StartServices(p.ComposeServices, p.DockerCredentials, usns...); err != nil {
+		p.UPN.RollbackToPreviousState()
+		return errors.Wrap(err, "unable to start services")
+	}
+
+	if err := h.service.RecordImageDigests(context.Background(), p, usns...); err != nil {
+		slog.Error("unable to record image digests", "upn", p.UPN, "err", err)
+	}
+
 	return nil
 }
+
+// recordDeployment adds the outcome of a deployment to the history of the project.
+func (h *Handler) recordDeployment(p *services.Project, kind, source string, deployErr error) {
+	d := services.Deployment{Kind: kind, Source: source, Status: services.DeploymentStatusSucceeded}
+	if deployErr != nil {
+		d.Status = services.DeploymentStatusFailed
+		d.Message = deployErr.Error()
+	}
+	if err := h.service.SaveDeployment(p, &d); err != nil {
+		slog.Error("unable to record deployment", "upn", p.UPN, "err", err)
+	}
+}
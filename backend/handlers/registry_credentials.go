@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// registryLoginTimeout limits test logins, which include credential helpers and token requests.
+const registryLoginTimeout = 30 * time.Second
+
+func (h *Handler) HandleGETRegistryCredentials(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	credentials, err := h.service.SelectRegistryCredentials(organisationID)
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get registry credentials", err)
+		return
+	}
+	for i := range credentials {
+		credentials[i].MaskSecrets()
+	}
+	ctx.JSON(http.StatusOK, credentials)
+}
+
+// HandleGETRegistryCredentialProjects lists the projects which use the registry credential.
+func (h *Handler) HandleGETRegistryCredentialProjects(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionOrganisationView)
+	if !ok {
+		return
+	}
+	projects, err := h.service.SelectRegistryCredentialProjects(organisationID, ctx.Param("name"))
+	if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get projects of registry credential", err)
+		return
+	}
+	ctx.JSON(http.StatusOK, projects)
+}
+
+// HandlePUTRegistryCredential creates or replaces the registry credential. Projects using it get the new
+// credential with their next deployment.
+func (h *Handler) HandlePUTRegistryCredential(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	var c services.RegistryCredential
+	if err := ctx.BindJSON(&c); err != nil {
+		UnableToParseRequestBody(ctx, err)
+		return
+	}
+	c.Name = ctx.Param("name")
+	c.OrganisationID = organisationID
+	if err := c.Validate(); err != nil {
+		HandleError(ctx, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if err := h.service.SaveRegistryCredential(&c); err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to save registry credential", err)
+		return
+	}
+	c.MaskSecrets()
+	ctx.JSON(http.StatusOK, c)
+}
+
+func (h *Handler) HandleDELETERegistryCredential(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	err := h.service.DeleteRegistryCredential(organisationID, ctx.Param("name"))
+	if errors.Is(err, services.ErrRegistryCredentialInUse) {
+		projects, err := h.service.SelectRegistryCredentialProjects(organisationID, ctx.Param("name"))
+		if err != nil {
+			HandleError(ctx, http.StatusInternalServerError, "unable to get projects of registry credential", err)
+			return
+		}
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "registry credential is used by projects", "projects": projects})
+		return
+	} else if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find registry credential", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to delete registry credential", err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// HandlePOSTRegistryCredentialTest logs in to the registry with the stored credential without deploying anything.
+// Failed logins aren't errors of the request, they are returned with their reason.
+func (h *Handler) HandlePOSTRegistryCredentialTest(ctx *gin.Context) {
+	organisationID, ok := h.organisationFromRequest(ctx, services.PermissionSettingsManage)
+	if !ok {
+		return
+	}
+	c, err := h.service.SelectRegistryCredential(organisationID, ctx.Param("name"))
+	if errors.Is(err, sql.ErrNoRows) {
+		h.abortWithError(ctx, http.StatusNotFound, "unable to find registry credential", err)
+		return
+	} else if err != nil {
+		HandleError(ctx, http.StatusInternalServerError, "unable to get registry credential", err)
+		return
+	}
+
+	loginCtx, cancel := context.WithTimeout(ctx, registryLoginTimeout)
+	defer cancel()
+	if err := h.service.TestRegistryCredential(loginCtx, c); err != nil {
+		ctx.JSON(http.StatusOK, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"success": true})
+}
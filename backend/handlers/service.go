@@ -17,7 +17,7 @@ import (
 func (h *Handler) HandleStreamServiceLogs(c *gin.Context) {
 	cfg := config.GetConfig()
 
-	currentOrganisationID := currentOrganisationIDFromSession(c)
+	currentOrganisationID := projectOrganisationIDFromRequest(c)
 	upn := services.UPN(c.Param("upn"))
 	s := c.Param("usn")
 
@@ -28,7 +28,7 @@ func (h *Handler) HandleStreamServiceLogs(c *gin.Context) {
 		Hook:           fmt.Sprintf("%s/v1/hook/%s", cfg.BackendUrl, upn),
 	}
 
-	err := h.service.SelectProjectByUPNOrAccessToken(&p)
+	err := h.service.SelectProjectByUPN(&p)
 	if err != nil {
 		h.abortWithError(c, http.StatusBadRequest, "unable to find project by upn", err)
 		return
@@ -67,7 +67,7 @@ func (h *Handler) HandleStreamServiceLogs(c *gin.Context) {
 }
 
 func (h *Handler) HandleStreamShell(ctx *gin.Context) {
-	organisationID := currentOrganisationIDFromSession(ctx)
+	organisationID := projectOrganisationIDFromRequest(ctx)
 	usn := ctx.Param("usn")
 	projectID, err := strconv.Atoi(ctx.Param("projectID"))
 	if err != nil {
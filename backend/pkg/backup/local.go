@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalTarget stores backups in a directory on the host.
+type LocalTarget struct {
+	Root string
+}
+
+func NewLocalTarget(root string) *LocalTarget {
+	return &LocalTarget{Root: root}
+}
+
+func (t *LocalTarget) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return fmt.Errorf("unable to create backup directory: %w", err)
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create backup file %s: %w", p, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(p)
+		return fmt.Errorf("unable to write backup file %s: %w", p, err)
+	}
+	return f.Close()
+}
+
+func (t *LocalTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := t.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (t *LocalTarget) Delete(ctx context.Context, key string) error {
+	p, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path resolves the key inside of the root and rejects keys escaping it.
+func (t *LocalTarget) path(key string) (string, error) {
+	root := filepath.Clean(t.Root)
+	p := filepath.Join(root, filepath.FromSlash(key))
+	if p != root && !strings.HasPrefix(p, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid backup key: %s", key)
+	}
+	return p, nil
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Retention describes how many backups are kept: the newest backup of each of the last KeepDaily days
+// and the newest backup of each of the last KeepWeekly ISO weeks. A backup may count for both.
+// When both values are 0 every backup is kept.
+type Retention struct {
+	KeepDaily  int `json:"keep_daily" db:"keep_daily"`
+	KeepWeekly int `json:"keep_weekly" db:"keep_weekly"`
+}
+
+// Expired returns the indices of the backups in times which are not covered by the retention policy.
+func (r Retention) Expired(times []time.Time) []int {
+	if r.KeepDaily <= 0 && r.KeepWeekly <= 0 {
+		return nil
+	}
+
+	order := make([]int, len(times))
+	for i := range order {
+		order[i] = i
+	}
+	// Newest first, so the first backup we see for a day or week is the one to keep
+	sort.SliceStable(order, func(a, b int) bool {
+		return times[order[a]].After(times[order[b]])
+	})
+
+	keep := make(map[int]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for _, idx := range order {
+		t := times[idx].UTC()
+
+		day := t.Format("2006-01-02")
+		if !days[day] && len(days) < r.KeepDaily {
+			days[day] = true
+			keep[idx] = true
+		}
+
+		year, week := t.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%02d", year, week)
+		if !weeks[weekKey] && len(weeks) < r.KeepWeekly {
+			weeks[weekKey] = true
+			keep[idx] = true
+		}
+	}
+
+	expired := make([]int, 0)
+	for _, idx := range order {
+		if !keep[idx] {
+			expired = append(expired, idx)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,173 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion   = "us-east-1"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Target stores backups in an S3 compatible object storage like AWS S3 or MinIO.
+// Requests use path-style addressing and are signed with AWS Signature Version 4.
+type S3Target struct {
+	cfg    TargetConfig
+	client *http.Client
+}
+
+func NewS3Target(cfg TargetConfig) *S3Target {
+	if cfg.Region == "" {
+		cfg.Region = s3DefaultRegion
+	}
+	return &S3Target{
+		cfg:    cfg,
+		client: &http.Client{},
+	}
+}
+
+func (t *S3Target) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := t.newRequest(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	_, err = t.do(req, s3UnsignedPayload)
+	return err
+}
+
+func (t *S3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := t.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.do(req, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (t *S3Target) Delete(ctx context.Context, key string) error {
+	req, err := t.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	res, err := t.do(req, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (t *S3Target) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	scheme := "http"
+	if t.cfg.UseSSL {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   t.cfg.Endpoint,
+		Path:   "/" + path.Join(t.cfg.Bucket, t.cfg.Prefix, key),
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs and executes the request. Responses with a non 2xx status are turned into errors.
+func (t *S3Target) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	t.sign(req, payloadHash, time.Now().UTC())
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 request failed: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s returned %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+func (t *S3Target) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(req.Header.Get(h)) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, t.cfg.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+t.cfg.SecretKey), date)
+	key = hmacSHA256(key, t.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.cfg.AccessKey, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+func canonicalQuery(v url.Values) string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := v[k]
+		sort.Strings(values)
+		for _, val := range values {
+			parts = append(parts, url.QueryEscape(k)+"="+strings.ReplaceAll(url.QueryEscape(val), "+", "%20"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+const (
+	TargetTypeLocal = "local"
+	TargetTypeS3    = "s3"
+)
+
+// Target is a storage backend backups can be written to and read from.
+// Keys are slash separated paths relative to the root of the target.
+type Target interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// TargetConfig holds the settings for all target types, only the fields of the selected type are used.
+type TargetConfig struct {
+	// Local
+	Path string `json:"path,omitempty"`
+
+	// S3 compatible storage
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	UseSSL    bool   `json:"use_ssl,omitempty"`
+}
+
+// NewTarget creates the target for the given type. Local targets are confined to root, their path is either
+// relative to it or an absolute path within it. Without a path root is used.
+func NewTarget(targetType string, cfg TargetConfig, root string) (Target, error) {
+	switch targetType {
+	case TargetTypeLocal:
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		p := cfg.Path
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		if rel, err := filepath.Rel(root, filepath.Clean(p)); err != nil || !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("local target path %s must be within the backups directory", cfg.Path)
+		}
+		return NewLocalTarget(filepath.Clean(p)), nil
+	case TargetTypeS3:
+		if cfg.Endpoint == "" || cfg.Bucket == "" {
+			return nil, fmt.Errorf("s3 target requires an endpoint and a bucket")
+		}
+		return NewS3Target(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported backup target type: %s", targetType)
+	}
+}
@@ -27,6 +27,12 @@ func Up(pPath string) error {
 	return ExecuteDockerComposeCommand(pPath, command...)
 }
 
+// UpServices (re)creates only the given services without touching their dependencies.
+func UpServices(pPath string, services ...string) error {
+	command := append([]string{"up", "-d", "--no-deps"}, services...)
+	return ExecuteDockerComposeCommand(pPath, command...)
+}
+
 func ExecuteDockerComposeCommand(pPath string, command ...string) error {
 	messages, errChan, err := cmd(pPath, command...)
 	if err != nil {
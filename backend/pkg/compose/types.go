@@ -6,10 +6,14 @@ import (
 	"strings"
 )
 
+// PullPolicyNever uses the local image only, e.g. for images built by sloth which aren't pushed to a registry
+const PullPolicyNever = "never"
+
 type Services map[string]*Container
 
 type DockerCompose struct {
 	Networks map[string]*Network `json:"networks,omitempty"`
+	Volumes  map[string]*Volume  `json:"volumes,omitempty"`
 	Services Services            `json:"services"`
 }
 
@@ -22,6 +26,12 @@ type Network struct {
 	Driver   *string `json:"driver,omitempty"`
 }
 
+// Volume is a top-level named volume
+type Volume struct {
+	Driver     string            `json:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty"`
+}
+
 type HealthCheck struct {
 	Test        string `json:"test"`
 	Interval    string `json:"interval"`
@@ -85,14 +95,19 @@ type Container struct {
 	Pid         string               `json:"pid,omitempty"`
 	Ports       []string             `json:"ports,omitempty"`
 	Privileged  bool                 `json:"privileged,omitempty"`
+	PullPolicy  string               `json:"pull_policy,omitempty"`
 	User        string               `json:"user,omitempty"`
-	Volumes     []string             `json:"volumes,omitempty"`
+	Volumes     []VolumeMount        `json:"volumes,omitempty"`
 	VolumesFrom []string             `json:"volumes_from,omitempty"`
 	WorkDir     string               `json:"working_dir,omitempty"`
 	Restart     string               `json:"restart"`
 	HealthCheck *HealthCheck         `json:"healthcheck,omitempty"`
 	Depends     map[string]Condition `json:"depends_on,omitempty"`
 	Deploy      *Deploy              `json:"deploy,omitempty"`
+
+	// VolumeDefinitions are the named volumes used by the container. They are stored next to it
+	// as an extension field, so the DCJ of a service is self-contained.
+	VolumeDefinitions map[string]*Volume `json:"x-volumes,omitempty"`
 }
 
 type Build struct {
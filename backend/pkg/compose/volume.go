@@ -0,0 +1,80 @@
+package compose
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	VolumeTypeBind   = "bind"
+	VolumeTypeVolume = "volume"
+	VolumeTypeTmpfs  = "tmpfs"
+)
+
+// VolumeMount is the long syntax of a service volume.
+// It's always written in the long syntax, but the short syntax "source:target[:mode]" can be read as well.
+type VolumeMount struct {
+	Type     string        `json:"type"`
+	Source   string        `json:"source,omitempty"`
+	Target   string        `json:"target"`
+	ReadOnly bool          `json:"read_only,omitempty"`
+	Tmpfs    *TmpfsOptions `json:"tmpfs,omitempty"`
+}
+
+type TmpfsOptions struct {
+	// Size in bytes, 0 is unlimited
+	Size int64 `json:"size,omitempty"`
+}
+
+func (v *VolumeMount) UnmarshalJSON(b []byte) error {
+	var short string
+	if err := json.Unmarshal(b, &short); err == nil {
+		mount, err := ParseVolumeMount(short)
+		if err != nil {
+			return err
+		}
+		*v = *mount
+		return nil
+	}
+
+	// Alias to avoid recursion
+	type volumeMount VolumeMount
+	var long volumeMount
+	if err := json.Unmarshal(b, &long); err != nil {
+		return err
+	}
+	*v = VolumeMount(long)
+	return nil
+}
+
+// ParseVolumeMount parses the short syntax of a service volume, e.g. "./data:/data:ro", "cache:/cache" or "/tmp".
+func ParseVolumeMount(s string) (*VolumeMount, error) {
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 1:
+		if parts[0] == "" {
+			return nil, fmt.Errorf("empty volume")
+		}
+		// Anonymous volume
+		return &VolumeMount{Type: VolumeTypeVolume, Target: parts[0]}, nil
+	case 2, 3:
+		if parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid volume %q, expected 'source:target[:mode]'", s)
+		}
+		v := &VolumeMount{Type: VolumeTypeVolume, Source: parts[0], Target: parts[1]}
+		if strings.HasPrefix(v.Source, ".") || strings.HasPrefix(v.Source, "/") || strings.HasPrefix(v.Source, "~") {
+			v.Type = VolumeTypeBind
+		}
+		if len(parts) == 3 {
+			for _, opt := range strings.Split(parts[2], ",") {
+				if opt == "ro" {
+					v.ReadOnly = true
+				}
+			}
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("invalid volume %q, expected 'source:target[:mode]'", s)
+	}
+}
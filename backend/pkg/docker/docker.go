@@ -1,16 +1,25 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	dockerregistry "github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/devs-group/sloth/backend/pkg/registry"
 )
 
 func GetContainersByDirectory(dir string) ([]types.Container, error) {
@@ -70,50 +79,219 @@ func GetContainerIDByService(upn string, service string) (string, error) {
 	return "", errors.New(fmt.Sprintf("unable to find container with for service: %s in project: %s", service, upn))
 }
 
-func Login(username, password, registryURL, path string) error {
-	cmd := exec.Command("docker", "--config", "./", "login", registryURL, "-u", username, "-p", password)
-	cmd.Dir = path
+// Exec runs cmd inside of the container and writes its stdout to stdout. When stdin is not nil it is piped
+// into the command. An error containing the stderr output is returned if the command exits with a non-zero code.
+func Exec(ctx context.Context, containerID string, cmd, env []string, stdin io.Reader, stdout io.Writer) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	resp, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          env,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return err
+	}
 
-	err := cmd.Start()
+	hijackResp, err := cli.ContainerExecAttach(ctx, resp.ID, container.ExecAttachOptions{})
 	if err != nil {
 		return err
 	}
+	defer hijackResp.Close()
 
-	err = cmd.Wait()
+	stdinErr := make(chan error, 1)
+	go func() {
+		if stdin == nil {
+			stdinErr <- nil
+			return
+		}
+		_, err := io.Copy(hijackResp.Conn, stdin)
+		if cErr := hijackResp.CloseWrite(); err == nil {
+			err = cErr
+		}
+		stdinErr <- err
+	}()
+
+	var stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(stdout, &stderr, hijackResp.Reader); err != nil {
+		return err
+	}
+	if err := <-stdinErr; err != nil {
+		return fmt.Errorf("unable to write to exec stdin: %w", err)
+	}
+
+	inspect, err := cli.ContainerExecInspect(ctx, resp.ID)
 	if err != nil {
 		return err
 	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("command %q exited with code %d: %s", cmd[0], inspect.ExitCode, strings.TrimSpace(stderr.String()))
+	}
 	return nil
 }
 
-func Pull(image, path string) error {
-	cmd := exec.Command("docker", "--config", "./", "pull", image)
-	cmd.Dir = path
+// pullBackoff is the delay before the first retry of a failed pull, it doubles with every further retry.
+var pullBackoff = time.Second
 
-	err := cmd.Start()
+// Pull pulls the image, credentials are optional and only passed to the daemon with the request, so that they
+// aren't stored anywhere. Failed pulls are retried up to retries times, unless the image doesn't exist or access
+// to it is denied.
+func Pull(ctx context.Context, ref, username, password string, retries int) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
+	defer cli.Close()
 
-	err = cmd.Wait()
+	auth, err := registryAuth(ref, username, password)
 	if err != nil {
 		return err
 	}
+	backoff := pullBackoff
+	for attempt := 0; ; attempt++ {
+		err = pull(ctx, cli, ref, auth)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+		slog.Debug("retrying pull", "image", ref, "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func pull(ctx context.Context, cli *client.Client, ref, auth string) error {
+	resp, err := cli.ImagePull(ctx, ref, image.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("unable to pull %s: %w", ref, err)
+	}
+	defer resp.Close()
+	// Errors of the pull are only reported within the stream
+	if err := jsonmessage.DisplayJSONMessagesStream(resp, io.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("unable to pull %s: %w", ref, err)
+	}
 	return nil
 }
 
-func Logout(path, registry string) error {
-	cmd := exec.Command("docker", "--config", "./", "logout", registry)
-	cmd.Dir = path
+func retryable(err error) bool {
+	return !errdefs.IsNotFound(err) && !errdefs.IsUnauthorized(err) && !errdefs.IsForbidden(err) &&
+		!errdefs.IsInvalidParameter(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
 
-	err := cmd.Start()
+// registryAuth encodes the credentials of the registry of the image for requests to the daemon, it's empty
+// without credentials.
+func registryAuth(ref, username, password string) (string, error) {
+	if username == "" {
+		return "", nil
+	}
+	return dockerregistry.EncodeAuthConfig(dockerregistry.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: registry.Domain(ref),
+	})
+}
+
+// RepoDigest returns the digest of a local image, e.g. "sha256:...", under which it's stored in the repository
+// of the reference. The image can be given by its ID or reference.
+func RepoDigest(ctx context.Context, image, ref string) (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+	return repoDigest(ctx, cli, image, ref)
+}
+
+// ContainerRepoDigests returns the digests of the images of the containers by container ID, see RepoDigest.
+// Containers whose image has no digest, e.g. a locally built one, are left out.
+func ContainerRepoDigests(ctx context.Context, containers []types.Container) (map[string]string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	digests := make(map[string]string, len(containers))
+	for _, c := range containers {
+		digest, err := repoDigest(ctx, cli, c.ImageID, c.Image)
+		if err != nil {
+			slog.Debug("unable to get digest of running image", "image", c.Image, "err", err)
+			continue
+		}
+		digests[c.ID] = digest
+	}
+	return digests, nil
+}
+
+func repoDigest(ctx context.Context, cli *client.Client, image, ref string) (string, error) {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	repository := registry.Repository(ref)
+	for _, repoDigest := range inspect.RepoDigests {
+		name, digest, ok := strings.Cut(repoDigest, "@")
+		if ok && registry.Repository(name) == repository {
+			return digest, nil
+		}
+	}
+	return "", fmt.Errorf("image %s has no digest of %s, it might be built locally", image, repository)
+}
+
+// Build builds the image tagged with tag from a build context, a tarball which may be gzip compressed.
+// The dockerfile is relative to the root of the context. The progress of the build is written to out.
+func Build(ctx context.Context, buildContext io.Reader, dockerfile, tag string, args map[string]string, out io.Writer) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
+	defer cli.Close()
 
-	err = cmd.Wait()
+	buildArgs := make(map[string]*string, len(args))
+	for k, v := range args {
+		buildArgs[k] = &v
+	}
+	resp, err := cli.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  dockerfile,
+		BuildArgs:   buildArgs,
+		Remove:      true,
+		ForceRemove: true,
+		PullParent:  true,
+	})
 	if err != nil {
 		return err
 	}
-	return nil
+	defer resp.Body.Close()
+	// Errors of the build are only reported within the stream
+	return jsonmessage.DisplayJSONMessagesStream(resp.Body, out, 0, false, nil)
+}
+
+// Push pushes the image to its registry, credentials are optional. The progress is written to out.
+func Push(ctx context.Context, ref, username, password string, out io.Writer) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	auth, err := registryAuth(ref, username, password)
+	if err != nil {
+		return err
+	}
+	resp, err := cli.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	return jsonmessage.DisplayJSONMessagesStream(resp, out, 0, false, nil)
 }
@@ -0,0 +1,135 @@
+package dotenv
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var keyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// Var is an env var of a dotenv file.
+type Var struct {
+	Key   string
+	Value string
+}
+
+// Parse parses a dotenv file. Lines are "KEY=value", optionally prefixed by "export ". Comments start with "#",
+// after unquoted values they need to be preceded by whitespace. Single quoted values are literal, double quoted ones
+// support the escapes \n, \r, \t, \", \\ and \$. Quoted values can span multiple lines.
+// Keys which are defined more than once keep their first position and their last value.
+func Parse(content string) ([]Var, error) {
+	var vars []Var
+	index := make(map[string]int)
+
+	s := strings.ReplaceAll(content, "\r\n", "\n")
+	line := 1
+	for len(s) > 0 {
+		raw, next, _ := strings.Cut(s, "\n")
+		start := line
+		trimmed := strings.TrimLeft(raw, " \t")
+		if strings.TrimSpace(trimmed) == "" || strings.HasPrefix(trimmed, "#") {
+			s, line = next, line+1
+			continue
+		}
+
+		if after, ok := strings.CutPrefix(trimmed, "export "); ok {
+			trimmed = strings.TrimLeft(after, " \t")
+		}
+		key, rest, ok := strings.Cut(trimmed, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !keyRegex.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected KEY=value", start)
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if strings.HasPrefix(rest, "'") || strings.HasPrefix(rest, `"`) {
+			// rest ends the first line of s, quoted values might continue on the following lines
+			quoted := s[len(raw)-len(rest):]
+			var n int
+			var err error
+			value, n, err = parseQuoted(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", start, err)
+			}
+			line += strings.Count(quoted[:n], "\n")
+			var tail string
+			tail, next, _ = strings.Cut(quoted[n:], "\n")
+			if err := checkTrailing(tail); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		} else {
+			value = rest
+			for _, comment := range []string{" #", "\t#"} {
+				if i := strings.Index(value, comment); i != -1 {
+					value = value[:i]
+				}
+			}
+			value = strings.TrimSpace(value)
+		}
+		s, line = next, line+1
+
+		if i, ok := index[key]; ok {
+			vars[i].Value = value
+			continue
+		}
+		index[key] = len(vars)
+		vars = append(vars, Var{Key: key, Value: value})
+	}
+	return vars, nil
+}
+
+// parseQuoted parses the quoted value at the start of s and returns it with the number of bytes it spans.
+func parseQuoted(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("missing closing quote %c", quote)
+}
+
+func checkTrailing(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && !strings.HasPrefix(s, "#") {
+		return fmt.Errorf("unexpected %q after quoted value", s)
+	}
+	return nil
+}
+
+// Format formats the env vars as dotenv file which Parse and docker compose read the same way. Values are single
+// quoted, so that they are used literally, unless they contain single quotes or line breaks.
+func Format(vars []Var) []byte {
+	var b strings.Builder
+	for _, v := range vars {
+		if strings.ContainsAny(v.Value, "'\n\r") {
+			value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`).Replace(v.Value)
+			fmt.Fprintf(&b, "%s=\"%s\"\n", v.Key, value)
+		} else {
+			fmt.Fprintf(&b, "%s='%s'\n", v.Key, v.Value)
+		}
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,221 @@
+package dump
+
+import (
+	"strings"
+)
+
+// Engine describes how to dump and restore a database with its native tools from inside of its container.
+// Connection details are derived from the environment variables of the service, the same ones the
+// official images use for their initialisation.
+type Engine interface {
+	Name() string
+	// Extension is the file extension of the gzip compressed dump
+	Extension() string
+	// DumpCommand writes the dump to stdout
+	DumpCommand(env map[string]string) []string
+	// RestoreCommand reads a dump from stdin
+	RestoreCommand(env map[string]string) []string
+	// ExecEnv are additional environment variables for both commands, e.g. passwords
+	ExecEnv(env map[string]string) []string
+	// Compressed is true when the tool already compresses its output
+	Compressed() bool
+}
+
+// engines are the engines by repository of the known database images. Official images are also known with the
+// "library/" prefix, see EngineForImage.
+var engines = map[string]Engine{
+	"postgres":                         Postgres{},
+	"bitnami/postgresql":               Postgres{},
+	"postgis/postgis":                  Postgres{},
+	"timescale/timescaledb":            Postgres{},
+	"timescale/timescaledb-ha":         Postgres{},
+	"mariadb":                          MySQL{mariaDB: true},
+	"bitnami/mariadb":                  MySQL{mariaDB: true},
+	"mysql":                            MySQL{},
+	"bitnami/mysql":                    MySQL{},
+	"mysql/mysql-server":               MySQL{},
+	"percona":                          MySQL{},
+	"percona/percona-server":           MySQL{},
+	"mongo":                            Mongo{},
+	"bitnami/mongodb":                  Mongo{},
+	"mongodb/mongodb-community-server": Mongo{},
+	"redis":                            Redis{},
+	"bitnami/redis":                    Redis{},
+}
+
+// EngineForImage returns the engine of a known database image, e.g. "postgres:16" or
+// "registry.example.com/bitnami/mariadb", or nil if the image isn't a supported database. Only the exact
+// repositories are known, images which are merely named alike, e.g. "acme/postgres-exporter", aren't databases.
+func EngineForImage(image string) Engine {
+	name := strings.ToLower(image)
+	if idx := strings.Index(name, "@"); idx != -1 {
+		name = name[:idx]
+	}
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name = name[:idx]
+	}
+	// The first component is a registry if it looks like a host, as in Docker's reference format
+	if host, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		name = rest
+	}
+	return engines[strings.TrimPrefix(name, "library/")]
+}
+
+func firstOf(env map[string]string, fallback string, keys ...string) string {
+	for _, k := range keys {
+		if v := env[k]; v != "" {
+			return v
+		}
+	}
+	return fallback
+}
+
+type Postgres struct{}
+
+func (Postgres) Name() string      { return "postgres" }
+func (Postgres) Extension() string { return "sql.gz" }
+func (Postgres) Compressed() bool  { return false }
+
+func (Postgres) connection(env map[string]string) (user, db string) {
+	user = firstOf(env, "postgres", "POSTGRES_USER", "POSTGRESQL_USERNAME")
+	db = firstOf(env, user, "POSTGRES_DB", "POSTGRESQL_DATABASE")
+	return user, db
+}
+
+func (p Postgres) DumpCommand(env map[string]string) []string {
+	user, db := p.connection(env)
+	return []string{"pg_dump", "--username", user, "--dbname", db, "--clean", "--if-exists", "--no-owner"}
+}
+
+func (p Postgres) RestoreCommand(env map[string]string) []string {
+	user, db := p.connection(env)
+	return []string{"psql", "--username", user, "--dbname", db, "--set", "ON_ERROR_STOP=1", "--quiet"}
+}
+
+func (Postgres) ExecEnv(env map[string]string) []string {
+	if pw := firstOf(env, "", "POSTGRES_PASSWORD", "POSTGRESQL_PASSWORD"); pw != "" {
+		return []string{"PGPASSWORD=" + pw}
+	}
+	return nil
+}
+
+type MySQL struct {
+	mariaDB bool
+}
+
+func (m MySQL) Name() string {
+	if m.mariaDB {
+		return "mariadb"
+	}
+	return "mysql"
+}
+func (MySQL) Extension() string { return "sql.gz" }
+func (MySQL) Compressed() bool  { return false }
+
+// connection prefers the root user, since only root can dump all databases.
+func (MySQL) connection(env map[string]string) (user, password, db string) {
+	db = firstOf(env, "", "MYSQL_DATABASE", "MARIADB_DATABASE")
+	if pw := firstOf(env, "", "MYSQL_ROOT_PASSWORD", "MARIADB_ROOT_PASSWORD"); pw != "" {
+		return "root", pw, db
+	}
+	return firstOf(env, "root", "MYSQL_USER", "MARIADB_USER"), firstOf(env, "", "MYSQL_PASSWORD", "MARIADB_PASSWORD"), db
+}
+
+func (m MySQL) DumpCommand(env map[string]string) []string {
+	user, _, db := m.connection(env)
+	bin := "mysqldump"
+	if m.mariaDB {
+		bin = "mariadb-dump"
+	}
+	cmd := []string{bin, "--user=" + user, "--single-transaction", "--routines", "--triggers", "--events"}
+	if db == "" {
+		return append(cmd, "--all-databases")
+	}
+	return append(cmd, "--databases", db)
+}
+
+func (m MySQL) RestoreCommand(env map[string]string) []string {
+	user, _, _ := m.connection(env)
+	bin := "mysql"
+	if m.mariaDB {
+		bin = "mariadb"
+	}
+	// The dump contains the CREATE DATABASE and USE statements, so no database is selected here
+	return []string{bin, "--user=" + user}
+}
+
+func (m MySQL) ExecEnv(env map[string]string) []string {
+	if _, pw, _ := m.connection(env); pw != "" {
+		return []string{"MYSQL_PWD=" + pw}
+	}
+	return nil
+}
+
+type Mongo struct{}
+
+func (Mongo) Name() string      { return "mongo" }
+func (Mongo) Extension() string { return "archive.gz" }
+func (Mongo) Compressed() bool  { return true }
+
+// mongoPasswordEnv passes the password to mongoConfigScript, the tools only read it from arguments or a config file.
+const mongoPasswordEnv = "MONGO_DUMP_PASSWORD"
+
+// mongoConfigScript runs the command of its arguments with a config file containing the password, so that it
+// doesn't show up in the process list. The file is only readable by the user and removed afterwards.
+const mongoConfigScript = `umask 077 && config="$(mktemp)" && trap 'rm -f "$config"' EXIT && ` +
+	`printf "password: '%s'\n" "$(printf '%s' "$` + mongoPasswordEnv + `" | sed "s/'/''/g")" > "$config" && ` +
+	`"$@" --config "$config"`
+
+func (Mongo) user(env map[string]string) string {
+	return firstOf(env, "", "MONGO_INITDB_ROOT_USERNAME", "MONGODB_ROOT_USER")
+}
+
+func (m Mongo) command(env map[string]string, cmd ...string) []string {
+	user := m.user(env)
+	if user == "" {
+		return cmd
+	}
+	cmd = append(cmd, "--username", user, "--authenticationDatabase", "admin")
+	return append([]string{"sh", "-c", mongoConfigScript, "sh"}, cmd...)
+}
+
+func (m Mongo) DumpCommand(env map[string]string) []string {
+	return m.command(env, "mongodump", "--archive", "--gzip", "--quiet")
+}
+
+func (m Mongo) RestoreCommand(env map[string]string) []string {
+	return m.command(env, "mongorestore", "--archive", "--gzip", "--drop", "--quiet")
+}
+
+func (m Mongo) ExecEnv(env map[string]string) []string {
+	if m.user(env) == "" {
+		return nil
+	}
+	return []string{mongoPasswordEnv + "=" + firstOf(env, "", "MONGO_INITDB_ROOT_PASSWORD", "MONGODB_ROOT_PASSWORD")}
+}
+
+type Redis struct{}
+
+func (Redis) Name() string      { return "redis" }
+func (Redis) Extension() string { return "rdb.gz" }
+func (Redis) Compressed() bool  { return false }
+
+func (Redis) DumpCommand(env map[string]string) []string {
+	return []string{"redis-cli", "--rdb", "-"}
+}
+
+// RestoreCommand replaces the RDB file of the server and shuts it down without saving,
+// so the container restarts with the restored data set. This requires persistence via RDB instead of AOF.
+func (Redis) RestoreCommand(env map[string]string) []string {
+	script := `dir="$(redis-cli --raw CONFIG GET dir | tail -n 1)" && ` +
+		`file="$(redis-cli --raw CONFIG GET dbfilename | tail -n 1)" && ` +
+		`cat > "$dir/$file" && (redis-cli SHUTDOWN NOSAVE || true)`
+	return []string{"sh", "-c", script}
+}
+
+func (Redis) ExecEnv(env map[string]string) []string {
+	if pw := env["REDIS_PASSWORD"]; pw != "" {
+		return []string{"REDISCLI_AUTH=" + pw}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package dump
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+
+	"github.com/devs-group/sloth/backend/pkg/docker"
+)
+
+// Dump runs the engine's dump tool inside of the container and writes the gzip compressed dump to w.
+func Dump(ctx context.Context, containerID string, engine Engine, env map[string]string, w io.Writer) error {
+	cmd := engine.DumpCommand(env)
+	if engine.Compressed() {
+		return docker.Exec(ctx, containerID, cmd, engine.ExecEnv(env), nil, w)
+	}
+
+	gw := gzip.NewWriter(w)
+	if err := docker.Exec(ctx, containerID, cmd, engine.ExecEnv(env), nil, gw); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// Restore pipes a dump created by Dump into the engine's client inside of the container.
+func Restore(ctx context.Context, containerID string, engine Engine, env map[string]string, r io.Reader) error {
+	cmd := engine.RestoreCommand(env)
+	if engine.Compressed() {
+		return docker.Exec(ctx, containerID, cmd, engine.ExecEnv(env), r, io.Discard)
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	return docker.Exec(ctx, containerID, cmd, engine.ExecEnv(env), gr, io.Discard)
+}
@@ -14,18 +14,45 @@ import (
 //go:embed invitation.html
 var InvitationTemplate []byte
 
+//go:embed verification.html
+var VerificationTemplate []byte
+
+//go:embed password_reset.html
+var PasswordResetTemplate []byte
+
+//go:embed account_exists.html
+var AccountExistsTemplate []byte
+
 func SendInvitationMail(url, invitationToken, receiver string) error {
+	return sendLinkMail("Hey, you got an invitation 👀", InvitationTemplate, url+"="+invitationToken, receiver)
+}
+
+// SendVerificationMail sends the link to verify the email address of a new account.
+func SendVerificationMail(url, verificationToken, receiver string) error {
+	return sendLinkMail("Please verify your email 📬", VerificationTemplate, url+"="+verificationToken, receiver)
+}
+
+// SendPasswordResetMail sends the link to choose a new password.
+func SendPasswordResetMail(url, resetToken, receiver string) error {
+	return sendLinkMail("Reset your password 🔑", PasswordResetTemplate, url+"="+resetToken, receiver)
+}
+
+// SendAccountExistsMail tells the owner of an email about a sign-up with it and sends a link to choose a password.
+func SendAccountExistsMail(url, resetToken, receiver string) error {
+	return sendLinkMail("You already have an account 🦥", AccountExistsTemplate, url+"="+resetToken, receiver)
+}
+
+func sendLinkMail(subject string, htmlTemplate []byte, link, receiver string) error {
 	cfg := config.GetConfig()
 
-	subject := "Hey, you got an invitation 👀\r\n"
-	tpl, err := template.New("invitation").Parse(string(InvitationTemplate))
+	tpl, err := template.New("email").Parse(string(htmlTemplate))
 	if err != nil {
 		return fmt.Errorf("unable to parse email template: %w", err)
 	}
 	data := struct {
 		Link string
 	}{
-		Link: url + "=" + invitationToken,
+		Link: link,
 	}
 	var body bytes.Buffer
 	if err := tpl.Execute(&body, data); err != nil {
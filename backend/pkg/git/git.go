@@ -0,0 +1,230 @@
+package git
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// allowedProtocols are the transports git may use, also for submodules. Local repositories and "ext::"
+// commands are excluded, they would give access to the host.
+const allowedProtocols = "http:https:ssh:git"
+
+// ValidateRepository returns an error unless the repository is a http(s), ssh or git URL or uses the scp-like
+// syntax of ssh, e.g. "git@github.com:org/repo.git". Local paths and file:// URLs are rejected.
+func ValidateRepository(repository string) error {
+	if repository == "" || strings.HasPrefix(repository, "-") || strings.Contains(repository, "::") {
+		return fmt.Errorf("invalid repository %q", repository)
+	}
+	if strings.Contains(repository, "://") {
+		u, err := url.Parse(repository)
+		if err != nil {
+			return fmt.Errorf("invalid repository %q: %w", repository, err)
+		}
+		if !strings.Contains(":"+allowedProtocols+":", ":"+u.Scheme+":") {
+			return fmt.Errorf("unsupported protocol %q of repository, use %s", u.Scheme, allowedProtocols)
+		}
+		if u.Host == "" || strings.HasPrefix(u.Host, "-") {
+			return fmt.Errorf("invalid host of repository %q", repository)
+		}
+		return nil
+	}
+	host, _, ok := strings.Cut(repository, ":")
+	if !ok || host == "" || strings.Contains(host, "/") {
+		return fmt.Errorf("repository %q must be a http(s), ssh or git URL", repository)
+	}
+	return nil
+}
+
+// ValidateRef returns an error if the ref could be mistaken for an option by git.
+func ValidateRef(ref string) error {
+	if strings.HasPrefix(ref, "-") || strings.ContainsFunc(ref, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	return nil
+}
+
+// Auth authenticates against the remote of a repository. Only one of both is used, the deploy key
+// for SSH remotes, the token for HTTP(S) remotes.
+type Auth struct {
+	// DeployKey is a private SSH key in PEM/OpenSSH format
+	DeployKey string
+	// Token is an access token, e.g. a GitHub personal access token or a GitLab deploy token
+	Token string
+}
+
+// Clone checks out the ref of the repository into dir, which must not exist or be empty, and returns the
+// commit of the checkout. The ref is a branch, tag or commit, the default branch when empty.
+// The output of git is written to out.
+func Clone(ctx context.Context, repository, ref, dir string, auth Auth, out io.Writer) (string, error) {
+	if err := ValidateRepository(repository); err != nil {
+		return "", err
+	}
+	if err := ValidateRef(ref); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	env, cleanup, err := auth.env(dir)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	run := func(args ...string) error {
+		return runGit(ctx, dir, env, out, args...)
+	}
+
+	if err := run("init", "--quiet"); err != nil {
+		return "", err
+	}
+	if err := run("remote", "add", "origin", repository); err != nil {
+		return "", err
+	}
+
+	args := auth.args(repository)
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// Shallow fetches of arbitrary commits are not allowed by all servers, fall back to fetch everything.
+	fetch := append(args, "fetch", "--depth", "1", "--end-of-options", "origin", ref)
+	if err := run(fetch...); err != nil {
+		fmt.Fprintf(out, "shallow fetch of %s failed, fetching the whole repository\n", ref)
+		fetch = append(args, "fetch", "--tags", "--update-head-ok", "origin", "+refs/heads/*:refs/heads/*")
+		if err := run(fetch...); err != nil {
+			return "", err
+		}
+		// checkout doesn't support --end-of-options, so the ref is resolved first
+		cmd := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+		cmd.Dir = dir
+		commit, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("unknown ref %s", ref)
+		}
+		if err := run("checkout", "--quiet", "--detach", strings.TrimSpace(string(commit))); err != nil {
+			return "", err
+		}
+	} else if err := run("checkout", "--quiet", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+
+	if err := run(append(args, "submodule", "update", "--init", "--recursive", "--depth", "1")...); err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	commit, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %w", err)
+	}
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// RemoteCommit returns the commit the ref of the repository points to without cloning it, the default branch when
+// the ref is empty. Refs which aren't branches or tags, e.g. commits, are returned as they are.
+func RemoteCommit(ctx context.Context, repository, ref string, auth Auth) (string, error) {
+	if err := ValidateRepository(repository); err != nil {
+		return "", err
+	}
+	if err := ValidateRef(ref); err != nil {
+		return "", err
+	}
+
+	// The deploy key is written to the temporary directory
+	env, cleanup, err := auth.env(filepath.Join(os.TempDir(), "sloth-ls-remote"))
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+	var out strings.Builder
+	args := append(auth.args(repository), "ls-remote", "--end-of-options", repository, ref, ref+"^{}")
+	if err := runGit(ctx, "", env, &out, args...); err != nil {
+		return "", err
+	}
+
+	commit := ""
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// Annotated tags point to the tag object, the peeled ref to the commit
+		if commit == "" || strings.HasSuffix(fields[1], "^{}") {
+			commit = fields[0]
+		}
+	}
+	if commit == "" {
+		return ref, nil
+	}
+	return commit, nil
+}
+
+func runGit(ctx context.Context, dir string, env []string, out io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	// The same writer for both keeps the order of the output and doesn't write concurrently to out
+	var output strings.Builder
+	w := io.MultiWriter(out, &output)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// args returns the arguments to pass the token to git without storing it in the config of the repository.
+func (a Auth) args(repository string) []string {
+	if a.Token == "" || !strings.HasPrefix(repository, "http") {
+		return nil
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + a.Token))
+	return []string{"-c", "http.extraHeader=Authorization: Basic " + basic}
+}
+
+// env returns the environment which makes git use the deploy key. The key is written next to dir and removed
+// by cleanup, so that it isn't part of the checkout.
+func (a Auth) env(dir string) ([]string, func(), error) {
+	env := []string{"GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=" + allowedProtocols}
+	if a.DeployKey == "" {
+		return env, func() {}, nil
+	}
+
+	key, err := os.CreateTemp(filepath.Dir(filepath.Clean(dir)), ".deploy-key-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { _ = os.Remove(key.Name()) }
+	// Keys without a trailing newline are rejected by ssh
+	content := strings.TrimSpace(a.DeployKey) + "\n"
+	if _, err := key.WriteString(content); err != nil {
+		key.Close()
+		cleanup()
+		return nil, nil, err
+	}
+	if err := key.Close(); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := os.Chmod(key.Name(), 0o600); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	ssh := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", key.Name())
+	return append(env, "GIT_SSH_COMMAND="+ssh), cleanup, nil
+}
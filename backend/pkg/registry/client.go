@@ -0,0 +1,278 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// manifestMediaTypes are accepted when resolving digests, so that the digest of multi-platform images
+// matches the one docker pulls.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Client talks to the HTTP API V2 of registries, e.g. Docker Hub, GHCR or a "registry:2" container.
+type Client struct {
+	httpClient *http.Client
+	// credentials by registry domain
+	credentials map[string]Credentials
+}
+
+func NewClient(credentials map[string]Credentials) *Client {
+	return &Client{
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		credentials: credentials,
+	}
+}
+
+// NormalizeDomain returns the domain of a registry address like "https://index.docker.io/v1/" or "ghcr.io",
+// the way Domain returns it for image references.
+func NormalizeDomain(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		address = u.Host
+	}
+	address = strings.TrimSuffix(address, "/")
+	domain, _ := splitDomain(address + "/image")
+	return strings.ToLower(domain)
+}
+
+// Tags lists all tags of the repository of the image reference.
+func (c *Client) Tags(ctx context.Context, image string) ([]string, error) {
+	domain, name := c.split(image)
+	next := c.baseURL(domain) + "/v2/" + name + "/tags/list?n=1000"
+
+	var tags []string
+	for next != "" {
+		res, err := c.do(ctx, http.MethodGet, domain, name, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode tags of %s: %w", image, err)
+		}
+		tags = append(tags, body.Tags...)
+
+		next, err = nextLink(res, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// Digest returns the digest of the manifest the tag points to.
+func (c *Client) Digest(ctx context.Context, image, tag string) (string, error) {
+	domain, name := c.split(image)
+	endpoint := c.baseURL(domain) + "/v2/" + name + "/manifests/" + tag
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+
+	res, err := c.do(ctx, http.MethodHead, domain, name, endpoint, header)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry didn't return the digest of %s:%s", image, tag)
+	}
+	return digest, nil
+}
+
+// Ping checks that the registry accepts the credentials of its domain, the way "docker login" does.
+func (c *Client) Ping(ctx context.Context, address string) error {
+	domain := NormalizeDomain(address)
+	res, err := c.do(ctx, http.MethodGet, domain, "", c.baseURL(domain)+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (c *Client) split(image string) (domain, name string) {
+	repository := Repository(image)
+	domain = Domain(repository)
+	return domain, strings.TrimPrefix(repository, domain+"/")
+}
+
+func (c *Client) baseURL(domain string) string {
+	if domain == DefaultDomain {
+		return "https://registry-1.docker.io"
+	}
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+	// Like docker, local registries are expected without TLS
+	if host == "localhost" || net.ParseIP(host).IsLoopback() {
+		return "http://" + domain
+	}
+	return "https://" + domain
+}
+
+// do sends the request and authenticates it as the registry challenges.
+func (c *Client) do(ctx context.Context, method, domain, name, endpoint string, header http.Header) (*http.Response, error) {
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return c.httpClient.Do(req)
+	}
+
+	res, err := send("")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+		authorization, err := c.authorize(ctx, domain, name, challenge)
+		if err != nil {
+			return nil, err
+		}
+		if res, err = send(authorization); err != nil {
+			return nil, err
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if name == "" {
+			return nil, fmt.Errorf("registry %s responded with %s", domain, res.Status)
+		}
+		return nil, fmt.Errorf("registry %s responded with %s for %s", domain, res.Status, name)
+	}
+	return res, nil
+}
+
+// authorize answers a basic or bearer challenge of the registry and returns the authorization header.
+func (c *Client) authorize(ctx context.Context, domain, name, challenge string) (string, error) {
+	creds, hasCreds := c.credentials[domain]
+	scheme, params := parseChallenge(challenge)
+
+	switch scheme {
+	case "basic":
+		if !hasCreds {
+			return "", fmt.Errorf("registry %s requires credentials", domain)
+		}
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge of registry %s: %q", domain, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm of registry %s: %q", domain, params["realm"])
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" && name != "" {
+		scope = "repository:" + name + ":pull"
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCreds {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get token of registry %s: %s", domain, res.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("unable to decode token of registry %s: %w", domain, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+// nextLink returns the next page of the Link header, like `</v2/app/tags/list?n=1000&last=v2>; rel="next"`.
+func nextLink(res *http.Response, current string) (string, error) {
+	link := res.Header.Get("Link")
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return "", nil
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start == -1 || end < start {
+		return "", fmt.Errorf("invalid link header %q", link)
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var helperNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Helper returns the credentials of a registry, e.g. short-lived tokens of cloud registries like Amazon ECR.
+type Helper interface {
+	Get(ctx context.Context, registry string) (Credentials, error)
+}
+
+// HelperFunc adapts a function to a Helper.
+type HelperFunc func(ctx context.Context, registry string) (Credentials, error)
+
+func (f HelperFunc) Get(ctx context.Context, registry string) (Credentials, error) {
+	return f(ctx, registry)
+}
+
+var (
+	helpersMu sync.RWMutex
+	helpers   = make(map[string]Helper)
+)
+
+// RegisterHelper registers a helper by name, it takes precedence over the docker credential helper of the name.
+func RegisterHelper(name string, helper Helper) {
+	helpersMu.Lock()
+	defer helpersMu.Unlock()
+	helpers[name] = helper
+}
+
+// LookupHelper returns the registered helper of the name, otherwise the docker credential helper
+// "docker-credential-<name>", e.g. "ecr-login" of the Amazon ECR credential helper.
+func LookupHelper(name string) (Helper, error) {
+	helpersMu.RLock()
+	helper, ok := helpers[name]
+	helpersMu.RUnlock()
+	if ok {
+		return helper, nil
+	}
+	if !helperNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid credential helper %q", name)
+	}
+	program, err := exec.LookPath("docker-credential-" + name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find credential helper %q: %w", name, err)
+	}
+	return execHelper(program), nil
+}
+
+// execHelper runs a docker credential helper, which reads the registry from stdin and writes the credentials as JSON.
+type execHelper string
+
+func (h execHelper) Get(ctx context.Context, registry string) (Credentials, error) {
+	cmd := exec.CommandContext(ctx, string(h), "get")
+	cmd.Stdin = strings.NewReader(registry)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("credential helper failed: %v: %s", err, strings.TrimSpace(stderr.String()+string(out)))
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return Credentials{}, fmt.Errorf("unable to decode credentials of helper: %w", err)
+	}
+	return Credentials{Username: creds.Username, Password: creds.Secret}, nil
+}
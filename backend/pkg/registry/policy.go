@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Types of tag policies, which decide to which tag of the registry a service gets updated.
+const (
+	// PolicyExact waits for the tag of the constraint to appear
+	PolicyExact = "exact"
+	// PolicySemver selects the highest version matching the constraint, e.g. "~1.4"
+	PolicySemver = "semver"
+	// PolicyRegex selects the highest tag matching the regular expression of the constraint
+	PolicyRegex = "regex"
+	// PolicyDigest keeps the tag, e.g. "latest", and redeploys when it points to a new image
+	PolicyDigest = "digest"
+)
+
+type Policy struct {
+	Type       string
+	Constraint string
+}
+
+func (p Policy) Validate() error {
+	switch p.Type {
+	case PolicyExact:
+		if p.Constraint == "" {
+			return fmt.Errorf("the exact policy requires a tag")
+		}
+	case PolicySemver:
+		if _, err := ParseConstraint(p.Constraint); err != nil {
+			return err
+		}
+	case PolicyRegex:
+		if _, err := regexp.Compile(p.Constraint); err != nil {
+			return err
+		}
+	case PolicyDigest:
+	default:
+		return fmt.Errorf("unknown tag policy %q", p.Type)
+	}
+	return nil
+}
+
+// SelectTag returns the tag the policy selects from the tags of a repository,
+// an empty string if none matches. The digest policy always selects the current tag.
+// The semver and regex policies never select a tag lower than the current one, they keep the current tag instead.
+func (p Policy) SelectTag(current string, tags []string) (string, error) {
+	switch p.Type {
+	case PolicyDigest:
+		return current, nil
+	case PolicyExact:
+		for _, tag := range tags {
+			if tag == p.Constraint {
+				return tag, nil
+			}
+		}
+		return "", nil
+	case PolicySemver:
+		constraint, err := ParseConstraint(p.Constraint)
+		if err != nil {
+			return "", err
+		}
+		var selected string
+		var highest Version
+		for _, tag := range tags {
+			v, err := ParseVersion(tag)
+			if err != nil || !constraint.Matches(v) {
+				continue
+			}
+			if selected == "" || v.Compare(highest) > 0 {
+				selected, highest = tag, v
+			}
+		}
+		if v, err := ParseVersion(current); err == nil && selected != "" && highest.Compare(v) <= 0 {
+			return current, nil
+		}
+		return selected, nil
+	case PolicyRegex:
+		re, err := regexp.Compile(p.Constraint)
+		if err != nil {
+			return "", err
+		}
+		var selected string
+		for _, tag := range tags {
+			if re.MatchString(tag) && (selected == "" || compareTags(tag, selected) > 0) {
+				selected = tag
+			}
+		}
+		// A current tag which doesn't match isn't comparable, e.g. "latest" before the policy was set
+		if re.MatchString(current) && selected != "" && compareTags(selected, current) <= 0 {
+			return current, nil
+		}
+		return selected, nil
+	}
+	return "", fmt.Errorf("unknown tag policy %q", p.Type)
+}
+
+// compareTags compares tags as versions if possible, otherwise by their numbers and text.
+func compareTags(a, b string) int {
+	va, errA := ParseVersion(a)
+	vb, errB := ParseVersion(b)
+	if errA == nil && errB == nil {
+		if cmp := va.Compare(vb); cmp != 0 {
+			return cmp
+		}
+	}
+	return compareNatural(a, b)
+}
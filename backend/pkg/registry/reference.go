@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"strings"
+)
+
+const DefaultDomain = "docker.io"
+
+// SplitReference splits an image reference into its repository and tag or digest,
+// e.g. "ghcr.io/org/app:v1" becomes "ghcr.io/org/app" and "v1".
+func SplitReference(ref string) (repository, tag, digest string) {
+	if idx := strings.Index(ref, "@"); idx != -1 {
+		ref, digest = ref[:idx], ref[idx+1:]
+	}
+	// A colon after the last slash separates the tag, otherwise it's the port of the registry
+	if idx := strings.LastIndex(ref, ":"); idx != -1 && !strings.Contains(ref[idx:], "/") {
+		ref, tag = ref[:idx], ref[idx+1:]
+	}
+	return ref, tag, digest
+}
+
+// Domain returns the registry of an image reference, "docker.io" for images of Docker Hub.
+func Domain(ref string) string {
+	domain, _ := splitDomain(ref)
+	return domain
+}
+
+// Repository returns the fully qualified repository of an image reference without tag or digest,
+// so that different spellings of the same image can be compared, e.g. "nginx:latest" becomes
+// "docker.io/library/nginx".
+func Repository(ref string) string {
+	repository, _, _ := SplitReference(strings.TrimSpace(ref))
+	domain, path := splitDomain(repository)
+	if domain == DefaultDomain && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return strings.ToLower(domain + "/" + path)
+}
+
+func splitDomain(ref string) (domain, path string) {
+	idx := strings.Index(ref, "/")
+	if idx == -1 {
+		return DefaultDomain, ref
+	}
+	first := ref[:idx]
+	if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return DefaultDomain, ref
+	}
+	switch first {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		first = DefaultDomain
+	}
+	return first, ref[idx+1:]
+}
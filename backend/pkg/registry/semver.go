@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version parsed from an image tag, e.g. "v1.4.2" or "1.4".
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+}
+
+// ParseVersion parses tags like "1", "1.4", "v1.4.2" or "1.4.2-rc.1". Build metadata after "+" is ignored.
+func ParseVersion(tag string) (Version, error) {
+	v, parts, err := parsePartialVersion(tag)
+	if err != nil {
+		return Version{}, err
+	}
+	if parts == 0 {
+		return Version{}, fmt.Errorf("invalid version %q", tag)
+	}
+	return v, nil
+}
+
+// parsePartialVersion parses a version with wildcards, which returns the number of given parts,
+// e.g. 2 for "1.4" and "1.4.x".
+func parsePartialVersion(s string) (Version, int, error) {
+	var v Version
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	if idx := strings.Index(s, "+"); idx != -1 {
+		s = s[:idx]
+	}
+	if idx := strings.Index(s, "-"); idx != -1 {
+		s, v.Prerelease = s[:idx], s[idx+1:]
+	}
+	if s == "" {
+		return v, 0, fmt.Errorf("invalid version %q", s)
+	}
+
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 {
+		return v, 0, fmt.Errorf("invalid version %q", s)
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	parts := 0
+	for i, field := range fields {
+		if field == "x" || field == "X" || field == "*" {
+			break
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", s)
+		}
+		*numbers[i] = n
+		parts++
+	}
+	return v, parts, nil
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal or greater than o. Prereleases are lower than their release.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+	return compareNatural(v.Prerelease, o.Prerelease)
+}
+
+type comparator struct {
+	op      string
+	version Version
+}
+
+func (c comparator) matches(v Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return cmp == 0
+	}
+}
+
+// Constraint is a range of versions like "~1.4", "^2", ">=1.2 <1.5" or "1.x || 2.x".
+type Constraint struct {
+	ranges            [][]comparator
+	allowsPrereleases bool
+}
+
+// ParseConstraint parses ranges separated by "||", each with comparators separated by spaces or commas.
+// Comparators are "~" (patch updates), "^" (compatible updates), ">", ">=", "<", "<=", "=" and versions
+// with wildcards. Prereleases only match constraints which mention one.
+func ParseConstraint(s string) (*Constraint, error) {
+	c := Constraint{allowsPrereleases: strings.Contains(s, "-")}
+	for _, r := range strings.Split(s, "||") {
+		var comparators []comparator
+		for _, field := range strings.FieldsFunc(r, func(r rune) bool { return r == ' ' || r == ',' }) {
+			cs, err := parseComparator(field)
+			if err != nil {
+				return nil, err
+			}
+			comparators = append(comparators, cs...)
+		}
+		if len(comparators) == 0 {
+			return nil, fmt.Errorf("invalid constraint %q", s)
+		}
+		c.ranges = append(c.ranges, comparators)
+	}
+	return &c, nil
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	if s == "*" || s == "x" || s == "X" {
+		return []comparator{{op: ">=", version: Version{}}}, nil
+	}
+
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, strings.TrimPrefix(s, prefix)
+			break
+		}
+	}
+	v, parts, err := parsePartialVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	if parts == 0 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+
+	// next returns the lowest version above all versions matching the given parts
+	next := func(parts int) Version {
+		switch parts {
+		case 1:
+			return Version{Major: v.Major + 1}
+		case 2:
+			return Version{Major: v.Major, Minor: v.Minor + 1}
+		default:
+			return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+		}
+	}
+
+	switch op {
+	case "~":
+		return []comparator{{">=", v}, {"<", next(min(parts, 2))}}, nil
+	case "^":
+		upper := Version{Major: v.Major + 1}
+		if v.Major == 0 && parts > 1 {
+			upper = Version{Minor: v.Minor + 1}
+			if v.Minor == 0 && parts > 2 {
+				upper = Version{Patch: v.Patch + 1}
+			}
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	case ">":
+		if parts < 3 {
+			return []comparator{{">=", next(parts)}}, nil
+		}
+		return []comparator{{">", v}}, nil
+	case "<=":
+		if parts < 3 {
+			return []comparator{{"<", next(parts)}}, nil
+		}
+		return []comparator{{"<=", v}}, nil
+	case ">=", "<":
+		return []comparator{{op, v}}, nil
+	default:
+		if parts < 3 {
+			return []comparator{{">=", v}, {"<", next(parts)}}, nil
+		}
+		return []comparator{{"=", v}}, nil
+	}
+}
+
+// Matches reports whether the version is within one of the ranges.
+func (c *Constraint) Matches(v Version) bool {
+	if v.Prerelease != "" && !c.allowsPrereleases {
+		return false
+	}
+	for _, r := range c.ranges {
+		matches := true
+		for _, comp := range r {
+			if !comp.matches(v) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// compareNatural compares strings with numbers by their value, e.g. "build-9" is lower than "build-10".
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		ca, restA := nextChunk(a)
+		cb, restB := nextChunk(b)
+		na, errA := strconv.Atoi(ca)
+		nb, errB := strconv.Atoi(cb)
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case ca != cb:
+			return strings.Compare(ca, cb)
+		}
+		a, b = restA, restB
+	}
+	return strings.Compare(a, b)
+}
+
+func nextChunk(s string) (chunk, rest string) {
+	isDigit := func(r byte) bool { return r >= '0' && r <= '9' }
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
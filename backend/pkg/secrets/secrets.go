@@ -0,0 +1,190 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// prefix marks encrypted values, values without it are plaintext
+const prefix = "enc:v1:"
+
+// keyLen is the length of master keys and data keys, AES-256 is used for both
+const keyLen = 32
+
+// Keyring encrypts values with envelope encryption: every value is encrypted by a data key of its own, which is
+// encrypted by a master key. Values are decrypted by the master key they were encrypted with, so master keys can be
+// rotated by adding a new primary key and rewrapping the data keys, see Rotate.
+//
+// A nil Keyring stores values as plaintext.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring parses master keys in the format "<id>:<base64 key>[,<id>:<base64 key>...]". The first key is the
+// primary key new values are encrypted with, the others are only used for decryption. Keys are 32 bytes long, e.g.
+// generated by "openssl rand -base64 32". An empty spec returns a nil Keyring.
+func NewKeyring(spec string) (*Keyring, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key %q, expected <id>:<base64 key>", id)
+		}
+		if _, exists := k.keys[id]; exists {
+			return nil, fmt.Errorf("key %q is defined twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		if len(key) != keyLen {
+			return nil, fmt.Errorf("invalid key %q: expected %d bytes, got %d", id, keyLen, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.primary == "" {
+			k.primary = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// IsEncrypted reports whether the value was encrypted by a Keyring.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt encrypts the value with a new data key, which is encrypted by the primary key.
+// The result has the format "enc:v1:<key id>:<encrypted data key>:<encrypted value>".
+func (k *Keyring) Encrypt(value string) (string, error) {
+	if k == nil {
+		return value, nil
+	}
+	dataKey := make([]byte, keyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(data, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return prefix + k.primary + ":" + wrapped + ":" + ciphertext, nil
+}
+
+// Decrypt decrypts a value returned by Encrypt, plaintext values are returned as they are.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	_, dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(data, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rotate returns the value encrypted by the primary key. Values of other keys only get their data key rewrapped,
+// plaintext values are encrypted. It reports whether the value changed.
+func (k *Keyring) Rotate(value string) (string, bool, error) {
+	if k == nil {
+		return value, false, nil
+	}
+	if !IsEncrypted(value) {
+		encrypted, err := k.Encrypt(value)
+		return encrypted, err == nil, err
+	}
+	id, dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", false, err
+	}
+	if id == k.primary {
+		return value, false, nil
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey)
+	if err != nil {
+		return "", false, err
+	}
+	return prefix + k.primary + ":" + wrapped + ":" + ciphertext, true, nil
+}
+
+// unwrap returns the key id, the decrypted data key and the still encrypted value.
+func (k *Keyring) unwrap(value string) (string, []byte, string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, "", errors.New("malformed encrypted value")
+	}
+	if k == nil {
+		return "", nil, "", errors.New("value is encrypted, but no keys are configured")
+	}
+	master, ok := k.keys[parts[0]]
+	if !ok {
+		return "", nil, "", fmt.Errorf("value is encrypted by the unknown key %q", parts[0])
+	}
+	dataKey, err := open(master, parts[1])
+	if err != nil {
+		return "", nil, "", err
+	}
+	return parts[0], dataKey, parts[2], nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce, which is prepended to the base64 encoded result.
+func seal(aead cipher.AEAD, plaintext []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func open(aead cipher.AEAD, encoded string) ([]byte, error) {
+	b, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted value")
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt value: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type pullRequestPayload struct {
+	// GitHub
+	Action      string `json:"action"`
+	PullRequest *struct {
+		Head struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+	} `json:"pull_request"`
+
+	// GitLab
+	ObjectAttributes *struct {
+		Action       string `json:"action"`
+		SourceBranch string `json:"source_branch"`
+	} `json:"object_attributes"`
+}
+
+// ClosedPullRequest returns the source branch of a pull request of GitHub or merge request of GitLab which got
+// closed or merged. Other deliveries return an empty branch.
+func ClosedPullRequest(header http.Header, body []byte) (string, error) {
+	github := header.Get("X-GitHub-Event") == "pull_request"
+	gitlab := header.Get("X-Gitlab-Event") == "Merge Request Hook"
+	if !github && !gitlab {
+		return "", nil
+	}
+
+	var p pullRequestPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", fmt.Errorf("unable to parse payload: %w", err)
+	}
+	switch {
+	case github && p.PullRequest != nil && p.Action == "closed":
+		return p.PullRequest.Head.Ref, nil
+	case gitlab && p.ObjectAttributes != nil && (p.ObjectAttributes.Action == "close" || p.ObjectAttributes.Action == "merge"):
+		return p.ObjectAttributes.SourceBranch, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,159 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/devs-group/sloth/backend/pkg/registry"
+)
+
+// Push is an image tag which got pushed to a registry
+type Push struct {
+	// Image is the repository without tag, e.g. "ghcr.io/org/app"
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+}
+
+// payload contains the fields of all supported payloads, the format is detected by the fields which are set.
+type payload struct {
+	// Docker Hub
+	PushData *struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository json.RawMessage `json:"repository"`
+
+	// Distribution notifications, e.g. of the GitLab container registry
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+
+	// Harbor
+	Type      string `json:"type"`
+	EventData *struct {
+		Resources []struct {
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+	} `json:"event_data"`
+
+	// GitHub package events of GHCR
+	Package         *githubPackage `json:"package"`
+	RegistryPackage *githubPackage `json:"registry_package"`
+
+	// Generic
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+}
+
+type githubPackage struct {
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	PackageType string `json:"package_type"`
+	Owner       struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	PackageVersion struct {
+		PackageURL        string `json:"package_url"`
+		ContainerMetadata struct {
+			Tag struct {
+				Name string `json:"name"`
+			} `json:"tag"`
+		} `json:"container_metadata"`
+	} `json:"package_version"`
+}
+
+// ParsePushes extracts the pushed images from the payload of a registry webhook.
+// Supported are Docker Hub, GHCR (GitHub package events), the GitLab container registry and other registries
+// sending distribution notifications, Harbor and the generic format {"image": "...", "tag": "..."}.
+// Deliveries which aren't about pushed tags, e.g. GitHub pings, return no pushes.
+func ParsePushes(header http.Header, body []byte) ([]Push, error) {
+	var p payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse payload: %w", err)
+	}
+
+	if event := header.Get("X-GitHub-Event"); event != "" {
+		pkg := p.Package
+		if event == "registry_package" {
+			pkg = p.RegistryPackage
+		}
+		if pkg == nil || !strings.EqualFold(pkg.PackageType, "container") {
+			return nil, nil
+		}
+		return pkg.pushes(), nil
+	}
+
+	var pushes []Push
+	switch {
+	case p.PushData != nil:
+		var repository struct {
+			RepoName string `json:"repo_name"`
+		}
+		if err := json.Unmarshal(p.Repository, &repository); err != nil {
+			return nil, fmt.Errorf("unable to parse docker hub repository: %w", err)
+		}
+		pushes = append(pushes, Push{Image: repository.RepoName, Tag: p.PushData.Tag})
+	case len(p.Events) > 0:
+		for _, e := range p.Events {
+			if e.Action != "push" || e.Target.Tag == "" {
+				continue
+			}
+			image := e.Target.Repository
+			if e.Request.Host != "" {
+				image = e.Request.Host + "/" + image
+			}
+			pushes = append(pushes, Push{Image: image, Tag: e.Target.Tag})
+		}
+	case p.EventData != nil:
+		if p.Type != "PUSH_ARTIFACT" && p.Type != "pushImage" {
+			return nil, nil
+		}
+		for _, r := range p.EventData.Resources {
+			image, _, _ := registry.SplitReference(r.ResourceURL)
+			pushes = append(pushes, Push{Image: image, Tag: r.Tag})
+		}
+	case p.Image != "":
+		image, tag, _ := registry.SplitReference(p.Image)
+		if p.Tag != "" {
+			tag = p.Tag
+		}
+		pushes = append(pushes, Push{Image: image, Tag: tag})
+	default:
+		return nil, fmt.Errorf("unsupported payload")
+	}
+
+	valid := pushes[:0]
+	for _, push := range pushes {
+		if push.Image != "" && push.Tag != "" {
+			valid = append(valid, push)
+		}
+	}
+	return valid, nil
+}
+
+func (p *githubPackage) pushes() []Push {
+	tag := p.PackageVersion.ContainerMetadata.Tag.Name
+	if tag == "" {
+		// Untagged pushes, e.g. of the single platform images of a multi platform image
+		return nil
+	}
+
+	image, _, _ := registry.SplitReference(p.PackageVersion.PackageURL)
+	if image == "" {
+		owner := p.Namespace
+		if owner == "" {
+			owner = p.Owner.Login
+		}
+		image = fmt.Sprintf("ghcr.io/%s/%s", owner, p.Name)
+	}
+	return []Push{{Image: image, Tag: tag}}
+}
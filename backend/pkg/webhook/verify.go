@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Providers are the ways a delivery can be authenticated
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+	// ProviderGeneric signs the body like GitHub, but in the X-Signature-256 header
+	ProviderGeneric = "generic"
+	// ProviderAuthorization sends the secret in the Authorization header, e.g. Harbor or registry notifications.
+	// Secrets aren't accepted as query parameter, as URLs end up in the logs of proxies and registries.
+	ProviderAuthorization = "authorization"
+)
+
+const (
+	HeaderGitHubSignature  = "X-Hub-Signature-256"
+	HeaderGitLabToken      = "X-Gitlab-Token"
+	HeaderGenericSignature = "X-Signature-256"
+)
+
+var ErrUnauthenticated = errors.New("missing signature or token")
+var ErrInvalidSignature = errors.New("invalid signature or token")
+
+// Verify authenticates a delivery with the secret of the project and returns the provider which signed it.
+// Signatures take precedence over plain tokens.
+func Verify(header http.Header, body []byte, secret string) (string, error) {
+	if secret == "" {
+		return "", ErrInvalidSignature
+	}
+
+	if sig := header.Get(HeaderGitHubSignature); sig != "" {
+		return ProviderGitHub, verifySignature(sig, body, secret)
+	}
+	if sig := header.Get(HeaderGenericSignature); sig != "" {
+		return ProviderGeneric, verifySignature(sig, body, secret)
+	}
+	if token := header.Get(HeaderGitLabToken); token != "" {
+		return ProviderGitLab, verifyToken(token, secret)
+	}
+	if auth := header.Get("Authorization"); auth != "" {
+		return ProviderAuthorization, verifyToken(strings.TrimPrefix(auth, "Bearer "), secret)
+	}
+	return "", ErrUnauthenticated
+}
+
+// Sign returns the signature of the body in the format of the X-Hub-Signature-256 header.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifySignature(signature string, body []byte, secret string) error {
+	if !hmac.Equal([]byte(signature), []byte(Sign(body, secret))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func verifyToken(token, secret string) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
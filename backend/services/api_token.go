@@ -0,0 +1,246 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+// Scopes of API tokens. Read allows safe requests like GET, write all others.
+const (
+	APITokenScopeRead  = "read"
+	APITokenScopeWrite = "write"
+)
+
+const apiTokenPrefix = "sla_"
+
+// APIToken authenticates requests to the API like a session does. Personal tokens act as their user,
+// organisation tokens as a service account which is a member of the organisation. Both act in the organisation
+// they were created for, independent of the current organisation of their user.
+type APIToken struct {
+	ID             int        `json:"id" db:"id"`
+	Name           string     `json:"name" binding:"required" db:"name"`
+	Scopes         StringList `json:"scopes" binding:"required" db:"scopes"`
+	ExpiresAt      *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt     *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UserID         int        `json:"-" db:"user_id"`
+	OrganisationID *int       `json:"organisation_id,omitempty" db:"organisation_id"`
+	TokenHash      string     `json:"-" db:"token_hash"`
+
+	// Token is only set when it got created
+	Token string `json:"token,omitempty" db:"-"`
+}
+
+// APITokenIdentity is who a request authenticated with an API token acts as.
+type APITokenIdentity struct {
+	TokenID int
+	UserID  int
+	// OrganisationID is the organisation of the token, which requests act in
+	OrganisationID int
+	Scopes         StringList
+}
+
+func (i *APITokenIdentity) HasScope(scope string) bool {
+	return slices.Contains(i.Scopes, scope)
+}
+
+func (t *APIToken) Validate() error {
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range t.Scopes {
+		if scope != APITokenScopeRead && scope != APITokenScopeWrite {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()) {
+		return fmt.Errorf("expiry must be in the future")
+	}
+	return nil
+}
+
+// ScopeForMethod returns the scope required for requests with the HTTP method.
+func ScopeForMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return APITokenScopeRead
+	default:
+		return APITokenScopeWrite
+	}
+}
+
+const selectAPITokens = `
+	SELECT id, name, scopes, expires_at, last_used_at, created_at, user_id, organisation_id, token_hash
+	FROM api_tokens
+`
+
+func (s *S) SelectPersonalAPITokens(userID string) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+	query := selectAPITokens + `WHERE user_id = $1 ORDER BY id`
+	if err := s.dbService.GetConn().Select(&tokens, query, userID); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *S) SelectOrganisationAPITokens(organisationID int) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+	query := selectAPITokens + `
+		WHERE organisation_id = $1 AND user_id IN (SELECT user_id FROM users WHERE is_service_account = TRUE)
+		ORDER BY id
+	`
+	if err := s.dbService.GetConn().Select(&tokens, query, organisationID); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// SavePersonalAPIToken generates a new token for the user of t.UserID, which is only returned in t.Token. It acts in
+// the organisation of t.OrganisationID, the current one of the user by default, which the caller has to authorize.
+func (s *S) SavePersonalAPIToken(t *APIToken) error {
+	if t.OrganisationID == nil {
+		var organisationID int
+		query := `SELECT current_organisation_id FROM users WHERE user_id = $1`
+		if err := s.dbService.GetConn().Get(&organisationID, query, t.UserID); err != nil {
+			return err
+		}
+		t.OrganisationID = &organisationID
+	}
+	if err := s.insertAPIToken(s.dbService.GetConn(), t); err != nil {
+		return err
+	}
+	s.audit(*t.OrganisationID, AuditActionAPITokenCreate, t.Name, nil, t)
+	return nil
+}
+
+// SaveOrganisationAPIToken creates a service account for the token and adds it as member to the organisation.
+// The token is only returned in t.Token.
+func (s *S) SaveOrganisationAPIToken(t *APIToken, organisationID int) error {
+	err := s.WithTransaction(func(tx *sqlx.Tx) error {
+		local, err := utils.RandStringRunes(16)
+		if err != nil {
+			return err
+		}
+		query := `
+			INSERT INTO users (email, username, email_verified, current_organisation_id, is_service_account)
+			VALUES ($1, $2, TRUE, $3, TRUE)
+			RETURNING user_id
+		`
+		email := fmt.Sprintf("%s@service-accounts.invalid", local)
+		if err := tx.Get(&t.UserID, query, email, t.Name, organisationID); err != nil {
+			return errors.Wrap(err, "unable to create service account")
+		}
+
+		query = `INSERT INTO organisation_members (organisation_id, user_id, role) VALUES ($1, $2, 'member')`
+		if _, err := tx.Exec(query, organisationID, t.UserID); err != nil {
+			return errors.Wrap(err, "unable to add service account to organisation")
+		}
+
+		t.OrganisationID = &organisationID
+		return s.insertAPIToken(tx, t)
+	})
+	if err != nil {
+		return err
+	}
+	s.audit(organisationID, AuditActionAPITokenCreate, t.Name, nil, t)
+	return nil
+}
+
+func (s *S) insertAPIToken(db sqlx.Queryer, t *APIToken) error {
+	var err error
+	t.Token, t.TokenHash, err = generateToken(apiTokenPrefix)
+	if err != nil {
+		return err
+	}
+	t.CreatedAt = time.Now().UTC()
+	query := `
+		INSERT INTO api_tokens (name, token_hash, scopes, expires_at, created_at, user_id, organisation_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	return sqlx.Get(db, &t.ID, query, t.Name, t.TokenHash, t.Scopes, t.ExpiresAt, t.CreatedAt, t.UserID, t.OrganisationID)
+}
+
+func (s *S) DeletePersonalAPIToken(userID string, tokenID int) error {
+	var t APIToken
+	query := selectAPITokens + `WHERE id = $1 AND user_id = $2`
+	if err := s.dbService.GetConn().Get(&t, query, tokenID, userID); err != nil {
+		return err
+	}
+	query = `DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`
+	res, err := s.dbService.GetConn().Exec(query, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	if t.OrganisationID != nil {
+		s.audit(*t.OrganisationID, AuditActionAPITokenDelete, t.Name, &t, nil)
+	}
+	return nil
+}
+
+// DeleteOrganisationAPIToken deletes the service account of the token, which deletes the token as well.
+func (s *S) DeleteOrganisationAPIToken(organisationID, tokenID int) error {
+	var t APIToken
+	query := selectAPITokens + `WHERE id = $1 AND organisation_id = $2`
+	if err := s.dbService.GetConn().Get(&t, query, tokenID, organisationID); err != nil {
+		return err
+	}
+	query = `
+		DELETE FROM users
+		WHERE is_service_account = TRUE AND user_id = (
+			SELECT user_id FROM api_tokens WHERE id = $1 AND organisation_id = $2
+		)
+	`
+	res, err := s.dbService.GetConn().Exec(query, tokenID, organisationID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	s.audit(organisationID, AuditActionAPITokenDelete, t.Name, &t, nil)
+	return nil
+}
+
+// AuthenticateAPIToken returns who the token acts as, if it's valid and has the scope.
+// The last use of the token is recorded.
+func (s *S) AuthenticateAPIToken(token, scope string) (*APITokenIdentity, error) {
+	var t APIToken
+	err := s.dbService.GetConn().Get(&t, selectAPITokens+`WHERE token_hash = $1`, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(now) {
+		return nil, ErrInvalidToken
+	}
+	if !slices.Contains(t.Scopes, scope) {
+		return nil, errors.Wrap(ErrMissingScope, scope)
+	}
+
+	if t.OrganisationID == nil {
+		return nil, ErrInvalidToken
+	}
+	identity := APITokenIdentity{TokenID: t.ID, UserID: t.UserID, OrganisationID: *t.OrganisationID, Scopes: t.Scopes}
+
+	query := `UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`
+	if _, err := s.dbService.GetConn().Exec(query, now, t.ID); err != nil {
+		slog.Error("unable to update last use of api token", "err", err)
+	}
+	return &identity, nil
+}
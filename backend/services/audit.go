@@ -0,0 +1,371 @@
+package services
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of actors of audit events.
+const (
+	ActorTypeUser         = "user"
+	ActorTypeAPIToken     = "api_token"
+	ActorTypeProjectToken = "project_token"
+	ActorTypeHook         = "hook"
+	// ActorTypeSystem are background jobs like schedulers
+	ActorTypeSystem = "system"
+)
+
+// Actions of audit events.
+const (
+	AuditActionOrganisationCreate   = "organisation.create"
+	AuditActionOrganisationDelete   = "organisation.delete"
+	AuditActionInvitationCreate     = "invitation.create"
+	AuditActionInvitationWithdraw   = "invitation.withdraw"
+	AuditActionMemberJoin           = "member.join"
+	AuditActionMemberRemove         = "member.remove"
+	AuditActionMemberLeave          = "member.leave"
+	AuditActionMemberRoleChange     = "member.role_change"
+	AuditActionAPITokenCreate       = "api_token.create"
+	AuditActionAPITokenDelete       = "api_token.delete"
+	AuditActionEnvGroupSave         = "env_group.save"
+	AuditActionEnvGroupDelete       = "env_group.delete"
+	AuditActionRegistryCredSave     = "registry_credential.save"
+	AuditActionRegistryCredDelete   = "registry_credential.delete"
+	AuditActionProjectCreate        = "project.create"
+	AuditActionProjectUpdate        = "project.update"
+	AuditActionProjectDelete        = "project.delete"
+	AuditActionProjectMove          = "project.move"
+	AuditActionProjectDeploy        = "project.deploy"
+	AuditActionServiceBuild         = "service.build"
+	AuditActionProjectMemberSave    = "project_member.save"
+	AuditActionProjectMemberDelete  = "project_member.delete"
+	AuditActionProjectTokenCreate   = "project_token.create"
+	AuditActionProjectTokenRotate   = "project_token.rotate"
+	AuditActionProjectTokenDelete   = "project_token.delete"
+	AuditActionHookSecretRotate     = "hook_secret.rotate"
+	AuditActionBackupScheduleCreate = "backup_schedule.create"
+	AuditActionBackupScheduleUpdate = "backup_schedule.update"
+	AuditActionBackupScheduleDelete = "backup_schedule.delete"
+	AuditActionBackupRestore        = "backup.restore"
+	AuditActionGitOpsSourceSave     = "gitops_source.save"
+	AuditActionGitOpsSourceDelete   = "gitops_source.delete"
+	AuditActionPreviewSave          = "preview.save"
+	AuditActionEnvironmentSave      = "environment.save"
+)
+
+// redactedKeys are keys of JSON objects whose values are replaced in snapshots of audit events.
+var redactedKeys = map[string]bool{
+	"password":         true,
+	"password_hash":    true,
+	"token":            true,
+	"hook_secret":      true,
+	"access_token":     true,
+	"invitation_token": true,
+	"deploy_key":       true,
+	"secret_key":       true,
+	"secret":           true,
+}
+
+// redactedKeySuffixes are suffixes of keys of JSON objects whose values are replaced as well, e.g. "build_token".
+var redactedKeySuffixes = []string{"_token", "_password", "_secret", "_key"}
+
+// Actor is who causes mutations, it's recorded with their audit events. See S.As.
+type Actor struct {
+	Type string
+	// UserID is 0 if the actor isn't a user, for API tokens it's the user of the token
+	UserID int
+	// TokenID is the API or project token of the actor, 0 otherwise
+	TokenID int
+	// Name is the provider of hooks, for users and tokens it's looked up when the event is recorded
+	Name      string
+	IP        string
+	UserAgent string
+}
+
+// As returns a copy of the service which records the actor with the audit events of its mutations. Without an actor
+// events are recorded as caused by the system.
+func (s *S) As(actor Actor) *S {
+	c := *s
+	c.actor = &actor
+	return &c
+}
+
+// AuditSnapshot is the state of what an audit event changed, stored as JSON in a TEXT column. Secrets are redacted.
+type AuditSnapshot json.RawMessage
+
+func (a AuditSnapshot) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	return string(a), nil
+}
+
+func (a *AuditSnapshot) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		*a = AuditSnapshot(v)
+	case []byte:
+		*a = append(AuditSnapshot(nil), v...)
+	case nil:
+		*a = nil
+	default:
+		return fmt.Errorf("unable to scan %T into an audit snapshot", src)
+	}
+	return nil
+}
+
+func (a AuditSnapshot) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("null"), nil
+	}
+	return a, nil
+}
+
+func (a *AuditSnapshot) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*a = nil
+		return nil
+	}
+	*a = append(AuditSnapshot(nil), b...)
+	return nil
+}
+
+// AuditEvent records a mutation, who caused it and what it changed.
+type AuditEvent struct {
+	ID             int           `json:"id" db:"id"`
+	CreatedAt      time.Time     `json:"created_at" db:"created_at"`
+	ActorType      string        `json:"actor_type" db:"actor_type"`
+	ActorUserID    *int          `json:"actor_user_id" db:"actor_user_id"`
+	ActorTokenID   *int          `json:"actor_token_id" db:"actor_token_id"`
+	ActorName      string        `json:"actor_name" db:"actor_name"`
+	Action         string        `json:"action" db:"action"`
+	Target         string        `json:"target" db:"target"`
+	OrganisationID int           `json:"organisation_id" db:"organisation_id"`
+	ProjectID      *int          `json:"project_id" db:"project_id"`
+	ProjectName    string        `json:"project_name" db:"project_name"`
+	Before         AuditSnapshot `json:"before" db:"before"`
+	After          AuditSnapshot `json:"after" db:"after"`
+	IP             string        `json:"ip" db:"ip"`
+	UserAgent      string        `json:"user_agent" db:"user_agent"`
+}
+
+// audit records an event of the organisation with the actor of the service. Failures are logged, they don't fail
+// the mutation.
+func (s *S) audit(organisationID int, action, target string, before, after any) {
+	s.recordAudit(&AuditEvent{OrganisationID: organisationID, Action: action, Target: target}, before, after)
+}
+
+// auditProject records an event of the project, see audit.
+func (s *S) auditProject(p *Project, action, target string, before, after any) {
+	organisationID, err := strconv.Atoi(p.OrganisationID)
+	if err != nil {
+		slog.Error("unable to record audit event", "action", action, "upn", p.UPN, "err", err)
+		return
+	}
+	projectID := p.ID
+	e := &AuditEvent{OrganisationID: organisationID, ProjectID: &projectID, ProjectName: p.Name, Action: action, Target: target}
+	s.recordAudit(e, before, after)
+}
+
+// auditProjectByID records an event of the project with the ID, see audit.
+func (s *S) auditProjectByID(projectID int, action, target string, before, after any) {
+	var p Project
+	query := `SELECT id, name, unique_name, organisation_id FROM projects WHERE id = $1`
+	if err := s.dbService.GetConn().Get(&p, query, projectID); err != nil {
+		slog.Error("unable to record audit event", "action", action, "project_id", projectID, "err", err)
+		return
+	}
+	s.auditProject(&p, action, target, before, after)
+}
+
+func (s *S) recordAudit(e *AuditEvent, before, after any) {
+	actor := Actor{Type: ActorTypeSystem}
+	if s.actor != nil {
+		actor = *s.actor
+	}
+	e.ActorType = actor.Type
+	e.ActorName = s.actorName(actor)
+	e.IP = actor.IP
+	e.UserAgent = actor.UserAgent
+	if actor.UserID != 0 {
+		e.ActorUserID = &actor.UserID
+	}
+	if actor.TokenID != 0 {
+		e.ActorTokenID = &actor.TokenID
+	}
+	var err error
+	if e.Before, err = snapshot(before); err == nil {
+		e.After, err = snapshot(after)
+	}
+	if err == nil {
+		query := `
+			INSERT INTO audit_events (actor_type, actor_user_id, actor_token_id, actor_name, action, target,
+				organisation_id, project_id, project_name, before, after, ip, user_agent)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		`
+		_, err = s.dbService.GetConn().Exec(query, e.ActorType, e.ActorUserID, e.ActorTokenID, e.ActorName, e.Action,
+			e.Target, e.OrganisationID, e.ProjectID, e.ProjectName, e.Before, e.After, e.IP, e.UserAgent)
+	}
+	if err != nil {
+		slog.Error("unable to record audit event", "action", e.Action, "organisation_id", e.OrganisationID, "err", err)
+	}
+}
+
+// actorName returns the name the actor is shown with, which is kept when users or tokens are deleted.
+func (s *S) actorName(actor Actor) string {
+	if actor.Name != "" {
+		return actor.Name
+	}
+	var query string
+	var id int
+	switch actor.Type {
+	case ActorTypeUser:
+		query, id = `SELECT email FROM users WHERE user_id = $1`, actor.UserID
+	case ActorTypeAPIToken:
+		query, id = `SELECT name FROM api_tokens WHERE id = $1`, actor.TokenID
+	case ActorTypeProjectToken:
+		query, id = `SELECT name FROM project_tokens WHERE id = $1`, actor.TokenID
+	default:
+		return ""
+	}
+	var name string
+	if err := s.dbService.GetConn().Get(&name, query, id); err != nil {
+		slog.Error("unable to get name of audit actor", "type", actor.Type, "err", err)
+	}
+	return name
+}
+
+// masker is implemented by values with secrets which are masked before they are sent to clients.
+type masker interface {
+	MaskSecrets()
+}
+
+// snapshot returns the JSON of the value with secrets redacted, nil for nil values.
+func snapshot(v any) (AuditSnapshot, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Masking changes the value, it's done on a copy
+	if _, ok := v.(masker); ok {
+		c := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, err
+		}
+		c.(masker).MaskSecrets()
+		if b, err = json.Marshal(c); err != nil {
+			return nil, err
+		}
+	}
+	var data any
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	b, err = json.Marshal(redact(data))
+	if err != nil {
+		return nil, err
+	}
+	return AuditSnapshot(b), nil
+}
+
+// redact replaces the values of redacted keys in the decoded JSON, whole objects and lists under such a key too.
+func redact(data any) any {
+	switch v := data.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if value != nil && value != "" && isRedactedKey(key) {
+				v[key] = SecretMask
+				continue
+			}
+			v[key] = redact(value)
+		}
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return data
+}
+
+func isRedactedKey(key string) bool {
+	key = strings.ToLower(key)
+	if redactedKeys[key] {
+		return true
+	}
+	for _, suffix := range redactedKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, which use ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Limits of the number of audit events per request.
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 10000
+)
+
+// AuditFilter selects audit events of an organisation. Zero values don't filter.
+type AuditFilter struct {
+	// Action is either an action like "project.update" or the prefix of actions like "project"
+	Action      string
+	ActorType   string
+	ActorUserID int
+	ProjectID   int
+	From        *time.Time
+	To          *time.Time
+	Limit       int
+	Offset      int
+}
+
+// SelectAuditEvents returns the events of the organisation matching the filter, latest first.
+func (s *S) SelectAuditEvents(organisationID int, f AuditFilter) ([]AuditEvent, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultAuditLimit
+	}
+	f.Limit = min(f.Limit, MaxAuditLimit)
+	// created_at is stored as text by CURRENT_TIMESTAMP in UTC, bounds are compared in the same format
+	bound := func(t *time.Time) any {
+		if t == nil {
+			return nil
+		}
+		return t.UTC().Format(time.DateTime)
+	}
+	events := make([]AuditEvent, 0)
+	query := `
+		SELECT id, created_at, actor_type, actor_user_id, actor_token_id, actor_name, action, target, organisation_id,
+			project_id, project_name, before, after, ip, user_agent
+		FROM audit_events
+		WHERE organisation_id = $1
+			AND ($2 = '' OR action = $2 OR action LIKE $10 ESCAPE '\')
+			AND ($3 = '' OR actor_type = $3)
+			AND ($4 = 0 OR actor_user_id = $4)
+			AND ($5 = 0 OR project_id = $5)
+			AND ($6 IS NULL OR created_at >= $6)
+			AND ($7 IS NULL OR created_at < $7)
+		ORDER BY id DESC
+		LIMIT $8 OFFSET $9
+	`
+	err := s.dbService.GetConn().Select(&events, query, organisationID, f.Action, f.ActorType, f.ActorUserID,
+		f.ProjectID, bound(f.From), bound(f.To), f.Limit, f.Offset, likeEscaper.Replace(f.Action)+".%")
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
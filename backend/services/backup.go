@@ -0,0 +1,662 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/pkg/cron"
+	"github.com/devs-group/sloth/backend/pkg/docker"
+	"github.com/devs-group/sloth/backend/pkg/dump"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+const (
+	BackupRunStatusRunning   = "running"
+	BackupRunStatusSucceeded = "succeeded"
+	BackupRunStatusFailed    = "failed"
+	BackupRunStatusPruned    = "pruned"
+
+	BackupModeVolume = "volume"
+	BackupModeDump   = "dump"
+)
+
+type BackupSchedule struct {
+	ID  int    `json:"id" db:"id"`
+	Usn string `json:"usn" db:"usn"`
+	// Cron expression, e.g. "0 3 * * *" or "@daily"
+	Cron string `json:"cron" binding:"required" db:"cron"`
+	// Either "volume" or "dump"
+	Mode string `json:"mode" db:"mode"`
+	backup.Retention
+	TargetType   string              `json:"target_type" binding:"required,oneof=local s3" db:"target_type"`
+	TargetConfig backup.TargetConfig `json:"target_config" db:"-"`
+	Enabled      bool                `json:"enabled" db:"enabled"`
+	NextRunAt    *time.Time          `json:"next_run_at" db:"next_run_at"`
+	CreatedAt    time.Time           `json:"created_at" db:"created_at"`
+	ProjectID    int                 `json:"-" db:"project_id"`
+
+	// Raw JSON of TargetConfig as stored in the database
+	TargetConfigJSON string `json:"-" db:"target_config"`
+}
+
+type BackupRun struct {
+	ID         int        `json:"id" db:"id"`
+	Usn        string     `json:"usn" db:"usn"`
+	Status     string     `json:"status" db:"status"`
+	Mode       string     `json:"mode" db:"mode"`
+	Engine     string     `json:"engine" db:"engine"`
+	ObjectKey  string     `json:"object_key" db:"object_key"`
+	SizeBytes  int64      `json:"size_bytes" db:"size_bytes"`
+	Error      string     `json:"error" db:"error"`
+	StartedAt  time.Time  `json:"started_at" db:"started_at"`
+	FinishedAt *time.Time `json:"finished_at" db:"finished_at"`
+	ScheduleID int        `json:"schedule_id" db:"schedule_id"`
+	ProjectID  int        `json:"-" db:"project_id"`
+}
+
+const backupScheduleColumns = `
+	id, usn, cron, mode, keep_daily, keep_weekly, target_type, target_config, enabled, next_run_at, created_at, project_id
+`
+
+// Validate checks the service, the mode, the cron expression and the target configuration. Schedules without a
+// service back up all services of the project.
+func (bs *BackupSchedule) Validate(p *Project) error {
+	if bs.Usn != "" && !slices.ContainsFunc(p.Services, func(service *Service) bool { return service.Usn == bs.Usn }) {
+		return fmt.Errorf("%w: usn %q", ErrUnknownService, bs.Usn)
+	}
+	if bs.Mode == "" {
+		bs.Mode = BackupModeVolume
+	}
+	if bs.Mode != BackupModeVolume && bs.Mode != BackupModeDump {
+		return fmt.Errorf("unsupported backup mode: %s", bs.Mode)
+	}
+	if _, err := cron.Parse(bs.Cron); err != nil {
+		return err
+	}
+	if bs.KeepDaily < 0 || bs.KeepWeekly < 0 {
+		return fmt.Errorf("retention values must not be negative")
+	}
+	_, err := bs.Target()
+	return err
+}
+
+// Target creates the storage target the schedule writes to.
+func (bs *BackupSchedule) Target() (backup.Target, error) {
+	cfg := config.GetConfig()
+	return backup.NewTarget(bs.TargetType, bs.TargetConfig, cfg.BackupsDir)
+}
+
+// MaskSecrets removes credentials of the target before the schedule is sent to a client.
+func (bs *BackupSchedule) MaskSecrets() {
+	bs.TargetConfig.SecretKey = ""
+}
+
+func (bs *BackupSchedule) nextRun(after time.Time) (*time.Time, error) {
+	schedule, err := cron.Parse(bs.Cron)
+	if err != nil {
+		return nil, err
+	}
+	next := schedule.Next(after.UTC())
+	if next.IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", bs.Cron)
+	}
+	return &next, nil
+}
+
+// encodeTargetConfig returns the JSON of the target configuration as it's stored, with an encrypted secret key.
+func (bs *BackupSchedule) encodeTargetConfig() (string, error) {
+	c := bs.TargetConfig
+	if c.SecretKey != "" {
+		var err error
+		if c.SecretKey, err = encryptSecret(c.SecretKey); err != nil {
+			return "", err
+		}
+	}
+	j, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(j), nil
+}
+
+func (bs *BackupSchedule) decodeTargetConfig() error {
+	if bs.TargetConfigJSON == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(bs.TargetConfigJSON), &bs.TargetConfig); err != nil {
+		return err
+	}
+	if bs.TargetConfig.SecretKey == "" {
+		return nil
+	}
+	var err error
+	bs.TargetConfig.SecretKey, err = decryptSecret(bs.TargetConfig.SecretKey)
+	return err
+}
+
+func (s *S) SelectBackupSchedules(projectID int) ([]BackupSchedule, error) {
+	schedules := make([]BackupSchedule, 0)
+	query := `SELECT ` + backupScheduleColumns + ` FROM backup_schedules WHERE project_id = $1 ORDER BY id`
+	if err := s.dbService.GetConn().Select(&schedules, query, projectID); err != nil {
+		return nil, err
+	}
+	for i := range schedules {
+		if err := schedules[i].decodeTargetConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return schedules, nil
+}
+
+func (s *S) SelectBackupSchedule(projectID, scheduleID int) (*BackupSchedule, error) {
+	var bs BackupSchedule
+	query := `SELECT ` + backupScheduleColumns + ` FROM backup_schedules WHERE project_id = $1 AND id = $2`
+	if err := s.dbService.GetConn().Get(&bs, query, projectID, scheduleID); err != nil {
+		return nil, err
+	}
+	if err := bs.decodeTargetConfig(); err != nil {
+		return nil, err
+	}
+	return &bs, nil
+}
+
+func (s *S) SaveBackupSchedule(bs *BackupSchedule) error {
+	targetConfig, err := bs.encodeTargetConfig()
+	if err != nil {
+		return err
+	}
+	bs.NextRunAt, err = bs.nextRun(time.Now())
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO backup_schedules (usn, cron, mode, keep_daily, keep_weekly, target_type, target_config, enabled, next_run_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at
+	`
+	err = s.dbService.GetConn().QueryRowx(
+		query, bs.Usn, bs.Cron, bs.Mode, bs.KeepDaily, bs.KeepWeekly, bs.TargetType, targetConfig, bs.Enabled, bs.NextRunAt, bs.ProjectID,
+	).Scan(&bs.ID, &bs.CreatedAt)
+	if err != nil {
+		return err
+	}
+	s.auditProjectByID(bs.ProjectID, AuditActionBackupScheduleCreate, bs.Usn, nil, bs)
+	return nil
+}
+
+// UpdateBackupSchedule updates the schedule. An empty secret key keeps the stored one,
+// since secrets are never sent to the client.
+func (s *S) UpdateBackupSchedule(bs *BackupSchedule) error {
+	existing, err := s.SelectBackupSchedule(bs.ProjectID, bs.ID)
+	if err != nil {
+		return err
+	}
+	if bs.TargetConfig.SecretKey == "" {
+		bs.TargetConfig.SecretKey = existing.TargetConfig.SecretKey
+	}
+	targetConfig, err := bs.encodeTargetConfig()
+	if err != nil {
+		return err
+	}
+	bs.NextRunAt, err = bs.nextRun(time.Now())
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE backup_schedules
+		SET usn = $3, cron = $4, mode = $5, keep_daily = $6, keep_weekly = $7, target_type = $8, target_config = $9, enabled = $10, next_run_at = $11
+		WHERE project_id = $1 AND id = $2
+	`
+	_, err = s.dbService.GetConn().Exec(
+		query, bs.ProjectID, bs.ID, bs.Usn, bs.Cron, bs.Mode, bs.KeepDaily, bs.KeepWeekly, bs.TargetType, targetConfig, bs.Enabled, bs.NextRunAt,
+	)
+	if err != nil {
+		return err
+	}
+	s.auditProjectByID(bs.ProjectID, AuditActionBackupScheduleUpdate, bs.Usn, existing, bs)
+	return nil
+}
+
+// DeleteBackupSchedule deletes the schedule together with its backups, which can't be restored without the
+// target of the schedule anymore. The schedule is kept if a backup can't be deleted from the target.
+func (s *S) DeleteBackupSchedule(ctx context.Context, projectID, scheduleID int) error {
+	existing, err := s.SelectBackupSchedule(projectID, scheduleID)
+	if err != nil {
+		return err
+	}
+	target, err := existing.Target()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	query := `SELECT object_key FROM backup_runs WHERE schedule_id = $1 AND status IN ($2, $3)`
+	if err := s.dbService.GetConn().Select(&keys, query, scheduleID, BackupRunStatusSucceeded, BackupRunStatusFailed); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := target.Delete(ctx, key); err != nil {
+			return fmt.Errorf("unable to delete backup %s: %w", key, err)
+		}
+	}
+
+	query = `DELETE FROM backup_schedules WHERE project_id = $1 AND id = $2`
+	res, err := s.dbService.GetConn().Exec(query, projectID, scheduleID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return fmt.Errorf("expected to delete 1 backup schedule, but deleted %d", affected)
+	}
+	s.auditProjectByID(projectID, AuditActionBackupScheduleDelete, existing.Usn, existing, nil)
+	return nil
+}
+
+func (s *S) SelectBackupRuns(projectID int) ([]BackupRun, error) {
+	runs := make([]BackupRun, 0)
+	query := `SELECT * FROM backup_runs WHERE project_id = $1 ORDER BY started_at DESC, id DESC`
+	if err := s.dbService.GetConn().Select(&runs, query, projectID); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (s *S) SelectBackupRun(projectID, runID int) (*BackupRun, error) {
+	var run BackupRun
+	query := `SELECT * FROM backup_runs WHERE project_id = $1 AND id = $2`
+	if err := s.dbService.GetConn().Get(&run, query, projectID, runID); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// RunBackupSchedule backs up the scheduled services into the schedule's target and prunes backups
+// which fall out of the retention policy afterwards. Depending on the mode either the volume directories
+// are archived or the databases are dumped with their native tools.
+// Failures are recorded per run and sent as notifications to the members of the project's organisation.
+func (s *S) RunBackupSchedule(ctx context.Context, bs *BackupSchedule) error {
+	p, err := s.SelectProjectByID(bs.ProjectID)
+	if err != nil {
+		return fmt.Errorf("unable to find project of backup schedule %d: %w", bs.ID, err)
+	}
+
+	err = s.runBackupSchedule(ctx, bs, p)
+	if err != nil {
+		slog.Error("backup failed", "schedule", bs.ID, "upn", p.UPN, "err", err)
+		subject := fmt.Sprintf("Backup of project %s failed", p.Name)
+		if nErr := s.NotifyOrganisationMembers(p.OrganisationID, subject, err.Error()); nErr != nil {
+			slog.Error("unable to send backup notification", "err", nErr)
+		}
+	}
+	return err
+}
+
+func (s *S) runBackupSchedule(ctx context.Context, bs *BackupSchedule, p *Project) error {
+	target, err := bs.Target()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, service := range p.Services {
+		if bs.Usn != "" && service.Usn != bs.Usn {
+			continue
+		}
+		if err := s.backupService(ctx, bs, p, service, target); err != nil {
+			errs = append(errs, fmt.Errorf("service %s (%s): %w", service.Name, service.Usn, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return s.pruneBackups(ctx, bs, target)
+}
+
+func (s *S) backupService(ctx context.Context, bs *BackupSchedule, p *Project, service *Service, target backup.Target) error {
+	cfg := config.GetConfig()
+
+	run := BackupRun{
+		Usn:        service.Usn,
+		Status:     BackupRunStatusRunning,
+		Mode:       bs.Mode,
+		StartedAt:  time.Now().UTC(),
+		ScheduleID: bs.ID,
+		ProjectID:  p.ID,
+	}
+
+	var extension string
+	var write func(w io.Writer) error
+	switch bs.Mode {
+	case BackupModeDump:
+		engine := dump.EngineForImage(service.Image)
+		if engine == nil {
+			if bs.Usn != "" {
+				return fmt.Errorf("image %s is not a supported database", service.Image)
+			}
+			// Schedules for the whole project only dump the database services
+			return nil
+		}
+		run.Engine = engine.Name()
+		extension = engine.Extension()
+		write = func(w io.Writer) error {
+			containerID, err := docker.GetContainerIDByService(string(p.UPN), sanitizeName(service.Usn))
+			if err != nil {
+				return err
+			}
+			env, err := s.ResolveServiceEnv(p, service)
+			if err != nil {
+				return err
+			}
+			return dump.Dump(ctx, containerID, engine, env, w)
+		}
+	default:
+		dir := path.Join(p.UPN.GetProjectPath(), cfg.PersistentVolumeDirectoryName, sanitizeName(service.Usn))
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			// Nothing to back up for services without volumes
+			return nil
+		}
+		extension = "tar.gz"
+		write = func(w io.Writer) error {
+			return backup.Archive(dir, w)
+		}
+	}
+	run.ObjectKey = fmt.Sprintf("%s/%s/%s.%s", p.UPN, service.Usn, run.StartedAt.Format("20060102T150405Z"), extension)
+
+	query := `
+		INSERT INTO backup_runs (usn, status, mode, engine, object_key, started_at, schedule_id, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	err := s.dbService.GetConn().Get(
+		&run.ID, query, run.Usn, run.Status, run.Mode, run.Engine, run.ObjectKey, run.StartedAt, run.ScheduleID, run.ProjectID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to record backup run: %w", err)
+	}
+
+	run.SizeBytes, err = upload(ctx, run.ObjectKey, target, write)
+	if err != nil {
+		run.Status = BackupRunStatusFailed
+		run.Error = err.Error()
+	} else {
+		run.Status = BackupRunStatusSucceeded
+	}
+	if uErr := s.finishBackupRun(&run); uErr != nil {
+		slog.Error("unable to update backup run", "id", run.ID, "err", uErr)
+	}
+	return err
+}
+
+func (s *S) finishBackupRun(run *BackupRun) error {
+	finishedAt := time.Now().UTC()
+	run.FinishedAt = &finishedAt
+	query := `UPDATE backup_runs SET status = $2, size_bytes = $3, error = $4, finished_at = $5 WHERE id = $1`
+	_, err := s.dbService.GetConn().Exec(query, run.ID, run.Status, run.SizeBytes, run.Error, run.FinishedAt)
+	return err
+}
+
+// upload streams the output of write into a temporary file first, since targets need to know the size upfront.
+func upload(ctx context.Context, key string, target backup.Target, write func(w io.Writer) error) (int64, error) {
+	f, err := os.CreateTemp("", "sloth-backup-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if err := write(f); err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := target.Put(ctx, key, f, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// pruneBackups deletes the objects of all successful runs of the schedule which are not covered by its retention.
+func (s *S) pruneBackups(ctx context.Context, bs *BackupSchedule, target backup.Target) error {
+	var runs []BackupRun
+	query := `SELECT * FROM backup_runs WHERE schedule_id = $1 AND status = $2`
+	if err := s.dbService.GetConn().Select(&runs, query, bs.ID, BackupRunStatusSucceeded); err != nil {
+		return err
+	}
+
+	runsByUsn := make(map[string][]BackupRun)
+	for _, run := range runs {
+		runsByUsn[run.Usn] = append(runsByUsn[run.Usn], run)
+	}
+
+	for _, serviceRuns := range runsByUsn {
+		times := make([]time.Time, len(serviceRuns))
+		for i := range serviceRuns {
+			times[i] = serviceRuns[i].StartedAt
+		}
+		for _, idx := range bs.Retention.Expired(times) {
+			run := serviceRuns[idx]
+			if err := target.Delete(ctx, run.ObjectKey); err != nil {
+				return fmt.Errorf("unable to delete expired backup %s: %w", run.ObjectKey, err)
+			}
+			query := `UPDATE backup_runs SET status = $2 WHERE id = $1`
+			if _, err := s.dbService.GetConn().Exec(query, run.ID, BackupRunStatusPruned); err != nil {
+				return err
+			}
+			slog.Info("Pruned backup", "key", run.ObjectKey)
+		}
+	}
+	return nil
+}
+
+// RestoreBackupRun restores a successful backup. Dumps are piped into the database client of the running
+// service. Volume backups replace the volume directory of the service, running containers are stopped
+// during the restore and started again afterwards.
+func (s *S) RestoreBackupRun(ctx context.Context, p *Project, run *BackupRun) error {
+	if run.Status != BackupRunStatusSucceeded {
+		return fmt.Errorf("backup %d can't be restored, its status is %s", run.ID, run.Status)
+	}
+	bs, err := s.SelectBackupSchedule(p.ID, run.ScheduleID)
+	if err != nil {
+		return err
+	}
+	target, err := bs.Target()
+	if err != nil {
+		return err
+	}
+
+	r, err := target.Get(ctx, run.ObjectKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if run.Mode == BackupModeDump {
+		err = s.restoreDump(ctx, p, run, r)
+	} else {
+		err = restoreVolume(p, run, r)
+	}
+	if err != nil {
+		return err
+	}
+	s.auditProject(p, AuditActionBackupRestore, run.Usn, nil, run)
+	return nil
+}
+
+func (s *S) restoreDump(ctx context.Context, p *Project, run *BackupRun, r io.Reader) error {
+	var service *Service
+	for _, svc := range p.Services {
+		if svc.Usn == run.Usn {
+			service = svc
+		}
+	}
+	if service == nil {
+		return fmt.Errorf("service %s of backup %d doesn't exist anymore", run.Usn, run.ID)
+	}
+
+	engine := dump.EngineForImage(service.Image)
+	if engine == nil || engine.Name() != run.Engine {
+		return fmt.Errorf("backup %d is a %s dump, but the service runs %s", run.ID, run.Engine, service.Image)
+	}
+	env, err := s.ResolveServiceEnv(p, service)
+	if err != nil {
+		return err
+	}
+	containerID, err := docker.GetContainerIDByService(string(p.UPN), sanitizeName(service.Usn))
+	if err != nil {
+		return err
+	}
+	return dump.Restore(ctx, containerID, engine, env, r)
+}
+
+func restoreVolume(p *Project, run *BackupRun, r io.Reader) error {
+	cfg := config.GetConfig()
+
+	dir := path.Join(p.UPN.GetProjectPath(), cfg.PersistentVolumeDirectoryName, sanitizeName(run.Usn))
+	restoreDir := dir + ".restore"
+	oldDir := dir + ".old"
+	_ = utils.DeleteFolder(restoreDir)
+
+	if err := backup.Extract(r, restoreDir); err != nil {
+		_ = utils.DeleteFolder(restoreDir)
+		return err
+	}
+
+	isRunning, err := p.UPN.IsOneContainerRunning()
+	if err != nil {
+		_ = utils.DeleteFolder(restoreDir)
+		return err
+	}
+	if isRunning {
+		if err := p.UPN.StopContainers(); err != nil {
+			_ = utils.DeleteFolder(restoreDir)
+			return err
+		}
+	}
+
+	// Containers which were stopped are started again, with the previous volume if the restore failed
+	err = replaceVolume(dir, restoreDir, oldDir)
+	if isRunning {
+		if upErr := compose.Up(p.UPN.GetProjectPath()); upErr != nil {
+			return errors.Join(err, upErr)
+		}
+	}
+	return err
+}
+
+// replaceVolume moves the restored directory in place of dir, the previous one is restored on failure.
+func replaceVolume(dir, restoreDir, oldDir string) error {
+	if err := os.Rename(dir, oldDir); err != nil && !os.IsNotExist(err) {
+		_ = utils.DeleteFolder(restoreDir)
+		return err
+	}
+	if err := os.Rename(restoreDir, dir); err != nil {
+		_ = os.Rename(oldDir, dir)
+		_ = utils.DeleteFolder(restoreDir)
+		return err
+	}
+	if err := utils.DeleteFolder(oldDir); err != nil {
+		slog.Error("unable to delete previous volume directory", "path", oldDir, "err", err)
+	}
+	return nil
+}
+
+// StartBackupScheduler checks for due backup schedules until the context is canceled.
+func (s *S) StartBackupScheduler(ctx context.Context) {
+	cfg := config.GetConfig()
+
+	go func() {
+		ticker := time.NewTicker(cfg.BackupSchedulerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.runDueBackupSchedules(ctx, now)
+			}
+		}
+	}()
+}
+
+// runningBackups contains the IDs of the schedules whose backups are running, so that slow backups aren't started
+// again before they finished.
+var runningBackups sync.Map
+
+// ErrBackupRunning is returned when a backup is started while the previous backup of the schedule is still running.
+var ErrBackupRunning = errors.New("backup is already running")
+
+// StartBackupSchedule runs the backup of the schedule in the background, see RunBackupSchedule. It fails with
+// ErrBackupRunning if the previous backup of the schedule is still running.
+func (s *S) StartBackupSchedule(ctx context.Context, bs *BackupSchedule) error {
+	if _, running := runningBackups.LoadOrStore(bs.ID, true); running {
+		return ErrBackupRunning
+	}
+	go func() {
+		defer runningBackups.Delete(bs.ID)
+		_ = s.RunBackupSchedule(ctx, bs)
+	}()
+	return nil
+}
+
+// runDueBackupSchedules starts the backups of the due schedules in the background, so that slow backups don't delay
+// the others.
+func (s *S) runDueBackupSchedules(ctx context.Context, now time.Time) {
+	schedules := make([]BackupSchedule, 0)
+	query := `SELECT ` + backupScheduleColumns + ` FROM backup_schedules WHERE enabled = TRUE`
+	if err := s.dbService.GetConn().Select(&schedules, query); err != nil {
+		slog.Error("unable to select backup schedules", "err", err)
+		return
+	}
+
+	for i := range schedules {
+		bs := &schedules[i]
+		if bs.NextRunAt != nil && bs.NextRunAt.After(now) {
+			continue
+		}
+		if err := bs.decodeTargetConfig(); err != nil {
+			slog.Error("invalid backup target config", "schedule", bs.ID, "err", err)
+			continue
+		}
+
+		// Schedules without a next run were never planned, they only get planned here
+		if bs.NextRunAt != nil {
+			if err := s.StartBackupSchedule(ctx, bs); errors.Is(err, ErrBackupRunning) {
+				slog.Warn("previous backup is still running, skipping", "schedule", bs.ID)
+			}
+		}
+
+		next, err := bs.nextRun(now)
+		if err != nil {
+			slog.Error("unable to plan next backup", "schedule", bs.ID, "err", err)
+			continue
+		}
+		query := `UPDATE backup_schedules SET next_run_at = $2 WHERE id = $1`
+		if _, err := s.dbService.GetConn().Exec(query, bs.ID, next); err != nil {
+			slog.Error("unable to plan next backup", "schedule", bs.ID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/pkg/docker"
+	"github.com/devs-group/sloth/backend/pkg/git"
+	"github.com/devs-group/sloth/backend/pkg/registry"
+)
+
+const (
+	BuildStatusRunning   = "running"
+	BuildStatusSucceeded = "succeeded"
+	BuildStatusFailed    = "failed"
+)
+
+// localBuildRepository is the repository prefix of images which are built without a registry configured
+const localBuildRepository = "sloth"
+
+const (
+	// buildsToKeep is the number of builds which are kept per service
+	buildsToKeep = 20
+	// maxBuildLogBytes limits the stored log of a build, further output is dropped
+	maxBuildLogBytes = 1 << 20
+)
+
+var (
+	ErrNoBuildSource = errors.New("service isn't built from a repository")
+	ErrBuildRunning  = errors.New("service is already being built")
+)
+
+// BuildSource is the git repository the image of a service is built from.
+type BuildSource struct {
+	Repository string `json:"repository" binding:"required"`
+	// Ref is a branch, tag or commit, the default branch of the repository when empty
+	Ref string `json:"ref"`
+	// DeployKey is used for SSH remotes, Token for HTTP(S) remotes. Both are write-only, see Project.MaskSecrets,
+	// and stored encrypted.
+	DeployKey string `json:"deploy_key,omitempty"`
+	Token     string `json:"token,omitempty"`
+	// Context is a directory of the repository, Dockerfile is relative to it
+	compose.BuildContext
+}
+
+func (b *BuildSource) Validate() error {
+	if b.Repository == "" {
+		return fmt.Errorf("repository is required")
+	}
+	if err := git.ValidateRepository(b.Repository); err != nil {
+		return err
+	}
+	if err := git.ValidateRef(b.Ref); err != nil {
+		return err
+	}
+	if b.DeployKey != "" && b.Token != "" {
+		return fmt.Errorf("either a deploy key or a token can be used")
+	}
+	for _, p := range []string{b.Context, b.Dockerfile} {
+		if p != "" && !filepath.IsLocal(p) {
+			return fmt.Errorf("path %s must be within the repository", p)
+		}
+	}
+	return nil
+}
+
+func (b BuildSource) Value() (driver.Value, error) {
+	for _, secret := range []*string{&b.DeployKey, &b.Token} {
+		if *secret == "" {
+			continue
+		}
+		encrypted, err := encryptSecret(*secret)
+		if err != nil {
+			return nil, err
+		}
+		*secret = encrypted
+	}
+	j, err := json.Marshal(b)
+	return string(j), err
+}
+
+func (b *BuildSource) Scan(src any) error {
+	var err error
+	switch v := src.(type) {
+	case string:
+		err = json.Unmarshal([]byte(v), b)
+	case []byte:
+		err = json.Unmarshal(v, b)
+	default:
+		return fmt.Errorf("unable to scan %T into a build source", src)
+	}
+	if err != nil {
+		return err
+	}
+	for _, secret := range []*string{&b.DeployKey, &b.Token} {
+		if *secret, err = decryptSecret(*secret); err != nil {
+			return fmt.Errorf("unable to decrypt credentials of build source: %w", err)
+		}
+	}
+	return nil
+}
+
+// buildRepository returns the repository images of a service are built into.
+func buildRepository(usn string) string {
+	cfg := config.GetConfig()
+	if cfg.BuildRegistry != "" {
+		return path.Join(cfg.BuildRegistry, sanitizeName(usn))
+	}
+	return path.Join(localBuildRepository, sanitizeName(usn))
+}
+
+// isLocalBuild reports whether the image is only available on this host.
+func isLocalBuild(image string) bool {
+	return strings.HasPrefix(image, localBuildRepository+"/")
+}
+
+type ServiceBuild struct {
+	ID         int    `json:"id" db:"id"`
+	Usn        string `json:"usn" db:"usn"`
+	Status     string `json:"status" db:"status"`
+	Repository string `json:"repository" db:"repository"`
+	Ref        string `json:"ref" db:"ref"`
+	Commit     string `json:"commit" db:"commit_sha"`
+	Image      string `json:"image" db:"image"`
+	// Log is only returned for single builds
+	Log string `json:"log,omitempty" db:"log"`
+	// Message contains the error of failed builds
+	Message    string     `json:"message" db:"message"`
+	StartedAt  time.Time  `json:"started_at" db:"started_at"`
+	FinishedAt *time.Time `json:"finished_at" db:"finished_at"`
+	ProjectID  int        `json:"-" db:"project_id"`
+}
+
+// buildLog collects the output of a running build, which can be followed while it grows.
+type buildLog struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	done      bool
+	// changed is closed and replaced on every write
+	changed chan struct{}
+}
+
+func newBuildLog() *buildLog {
+	return &buildLog{changed: make(chan struct{})}
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.truncated {
+		return len(p), nil
+	}
+	if remaining := maxBuildLogBytes - l.buf.Len(); len(p) > remaining {
+		l.buf.Write(p[:remaining])
+		l.buf.WriteString("\n[log truncated]\n")
+		l.truncated = true
+	} else {
+		l.buf.Write(p)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return len(p), nil
+}
+
+func (l *buildLog) finish() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done = true
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return l.buf.String()
+}
+
+// follow writes the log to w as it grows until the build finished or the context is canceled.
+func (l *buildLog) follow(ctx context.Context, w io.Writer) error {
+	offset := 0
+	for {
+		l.mu.Lock()
+		chunk := bytes.Clone(l.buf.Bytes()[offset:])
+		done, changed := l.done, l.changed
+		l.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			offset += len(chunk)
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// runningBuilds are the logs of the builds of this process by build id, and the running build by service.
+var runningBuilds = struct {
+	sync.Mutex
+	logs     map[int]*buildLog
+	services map[string]int
+}{logs: make(map[int]*buildLog), services: make(map[string]int)}
+
+func (s *S) saveServiceBuild(b *ServiceBuild) error {
+	b.StartedAt = time.Now().UTC()
+	query := `
+		INSERT INTO service_builds (usn, status, repository, ref, started_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	if err := s.dbService.GetConn().Get(&b.ID, query, b.Usn, b.Status, b.Repository, b.Ref, b.StartedAt, b.ProjectID); err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM service_builds
+		WHERE project_id = $1 AND usn = $2 AND id NOT IN (
+			SELECT id FROM service_builds WHERE project_id = $1 AND usn = $2 ORDER BY id DESC LIMIT $3
+		)
+	`
+	_, err := s.dbService.GetConn().Exec(query, b.ProjectID, b.Usn, buildsToKeep)
+	return err
+}
+
+func (s *S) finishServiceBuild(b *ServiceBuild) error {
+	now := time.Now().UTC()
+	b.FinishedAt = &now
+	query := `
+		UPDATE service_builds SET status = $2, commit_sha = $3, image = $4, log = $5, message = $6, finished_at = $7
+		WHERE id = $1
+	`
+	_, err := s.dbService.GetConn().Exec(query, b.ID, b.Status, b.Commit, b.Image, b.Log, b.Message, b.FinishedAt)
+	return err
+}
+
+// SelectServiceBuilds returns the builds of a service without their logs, the latest first.
+func (s *S) SelectServiceBuilds(projectID int, usn string) ([]ServiceBuild, error) {
+	builds := make([]ServiceBuild, 0)
+	query := `
+		SELECT id, usn, status, repository, ref, commit_sha, image, message, started_at, finished_at, project_id
+		FROM service_builds
+		WHERE project_id = $1 AND usn = $2
+		ORDER BY id DESC
+	`
+	if err := s.dbService.GetConn().Select(&builds, query, projectID, usn); err != nil {
+		return nil, err
+	}
+	return builds, nil
+}
+
+// SelectServiceBuild returns a build of the project including its log.
+func (s *S) SelectServiceBuild(projectID, buildID int) (*ServiceBuild, error) {
+	var b ServiceBuild
+	query := `
+		SELECT id, usn, status, repository, ref, commit_sha, image, log, message, started_at, finished_at, project_id
+		FROM service_builds
+		WHERE project_id = $1 AND id = $2
+	`
+	if err := s.dbService.GetConn().Get(&b, query, projectID, buildID); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// FailInterruptedBuilds marks builds as failed which were running when sloth stopped.
+func (s *S) FailInterruptedBuilds() error {
+	query := `
+		UPDATE service_builds SET status = $1, message = 'build was interrupted', finished_at = $2
+		WHERE status = $3
+	`
+	_, err := s.dbService.GetConn().Exec(query, BuildStatusFailed, time.Now().UTC(), BuildStatusRunning)
+	return err
+}
+
+// StartBuild builds the image of the service from its repository in the background and deploys it
+// when the build succeeds. The returned build is running.
+func (s *S) StartBuild(p *Project, service *Service, deploy DeployFunc) (*ServiceBuild, error) {
+	if service.Build == nil {
+		return nil, ErrNoBuildSource
+	}
+	if err := service.Build.Validate(); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%d/%s", p.ID, service.Usn)
+	runningBuilds.Lock()
+	defer runningBuilds.Unlock()
+	if _, ok := runningBuilds.services[key]; ok {
+		return nil, ErrBuildRunning
+	}
+
+	b := &ServiceBuild{
+		Usn:        service.Usn,
+		Status:     BuildStatusRunning,
+		Repository: service.Build.Repository,
+		Ref:        service.Build.Ref,
+		ProjectID:  p.ID,
+	}
+	if err := s.saveServiceBuild(b); err != nil {
+		return nil, err
+	}
+	s.auditProject(p, AuditActionServiceBuild, service.Name, nil, b)
+	log := newBuildLog()
+	runningBuilds.logs[b.ID] = log
+	runningBuilds.services[key] = b.ID
+	// The build is updated while running
+	started := *b
+
+	go func() {
+		defer func() {
+			runningBuilds.Lock()
+			delete(runningBuilds.logs, b.ID)
+			delete(runningBuilds.services, key)
+			runningBuilds.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.GetConfig().BuildTimeout)
+		defer cancel()
+
+		err := s.buildImage(ctx, p, service, b, log)
+		if err == nil {
+			fmt.Fprintf(log, "Deploying %s\n", b.Image)
+			err = s.deployBuild(p.ID, service.Usn, b.Image, deploy)
+		}
+		if err != nil {
+			b.Status = BuildStatusFailed
+			b.Message = err.Error()
+			fmt.Fprintf(log, "Build failed: %v\n", err)
+		} else {
+			b.Status = BuildStatusSucceeded
+			fmt.Fprintf(log, "Build succeeded\n")
+		}
+
+		b.Log = log.finish()
+		if err := s.finishServiceBuild(b); err != nil {
+			slog.Error("unable to save build", "upn", p.UPN, "usn", service.Usn, "err", err)
+		}
+	}()
+
+	return &started, nil
+}
+
+// buildImage clones the repository of the service, builds the image and pushes it unless it's kept locally.
+func (s *S) buildImage(ctx context.Context, p *Project, service *Service, b *ServiceBuild, log io.Writer) error {
+	cfg := config.GetConfig()
+	source := service.Build
+
+	if err := os.MkdirAll(cfg.BuildsDir, 0o755); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(cfg.BuildsDir, fmt.Sprintf("%s-%s-", p.UPN, sanitizeName(service.Usn)))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Fprintf(log, "Cloning %s %s\n", source.Repository, source.Ref)
+	src := filepath.Join(dir, "src")
+	auth := git.Auth{DeployKey: source.DeployKey, Token: source.Token}
+	b.Commit, err = git.Clone(ctx, source.Repository, source.Ref, src, auth, log)
+	if err != nil {
+		return errors.Wrap(err, "unable to clone repository")
+	}
+	// The history isn't part of the build context
+	if err := os.RemoveAll(filepath.Join(src, ".git")); err != nil {
+		return err
+	}
+
+	repository := service.Image
+	if repository == "" {
+		repository = buildRepository(service.Usn)
+	}
+	b.Image = fmt.Sprintf("%s:%s", repository, b.Commit[:min(12, len(b.Commit))])
+	dockerfile := source.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	fmt.Fprintf(log, "Building %s from commit %s\n", b.Image, b.Commit)
+	buildContext, w := io.Pipe()
+	defer buildContext.Close()
+	go func() {
+		w.CloseWithError(backup.Archive(filepath.Join(src, source.Context), w))
+	}()
+	if err := docker.Build(ctx, buildContext, dockerfile, b.Image, source.Args, log); err != nil {
+		return errors.Wrap(err, "unable to build image")
+	}
+
+	if isLocalBuild(repository) {
+		return nil
+	}
+	fmt.Fprintf(log, "Pushing %s\n", b.Image)
+	creds := registryCredentials(p.DockerCredentials)[registry.NormalizeDomain(registry.Domain(repository))]
+	if err := docker.Push(ctx, b.Image, creds.Username, creds.Password, log); err != nil {
+		return errors.Wrap(err, "unable to push image")
+	}
+	return nil
+}
+
+// deployBuild deploys the built image to the service. The project is loaded again, as it might have
+// changed during the build.
+func (s *S) deployBuild(projectID int, usn, image string, deploy DeployFunc) error {
+	p, err := s.SelectProjectByID(projectID)
+	if err != nil {
+		return err
+	}
+	for _, service := range p.Services {
+		if service.Usn == usn {
+			service.Image, service.ImageTag, _ = registry.SplitReference(image)
+			return deploy(p, []string{usn})
+		}
+	}
+	return fmt.Errorf("service %s was removed during the build", usn)
+}
+
+// StreamBuildLog writes the log of the build to w, following it while the build is running.
+func (s *S) StreamBuildLog(ctx context.Context, b *ServiceBuild, w io.Writer) error {
+	runningBuilds.Lock()
+	log, ok := runningBuilds.logs[b.ID]
+	runningBuilds.Unlock()
+	if ok {
+		return log.follow(ctx, w)
+	}
+
+	// The build might have finished in the meantime
+	finished, err := s.SelectServiceBuild(b.ProjectID, b.ID)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, finished.Log)
+	return err
+}
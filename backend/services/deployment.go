@@ -0,0 +1,129 @@
+package services
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	DeploymentKindDeploy = "deploy"
+	// DeploymentKindPromotion deploys the images of another environment, see Promote
+	DeploymentKindPromotion = "promotion"
+)
+
+const (
+	DeploymentStatusSucceeded = "succeeded"
+	DeploymentStatusFailed    = "failed"
+)
+
+// deploymentsToKeep is the number of deployments which are kept per project
+const deploymentsToKeep = 100
+
+// DeployedImage is the image a service ran after a deployment.
+type DeployedImage struct {
+	Service string `json:"service"`
+	Usn     string `json:"usn"`
+	// Image is the image with tag
+	Image string `json:"image"`
+	// Digest is empty if it couldn't be recorded, e.g. for failed deployments
+	Digest string `json:"digest,omitempty"`
+}
+
+// DeployedImages is stored as JSON array in a TEXT column.
+type DeployedImages []DeployedImage
+
+func (i DeployedImages) Value() (driver.Value, error) {
+	if i == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(i)
+	return string(b), err
+}
+
+func (i *DeployedImages) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), i)
+	case []byte:
+		return json.Unmarshal(v, i)
+	case nil:
+		*i = nil
+		return nil
+	default:
+		return fmt.Errorf("unable to scan %T into deployed images", src)
+	}
+}
+
+// Deployment is an entry of the deployment history of a project.
+type Deployment struct {
+	ID   int    `json:"id" db:"id"`
+	Kind string `json:"kind" db:"kind"`
+	// Source is the environment the images of promotions come from
+	Source string `json:"source,omitempty" db:"source"`
+	Status string `json:"status" db:"status"`
+	// Message contains the error of failed deployments
+	Message   string         `json:"message" db:"message"`
+	Images    DeployedImages `json:"images" db:"images"`
+	CreatedAt time.Time      `json:"created_at" db:"created_at"`
+	ProjectID int            `json:"-" db:"project_id"`
+}
+
+// SaveDeployment adds the deployment to the history of the project with the images of its services and the digests
+// recorded for them.
+func (s *S) SaveDeployment(p *Project, d *Deployment) error {
+	digests, err := s.selectImageDigests(p.ID)
+	if err != nil {
+		return err
+	}
+	d.Images = make(DeployedImages, 0, len(p.Services))
+	for _, service := range p.Services {
+		image := DeployedImage{
+			Service: service.Name,
+			Usn:     service.Usn,
+			Image:   fmt.Sprintf("%s:%s", service.Image, service.ImageTag),
+		}
+		if digest, ok := digests[service.Usn]; ok && digest.Image == image.Image {
+			image.Digest = digest.Digest
+		}
+		d.Images = append(d.Images, image)
+	}
+	d.ProjectID = p.ID
+	d.CreatedAt = time.Now().UTC()
+
+	query := `
+		INSERT INTO deployments (kind, source, status, message, images, created_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	err = s.dbService.GetConn().Get(&d.ID, query, d.Kind, d.Source, d.Status, d.Message, d.Images, d.CreatedAt, d.ProjectID)
+	if err != nil {
+		return err
+	}
+	s.auditProject(p, AuditActionProjectDeploy, d.Kind, nil, d)
+
+	query = `
+		DELETE FROM deployments
+		WHERE project_id = $1 AND id NOT IN (
+			SELECT id FROM deployments WHERE project_id = $1 ORDER BY id DESC LIMIT $2
+		)
+	`
+	_, err = s.dbService.GetConn().Exec(query, d.ProjectID, deploymentsToKeep)
+	return err
+}
+
+// SelectDeployments returns the deployment history of a project, latest first.
+func (s *S) SelectDeployments(projectID int) ([]Deployment, error) {
+	deployments := make([]Deployment, 0)
+	query := `
+		SELECT id, kind, source, status, message, images, created_at, project_id
+		FROM deployments
+		WHERE project_id = $1
+		ORDER BY id DESC
+	`
+	if err := s.dbService.GetConn().Select(&deployments, query, projectID); err != nil {
+		return nil, err
+	}
+	return deployments, nil
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+// Previews and environments are derived projects: they run the services of their parent project under
+// a UPN of their own.
+
+// isDerivedProject reports whether the project is a preview or an environment of another project.
+func (s *S) isDerivedProject(projectID int) (bool, error) {
+	var derived bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM preview_environments WHERE project_id = $1)
+			OR EXISTS (SELECT 1 FROM project_environments WHERE project_id = $1)
+	`
+	err := s.dbService.GetConn().Get(&derived, query, projectID)
+	return derived, err
+}
+
+// derivedNameTaken reports whether a preview or environment of the parent has the name. Both share
+// the names, as they are used in UPNs and hostnames.
+func (s *S) derivedNameTaken(parentID int, name string) (bool, error) {
+	var taken bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM preview_environments WHERE parent_id = $1 AND branch = $2)
+			OR EXISTS (SELECT 1 FROM project_environments WHERE parent_id = $1 AND name = $2)
+	`
+	err := s.dbService.GetConn().Get(&taken, query, parentID, name)
+	return taken, err
+}
+
+// deriveProject copies the services of the parent into the project with the name, which exists already
+// if its ID isn't 0. Services of existing projects keep their usns by service name, new ones get their
+// own, as usns name the routers of traefik. Public services get hostnames like "<name>.<usn>.<BACKEND_HOST>",
+// where usn is the one of the parent service. Images aren't updated automatically, as derived projects
+// choose their tags.
+func (s *S) deriveProject(parent *Project, name string, existingID int) (*Project, error) {
+	cfg := config.GetConfig()
+
+	p := &Project{
+		Name:                fmt.Sprintf("%s (%s)", parent.Name, name),
+		UPN:                 UPN(fmt.Sprintf("%s-%s", parent.UPN, name)),
+		OrganisationID:      parent.OrganisationID,
+		RegistryCredentials: parent.RegistryCredentials,
+		DockerCredentials:   parent.DockerCredentials,
+	}
+	usns := make(map[string]string)
+	if existingID != 0 {
+		existing, err := s.SelectProjectByID(existingID)
+		if err != nil {
+			return nil, err
+		}
+		p.ID = existing.ID
+		p.UPN = existing.UPN
+		p.HookSecret = existing.HookSecret
+		for _, service := range existing.Services {
+			usns[service.Name] = service.Usn
+		}
+	}
+	p.Path = p.UPN.GetProjectPath()
+
+	for _, v := range parent.SharedVolumes {
+		p.SharedVolumes = append(p.SharedVolumes, SharedVolume{Name: v.Name})
+	}
+
+	derivedUsns := make(map[string]string, len(parent.Services))
+	taken := make(map[string]bool, len(parent.Services))
+	for _, service := range parent.Services {
+		usn, ok := usns[service.Name]
+		for !ok || taken[usn] {
+			usn, ok = utils.GenerateRandomName(), true
+		}
+		derivedUsns[service.Usn] = usn
+		taken[usn] = true
+	}
+
+	for _, parentService := range parent.Services {
+		service := parentService.copyWithUsns(derivedUsns)
+		service.UpdatePolicy = ""
+		service.UpdateConstraint = ""
+		if service.Public.Enabled {
+			service.Public.Hosts = []string{fmt.Sprintf("%s.%s.%s", name, sanitizeName(parentService.Usn), cfg.BackendHost)}
+		}
+		p.Services = append(p.Services, service)
+	}
+	return p, nil
+}
+
+// copyWithUsns copies the service for another project, its usn and the ones of its dependencies are replaced by
+// the usns of the other project by usn of this project.
+func (service *Service) copyWithUsns(usns map[string]string) *Service {
+	c := *service
+	c.ID = 0
+	c.Usn = usns[service.Usn]
+	if service.Depends != nil {
+		c.Depends = make(map[string]compose.Condition, len(service.Depends))
+		for usn, condition := range service.Depends {
+			if copiedUsn, ok := usns[usn]; ok {
+				usn = copiedUsn
+			}
+			c.Depends[usn] = condition
+		}
+	}
+	c.DiskUsage, c.ImageUpdate, c.ImageDigest = nil, nil, nil
+	return &c
+}
+
+// saveProjectWithUsns saves a new project with the usns its services already have, e.g. derived projects or clones.
+func (s *S) saveProjectWithUsns(p *Project) error {
+	project := *p
+	project.Services = nil
+	if err := s.saveProject(&project, p.OrganisationID); err != nil {
+		return err
+	}
+	p.ID = project.ID
+	for _, service := range p.Services {
+		if err := s.insertService(s.dbService.GetConn(), service, p.ID); err != nil {
+			_ = s.deleteProject(p.ID, p.OrganisationID)
+			return err
+		}
+	}
+	s.auditProject(p, AuditActionProjectCreate, string(p.UPN), nil, p)
+	return nil
+}
+
+func (p *Project) hasService(name string) bool {
+	for _, service := range p.Services {
+		if service.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// publicHosts returns the first host of public services by service name.
+func (p *Project) publicHosts() map[string]string {
+	hosts := make(map[string]string)
+	for _, service := range p.Services {
+		if service.Public.Enabled && len(service.Public.Hosts) > 0 {
+			hosts[service.Name] = service.Public.Hosts[0]
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+type DiskUsage struct {
+	Usn       string    `json:"usn" db:"usn"`
+	SizeBytes int64     `json:"size_bytes" db:"size_bytes"`
+	OverLimit bool      `json:"over_limit" db:"over_limit"`
+	ScannedAt time.Time `json:"scanned_at" db:"scanned_at"`
+	ProjectID int       `json:"-" db:"project_id"`
+}
+
+type ProjectDiskUsage struct {
+	ID         int         `json:"id" db:"id"`
+	Name       string      `json:"name" db:"name"`
+	UPN        string      `json:"upn" db:"unique_name"`
+	TotalBytes int64       `json:"total_bytes" db:"total_bytes"`
+	Services   []DiskUsage `json:"services"`
+}
+
+type OrganisationDiskUsage struct {
+	OrganisationID int                `json:"organisation_id"`
+	TotalBytes     int64              `json:"total_bytes"`
+	Projects       []ProjectDiskUsage `json:"projects"`
+}
+
+func (s *S) selectDiskUsage(projectID int) (map[string]DiskUsage, error) {
+	var rows []DiskUsage
+	query := `SELECT usn, size_bytes, over_limit, scanned_at, project_id FROM service_disk_usage WHERE project_id = $1`
+	if err := s.dbService.GetConn().Select(&rows, query, projectID); err != nil {
+		return nil, err
+	}
+	usage := make(map[string]DiskUsage, len(rows))
+	for _, u := range rows {
+		usage[u.Usn] = u
+	}
+	return usage, nil
+}
+
+// SelectOrganisationDiskUsage sums up the last scanned disk usage of all projects in the organisation.
+// The user must be a member of the organisation.
+func (s *S) SelectOrganisationDiskUsage(organisationID int, userID string) (*OrganisationDiskUsage, error) {
+	projects := make([]ProjectDiskUsage, 0)
+	query := `
+		SELECT p.id, p.name, p.unique_name, COALESCE(SUM(du.size_bytes), 0) AS total_bytes
+		FROM projects p
+		JOIN organisation_members om ON om.organisation_id = p.organisation_id AND om.user_id = $2
+		LEFT JOIN service_disk_usage du ON du.project_id = p.id
+		WHERE p.organisation_id = $1
+		GROUP BY p.id, p.name, p.unique_name
+		ORDER BY total_bytes DESC
+	`
+	if err := s.dbService.GetConn().Select(&projects, query, organisationID, userID); err != nil {
+		return nil, err
+	}
+
+	usage := OrganisationDiskUsage{
+		OrganisationID: organisationID,
+		Projects:       projects,
+	}
+	for i := range usage.Projects {
+		services, err := s.selectDiskUsage(usage.Projects[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		usage.Projects[i].Services = make([]DiskUsage, 0, len(services))
+		for _, u := range services {
+			usage.Projects[i].Services = append(usage.Projects[i].Services, u)
+		}
+		usage.TotalBytes += usage.Projects[i].TotalBytes
+	}
+	return &usage, nil
+}
+
+// ScanDiskUsage measures the volume directories of all projects and stores the results per service. Projects which
+// fail are logged and skipped. Members of the organisation are notified once when a service exceeds its volume limit.
+func (s *S) ScanDiskUsage(ctx context.Context) error {
+	var projectIDs []int
+	if err := s.dbService.GetConn().Select(&projectIDs, `SELECT id FROM projects ORDER BY id`); err != nil {
+		return err
+	}
+	for _, id := range projectIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p, err := s.SelectProjectByID(id)
+		if err != nil {
+			slog.Error("unable to get project for disk usage scan", "id", id, "err", err)
+			continue
+		}
+		if err := s.scanProjectDiskUsage(p); err != nil {
+			slog.Error("unable to scan disk usage of project", "upn", p.UPN, "err", err)
+		}
+	}
+	return nil
+}
+
+func (s *S) scanProjectDiskUsage(p *Project) error {
+	usns := make([]string, 0, len(p.Services))
+	for _, service := range p.Services {
+		usns = append(usns, service.Usn)
+
+		size, err := serviceVolumeSize(p.UPN, service.Usn)
+		if err != nil {
+			return err
+		}
+		overLimit := service.VolumeLimitBytes > 0 && size > service.VolumeLimitBytes
+		wasOverLimit := service.DiskUsage != nil && service.DiskUsage.OverLimit
+
+		query := `
+			INSERT INTO service_disk_usage (usn, size_bytes, over_limit, scanned_at, project_id)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (project_id, usn) DO UPDATE
+			SET size_bytes = excluded.size_bytes, over_limit = excluded.over_limit, scanned_at = excluded.scanned_at
+		`
+		_, err = s.dbService.GetConn().Exec(query, service.Usn, size, overLimit, time.Now().UTC(), p.ID)
+		if err != nil {
+			return err
+		}
+
+		if overLimit && !wasOverLimit {
+			subject := fmt.Sprintf("Service %s in project %s exceeds its volume limit", service.Name, p.Name)
+			content := fmt.Sprintf(
+				"The volumes of %s use %s of %s.", service.Name, utils.FormatBytes(size), utils.FormatBytes(service.VolumeLimitBytes),
+			)
+			if service.BlockDeployOverLimit {
+				content += " Deployments of the service are blocked until the usage is below the limit."
+			}
+			if err := s.NotifyOrganisationMembers(p.OrganisationID, subject, content); err != nil {
+				slog.Error("unable to send volume limit notification", "err", err)
+			}
+		}
+	}
+
+	// Forget about services which got removed from the project
+	usnJSON, err := json.Marshal(usns)
+	if err != nil {
+		return err
+	}
+	query := `DELETE FROM service_disk_usage WHERE project_id = $1 AND usn NOT IN (SELECT value FROM json_each($2))`
+	_, err = s.dbService.GetConn().Exec(query, p.ID, string(usnJSON))
+	return err
+}
+
+// ServicesOverVolumeLimit measures the volumes of all services which block deployments over their limit
+// and returns the names of those exceeding it.
+func (s *S) ServicesOverVolumeLimit(p *Project) ([]string, error) {
+	overLimit, err := servicesOverVolumeLimit(p)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(overLimit))
+	for i, service := range overLimit {
+		names[i] = service.Name
+	}
+	return names, nil
+}
+
+func servicesOverVolumeLimit(p *Project) ([]*Service, error) {
+	var overLimit []*Service
+	for _, service := range p.Services {
+		if !service.BlockDeployOverLimit || service.VolumeLimitBytes <= 0 || service.Usn == "" {
+			continue
+		}
+		size, err := serviceVolumeSize(p.UPN, service.Usn)
+		if err != nil {
+			return nil, err
+		}
+		if size > service.VolumeLimitBytes {
+			overLimit = append(overLimit, service)
+		}
+	}
+	return overLimit, nil
+}
+
+// ErrServicesHeld is returned when all services of a deployment are held, see HoldServicesOverVolumeLimit.
+var ErrServicesHeld = errors.New("volumes of the services exceed their limit, the deployment is blocked")
+
+// HoldServicesOverVolumeLimit replaces the services of the project which block deployments over their volume limit
+// and exceed it with their stored version, so that a deployment of the project keeps their current configuration
+// while the other services are deployed. It returns the USNs of the held services.
+func (s *S) HoldServicesOverVolumeLimit(p *Project) ([]string, error) {
+	overLimit, err := servicesOverVolumeLimit(p)
+	if err != nil || len(overLimit) == 0 {
+		return nil, err
+	}
+	existing, err := s.SelectServices(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]*Service, len(existing))
+	for _, service := range existing {
+		stored[service.Usn] = service
+	}
+
+	held := make(map[string]bool, len(overLimit))
+	for _, service := range overLimit {
+		held[service.Usn] = true
+	}
+	services := make([]*Service, 0, len(p.Services))
+	for _, service := range p.Services {
+		if !held[service.Usn] {
+			services = append(services, service)
+		} else if storedService, ok := stored[service.Usn]; ok {
+			services = append(services, storedService)
+		}
+	}
+	p.Services = services
+
+	usns := make([]string, 0, len(held))
+	for _, service := range overLimit {
+		usns = append(usns, service.Usn)
+	}
+	return usns, nil
+}
+
+func serviceVolumeSize(upn UPN, usn string) (int64, error) {
+	cfg := config.GetConfig()
+	return utils.DirSize(path.Join(upn.GetProjectPath(), cfg.PersistentVolumeDirectoryName, sanitizeName(usn)))
+}
+
+// StartDiskUsageScanner scans the disk usage periodically until the context is canceled.
+func (s *S) StartDiskUsageScanner(ctx context.Context) {
+	cfg := config.GetConfig()
+
+	go func() {
+		ticker := time.NewTicker(cfg.DiskUsageScanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.ScanDiskUsage(ctx); err != nil {
+					slog.Error("unable to scan disk usage", "err", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/models"
+)
+
+var (
+	resourceNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	envKeyRegex       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+)
+
+// ErrEnvGroupInUse is returned when deleting an env group which is used by services.
+var ErrEnvGroupInUse = errors.New("env group is in use")
+
+// EnvGroupVar is an env var of an env group. Values of secret ones are encrypted and masked like secret env vars
+// of services.
+type EnvGroupVar struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret"`
+}
+
+// EnvGroupVars is stored as JSON array in a TEXT column.
+type EnvGroupVars []EnvGroupVar
+
+func (v EnvGroupVars) Value() (driver.Value, error) {
+	if v == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (v *EnvGroupVars) Scan(src any) error {
+	switch s := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(s), v)
+	case []byte:
+		return json.Unmarshal(s, v)
+	case nil:
+		*v = nil
+		return nil
+	default:
+		return fmt.Errorf("unable to scan %T into env group vars", src)
+	}
+}
+
+// EnvGroup is a named set of env vars of an organisation, e.g. the SMTP settings, which services use by name.
+// Env vars of the service itself take precedence over the ones of its groups.
+type EnvGroup struct {
+	ID             int          `json:"id" db:"id"`
+	Name           string       `json:"name" db:"name"`
+	Vars           EnvGroupVars `json:"vars" db:"vars"`
+	CreatedAt      time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at" db:"updated_at"`
+	OrganisationID int          `json:"-" db:"organisation_id"`
+}
+
+func (g *EnvGroup) Validate() error {
+	if !resourceNameRegex.MatchString(g.Name) || len(g.Name) > 63 {
+		return fmt.Errorf("invalid env group name %q, only lowercase letters, digits, '-' and '_' are allowed", g.Name)
+	}
+	keys := make(map[string]bool, len(g.Vars))
+	for _, v := range g.Vars {
+		if !envKeyRegex.MatchString(v.Key) {
+			return fmt.Errorf("invalid env var key %q", v.Key)
+		}
+		if keys[v.Key] {
+			return fmt.Errorf("env var %s is defined twice", v.Key)
+		}
+		keys[v.Key] = true
+	}
+	return nil
+}
+
+// MaskSecrets replaces the values of secret env vars before the group is sent to a client.
+func (g *EnvGroup) MaskSecrets() {
+	for i := range g.Vars {
+		if g.Vars[i].Secret {
+			g.Vars[i].Value = SecretMask
+		}
+	}
+}
+
+func (s *S) SelectEnvGroups(organisationID int) ([]EnvGroup, error) {
+	groups := make([]EnvGroup, 0)
+	query := `SELECT * FROM env_groups WHERE organisation_id = $1 ORDER BY name`
+	if err := s.dbService.GetConn().Select(&groups, query, organisationID); err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if err := groups[i].decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (s *S) SelectEnvGroup(organisationID int, name string) (*EnvGroup, error) {
+	var g EnvGroup
+	query := `SELECT * FROM env_groups WHERE organisation_id = $1 AND name = $2`
+	if err := s.dbService.GetConn().Get(&g, query, organisationID, name); err != nil {
+		return nil, err
+	}
+	if err := g.decrypt(); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (g *EnvGroup) decrypt() error {
+	for i, v := range g.Vars {
+		if !v.Secret {
+			continue
+		}
+		value, err := decryptSecret(v.Value)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt env var %s of env group %s: %w", v.Key, g.Name, err)
+		}
+		g.Vars[i].Value = value
+	}
+	return nil
+}
+
+// SaveEnvGroup creates or replaces the env group of the organisation. Masked secrets keep their stored values. Like
+// env vars of services, vars whose keys look like secrets, e.g. DB_PASSWORD, and vars which were secret once are
+// encrypted even if the client didn't mark them.
+func (s *S) SaveEnvGroup(g *EnvGroup) error {
+	existing, err := s.SelectEnvGroup(g.OrganisationID, g.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	vars := make(EnvGroupVars, len(g.Vars))
+	for i, v := range g.Vars {
+		if _, stored := existing.storedSecret(v.Key); !v.Secret && (stored || secretEnvKey.MatchString(v.Key)) {
+			v.Secret = true
+			g.Vars[i].Secret = true
+		}
+		if v.Secret && v.Value == SecretMask {
+			value, ok := existing.storedSecret(v.Key)
+			if !ok {
+				return fmt.Errorf("env group %s has no stored value for the masked env var %s", g.Name, v.Key)
+			}
+			v.Value = value
+			g.Vars[i].Value = value
+		}
+		if v.Secret {
+			if v.Value, err = encryptSecret(v.Value); err != nil {
+				return err
+			}
+		}
+		vars[i] = v
+	}
+
+	now := time.Now().UTC()
+	g.UpdatedAt = now
+	query := `
+		INSERT INTO env_groups (name, vars, created_at, updated_at, organisation_id)
+		VALUES ($1, $2, $3, $3, $4)
+		ON CONFLICT (organisation_id, name) DO UPDATE
+		SET vars = excluded.vars, updated_at = excluded.updated_at
+		RETURNING id, created_at
+	`
+	if err := s.dbService.GetConn().QueryRowx(query, g.Name, vars, now, g.OrganisationID).Scan(&g.ID, &g.CreatedAt); err != nil {
+		return err
+	}
+	s.audit(g.OrganisationID, AuditActionEnvGroupSave, g.Name, existing, g)
+	return nil
+}
+
+// storedSecret returns the value of a secret env var of a stored group.
+func (g *EnvGroup) storedSecret(key string) (string, bool) {
+	if g == nil {
+		return "", false
+	}
+	for _, v := range g.Vars {
+		if v.Key == key && v.Secret {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+// DeleteEnvGroup deletes the env group, groups which are used by services return ErrEnvGroupInUse.
+func (s *S) DeleteEnvGroup(organisationID int, name string) error {
+	projects, err := s.SelectEnvGroupProjects(organisationID, name)
+	if err != nil {
+		return err
+	}
+	if len(projects) > 0 {
+		return ErrEnvGroupInUse
+	}
+	existing, err := s.SelectEnvGroup(organisationID, name)
+	if err != nil {
+		return err
+	}
+	res, err := s.dbService.GetConn().Exec(`DELETE FROM env_groups WHERE organisation_id = $1 AND name = $2`, organisationID, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	s.audit(organisationID, AuditActionEnvGroupDelete, name, existing, nil)
+	return nil
+}
+
+// SelectEnvGroupProjects returns the projects of the organisation with services using the env group, including
+// previews and environments, as they are affected by changes of the group as well.
+func (s *S) SelectEnvGroupProjects(organisationID int, name string) ([]models.OrganisationProjects, error) {
+	projects := make([]models.OrganisationProjects, 0)
+	query := `
+		SELECT DISTINCT p.unique_name, p.name, p.id
+		FROM projects p
+		JOIN services s ON s.project_id = p.id, json_each(s.env_groups) g
+		WHERE p.organisation_id = $1 AND g.value = $2
+		ORDER BY p.id
+	`
+	if err := s.dbService.GetConn().Select(&projects, query, organisationID, name); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// resolveEnv returns the env vars of the services of the project by usn, including the ones of their env groups.
+// Later groups take precedence over earlier ones, the env vars of the service over all groups. References to other
+// services are resolved, see resolveReferences.
+func (s *S) resolveEnv(p *Project) (map[string][]envVar, error) {
+	var groups map[string]*EnvGroup
+	env := make(map[string][]envVar, len(p.Services))
+	for _, service := range p.Services {
+		if len(service.EnvGroups) > 0 && groups == nil {
+			var err error
+			if groups, err = s.selectProjectEnvGroups(p); err != nil {
+				return nil, err
+			}
+		}
+
+		var vars []envVar
+		index := make(map[string]int)
+		set := func(key, value string, secret bool) {
+			if i, ok := index[key]; ok {
+				vars[i] = envVar{Key: key, Value: value, Secret: secret}
+				return
+			}
+			index[key] = len(vars)
+			vars = append(vars, envVar{Key: key, Value: value, Secret: secret})
+		}
+		for _, name := range service.EnvGroups {
+			g, ok := groups[name]
+			if !ok {
+				return nil, fmt.Errorf("service %s uses the unknown env group %q", service.Name, name)
+			}
+			for _, v := range g.Vars {
+				set(v.Key, v.Value, v.Secret)
+			}
+		}
+		for _, ev := range service.EnvVars {
+			if len(ev) == 2 && ev[0] != "" && ev[1] != "" {
+				set(ev[0], ev[1], service.isSecretEnv(ev[0]))
+			}
+		}
+		env[service.Usn] = vars
+	}
+	if err := resolveReferences(p, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// ResolveServiceEnv returns the env of the service's container as it's deployed, with the vars of its env groups
+// and resolved references.
+func (s *S) ResolveServiceEnv(p *Project, service *Service) (map[string]string, error) {
+	env, err := s.resolveEnv(p)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string, len(env[service.Usn]))
+	for _, v := range env[service.Usn] {
+		vars[v.Key] = v.Value
+	}
+	return vars, nil
+}
+
+func (s *S) selectProjectEnvGroups(p *Project) (map[string]*EnvGroup, error) {
+	organisationID, err := strconv.Atoi(p.OrganisationID)
+	if err != nil {
+		return nil, fmt.Errorf("env groups require the project to belong to an organisation")
+	}
+	groups, err := s.SelectEnvGroups(organisationID)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*EnvGroup, len(groups))
+	for i := range groups {
+		byName[groups[i].Name] = &groups[i]
+	}
+	return byName, nil
+}
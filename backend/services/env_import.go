@@ -0,0 +1,86 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/devs-group/sloth/backend/pkg/dotenv"
+)
+
+// EnvImport lists the keys of the env vars a dotenv file adds to a service, changes or removes from it.
+type EnvImport struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+	// Applied is set once the service was redeployed with the env vars, otherwise the changes are only listed
+	Applied bool `json:"applied"`
+}
+
+// ImportEnv replaces the env vars of the service with the ones of the dotenv file. With merge, env vars which aren't
+// part of the file are kept. Secret env vars stay secret, masked values keep the stored ones like in updates of the
+// project, so that exported files can be imported again.
+func (s *Service) ImportEnv(content string, merge bool) (EnvImport, error) {
+	imported, err := dotenv.Parse(content)
+	if err != nil {
+		return EnvImport{}, fmt.Errorf("invalid dotenv file: %w", err)
+	}
+
+	result := EnvImport{Added: []string{}, Changed: []string{}, Removed: []string{}}
+	current := s.EnvMap()
+	keys := make(map[string]bool, len(imported))
+	var envVars [][]string
+	for _, v := range imported {
+		keys[v.Key] = true
+		value, ok := current[v.Key]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, v.Key)
+		case v.Value == SecretMask && s.isSecretEnv(v.Key):
+			v.Value = value
+		case v.Value != value:
+			result.Changed = append(result.Changed, v.Key)
+		}
+		envVars = append(envVars, []string{v.Key, v.Value})
+	}
+
+	var secretEnvVars []string
+	for _, ev := range s.EnvVars {
+		if len(ev) != 2 || ev[0] == "" || keys[ev[0]] {
+			continue
+		}
+		if !merge {
+			result.Removed = append(result.Removed, ev[0])
+			continue
+		}
+		envVars = append(envVars, ev)
+	}
+	for _, key := range s.SecretEnvVars {
+		if !slices.Contains(result.Removed, key) {
+			secretEnvVars = append(secretEnvVars, key)
+		}
+	}
+
+	s.EnvVars = envVars
+	s.SecretEnvVars = secretEnvVars
+	sort.Strings(result.Added)
+	sort.Strings(result.Changed)
+	sort.Strings(result.Removed)
+	return result, nil
+}
+
+// ExportEnv returns the env vars of the service as dotenv file, the values of secret ones are masked.
+func (s *Service) ExportEnv() []byte {
+	var vars []dotenv.Var
+	for _, ev := range s.EnvVars {
+		if len(ev) != 2 || ev[0] == "" {
+			continue
+		}
+		value := ev[1]
+		if s.isSecretEnv(ev[0]) {
+			value = SecretMask
+		}
+		vars = append(vars, dotenv.Var{Key: ev[0], Value: value})
+	}
+	return dotenv.Format(vars)
+}
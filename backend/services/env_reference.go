@@ -0,0 +1,187 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+// ErrInvalidEnvReference is returned for env vars with unknown or cyclic references.
+var ErrInvalidEnvReference = errors.New("invalid env reference")
+
+// envExpression matches the expressions of env var values, e.g. "${services.db.env.POSTGRES_PASSWORD}",
+// "${services.db.hostname}" or "${random:32}". "$$" escapes a literal "$". Other "${...}" are no expressions of
+// sloth and are passed on unchanged, e.g. for applications doing their own interpolation.
+var envExpression = regexp.MustCompile(`\$\$|\$\{((?:services\.|random:)[^}]*)\}`)
+
+// maxRandomLen limits the length of values generated by "${random:<length>}"
+const maxRandomLen = 256
+
+// envVar is an env var of a service as it's passed to the container.
+type envVar struct {
+	Key   string
+	Value string
+	// Secret env vars are masked, as are the ones referencing them
+	Secret bool
+}
+
+// parseRandom returns the length of a "random:<length>" expression.
+func parseRandom(expr string) (int, bool, error) {
+	arg, ok := strings.CutPrefix(expr, "random:")
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > maxRandomLen {
+		return 0, true, fmt.Errorf("%w: the length of ${%s} must be between 1 and %d", ErrInvalidEnvReference, expr, maxRandomLen)
+	}
+	return n, true, nil
+}
+
+// generateEnvValues evaluates the "${random:<length>}" expressions of the env vars, so that the generated values are
+// stored instead of the expressions. The env vars become secret, as generated values are usually passwords.
+func (s *Service) generateEnvValues() error {
+	for i, ev := range s.EnvVars {
+		if len(ev) != 2 || !strings.Contains(ev[1], "${random:") {
+			continue
+		}
+		var err error
+		generated := false
+		value := envExpression.ReplaceAllStringFunc(ev[1], func(m string) string {
+			expr := strings.TrimSuffix(strings.TrimPrefix(m, "${"), "}")
+			n, ok, parseErr := parseRandom(expr)
+			if !ok || err != nil {
+				return m
+			}
+			if parseErr != nil {
+				err = parseErr
+				return m
+			}
+			r, randErr := utils.RandStringRunes(n)
+			if randErr != nil {
+				err = randErr
+				return m
+			}
+			generated = true
+			return r
+		})
+		if err != nil {
+			return fmt.Errorf("env var %s of service %s: %w", ev[0], s.Name, err)
+		}
+		if generated {
+			s.EnvVars[i] = []string{ev[0], value}
+			if !s.isSecretEnv(ev[0]) {
+				s.SecretEnvVars = append(s.SecretEnvVars, ev[0])
+			}
+		}
+	}
+	return nil
+}
+
+// envResolver resolves the expressions of the env vars of the services of a project.
+type envResolver struct {
+	services map[string]*Service
+	env      map[string]map[string]*envVar
+	// state is 1 while the references of an env var are resolved and 2 once they are
+	state map[*envVar]int
+}
+
+// resolveReferences replaces the expressions of the env vars by service usn with their values.
+func resolveReferences(p *Project, env map[string][]envVar) error {
+	r := envResolver{
+		services: make(map[string]*Service, len(p.Services)),
+		env:      make(map[string]map[string]*envVar, len(p.Services)),
+		state:    make(map[*envVar]int),
+	}
+	for _, service := range p.Services {
+		r.services[service.Name] = service
+		vars := make(map[string]*envVar, len(env[service.Usn]))
+		for i := range env[service.Usn] {
+			v := &env[service.Usn][i]
+			vars[v.Key] = v
+		}
+		r.env[service.Name] = vars
+	}
+	for _, service := range p.Services {
+		for i := range env[service.Usn] {
+			if err := r.resolve(service.Name, &env[service.Usn][i], nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *envResolver) resolve(service string, v *envVar, path []string) error {
+	path = append(path, service+"."+v.Key)
+	switch r.state[v] {
+	case 1:
+		return fmt.Errorf("%w: cyclic reference %s", ErrInvalidEnvReference, strings.Join(path, " -> "))
+	case 2:
+		return nil
+	}
+	r.state[v] = 1
+
+	var err error
+	v.Value = envExpression.ReplaceAllStringFunc(v.Value, func(m string) string {
+		if err != nil {
+			return m
+		}
+		if m == "$$" {
+			return "$"
+		}
+		var value string
+		value, err = r.evaluate(strings.TrimSuffix(strings.TrimPrefix(m, "${"), "}"), v, path)
+		return value
+	})
+	if err != nil {
+		return err
+	}
+	r.state[v] = 2
+	return nil
+}
+
+// evaluate returns the value of an expression of the env var v.
+func (r *envResolver) evaluate(expr string, v *envVar, path []string) (string, error) {
+	if n, ok, err := parseRandom(expr); ok {
+		// Only values which weren't stored yet still contain generators, see generateEnvValues
+		if err != nil {
+			return "", err
+		}
+		v.Secret = true
+		return utils.RandStringRunes(n)
+	}
+
+	ref, ok := strings.CutPrefix(expr, "services.")
+	if !ok {
+		return "", fmt.Errorf("%w: unknown expression ${%s} in %s", ErrInvalidEnvReference, expr, path[len(path)-1])
+	}
+	if name, ok := strings.CutSuffix(ref, ".hostname"); ok {
+		service, ok := r.services[name]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown service %q in %s", ErrInvalidEnvReference, name, path[len(path)-1])
+		}
+		return service.Usn, nil
+	}
+	name, key, ok := strings.Cut(ref, ".env.")
+	if !ok {
+		return "", fmt.Errorf("%w: unknown expression ${%s} in %s", ErrInvalidEnvReference, expr, path[len(path)-1])
+	}
+	if _, ok := r.services[name]; !ok {
+		return "", fmt.Errorf("%w: unknown service %q in %s", ErrInvalidEnvReference, name, path[len(path)-1])
+	}
+	referenced, ok := r.env[name][key]
+	if !ok {
+		return "", fmt.Errorf("%w: service %s has no env var %s, referenced in %s", ErrInvalidEnvReference, name, key, path[len(path)-1])
+	}
+	if err := r.resolve(name, referenced, path); err != nil {
+		return "", err
+	}
+	v.Secret = v.Secret || referenced.Secret
+	return referenced.Value, nil
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServiceOverride changes a service of the parent project within an environment.
+type ServiceOverride struct {
+	// ImageTag replaces the tag of the parent service when set
+	ImageTag string `json:"image_tag,omitempty"`
+	// Digest pins the image to a digest of the tag, it's set by promotions
+	Digest string `json:"digest,omitempty"`
+	// EnvVars are added to the env vars of the parent service, replacing the ones with the same key
+	EnvVars map[string]string `json:"env_vars,omitempty"`
+	// Hosts replace the generated hostnames of public services
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// EnvironmentOverrides are the overrides of an environment by service name, stored as JSON object in a TEXT column.
+type EnvironmentOverrides map[string]ServiceOverride
+
+// Value encrypts the values of the env vars, they may contain secrets.
+func (o EnvironmentOverrides) Value() (driver.Value, error) {
+	if o == nil {
+		return "{}", nil
+	}
+	encrypted := make(EnvironmentOverrides, len(o))
+	for name, override := range o {
+		env := make(map[string]string, len(override.EnvVars))
+		for key, value := range override.EnvVars {
+			v, err := encryptSecret(value)
+			if err != nil {
+				return nil, err
+			}
+			env[key] = v
+		}
+		if len(env) > 0 {
+			override.EnvVars = env
+		}
+		encrypted[name] = override
+	}
+	b, err := json.Marshal(encrypted)
+	return string(b), err
+}
+
+func (o *EnvironmentOverrides) Scan(src any) error {
+	var err error
+	switch v := src.(type) {
+	case string:
+		err = json.Unmarshal([]byte(v), o)
+	case []byte:
+		err = json.Unmarshal(v, o)
+	case nil:
+		*o = nil
+		return nil
+	default:
+		return fmt.Errorf("unable to scan %T into environment overrides", src)
+	}
+	if err != nil {
+		return err
+	}
+	for _, override := range *o {
+		for key, value := range override.EnvVars {
+			if override.EnvVars[key], err = decryptSecret(value); err != nil {
+				return fmt.Errorf("unable to decrypt env var %s of environment overrides: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Environment is a long-lived stage of a project, e.g. staging or production. Like previews it runs as project
+// of its own, derived from the services of its parent project.
+type Environment struct {
+	ID        int                  `json:"id" db:"id"`
+	Name      string               `json:"name" db:"name"`
+	Overrides EnvironmentOverrides `json:"overrides" db:"overrides"`
+	CreatedAt time.Time            `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at" db:"updated_at"`
+	ParentID  int                  `json:"-" db:"parent_id"`
+	ProjectID int                  `json:"project_id" db:"project_id"`
+	UPN       UPN                  `json:"upn" db:"unique_name"`
+
+	// Ignored in DB operations - populated separately
+	// Hosts are the hostnames of the public services by service name
+	Hosts map[string]string `json:"hosts,omitempty" db:"-"`
+}
+
+// MaskSecrets replaces the values of the env vars of the overrides before the environment is sent to a client, they
+// may contain secrets. Updates which send the mask keep the stored value.
+func (e *Environment) MaskSecrets() {
+	masked := make(EnvironmentOverrides, len(e.Overrides))
+	for name, override := range e.Overrides {
+		if len(override.EnvVars) > 0 {
+			env := make(map[string]string, len(override.EnvVars))
+			for key := range override.EnvVars {
+				env[key] = SecretMask
+			}
+			override.EnvVars = env
+		}
+		masked[name] = override
+	}
+	e.Overrides = masked
+}
+
+// restoreMaskedEnvVars replaces masked env vars of the overrides with the stored ones, see MaskSecrets.
+func (o EnvironmentOverrides) restoreMaskedEnvVars(stored EnvironmentOverrides) error {
+	for name, override := range o {
+		for key, value := range override.EnvVars {
+			if value != SecretMask {
+				continue
+			}
+			storedValue, ok := stored[name].EnvVars[key]
+			if !ok {
+				return fmt.Errorf("service %s has no stored value for the masked env var %s", name, key)
+			}
+			override.EnvVars[key] = storedValue
+		}
+	}
+	return nil
+}
+
+type PromotionRequest struct {
+	// From is the name of the environment the images are promoted from
+	From string `json:"from" binding:"required"`
+}
+
+const selectEnvironments = `
+	SELECT pe.id, pe.name, pe.overrides, pe.created_at, pe.updated_at, pe.parent_id, pe.project_id, p.unique_name
+	FROM project_environments pe
+	JOIN projects p ON p.id = pe.project_id
+`
+
+// SelectEnvironments returns the environments of a project.
+func (s *S) SelectEnvironments(parentID int) ([]Environment, error) {
+	environments := make([]Environment, 0)
+	if err := s.dbService.GetConn().Select(&environments, selectEnvironments+`WHERE pe.parent_id = $1 ORDER BY pe.id`, parentID); err != nil {
+		return nil, err
+	}
+	return environments, nil
+}
+
+// SelectEnvironment returns the environment of a project with the name.
+func (s *S) SelectEnvironment(parentID int, name string) (*Environment, error) {
+	var environment Environment
+	err := s.dbService.GetConn().Get(&environment, selectEnvironments+`WHERE pe.parent_id = $1 AND pe.name = $2`, parentID, name)
+	if err != nil {
+		return nil, err
+	}
+	return &environment, nil
+}
+
+// EnvironmentProject derives the project of the environment with the name from its parent, see deriveProject,
+// and applies the overrides to its services. The environment is new if its ID is 0, neither the project nor the
+// environment are saved.
+func (s *S) EnvironmentProject(parent *Project, name string, overrides EnvironmentOverrides) (*Project, *Environment, error) {
+	if name == "" || PreviewSlug(name) != name {
+		return nil, nil, fmt.Errorf("invalid environment name %q, use lowercase letters, digits and dashes", name)
+	}
+	if derived, err := s.isDerivedProject(parent.ID); err != nil {
+		return nil, nil, err
+	} else if derived {
+		return nil, nil, fmt.Errorf("previews and environments can't have environments")
+	}
+	for serviceName, override := range overrides {
+		if !parent.hasService(serviceName) {
+			return nil, nil, fmt.Errorf("project has no service %q", serviceName)
+		}
+		if override.Digest != "" && override.ImageTag == "" {
+			return nil, nil, fmt.Errorf("digest of service %q requires an image tag", serviceName)
+		}
+	}
+
+	environment, err := s.SelectEnvironment(parent.ID, name)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if taken, err := s.derivedNameTaken(parent.ID, name); err != nil {
+			return nil, nil, err
+		} else if taken {
+			return nil, nil, fmt.Errorf("project has a preview %q", name)
+		}
+		environment = &Environment{Name: name, ParentID: parent.ID}
+	case err != nil:
+		return nil, nil, err
+	}
+	if err := overrides.restoreMaskedEnvVars(environment.Overrides); err != nil {
+		return nil, nil, err
+	}
+
+	p, err := s.deriveProject(parent, name, environment.ProjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, service := range p.Services {
+		if override, ok := overrides[service.Name]; ok {
+			override.apply(service)
+		}
+	}
+	environment.Overrides = overrides
+	environment.UPN = p.UPN
+	environment.Hosts = p.publicHosts()
+	return p, environment, nil
+}
+
+func (o ServiceOverride) apply(service *Service) {
+	if o.ImageTag != "" {
+		service.ImageTag = o.ImageTag
+	}
+	if o.Digest != "" {
+		service.PinDigest = true
+	}
+	if len(o.EnvVars) > 0 {
+		envVars := make([][]string, 0, len(service.EnvVars)+len(o.EnvVars))
+		overridden := make(map[string]bool, len(o.EnvVars))
+		for _, ev := range service.EnvVars {
+			if len(ev) == 2 {
+				if value, ok := o.EnvVars[ev[0]]; ok {
+					ev = []string{ev[0], value}
+					overridden[ev[0]] = true
+				}
+			}
+			envVars = append(envVars, ev)
+		}
+		for key, value := range o.EnvVars {
+			if !overridden[key] {
+				envVars = append(envVars, []string{key, value})
+			}
+			// Overrides are masked like secrets, so are the env vars of the environment
+			if !service.isSecretEnv(key) {
+				service.SecretEnvVars = append(service.SecretEnvVars, key)
+			}
+		}
+		service.EnvVars = envVars
+	}
+	if len(o.Hosts) > 0 && service.Public.Enabled {
+		service.Public.Hosts = o.Hosts
+	}
+}
+
+// SaveEnvironmentProject prepares the deployment of an environment: the project of a new environment is saved, the
+// one of an existing environment is saved on deployment. Digests of the overrides are recorded for their services,
+// so their deployment pins them. The overrides are saved by SaveEnvironment once the deployment succeeded.
+func (s *S) SaveEnvironmentProject(p *Project, environment *Environment) error {
+	if environment.ID == 0 {
+		if err := s.saveProjectWithUsns(p); err != nil {
+			return err
+		}
+		environment.ProjectID = p.ID
+	}
+	return s.saveOverrideDigests(p, environment.Overrides)
+}
+
+// SaveEnvironment saves a new environment or the overrides of an existing one after its project was deployed, see
+// SaveEnvironmentProject.
+func (s *S) SaveEnvironment(p *Project, environment *Environment) error {
+	now := time.Now().UTC()
+	environment.UpdatedAt = now
+	if environment.ID != 0 {
+		query := `UPDATE project_environments SET overrides = $2, updated_at = $3 WHERE id = $1`
+		if _, err := s.dbService.GetConn().Exec(query, environment.ID, environment.Overrides, now); err != nil {
+			return err
+		}
+		// Overrides may contain secret env vars, only the project is recorded with its secrets masked
+		s.auditProject(p, AuditActionEnvironmentSave, environment.Name, nil, p)
+		return nil
+	}
+
+	environment.CreatedAt = now
+	query := `
+		INSERT INTO project_environments (name, overrides, created_at, updated_at, parent_id, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	return s.dbService.GetConn().Get(
+		&environment.ID, query, environment.Name, environment.Overrides, now, now, environment.ParentID, environment.ProjectID,
+	)
+}
+
+func (s *S) saveOverrideDigests(p *Project, overrides EnvironmentOverrides) error {
+	for _, service := range p.Services {
+		override, ok := overrides[service.Name]
+		if !ok || override.Digest == "" {
+			continue
+		}
+		d := ImageDigest{
+			Usn:       service.Usn,
+			Image:     fmt.Sprintf("%s:%s", service.Image, service.ImageTag),
+			Digest:    override.Digest,
+			ProjectID: p.ID,
+		}
+		if err := s.saveImageDigest(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Promote derives the project of the environment with the name, running the exact images of the environment from:
+// the tags of its services and the digests they were deployed with. Other overrides of the environment are kept.
+func (s *S) Promote(parent *Project, from, name string) (*Project, *Environment, error) {
+	if from == name {
+		return nil, nil, fmt.Errorf("environment %q can't be promoted to itself", name)
+	}
+	source, err := s.SelectEnvironment(parent.ID, from)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("project has no environment %q", from)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	target, err := s.SelectEnvironment(parent.ID, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("project has no environment %q", name)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	sourceProject, err := s.SelectProjectByID(source.ProjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	overrides := make(EnvironmentOverrides, len(sourceProject.Services))
+	for serviceName, override := range target.Overrides {
+		overrides[serviceName] = override
+	}
+	for _, service := range sourceProject.Services {
+		if !parent.hasService(service.Name) {
+			continue
+		}
+		override := overrides[service.Name]
+		override.ImageTag = service.ImageTag
+		override.Digest = ""
+		// The digest is only known once the source was deployed with its current tag
+		image := fmt.Sprintf("%s:%s", service.Image, service.ImageTag)
+		if service.ImageDigest != nil && service.ImageDigest.Image == image {
+			override.Digest = service.ImageDigest.Digest
+		}
+		overrides[service.Name] = override
+	}
+	return s.EnvironmentProject(parent, name, overrides)
+}
@@ -1,12 +1,18 @@
 package services
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
 	"github.com/devs-group/sloth/backend/database"
 	"github.com/jmoiron/sqlx"
 )
 
 type S struct {
 	dbService database.IDatabaseService
+	// actor causes the mutations of the service, see As
+	actor *Actor
 }
 
 type TransactionFunc func(*sqlx.Tx) error
@@ -15,7 +21,7 @@ func New(db database.IDatabaseService) *S {
 	return &S{dbService: db}
 }
 
-func (s *S) WithTransaction(fn func(tx *sqlx.Tx) error) error {
+func (s *S) WithTransaction(fn func(tx *sqlx.Tx) error) (err error) {
 	tx, err := s.dbService.GetConn().Beginx()
 	if err != nil {
 		return err
@@ -33,3 +39,28 @@ func (s *S) WithTransaction(fn func(tx *sqlx.Tx) error) error {
 	err = fn(tx)
 	return err
 }
+
+// StringList is stored as JSON array in a TEXT column.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+func (l *StringList) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	case []byte:
+		return json.Unmarshal(v, l)
+	case nil:
+		*l = nil
+		return nil
+	default:
+		return fmt.Errorf("unable to scan %T into a string list", src)
+	}
+}
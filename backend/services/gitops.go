@@ -0,0 +1,379 @@
+package services
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/git"
+)
+
+const (
+	// GitOpsStatusPending is used until the first sync of a source
+	GitOpsStatusPending = "pending"
+	GitOpsStatusSynced  = "synced"
+	// GitOpsStatusInvalid is used for manifests which were rejected, the project is left unchanged
+	GitOpsStatusInvalid = "invalid"
+	GitOpsStatusFailed  = "failed"
+)
+
+// defaultManifestPath is the path of the manifest within repositories if none is configured
+const defaultManifestPath = "sloth.yaml"
+
+// gitopsSync serializes syncs, so that polls and hooks don't apply manifests of the same project concurrently
+var gitopsSync sync.Mutex
+
+// GitOpsSource is the repository a project is synced from, see Manifest.
+type GitOpsSource struct {
+	ID         int    `json:"id" db:"id"`
+	Repository string `json:"repository" binding:"required" db:"repository"`
+	// Ref is a branch, tag or commit, the default branch of the repository when empty
+	Ref string `json:"ref" db:"ref"`
+	// Path of the manifest within the repository, "sloth.yaml" when empty
+	Path string `json:"path" db:"path"`
+	// DeployKey is used for SSH remotes, Token for HTTP(S) remotes
+	DeployKey string `json:"deploy_key,omitempty" db:"deploy_key"`
+	Token     string `json:"token,omitempty" db:"token"`
+	// ClearCredentials removes the stored credentials when none are sent
+	ClearCredentials bool   `json:"clear_credentials,omitempty" db:"-"`
+	Status           string `json:"status" db:"status"`
+	// Message contains the error of invalid manifests and failed syncs
+	Message string `json:"message" db:"message"`
+	// Commit is the commit of the last sync
+	Commit    string        `json:"commit" db:"commit_sha"`
+	Diff      *ManifestDiff `json:"diff" db:"diff"`
+	SyncedAt  *time.Time    `json:"synced_at" db:"synced_at"`
+	CreatedAt time.Time     `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at" db:"updated_at"`
+	ProjectID int           `json:"-" db:"project_id"`
+}
+
+func (d ManifestDiff) Value() (driver.Value, error) {
+	b, err := json.Marshal(d)
+	return string(b), err
+}
+
+func (d *ManifestDiff) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	case []byte:
+		return json.Unmarshal(v, d)
+	default:
+		return fmt.Errorf("unable to scan %T into a manifest diff", src)
+	}
+}
+
+func (g *GitOpsSource) Validate() error {
+	if g.Repository == "" {
+		return fmt.Errorf("repository is required")
+	}
+	if err := git.ValidateRepository(g.Repository); err != nil {
+		return err
+	}
+	if err := git.ValidateRef(g.Ref); err != nil {
+		return err
+	}
+	if g.DeployKey != "" && g.Token != "" {
+		return fmt.Errorf("either a deploy key or a token can be used")
+	}
+	if g.Path == "" {
+		g.Path = defaultManifestPath
+	}
+	if !filepath.IsLocal(g.Path) {
+		return fmt.Errorf("path %s must be within the repository", g.Path)
+	}
+	return nil
+}
+
+// MaskSecrets removes the credentials of the repository before the source is sent to a client.
+func (g *GitOpsSource) MaskSecrets() {
+	g.DeployKey = ""
+	g.Token = ""
+}
+
+// encryptedCredentials returns the credentials of the repository as stored in the database.
+func (g *GitOpsSource) encryptedCredentials() (string, string, error) {
+	credentials := []string{g.DeployKey, g.Token}
+	for i, c := range credentials {
+		if c == "" {
+			continue
+		}
+		encrypted, err := encryptSecret(c)
+		if err != nil {
+			return "", "", err
+		}
+		credentials[i] = encrypted
+	}
+	return credentials[0], credentials[1], nil
+}
+
+func (g *GitOpsSource) decryptCredentials() error {
+	var err error
+	for _, c := range []*string{&g.DeployKey, &g.Token} {
+		if *c, err = decryptSecret(*c); err != nil {
+			return errors.Wrap(err, "unable to decrypt credentials of gitops source")
+		}
+	}
+	return nil
+}
+
+func (g *GitOpsSource) auth() git.Auth {
+	return git.Auth{DeployKey: g.DeployKey, Token: g.Token}
+}
+
+const gitOpsSourceColumns = `
+	id, repository, ref, path, deploy_key, token, status, message, commit_sha, diff, synced_at, created_at, updated_at, project_id
+`
+
+func (s *S) SelectGitOpsSource(projectID int) (*GitOpsSource, error) {
+	var g GitOpsSource
+	query := `SELECT ` + gitOpsSourceColumns + ` FROM gitops_sources WHERE project_id = $1`
+	if err := s.dbService.GetConn().Get(&g, query, projectID); err != nil {
+		return nil, err
+	}
+	if err := g.decryptCredentials(); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *S) selectGitOpsSources() ([]GitOpsSource, error) {
+	var sources []GitOpsSource
+	query := `SELECT ` + gitOpsSourceColumns + ` FROM gitops_sources ORDER BY id`
+	if err := s.dbService.GetConn().Select(&sources, query); err != nil {
+		return nil, err
+	}
+	for i := range sources {
+		if err := sources[i].decryptCredentials(); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// SaveGitOpsSource creates or replaces the source of the project. Empty credentials keep the stored ones of the
+// same repository, since secrets are never sent to the client, unless ClearCredentials is set. Changing the
+// repository, ref or path makes the next poll sync.
+func (s *S) SaveGitOpsSource(g *GitOpsSource) error {
+	existing, err := s.SelectGitOpsSource(g.ProjectID)
+	if err == nil && g.DeployKey == "" && g.Token == "" && !g.ClearCredentials && existing.Repository == g.Repository {
+		g.DeployKey, g.Token = existing.DeployKey, existing.Token
+	}
+	deployKey, token, err := g.encryptedCredentials()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	g.Status = GitOpsStatusPending
+	g.Message = ""
+	g.Commit = ""
+	g.CreatedAt = now
+	g.UpdatedAt = now
+	query := `
+		INSERT INTO gitops_sources (repository, ref, path, deploy_key, token, status, message, commit_sha, created_at, updated_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, '', '', $7, $7, $8)
+		ON CONFLICT (project_id) DO UPDATE
+		SET repository = excluded.repository, ref = excluded.ref, path = excluded.path, deploy_key = excluded.deploy_key,
+			token = excluded.token, status = excluded.status, message = '', commit_sha = '', updated_at = excluded.updated_at
+		RETURNING id, created_at
+	`
+	err = s.dbService.GetConn().QueryRowx(
+		query, g.Repository, g.Ref, g.Path, deployKey, token, g.Status, now, g.ProjectID,
+	).Scan(&g.ID, &g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	s.auditProjectByID(g.ProjectID, AuditActionGitOpsSourceSave, g.Repository, existing, g)
+	return nil
+}
+
+func (s *S) DeleteGitOpsSource(projectID int) error {
+	res, err := s.dbService.GetConn().Exec(`DELETE FROM gitops_sources WHERE project_id = $1`, projectID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		s.auditProjectByID(projectID, AuditActionGitOpsSourceDelete, "", nil, nil)
+	}
+	return nil
+}
+
+func (s *S) saveGitOpsStatus(g *GitOpsSource) error {
+	query := `
+		UPDATE gitops_sources
+		SET status = $2, message = $3, commit_sha = $4, diff = $5, synced_at = $6
+		WHERE id = $1
+	`
+	_, err := s.dbService.GetConn().Exec(query, g.ID, g.Status, g.Message, g.Commit, g.Diff, g.SyncedAt)
+	return err
+}
+
+// ApplyFunc deploys the project rendered from a manifest.
+type ApplyFunc func(p *Project) error
+
+// SyncOptions changes how a manifest is synced.
+type SyncOptions struct {
+	// DryRun only computes the diff, neither the project nor the status of the source change
+	DryRun bool
+}
+
+// SyncProject renders the manifest of the source of the project at the current commit, computes the diff against
+// the project and applies it if there are changes. The outcome is stored as status of the source, invalid manifests
+// return an error wrapping ErrInvalidManifest.
+func (s *S) SyncProject(ctx context.Context, p *Project, apply ApplyFunc, opts SyncOptions) (*GitOpsSource, error) {
+	gitopsSync.Lock()
+	defer gitopsSync.Unlock()
+
+	g, err := s.SelectGitOpsSource(p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, diff, desired, err := s.renderSource(ctx, g, p)
+	if opts.DryRun {
+		g.Diff = diff
+		return g, err
+	}
+	if err == nil && !diff.Empty() {
+		err = apply(desired)
+	}
+
+	g.Commit = commit
+	g.Diff = diff
+	now := time.Now().UTC()
+	g.SyncedAt = &now
+	switch {
+	case errors.Is(err, ErrInvalidManifest):
+		g.Status = GitOpsStatusInvalid
+		g.Message = err.Error()
+	case err != nil:
+		g.Status = GitOpsStatusFailed
+		g.Message = err.Error()
+	default:
+		g.Status = GitOpsStatusSynced
+		g.Message = ""
+	}
+	if saveErr := s.saveGitOpsStatus(g); saveErr != nil {
+		return g, saveErr
+	}
+	return g, err
+}
+
+// renderSource checks out the source and returns the commit, the diff of the project to its manifest and the
+// rendered project.
+func (s *S) renderSource(ctx context.Context, g *GitOpsSource, p *Project) (string, *ManifestDiff, *Project, error) {
+	cfg := config.GetConfig()
+
+	if err := os.MkdirAll(cfg.BuildsDir, 0o755); err != nil {
+		return "", nil, nil, err
+	}
+	dir, err := os.MkdirTemp(cfg.BuildsDir, "gitops-")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	commit, err := git.Clone(ctx, g.Repository, g.Ref, src, g.auth(), io.Discard)
+	if err != nil {
+		return "", nil, nil, errors.Wrap(err, "unable to clone repository")
+	}
+
+	b, err := readManifest(src, g.Path)
+	if err != nil {
+		return commit, nil, nil, fmt.Errorf("%w: unable to read %s: %v", ErrInvalidManifest, g.Path, err)
+	}
+	m, err := ParseManifest(b)
+	if err != nil {
+		return commit, nil, nil, err
+	}
+	desired, err := s.Render(m, p)
+	if err != nil {
+		return commit, nil, nil, err
+	}
+	diff, err := DiffProjects(p, desired)
+	if err != nil {
+		return commit, nil, nil, err
+	}
+	return commit, &diff, desired, nil
+}
+
+// readManifest reads the manifest at path within the checkout in src. Symlinks are followed only as long as they
+// stay within src, errors don't contain the location of the checkout as they are shown to users.
+func readManifest(src, path string) ([]byte, error) {
+	root, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return nil, errors.New("checkout not found")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return nil, errors.New("file not found")
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+		return nil, errors.New("file links outside of the repository")
+	}
+	b, err := os.ReadFile(resolved)
+	if err != nil {
+		return nil, errors.New("file not readable")
+	}
+	return b, nil
+}
+
+// SyncChangedSources syncs the projects whose repositories have commits which weren't synced yet and retries
+// failed syncs.
+func (s *S) SyncChangedSources(ctx context.Context, apply ApplyFunc) {
+	sources, err := s.selectGitOpsSources()
+	if err != nil {
+		slog.Error("unable to get gitops sources", "err", err)
+		return
+	}
+	for _, g := range sources {
+		commit, err := git.RemoteCommit(ctx, g.Repository, g.Ref, g.auth())
+		if err != nil {
+			slog.Error("unable to check repository for new commits", "repository", g.Repository, "err", err)
+			continue
+		}
+		// Failed syncs are retried, invalid manifests only once they changed
+		if commit == g.Commit && (g.Status == GitOpsStatusSynced || g.Status == GitOpsStatusInvalid) {
+			continue
+		}
+		p, err := s.SelectProjectByID(g.ProjectID)
+		if err != nil {
+			slog.Error("unable to get project of gitops source", "project_id", g.ProjectID, "err", err)
+			continue
+		}
+		slog.Info("syncing project from repository", "upn", p.UPN, "repository", g.Repository, "commit", commit)
+		if _, err := s.SyncProject(ctx, p, apply, SyncOptions{}); err != nil {
+			slog.Error("unable to sync project", "upn", p.UPN, "err", err)
+		}
+	}
+}
+
+// StartGitOpsPoller syncs projects from their repositories periodically until the context is canceled.
+func (s *S) StartGitOpsPoller(ctx context.Context, apply ApplyFunc) {
+	cfg := config.GetConfig()
+
+	go func() {
+		ticker := time.NewTicker(cfg.GitOpsPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.SyncChangedSources(ctx, apply)
+			}
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/devs-group/sloth/backend/pkg/registry"
+	"github.com/devs-group/sloth/backend/pkg/webhook"
+)
+
+const (
+	HookDeliveryStatusSucceeded = "succeeded"
+	HookDeliveryStatusFailed    = "failed"
+	// HookDeliveryStatusIgnored is used for valid deliveries which don't affect any service
+	HookDeliveryStatusIgnored = "ignored"
+)
+
+// hookDeliveriesToKeep is the number of deliveries which are kept per project
+const hookDeliveriesToKeep = 100
+
+type HookDelivery struct {
+	ID       int        `json:"id" db:"id"`
+	Provider string     `json:"provider" db:"provider"`
+	Event    string     `json:"event" db:"event"`
+	Image    string     `json:"image" db:"image"`
+	Tag      string     `json:"tag" db:"tag"`
+	Services StringList `json:"services" db:"services"`
+	Status   string     `json:"status" db:"status"`
+	// Message contains the error of failed deliveries
+	Message   string    `json:"message" db:"message"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ProjectID int       `json:"-" db:"project_id"`
+}
+
+func (s *S) SaveHookDelivery(d *HookDelivery) error {
+	d.CreatedAt = time.Now().UTC()
+	query := `
+		INSERT INTO hook_deliveries (provider, event, image, tag, services, status, message, created_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	err := s.dbService.GetConn().Get(
+		&d.ID, query, d.Provider, d.Event, d.Image, d.Tag, d.Services, d.Status, d.Message, d.CreatedAt, d.ProjectID,
+	)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM hook_deliveries
+		WHERE project_id = $1 AND id NOT IN (
+			SELECT id FROM hook_deliveries WHERE project_id = $1 ORDER BY id DESC LIMIT $2
+		)
+	`
+	_, err = s.dbService.GetConn().Exec(query, d.ProjectID, hookDeliveriesToKeep)
+	return err
+}
+
+func (s *S) SelectHookDeliveries(projectID int) ([]HookDelivery, error) {
+	deliveries := make([]HookDelivery, 0)
+	query := `
+		SELECT id, provider, event, image, tag, services, status, message, created_at, project_id
+		FROM hook_deliveries
+		WHERE project_id = $1
+		ORDER BY id DESC
+	`
+	if err := s.dbService.GetConn().Select(&deliveries, query, projectID); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// UpdateHookSecret replaces the secret deliveries of the project's hook are signed with.
+func (s *S) UpdateHookSecret(projectID int, secret string) error {
+	res, err := s.dbService.GetConn().Exec(`UPDATE projects SET hook_secret = $1 WHERE id = $2`, secret, projectID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	s.auditProjectByID(projectID, AuditActionHookSecretRotate, "", nil, nil)
+	return nil
+}
+
+// ApplyPushes sets the pushed tags on the services using the pushed images and returns the usns of those services.
+// Services which already run the pushed tag are redeployed, since the tag might point to a new image. Other tags
+// are only followed by services with an update policy which selects them, see registry.Policy.
+func (p *Project) ApplyPushes(pushes []webhook.Push) []string {
+	var usns []string
+	for _, service := range p.Services {
+		repository := registry.Repository(service.Image)
+		for _, push := range pushes {
+			if registry.Repository(push.Image) == repository && service.followsTag(push.Tag) {
+				service.ImageTag = push.Tag
+				service.repin = true
+				usns = append(usns, service.Usn)
+				break
+			}
+		}
+	}
+	return usns
+}
+
+// followsTag reports whether a push of the tag changes the image the service runs.
+func (s *Service) followsTag(tag string) bool {
+	current := s.ImageTag
+	if current == "" {
+		current = "latest"
+	}
+	if tag == current {
+		return true
+	}
+	if s.UpdatePolicy == "" || s.UpdatePolicy == registry.PolicyDigest {
+		return false
+	}
+	selected, err := s.updatePolicy().SelectTag(current, []string{tag})
+	return err == nil && selected == tag
+}
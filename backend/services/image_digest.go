@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/devs-group/sloth/backend/pkg/docker"
+	"github.com/devs-group/sloth/backend/pkg/registry"
+)
+
+// tagDigestTTL is how long the digests of tags in registries are cached for the project state
+const tagDigestTTL = time.Minute
+
+type ImageDigest struct {
+	Usn string `json:"-" db:"usn"`
+	// Image is the image with tag the digest was resolved from
+	Image      string    `json:"image" db:"image"`
+	Digest     string    `json:"digest" db:"digest"`
+	DeployedAt time.Time `json:"deployed_at" db:"deployed_at"`
+	ProjectID  int       `json:"-" db:"project_id"`
+}
+
+type cachedDigest struct {
+	digest    string
+	expiresAt time.Time
+}
+
+var tagDigests = struct {
+	sync.Mutex
+	m map[string]cachedDigest
+}{m: make(map[string]cachedDigest)}
+
+func (s *S) selectImageDigests(projectID int) (map[string]ImageDigest, error) {
+	var rows []ImageDigest
+	query := `SELECT usn, image, digest, deployed_at, project_id FROM service_image_digests WHERE project_id = $1`
+	if err := s.dbService.GetConn().Select(&rows, query, projectID); err != nil {
+		return nil, err
+	}
+	digests := make(map[string]ImageDigest, len(rows))
+	for _, d := range rows {
+		digests[d.Usn] = d
+	}
+	return digests, nil
+}
+
+func (s *S) saveImageDigest(d ImageDigest) error {
+	query := `
+		INSERT INTO service_image_digests (usn, image, digest, deployed_at, project_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (project_id, usn) DO UPDATE
+		SET image = excluded.image, digest = excluded.digest, deployed_at = excluded.deployed_at
+	`
+	_, err := s.dbService.GetConn().Exec(query, d.Usn, d.Image, d.Digest, time.Now().UTC(), d.ProjectID)
+	return err
+}
+
+// RecordImageDigests stores the digests of the pulled images of the services with the usns, of all services if none
+// are given. The compose file is pinned to the recorded digests of services which pin their digest.
+func (s *S) RecordImageDigests(ctx context.Context, p *Project, usns ...string) error {
+	repin := false
+	for _, service := range p.Services {
+		if len(usns) > 0 && !slices.Contains(usns, service.Usn) {
+			continue
+		}
+		container, ok := p.ComposeServices[service.Usn]
+		if !ok {
+			continue
+		}
+		image := fmt.Sprintf("%s:%s", service.Image, service.ImageTag)
+		digest, err := docker.RepoDigest(ctx, container.Image, image)
+		if err != nil {
+			slog.Error("unable to get image digest", "image", image, "err", err)
+			continue
+		}
+		d := ImageDigest{Usn: service.Usn, Image: image, Digest: digest, ProjectID: p.ID}
+		if err := s.saveImageDigest(d); err != nil {
+			return err
+		}
+		service.repin = false
+		if service.PinDigest && container.Image == image {
+			repin = true
+		}
+	}
+
+	if len(usns) == 0 {
+		if err := s.deleteRemovedImageDigests(p); err != nil {
+			return err
+		}
+	}
+
+	if !repin {
+		return nil
+	}
+	dc, err := s.GenerateDockerCompose(p)
+	if err != nil {
+		return err
+	}
+	p.ComposeServices = dc.Services
+	return s.SaveDockerComposeFile(p.UPN, *dc)
+}
+
+// deleteRemovedImageDigests forgets about services which got removed from the project
+func (s *S) deleteRemovedImageDigests(p *Project) error {
+	usns := make([]string, 0, len(p.Services))
+	for _, service := range p.Services {
+		usns = append(usns, service.Usn)
+	}
+	usnJSON, err := json.Marshal(usns)
+	if err != nil {
+		return err
+	}
+	query := `DELETE FROM service_image_digests WHERE project_id = $1 AND usn NOT IN (SELECT value FROM json_each($2))`
+	_, err = s.dbService.GetConn().Exec(query, p.ID, string(usnJSON))
+	return err
+}
+
+// ProjectState returns the state of the containers of the project including drift of their images.
+func (s *S) ProjectState(ctx context.Context, p *Project) (map[string]ContainerState, error) {
+	state, err := p.UPN.GetContainersState()
+	if err != nil {
+		return nil, err
+	}
+	s.AddImageDrift(ctx, p, state)
+	return state, nil
+}
+
+// AddImageDrift resolves the digests the tags of the services point to in their registries and marks the states
+// of services which run another image.
+func (s *S) AddImageDrift(ctx context.Context, p *Project, state map[string]ContainerState) {
+	client := registry.NewClient(registryCredentials(p.DockerCredentials))
+	for _, service := range p.Services {
+		st, ok := state[service.Usn]
+		if !ok || st.Digest == "" {
+			continue
+		}
+		digest, err := tagDigest(ctx, client, service.Image, service.ImageTag)
+		if err != nil {
+			slog.Debug("unable to resolve digest of tag", "image", service.Image, "tag", service.ImageTag, "err", err)
+			continue
+		}
+		st.TagDigest = digest
+		st.Drift = digest != st.Digest
+		state[service.Usn] = st
+	}
+}
+
+func tagDigest(ctx context.Context, client *registry.Client, image, tag string) (string, error) {
+	key := registry.Repository(image) + ":" + tag
+	tagDigests.Lock()
+	cached, ok := tagDigests.m[key]
+	tagDigests.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.digest, nil
+	}
+
+	digest, err := client.Digest(ctx, image, tag)
+	if err != nil {
+		return "", err
+	}
+	tagDigests.Lock()
+	tagDigests.m[key] = cachedDigest{digest: digest, expiresAt: time.Now().Add(tagDigestTTL)}
+	tagDigests.Unlock()
+	return digest, nil
+}
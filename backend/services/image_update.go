@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/registry"
+)
+
+const (
+	ImageUpdateStatusUpdated  = "updated"
+	ImageUpdateStatusUpToDate = "up-to-date"
+	ImageUpdateStatusFailed   = "failed"
+)
+
+// imageUpdateChecksToKeep is the number of checks which are kept per service
+const imageUpdateChecksToKeep = 50
+
+// DeployFunc redeploys the services with the usns of a project after their image changed.
+type DeployFunc func(p *Project, usns []string) error
+
+type ImageUpdateCheck struct {
+	ID         int    `json:"id" db:"id"`
+	Usn        string `json:"usn" db:"usn"`
+	Image      string `json:"image" db:"image"`
+	Policy     string `json:"policy" db:"policy"`
+	CurrentTag string `json:"current_tag" db:"current_tag"`
+	// SelectedTag is the tag chosen by the policy, empty if no tag matches
+	SelectedTag string `json:"selected_tag" db:"selected_tag"`
+	Digest      string `json:"digest" db:"digest"`
+	Status      string `json:"status" db:"status"`
+	// Message contains the error of failed checks
+	Message   string    `json:"message" db:"message"`
+	CheckedAt time.Time `json:"checked_at" db:"checked_at"`
+	ProjectID int       `json:"-" db:"project_id"`
+}
+
+func (s *Service) updatePolicy() registry.Policy {
+	return registry.Policy{Type: s.UpdatePolicy, Constraint: s.UpdateConstraint}
+}
+
+func (s *S) saveImageUpdateCheck(c *ImageUpdateCheck) error {
+	c.CheckedAt = time.Now().UTC()
+	query := `
+		INSERT INTO image_update_checks (usn, image, policy, current_tag, selected_tag, digest, status, message, checked_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`
+	err := s.dbService.GetConn().Get(
+		&c.ID, query, c.Usn, c.Image, c.Policy, c.CurrentTag, c.SelectedTag, c.Digest, c.Status, c.Message, c.CheckedAt, c.ProjectID,
+	)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM image_update_checks
+		WHERE project_id = $1 AND usn = $2 AND id NOT IN (
+			SELECT id FROM image_update_checks WHERE project_id = $1 AND usn = $2 ORDER BY id DESC LIMIT $3
+		)
+	`
+	_, err = s.dbService.GetConn().Exec(query, c.ProjectID, c.Usn, imageUpdateChecksToKeep)
+	return err
+}
+
+// SelectImageUpdateChecks returns the check history of a service, the latest first.
+func (s *S) SelectImageUpdateChecks(projectID int, usn string) ([]ImageUpdateCheck, error) {
+	checks := make([]ImageUpdateCheck, 0)
+	query := `
+		SELECT id, usn, image, policy, current_tag, selected_tag, digest, status, message, checked_at, project_id
+		FROM image_update_checks
+		WHERE project_id = $1 AND usn = $2
+		ORDER BY id DESC
+	`
+	if err := s.dbService.GetConn().Select(&checks, query, projectID, usn); err != nil {
+		return nil, err
+	}
+	return checks, nil
+}
+
+func (s *S) selectLatestImageUpdateChecks(projectID int) (map[string]ImageUpdateCheck, error) {
+	var rows []ImageUpdateCheck
+	query := `
+		SELECT id, usn, image, policy, current_tag, selected_tag, digest, status, message, checked_at, project_id
+		FROM image_update_checks
+		WHERE id IN (SELECT MAX(id) FROM image_update_checks WHERE project_id = $1 GROUP BY usn)
+	`
+	if err := s.dbService.GetConn().Select(&rows, query, projectID); err != nil {
+		return nil, err
+	}
+	checks := make(map[string]ImageUpdateCheck, len(rows))
+	for _, c := range rows {
+		checks[c.Usn] = c
+	}
+	return checks, nil
+}
+
+// lastImageDigest returns the digest of the last successful check of a service.
+func (s *S) lastImageDigest(projectID int, usn, tag string) (string, error) {
+	var digest string
+	query := `
+		SELECT digest FROM image_update_checks
+		WHERE project_id = $1 AND usn = $2 AND selected_tag = $3 AND digest != '' AND status != $4
+		ORDER BY id DESC LIMIT 1
+	`
+	err := s.dbService.GetConn().Get(&digest, query, projectID, usn, tag, ImageUpdateStatusFailed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return digest, err
+}
+
+func registryCredentials(credentials []DockerCredential) map[string]registry.Credentials {
+	creds := make(map[string]registry.Credentials, len(credentials))
+	for _, dc := range credentials {
+		creds[registry.NormalizeDomain(dc.Registry)] = registry.Credentials{Username: dc.Username, Password: dc.Password}
+	}
+	return creds
+}
+
+// CheckImageUpdates queries the registries for new images of the services with an update policy.
+// Services get the tag selected by their policy, their usns are returned if they need to be redeployed
+// because the tag changed or points to a new digest. The checks aren't saved.
+func (s *S) CheckImageUpdates(ctx context.Context, p *Project) ([]*ImageUpdateCheck, []string) {
+	client := registry.NewClient(registryCredentials(p.DockerCredentials))
+
+	var checks []*ImageUpdateCheck
+	var usns []string
+	for _, service := range p.Services {
+		if service.UpdatePolicy == "" {
+			continue
+		}
+		check := &ImageUpdateCheck{
+			Usn:        service.Usn,
+			Image:      service.Image,
+			Policy:     service.UpdatePolicy,
+			CurrentTag: service.ImageTag,
+			ProjectID:  p.ID,
+		}
+		checks = append(checks, check)
+
+		updated, err := s.checkImageUpdate(ctx, client, service, check)
+		if err != nil {
+			check.Status = ImageUpdateStatusFailed
+			check.Message = err.Error()
+			continue
+		}
+		if updated {
+			check.Status = ImageUpdateStatusUpdated
+			service.ImageTag = check.SelectedTag
+			service.repin = true
+			usns = append(usns, service.Usn)
+		} else {
+			check.Status = ImageUpdateStatusUpToDate
+		}
+	}
+	return checks, usns
+}
+
+func (s *S) checkImageUpdate(ctx context.Context, client *registry.Client, service *Service, check *ImageUpdateCheck) (bool, error) {
+	policy := service.updatePolicy()
+	var tags []string
+	if policy.Type != registry.PolicyDigest {
+		var err error
+		if tags, err = client.Tags(ctx, service.Image); err != nil {
+			return false, err
+		}
+	}
+	selected, err := policy.SelectTag(service.ImageTag, tags)
+	if err != nil {
+		return false, err
+	}
+	if selected == "" {
+		check.Message = "no tag matches the policy"
+		return false, nil
+	}
+	check.SelectedTag = selected
+
+	check.Digest, err = client.Digest(ctx, service.Image, selected)
+	if err != nil {
+		return false, err
+	}
+	if selected != service.ImageTag {
+		return true, nil
+	}
+
+	// The tag is the same, but it might point to a new image. The first digest is only recorded.
+	previous, err := s.lastImageDigest(check.ProjectID, service.Usn, selected)
+	if err != nil {
+		return false, err
+	}
+	return previous != "" && previous != check.Digest, nil
+}
+
+// UpdateProjectImages checks the services of the project for new images, deploys those and saves the checks.
+func (s *S) UpdateProjectImages(ctx context.Context, p *Project, deploy DeployFunc) ([]*ImageUpdateCheck, error) {
+	checks, usns := s.CheckImageUpdates(ctx, p)
+	if len(usns) > 0 {
+		if err := deploy(p, usns); err != nil {
+			slog.Error("unable to deploy updated images", "upn", p.UPN, "usns", usns, "err", err)
+			for _, c := range checks {
+				if c.Status == ImageUpdateStatusUpdated {
+					c.Status = ImageUpdateStatusFailed
+					c.Message = err.Error()
+				}
+			}
+		}
+	}
+
+	for _, c := range checks {
+		if err := s.saveImageUpdateCheck(c); err != nil {
+			return nil, err
+		}
+	}
+	return checks, nil
+}
+
+// CheckAllImageUpdates updates the images of all projects with services that have an update policy.
+func (s *S) CheckAllImageUpdates(ctx context.Context, deploy DeployFunc) error {
+	var projectIDs []int
+	query := `SELECT DISTINCT project_id FROM services WHERE update_policy != ''`
+	if err := s.dbService.GetConn().Select(&projectIDs, query); err != nil {
+		return err
+	}
+	for _, id := range projectIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p, err := s.SelectProjectByID(id)
+		if err != nil {
+			slog.Error("unable to get project for image updates", "id", id, "err", err)
+			continue
+		}
+		if _, err := s.UpdateProjectImages(ctx, p, deploy); err != nil {
+			slog.Error("unable to check image updates of project", "upn", p.UPN, "err", err)
+		}
+	}
+	return nil
+}
+
+// StartImageUpdateScheduler polls the registries periodically until the context is canceled.
+func (s *S) StartImageUpdateScheduler(ctx context.Context, deploy DeployFunc) {
+	cfg := config.GetConfig()
+
+	go func() {
+		ticker := time.NewTicker(cfg.ImageUpdateCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.CheckAllImageUpdates(ctx, deploy); err != nil {
+					slog.Error("unable to check image updates", "err", err)
+				}
+			}
+		}
+	}()
+}
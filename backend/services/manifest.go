@@ -0,0 +1,294 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Manifest is the declarative definition of a project which is kept in a repository, see GitOpsSource.
+// Registry credentials aren't part of it, they are kept in the project.
+type Manifest struct {
+	Name          string            `json:"name"`
+	SharedVolumes []string          `json:"shared_volumes"`
+	Services      []ManifestService `json:"services"`
+}
+
+// ManifestService is a service of a manifest. Unlike services of the API, services depend on others by name.
+type ManifestService struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Tag     string   `json:"tag"`
+	Command string   `json:"command"`
+	Ports   []string `json:"ports"`
+	// Env are the env vars by key
+	Env         map[string]string            `json:"env"`
+	Volumes     []Volume                     `json:"volumes"`
+	Public      Public                       `json:"public"`
+	HealthCheck *compose.HealthCheck         `json:"healthcheck"`
+	DependsOn   map[string]compose.Condition `json:"depends_on"`
+	Deploy      *compose.Deploy              `json:"deploy"`
+
+	VolumeLimitBytes     int64        `json:"volume_limit_bytes"`
+	BlockDeployOverLimit bool         `json:"block_deploy_over_limit"`
+	UpdatePolicy         string       `json:"update_policy"`
+	UpdateConstraint     string       `json:"update_constraint"`
+	PinDigest            bool         `json:"pin_digest"`
+	Build                *BuildSource `json:"build"`
+	// EnvGroups are the names of the env groups of the organisation the service uses
+	EnvGroups []string `json:"env_groups"`
+}
+
+// ManifestDiff are the changes of a project by a manifest, services are listed by name.
+type ManifestDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	// Project lists the changed settings of the project itself, e.g. "name" or "shared_volumes"
+	Project []string `json:"project"`
+}
+
+func (d ManifestDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Project) == 0
+}
+
+// ParseManifest parses a manifest in YAML or JSON. Unknown fields are rejected, as they are most likely typos.
+func ParseManifest(b []byte) (*Manifest, error) {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(j))
+	decoder.DisallowUnknownFields()
+	var m Manifest
+	if err := decoder.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	return &m, nil
+}
+
+func (m *Manifest) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(m.Services) == 0 {
+		return fmt.Errorf("at least one service is required")
+	}
+	names := make(map[string]bool, len(m.Services))
+	for _, service := range m.Services {
+		if service.Name == "" {
+			return fmt.Errorf("services require a name")
+		}
+		if names[service.Name] {
+			return fmt.Errorf("service %q is defined twice", service.Name)
+		}
+		names[service.Name] = true
+		if service.Build == nil && (service.Image == "" || service.Tag == "") {
+			return fmt.Errorf("service %q requires an image and tag or a build", service.Name)
+		}
+		if service.Public.Enabled && service.Public.Port == "" {
+			return fmt.Errorf("public service %q requires a port", service.Name)
+		}
+	}
+	for _, service := range m.Services {
+		for name := range service.DependsOn {
+			if !names[name] || name == service.Name {
+				return fmt.Errorf("service %q depends on unknown service %q", service.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Render turns the manifest into the project it describes. The project keeps its identity and registry credentials,
+// services keep their usns by name, new services get new ones. The rendered project is validated like deployments.
+func (s *S) Render(m *Manifest, current *Project) (*Project, error) {
+	p := &Project{
+		ID:                  current.ID,
+		UPN:                 current.UPN,
+		HookSecret:          current.HookSecret,
+		Name:                m.Name,
+		OrganisationID:      current.OrganisationID,
+		Path:                current.Path,
+		RegistryCredentials: current.RegistryCredentials,
+		DockerCredentials:   current.DockerCredentials,
+	}
+	for _, name := range m.SharedVolumes {
+		p.SharedVolumes = append(p.SharedVolumes, SharedVolume{Name: name})
+	}
+
+	usns := make(map[string]string, len(m.Services))
+	currentServices := make(map[string]*Service, len(current.Services))
+	for _, service := range current.Services {
+		usns[service.Name] = service.Usn
+		currentServices[service.Name] = service
+	}
+	for _, service := range m.Services {
+		if _, ok := usns[service.Name]; !ok {
+			usns[service.Name] = utils.GenerateRandomName()
+		}
+	}
+
+	for _, ms := range m.Services {
+		service := &Service{
+			Name:                 ms.Name,
+			Usn:                  usns[ms.Name],
+			Image:                ms.Image,
+			ImageTag:             ms.Tag,
+			Command:              ms.Command,
+			Ports:                ms.Ports,
+			Volumes:              ms.Volumes,
+			Public:               ms.Public,
+			HealthCheck:          ms.HealthCheck,
+			Deploy:               ms.Deploy,
+			VolumeLimitBytes:     ms.VolumeLimitBytes,
+			BlockDeployOverLimit: ms.BlockDeployOverLimit,
+			UpdatePolicy:         ms.UpdatePolicy,
+			UpdateConstraint:     ms.UpdateConstraint,
+			PinDigest:            ms.PinDigest,
+			Build:                ms.Build,
+			EnvGroups:            ms.EnvGroups,
+		}
+		keys := make([]string, 0, len(ms.Env))
+		for key := range ms.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			service.EnvVars = append(service.EnvVars, []string{key, ms.Env[key]})
+		}
+		// Secrets aren't kept in repositories, services keep the ones of the project as well as the values which
+		// were generated already
+		if c, ok := currentServices[ms.Name]; ok {
+			env := c.secretEnv()
+			for _, key := range c.SecretEnvVars {
+				value, ok := ms.Env[key]
+				if !ok {
+					service.EnvVars = append(service.EnvVars, []string{key, env[key]})
+					service.SecretEnvVars = append(service.SecretEnvVars, key)
+				} else if strings.Contains(value, "${random:") {
+					i := slices.IndexFunc(service.EnvVars, func(ev []string) bool { return ev[0] == key })
+					service.EnvVars[i] = []string{key, env[key]}
+					service.SecretEnvVars = append(service.SecretEnvVars, key)
+				}
+			}
+		}
+		if len(ms.DependsOn) > 0 {
+			service.Depends = make(map[string]compose.Condition, len(ms.DependsOn))
+			for name, condition := range ms.DependsOn {
+				service.Depends[usns[name]] = condition
+			}
+		}
+		p.Services = append(p.Services, service)
+	}
+
+	if _, err := s.GenerateDockerCompose(p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	return p, nil
+}
+
+// DiffProjects returns the changes from the current project to the desired one. Services are compared by the
+// containers they generate and their settings which aren't part of those.
+func DiffProjects(current, desired *Project) (ManifestDiff, error) {
+	diff := ManifestDiff{Added: []string{}, Removed: []string{}, Changed: []string{}, Project: []string{}}
+	if current.Name != desired.Name {
+		diff.Project = append(diff.Project, "name")
+	}
+	if !slices.Equal(sharedVolumeNames(current.SharedVolumes), sharedVolumeNames(desired.SharedVolumes)) {
+		diff.Project = append(diff.Project, "shared_volumes")
+	}
+
+	currentServices := make(map[string]*Service, len(current.Services))
+	for _, service := range current.Services {
+		currentServices[service.Name] = service
+	}
+	desiredNames := make(map[string]bool, len(desired.Services))
+	for _, service := range desired.Services {
+		desiredNames[service.Name] = true
+		c, ok := currentServices[service.Name]
+		if !ok {
+			diff.Added = append(diff.Added, service.Name)
+			continue
+		}
+		changed, err := serviceChanged(c, service)
+		if err != nil {
+			return diff, err
+		}
+		if changed {
+			diff.Changed = append(diff.Changed, service.Name)
+		}
+	}
+	for _, service := range current.Services {
+		if !desiredNames[service.Name] {
+			diff.Removed = append(diff.Removed, service.Name)
+		}
+	}
+	return diff, nil
+}
+
+func serviceChanged(current, desired *Service) (bool, error) {
+	a, err := serviceFingerprint(current)
+	if err != nil {
+		return false, err
+	}
+	b, err := serviceFingerprint(desired)
+	if err != nil {
+		return false, err
+	}
+	return a != b, nil
+}
+
+func serviceFingerprint(service *Service) (string, error) {
+	container, _, err := generateServiceCompose(service)
+	if err != nil {
+		return "", err
+	}
+	// The order of env vars doesn't matter
+	environment := slices.Clone(container.Environment)
+	sort.Strings(environment)
+	container.Environment = environment
+	// Stored services without env groups have an empty list, rendered ones none
+	envGroups := []string(service.EnvGroups)
+	if len(envGroups) == 0 {
+		envGroups = nil
+	}
+	b, err := json.Marshal(struct {
+		Container            *compose.Container
+		SecretEnv            map[string]string
+		VolumeLimitBytes     int64
+		BlockDeployOverLimit bool
+		UpdatePolicy         string
+		UpdateConstraint     string
+		PinDigest            bool
+		Build                *BuildSource
+		EnvGroups            []string
+	}{
+		container, service.secretEnv(), service.VolumeLimitBytes, service.BlockDeployOverLimit, service.UpdatePolicy,
+		service.UpdateConstraint, service.PinDigest, service.Build, envGroups,
+	})
+	return string(b), err
+}
+
+func sharedVolumeNames(volumes []SharedVolume) []string {
+	names := make([]string, 0, len(volumes))
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	return names
+}
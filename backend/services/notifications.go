@@ -9,6 +9,8 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+const NotificationTypeSystem = "system"
+
 type Notification struct {
 	ID               int       `json:"id" db:"id"`
 	Subject          string    `json:"subject" db:"subject"`
@@ -23,7 +25,7 @@ func (s *S) CreateNotification(payload Notification, tx *sqlx.Tx) error {
 		INSERT INTO notifications (subject, content, notification_type, user_id) 
 		VALUES ($1, $2, $3, $4);
 	`
-	_, err := tx.Exec(query, payload.Subject, payload.Content, payload.UserID, payload.NotificationType)
+	_, err := tx.Exec(query, payload.Subject, payload.Content, payload.NotificationType, payload.UserID)
 	if err != nil {
 		slog.Error("Unable to store notification", "err", err)
 		return err
@@ -46,7 +48,8 @@ func (s *S) GetNotifications(userID string, tx *sqlx.Tx) ([]Notification, error)
         notifications n
     JOIN users u ON u.user_id = $1
     WHERE
-        n.user_id = u.email;
+        n.user_id = u.user_id
+    ORDER BY n.created_at DESC;
     `
 
 	var notifications []Notification
@@ -61,3 +64,26 @@ func (s *S) GetNotifications(userID string, tx *sqlx.Tx) ([]Notification, error)
 
 	return notifications, nil
 }
+
+// NotifyOrganisationMembers stores a system notification for every member of the organisation.
+func (s *S) NotifyOrganisationMembers(organisationID, subject, content string) error {
+	return s.WithTransaction(func(tx *sqlx.Tx) error {
+		var userIDs []int
+		query := `SELECT user_id FROM organisation_members WHERE organisation_id = $1`
+		if err := tx.Select(&userIDs, query, organisationID); err != nil {
+			return err
+		}
+		for _, userID := range userIDs {
+			err := s.CreateNotification(Notification{
+				Subject:          subject,
+				Content:          content,
+				NotificationType: NotificationTypeSystem,
+				UserID:           userID,
+			}, tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
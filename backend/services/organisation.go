@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -32,6 +34,7 @@ func (s *S) CreateOrganisation(o models.Organisation, userID string) (*models.Or
 	if err != nil {
 		return nil, fmt.Errorf("unable to insert organisation or it's member: %w", err)
 	}
+	s.audit(organisation.ID, AuditActionOrganisationCreate, organisation.Name, nil, map[string]any{"name": organisation.Name})
 	return &organisation, nil
 }
 
@@ -48,7 +51,7 @@ func (s *S) DeleteOrganisation(userID string, organisationID int) error {
 			AND organisation_members.role = 'owner'
 		);
 	`
-	res, err := s.dbService.GetConn().Exec(query, organisationID, organisationID)
+	res, err := s.dbService.GetConn().Exec(query, organisationID, userID)
 	if err != nil {
 		return fmt.Errorf("failed to execute delete query for user with id %s and orga id %d: %w", userID, organisationID, err)
 	}
@@ -59,6 +62,7 @@ func (s *S) DeleteOrganisation(userID string, organisationID int) error {
 	if rowsAffected != 1 {
 		return fmt.Errorf("unexpected number of rows affected, expected 1 but got %d for user %s", rowsAffected, userID)
 	}
+	s.audit(organisationID, AuditActionOrganisationDelete, strconv.Itoa(organisationID), nil, nil)
 	return nil
 }
 
@@ -67,7 +71,7 @@ func (s *S) DeleteOrganisation(userID string, organisationID int) error {
 func (s *S) SelectOrganisations(userID string) ([]models.Organisation, error) {
 	var organisations []models.Organisation
 	query := `
-		SELECT o.id, o.name, o.is_default, om.user_id = $1 as is_owner
+		SELECT o.id, o.name, o.is_default, om.role = 'owner' as is_owner
 		FROM organisations o
 		JOIN organisation_members om ON o.id = om.organisation_id
 		WHERE om.user_id = $1
@@ -96,7 +100,7 @@ func (s *S) GetOrganisation(orgID int, userID string) (*models.Organisation, err
 		}
 
 		orgQuery := `
-			SELECT o.id, o.name, o.is_default, u.user_id, u.email, u.username
+			SELECT o.id, o.name, om.role, u.user_id, u.email, u.username
 			FROM organisations o
 			INNER JOIN organisation_members om ON om.organisation_id = o.id
 			INNER JOIN users u ON om.user_id = u.user_id
@@ -113,12 +117,12 @@ func (s *S) GetOrganisation(orgID int, userID string) (*models.Organisation, err
 		isOwner := false
 
 		for rows.Next() {
-			var ownerID string
-			if err := rows.Scan(&organisation.ID, &organisation.Name, &ownerID, &organisationMember.UserID, &organisationMember.Email, &organisationMember.UserName); err != nil {
+			if err := rows.Scan(&organisation.ID, &organisation.Name, &organisationMember.Role, &organisationMember.UserID, &organisationMember.Email, &organisationMember.UserName); err != nil {
 				return fmt.Errorf("failed to scan organisation data: %w", err)
 			}
+			organisationMember.OrganisationID = organisation.ID
 			organisationMembers = append(organisationMembers, organisationMember)
-			if ownerID == userID {
+			if strconv.Itoa(organisationMember.UserID) == userID && organisationMember.Role == RoleOwner {
 				isOwner = true
 			}
 		}
@@ -139,23 +143,40 @@ func (s *S) GetOrganisation(orgID int, userID string) (*models.Organisation, err
 	return &organisation, nil
 }
 
-func (s *S) DeleteMember(ownerID, memberID, organisationID string) error {
-	query := `
-		DELETE FROM organisation_members
-		WHERE user_id = $1 AND organisation_id = $3
-		AND user_id <> $2
-	`
-	res, err := s.dbService.GetConn().Exec(query, memberID, ownerID, organisationID)
-	if err != nil {
-		return fmt.Errorf("failed to delete member: %w", err)
-	}
-	rowsAffected, err := res.RowsAffected()
+// DeleteMember removes the member from the organisation, users can't remove themselves. Owners can only be removed
+// by owners and the last owner can't be removed.
+func (s *S) DeleteMember(userID, memberID string, organisationID int) error {
+	var role string
+	err := s.WithTransaction(func(tx *sqlx.Tx) error {
+		var err error
+		if role, err = memberRole(tx, organisationID, memberID); err != nil {
+			return err
+		}
+		if err := canRemoveMember(tx, organisationID, userID, memberID); err != nil {
+			return err
+		}
+		query := `
+			DELETE FROM organisation_members
+			WHERE user_id = $1 AND organisation_id = $3
+			AND user_id <> $2
+		`
+		res, err := tx.Exec(query, memberID, userID, organisationID)
+		if err != nil {
+			return fmt.Errorf("failed to delete member: %w", err)
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("expected to delete 1 member from organisation '%d', but deleted %d", organisationID, rowsAffected)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
-	if rowsAffected != 1 {
-		return fmt.Errorf("expected to delete 1 member from organisation '%s', but deleted %d", organisationID, rowsAffected)
+		return err
 	}
+	s.audit(organisationID, AuditActionMemberRemove, memberID, map[string]any{"role": role}, nil)
 	return nil
 }
 
@@ -184,28 +205,68 @@ func (s *S) CreateOrganisationInvitation(newMemberEmail string, organisationID i
 	} else if rem != 1 {
 		return fmt.Errorf("expected to add 1 member to organisation with id '%d', but added %d", organisationID, rem)
 	}
+	s.audit(organisationID, AuditActionInvitationCreate, newMemberEmail, nil, map[string]any{"email": newMemberEmail, "valid_until": validUntil})
 	return nil
 }
 
+// PutMember adds the user as member to the organisation, which requires a valid invitation for the email of the
+// user. The invitations of the user to the organisation are consumed.
 func (s *S) PutMember(newMemberID string, organisationID int) error {
-	query := `
-		INSERT INTO organisation_members(organisation_id, user_id, role)
-		SELECT organisation_id, $1, $2
-		FROM organisation_invitations oi
-		JOIN organisations o ON o.id = oi.organisation_id
-		WHERE o.id = $2;
-	`
-	res, err := s.dbService.GetConn().Exec(query, newMemberID, "member", organisationID)
+	cfg := config.GetConfig()
+
+	err := s.WithTransaction(func(tx *sqlx.Tx) error {
+		var validUntil []time.Time
+		q := `
+			DELETE FROM organisation_invitations
+			WHERE organisation_id = $2
+			AND lower(email) = (SELECT lower(email) FROM users WHERE user_id = $1)
+			RETURNING valid_until
+		`
+		if err := tx.Select(&validUntil, q, newMemberID, organisationID); err != nil {
+			return fmt.Errorf("unable to delete invitations of user %s: %w", newMemberID, err)
+		}
+		valid := slices.ContainsFunc(validUntil, func(t time.Time) bool {
+			return time.Since(t) <= cfg.EmailInvitationMaxValid
+		})
+		if !valid {
+			return ErrNoInvitation
+		}
+		q = `INSERT INTO organisation_members(organisation_id, user_id, role) VALUES ($1, $2, $3)`
+		if _, err := tx.Exec(q, organisationID, newMemberID, RoleMember); err != nil {
+			return fmt.Errorf("unable to insert organisation member: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	affected, err := res.RowsAffected()
+	s.audit(organisationID, AuditActionMemberJoin, newMemberID, nil, map[string]any{"role": RoleMember})
+	return nil
+}
+
+// LeaveOrganisation removes the user from the organisation. The last owner of an organisation can't leave it.
+func (s *S) LeaveOrganisation(userID string, organisationID int) error {
+	var role string
+	err := s.WithTransaction(func(tx *sqlx.Tx) error {
+		var err error
+		if role, err = memberRole(tx, organisationID, userID); err != nil {
+			return err
+		}
+		if role == RoleOwner {
+			if err := ensureOtherOwner(tx, organisationID, userID); err != nil {
+				return err
+			}
+		}
+		query := `DELETE FROM organisation_members WHERE user_id = $1 AND organisation_id = $2`
+		if _, err := tx.Exec(query, userID, organisationID); err != nil {
+			return fmt.Errorf("failed to leave organisation: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	if affected != 1 {
-		return fmt.Errorf("expected to add 1 member to organisation '%d', but added %d", organisationID, affected)
-	}
+	s.audit(organisationID, AuditActionMemberLeave, userID, map[string]any{"role": role}, nil)
 	return nil
 }
 
@@ -235,6 +296,7 @@ func (s *S) WithdrawInvitation(email string, organisationID int) error {
 	} else if rem != 1 {
 		return fmt.Errorf("expected to delete 1 invitation from organisations '%d', but deleted %d", organisationID, rem)
 	}
+	s.audit(organisationID, AuditActionInvitationWithdraw, email, map[string]any{"email": email}, nil)
 	return nil
 }
 
@@ -242,7 +304,7 @@ func (s *S) CheckIsMemberOfOrganisation(userEmail string, organisationID int) bo
 	query := `SELECT 1 FROM organisation_members om
 			  JOIN organisations o ON o.id = om.organisation_id
 			  LEFT JOIN users u ON om.user_id = u.user_id
-			  WHERE u.email = $1 AND o.id = $2;`
+			  WHERE lower(u.email) = lower($1) AND o.id = $2;`
 	isMemberOfSomeOrganisation := false
 	_ = s.dbService.GetConn().Get(&isMemberOfSomeOrganisation, query, userEmail, organisationID)
 	return isMemberOfSomeOrganisation
@@ -264,6 +326,7 @@ func (s *S) GetInvitation(email, token string) (*models.Invitation, error) {
 func (s *S) AcceptInvitation(userID, email, token string) (bool, error) {
 	cfg := config.GetConfig()
 
+	var organisationID int
 	err := s.WithTransaction(func(tx *sqlx.Tx) error {
 		var accept models.AcceptInvite
 		q := `SELECT valid_until, organisation_id FROM organisation_invitations WHERE email = $1 AND invitation_token = $2`
@@ -291,11 +354,13 @@ func (s *S) AcceptInvitation(userID, email, token string) (bool, error) {
 		if ins != 1 {
 			return fmt.Errorf("unable to insert multiple users to organisations")
 		}
+		organisationID = accept.OrganisationID
 		return nil
 	})
 	if err != nil {
 		return false, err
 	}
+	s.audit(organisationID, AuditActionMemberJoin, userID, nil, map[string]any{"email": email, "role": RoleMember})
 	return true, nil
 }
 
@@ -303,7 +368,9 @@ func (s *S) GetProjectsByOrganisationID(organisationID int) ([]models.Organisati
 	projects := make([]models.OrganisationProjects, 0)
 	q := `SELECT DISTINCT p.unique_name, p.name, p.id
 	FROM projects p
-	WHERE p.organisation_id = $1;
+	WHERE p.organisation_id = $1
+		AND p.id NOT IN (SELECT project_id FROM preview_environments)
+		AND p.id NOT IN (SELECT project_id FROM project_environments);
     `
 	err := s.dbService.GetConn().Select(&projects, q, organisationID)
 	if err != nil {
@@ -315,15 +382,37 @@ func (s *S) GetProjectsByOrganisationID(organisationID int) ([]models.Organisati
 	return projects, nil
 }
 
-func (s *S) AddProjectToOrganisationByUPN(organisationID int, upn string) error {
-	q := `
-		UPDATE projects
-		SET organisation_id = $1
-		WHERE unique_name = $2
-	`
-	_, err := s.dbService.GetConn().Exec(q, organisationID, upn)
+// AddProjectToOrganisationByUPN moves the project to the organisation. The user needs to be allowed to move
+// the projects of its current organisation.
+func (s *S) AddProjectToOrganisationByUPN(userID string, organisationID int, upn string) error {
+	var currentOrganisationID int
+	err := s.WithTransaction(func(tx *sqlx.Tx) error {
+		q := `SELECT organisation_id FROM projects WHERE unique_name = $1`
+		if err := tx.Get(&currentOrganisationID, q, upn); err != nil {
+			return err
+		}
+		if err := authorize(tx, currentOrganisationID, userID, PermissionProjectCreate); err != nil {
+			return err
+		}
+		q = `
+			UPDATE projects
+			SET organisation_id = $1
+			WHERE unique_name = $2
+		`
+		if _, err := tx.Exec(q, organisationID, upn); err != nil {
+			return errors.Join(err, fmt.Errorf("can't add project your not owner or this project does not exist"))
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.Join(err, fmt.Errorf("can't add project your not owner or this project does not exist"))
+		return err
+	}
+	// The move is recorded in both organisations
+	before := map[string]any{"organisation_id": currentOrganisationID}
+	after := map[string]any{"organisation_id": organisationID}
+	s.audit(currentOrganisationID, AuditActionProjectMove, upn, before, after)
+	if currentOrganisationID != organisationID {
+		s.audit(organisationID, AuditActionProjectMove, upn, before, after)
 	}
 	return nil
 }
@@ -344,5 +433,20 @@ func (s *S) RemoveProjectFromOrganisation(organisationID int, upn string) error
 	} else if rem != 1 {
 		return fmt.Errorf("expected to remove 1 project from organisation with ID '%d', but deleted %d", organisationID, rem)
 	}
+	s.audit(organisationID, AuditActionProjectMove, upn, map[string]any{"organisation_id": organisationID}, map[string]any{"organisation_id": nil})
 	return nil
 }
+
+// OrganisationRole returns the role of the user in the organisation, sql.ErrNoRows if the user isn't a member.
+func (s *S) OrganisationRole(organisationID int, userID string) (string, error) {
+	return memberRole(s.dbService.GetConn(), organisationID, userID)
+}
+
+func memberRole(db sqlx.Queryer, organisationID int, userID string) (string, error) {
+	var role string
+	query := `SELECT role FROM organisation_members WHERE organisation_id = $1 AND user_id = $2`
+	if err := sqlx.Get(db, &role, query, organisationID, userID); err != nil {
+		return "", err
+	}
+	return role, nil
+}
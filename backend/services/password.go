@@ -0,0 +1,385 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/devs-group/sloth/backend/config"
+)
+
+// AuthMethodEmailPassword is the auth method of local accounts, which have a password instead of a social ID.
+const AuthMethodEmailPassword = "email_password"
+
+// Purposes of the tokens sent by email
+const (
+	AuthTokenPurposeEmailVerification = "email_verification"
+	AuthTokenPurposePasswordReset     = "password_reset"
+)
+
+const (
+	PasswordMinLength = 8
+	// bcrypt only hashes the first 72 bytes
+	PasswordMaxLength = 72
+)
+
+var ErrInvalidCredentials = errors.New("invalid email or password")
+var ErrEmailNotVerified = errors.New("email is not verified")
+var ErrEmailTaken = errors.New("email is already registered")
+var ErrInvalidEmail = errors.New("invalid email")
+var ErrInvalidPassword = fmt.Errorf("password needs %d to %d characters", PasswordMinLength, PasswordMaxLength)
+
+// LoginRateLimitError is returned when there were too many failed logins for an email or from a client.
+type LoginRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginRateLimitError) Error() string {
+	return fmt.Sprintf("too many attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// SignUpWithPassword creates a user with an unverified email and its default organisation. It returns the token
+// to verify the email with, or ErrEmailTaken for registered emails. Their users set a password with the password
+// reset instead, the sign-up must not tell them apart from new ones.
+func SignUpWithPassword(email, username, password string, tx *sqlx.Tx) (*User, string, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, "", err
+	}
+	// Hash first, so registered emails take as long as new ones
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, "", err
+	}
+	var exists bool
+	if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE lower(email) = $1)`, email); err != nil {
+		return nil, "", errors.Wrap(err, "can't select existing user")
+	}
+	if exists {
+		return nil, "", ErrEmailTaken
+	}
+	ids, err := createUser(email, username, false, tx)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `INSERT INTO auth_methods( user_id, method_type, password_hash ) VALUES ( $1, $2, $3 );`
+	if _, err := tx.Exec(query, ids.UserID, AuthMethodEmailPassword, hash); err != nil {
+		return nil, "", errors.Wrap(err, "can't insert auth method")
+	}
+	token, err := createAuthToken(ids.UserID, AuthTokenPurposeEmailVerification, config.GetConfig().EmailVerificationMaxValid, tx)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := getUserByID(ids.UserID, tx)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, token, nil
+}
+
+// AuthenticatePassword returns the user of the email if the password matches. Failed attempts are limited per email
+// and client IP, see config.LoginMaxAttempts. Users need to verify their email before they can log in.
+func AuthenticatePassword(email, password, clientIP string, tx *sqlx.Tx) (*User, error) {
+	cfg := config.GetConfig()
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	emailKey, clientKey := "login:"+email, "login-client:"+clientIP
+	if err := loginAttempts.check(emailKey, cfg.LoginMaxAttempts, cfg.LoginAttemptWindow); err != nil {
+		return nil, err
+	}
+	if err := loginAttempts.check(clientKey, cfg.LoginMaxAttempts*4, cfg.LoginAttemptWindow); err != nil {
+		return nil, err
+	}
+
+	var account struct {
+		User
+		PasswordHash string `db:"password_hash"`
+	}
+	query := `
+		SELECT u.*, am.password_hash
+		FROM users u
+		JOIN auth_methods am ON am.user_id = u.user_id
+		WHERE lower(u.email) = $1 AND am.method_type = $2
+	`
+	err = tx.Get(&account, query, email, AuthMethodEmailPassword)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrap(err, "can't select user")
+	}
+	if err != nil {
+		// Take as long as for existing users, so emails can't be told apart by the response time
+		_ = bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		loginAttempts.fail(emailKey, clientKey)
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		loginAttempts.fail(emailKey, clientKey)
+		return nil, ErrInvalidCredentials
+	}
+	loginAttempts.reset(emailKey)
+	if !account.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	return &account.User, nil
+}
+
+// CreateEmailVerification returns a new token to verify the email of a local account with, which invalidates
+// earlier ones. The user is nil if the email has no unverified local account.
+func CreateEmailVerification(email string, tx *sqlx.Tx) (*User, string, error) {
+	query := `
+		SELECT u.*
+		FROM users u
+		JOIN auth_methods am ON am.user_id = u.user_id
+		WHERE lower(u.email) = $1 AND am.method_type = $2 AND NOT u.email_verified
+	`
+	cfg := config.GetConfig()
+	return createAuthTokenForEmail(email, AuthTokenPurposeEmailVerification, cfg.EmailVerificationMaxValid, tx, query, AuthMethodEmailPassword)
+}
+
+// CreatePasswordReset returns a new token to set the password of the email's user with, which invalidates earlier
+// ones. This also works for users who only logged in with a provider so far. The user is nil if the email is unknown.
+func CreatePasswordReset(email string, tx *sqlx.Tx) (*User, string, error) {
+	query := `SELECT * FROM users WHERE lower(email) = $1 AND NOT is_service_account`
+	cfg := config.GetConfig()
+	return createAuthTokenForEmail(email, AuthTokenPurposePasswordReset, cfg.PasswordResetMaxValid, tx, query)
+}
+
+// VerifyEmail marks the email of the token's user as verified.
+func VerifyEmail(token string, tx *sqlx.Tx) (*User, error) {
+	userID, err := consumeAuthToken(token, AuthTokenPurposeEmailVerification, tx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified = true WHERE user_id = $1`, userID); err != nil {
+		return nil, errors.Wrap(err, "can't verify email")
+	}
+	return getUserByID(userID, tx)
+}
+
+// ResetPassword sets the password of the token's user. As the token was sent by email, the email is verified as well.
+func ResetPassword(token, password string, tx *sqlx.Tx) (*User, error) {
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+	userID, err := consumeAuthToken(token, AuthTokenPurposePasswordReset, tx)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		INSERT INTO auth_methods( user_id, method_type, password_hash ) VALUES ( $1, $2, $3 )
+		ON CONFLICT (method_type, user_id) DO UPDATE SET password_hash = excluded.password_hash
+	`
+	if _, err := tx.Exec(query, userID, AuthMethodEmailPassword, hash); err != nil {
+		return nil, errors.Wrap(err, "can't save password")
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified = true WHERE user_id = $1`, userID); err != nil {
+		return nil, errors.Wrap(err, "can't verify email")
+	}
+	user, err := getUserByID(userID, tx)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != nil {
+		loginAttempts.reset("login:" + strings.ToLower(*user.Email))
+	}
+	return user, nil
+}
+
+// dropUnverifiedPassword removes the password and pending tokens of a user whose email isn't verified.
+func dropUnverifiedPassword(userID int, tx *sqlx.Tx) error {
+	if _, err := tx.Exec(`DELETE FROM auth_methods WHERE user_id = $1 AND method_type = $2`, userID, AuthMethodEmailPassword); err != nil {
+		return errors.Wrap(err, "can't delete unverified password")
+	}
+	if _, err := tx.Exec(`DELETE FROM auth_tokens WHERE user_id = $1`, userID); err != nil {
+		return errors.Wrap(err, "can't delete auth tokens")
+	}
+	return nil
+}
+
+// createAuthTokenForEmail creates a token for the user the query selects by the email ($1) and args. Requests are
+// limited like failed logins, so nobody can flood an inbox.
+func createAuthTokenForEmail(email, purpose string, validFor time.Duration, tx *sqlx.Tx, query string, args ...any) (*User, string, error) {
+	cfg := config.GetConfig()
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+	key := purpose + ":" + email
+	if err := loginAttempts.check(key, cfg.LoginMaxAttempts, cfg.LoginAttemptWindow); err != nil {
+		return nil, "", err
+	}
+	loginAttempts.fail(key)
+
+	var user User
+	if err := tx.Get(&user, query, append([]any{email}, args...)...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", nil
+		}
+		return nil, "", errors.Wrap(err, "can't select user")
+	}
+	token, err := createAuthToken(user.UserID, purpose, validFor, tx)
+	if err != nil {
+		return nil, "", err
+	}
+	return &user, token, nil
+}
+
+func createAuthToken(userID int, purpose string, validFor time.Duration, tx *sqlx.Tx) (string, error) {
+	token, hash, err := generateToken("")
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate token")
+	}
+	if _, err := tx.Exec(`DELETE FROM auth_tokens WHERE user_id = $1 AND purpose = $2`, userID, purpose); err != nil {
+		return "", errors.Wrap(err, "can't delete previous tokens")
+	}
+	query := `INSERT INTO auth_tokens (purpose, token_hash, valid_until, user_id) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(query, purpose, hash, time.Now().UTC().Add(validFor), userID); err != nil {
+		return "", errors.Wrap(err, "can't insert token")
+	}
+	return token, nil
+}
+
+// consumeAuthToken deletes the token and returns its user, or ErrInvalidToken if it doesn't exist or expired.
+func consumeAuthToken(token, purpose string, tx *sqlx.Tx) (int, error) {
+	var t struct {
+		UserID     int       `db:"user_id"`
+		ValidUntil time.Time `db:"valid_until"`
+	}
+	query := `DELETE FROM auth_tokens WHERE token_hash = $1 AND purpose = $2 RETURNING user_id, valid_until`
+	if err := tx.Get(&t, query, hashToken(token), purpose); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, errors.Wrap(err, "can't select token")
+	}
+	if time.Now().After(t.ValidUntil) {
+		return 0, ErrInvalidToken
+	}
+	return t.UserID, nil
+}
+
+func getUserByID(userID int, tx *sqlx.Tx) (*User, error) {
+	var user User
+	if err := tx.Get(&user, `SELECT * FROM users WHERE user_id = $1`, userID); err != nil {
+		return nil, errors.Wrap(err, "can't select user")
+	}
+	return &user, nil
+}
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if a, err := mail.ParseAddress(email); err != nil || a.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < PasswordMinLength || len(password) > PasswordMaxLength {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "can't hash password")
+	}
+	return string(hash), nil
+}
+
+// unknownUserHash is compared with the passwords of unknown emails.
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+// loginAttempts counts failed logins and sent emails in memory, so limits reset when the server restarts.
+var loginAttempts = &attemptLimiter{attempts: make(map[string][]time.Time)}
+
+type attemptLimiter struct {
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+// check returns a LoginRateLimitError if the key had max attempts within the window.
+func (l *attemptLimiter) check(key string, max int, window time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	recent := l.attempts[key][:0]
+	for _, t := range l.attempts[key] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(l.attempts, key)
+		return nil
+	}
+	l.attempts[key] = recent
+	if max > 0 && len(recent) >= max {
+		return &LoginRateLimitError{RetryAfter: window - now.Sub(recent[0])}
+	}
+	return nil
+}
+
+func (l *attemptLimiter) fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		l.attempts[key] = append(l.attempts[key], now)
+	}
+}
+
+func (l *attemptLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, key)
+}
+
+// evict removes the keys without attempts within the window, so keys which are never checked again don't pile up.
+func (l *attemptLimiter) evict(window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, attempts := range l.attempts {
+		// Attempts are appended in order, so the last one is the latest
+		if len(attempts) == 0 || now.Sub(attempts[len(attempts)-1]) >= window {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// StartLoginAttemptEviction periodically removes expired failed logins, see config.LoginAttemptWindow.
+func StartLoginAttemptEviction(ctx context.Context) {
+	cfg := config.GetConfig()
+
+	go func() {
+		ticker := time.NewTicker(cfg.LoginAttemptWindow)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				loginAttempts.evict(cfg.LoginAttemptWindow)
+			}
+		}
+	}()
+}
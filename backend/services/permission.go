@@ -0,0 +1,163 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Roles of organisation members, see the check of organisation_members.role.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Permission is an action members of an organisation can be allowed to do.
+type Permission string
+
+const (
+	// PermissionOrganisationView allows reading the organisation, its members, invitations and settings.
+	PermissionOrganisationView Permission = "organisation:view"
+	// PermissionOrganisationDelete allows deleting the organisation.
+	PermissionOrganisationDelete Permission = "organisation:delete"
+	// PermissionMembersManage allows inviting and removing members and changing their roles.
+	PermissionMembersManage Permission = "members:manage"
+	// PermissionOwnersManage allows granting, revoking and removing owners.
+	PermissionOwnersManage Permission = "owners:manage"
+	// PermissionAuditView allows reading and exporting the audit log of the organisation.
+	PermissionAuditView Permission = "audit:view"
+	// PermissionSettingsManage allows managing API tokens, env groups and registry credentials.
+	PermissionSettingsManage Permission = "settings:manage"
+	// PermissionProjectCreate allows creating, cloning, deleting and moving projects.
+	PermissionProjectCreate Permission = "project:create"
+	// PermissionProjectView allows reading projects, their state, logs, builds and deployments.
+	PermissionProjectView Permission = "project:view"
+	// PermissionProjectDeploy allows changing and deploying projects, their previews and environments.
+	PermissionProjectDeploy Permission = "project:deploy"
+	// PermissionProjectManage allows managing tokens, backups, environments and GitOps sources of projects.
+	PermissionProjectManage Permission = "project:manage"
+	// PermissionProjectShell allows opening shells in containers of projects.
+	PermissionProjectShell Permission = "project:shell"
+)
+
+// rolePermissions is the matrix of what each role is allowed to do.
+var rolePermissions = map[string][]Permission{
+	RoleOwner: {
+		PermissionOrganisationView, PermissionOrganisationDelete, PermissionMembersManage, PermissionOwnersManage,
+		PermissionAuditView, PermissionSettingsManage, PermissionProjectCreate, PermissionProjectView,
+		PermissionProjectDeploy, PermissionProjectManage, PermissionProjectShell,
+	},
+	RoleAdmin: {
+		PermissionOrganisationView, PermissionMembersManage, PermissionAuditView, PermissionSettingsManage,
+		PermissionProjectCreate, PermissionProjectView, PermissionProjectDeploy, PermissionProjectManage,
+		PermissionProjectShell,
+	},
+	RoleMember: {
+		PermissionOrganisationView, PermissionProjectView, PermissionProjectDeploy,
+	},
+}
+
+var (
+	ErrForbidden    = errors.New("insufficient organisation role")
+	ErrInvalidRole  = errors.New("invalid role")
+	ErrLastOwner    = errors.New("organisation needs at least one owner")
+	ErrNoInvitation = errors.New("no valid invitation to the organisation")
+)
+
+// IsValidRole reports whether the role is one of the roles of organisation members.
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleAllows reports whether members with the role have the permission.
+func RoleAllows(role string, p Permission) bool {
+	return slices.Contains(rolePermissions[role], p)
+}
+
+// Authorize returns ErrForbidden if the user's role in the organisation doesn't have the permission,
+// sql.ErrNoRows if the user isn't a member of it.
+func (s *S) Authorize(organisationID int, userID string, p Permission) error {
+	return authorize(s.dbService.GetConn(), organisationID, userID, p)
+}
+
+func authorize(db sqlx.Queryer, organisationID int, userID string, p Permission) error {
+	role, err := memberRole(db, organisationID, userID)
+	if err != nil {
+		return err
+	}
+	if !RoleAllows(role, p) {
+		return errors.Wrap(ErrForbidden, string(p))
+	}
+	return nil
+}
+
+// ChangeMemberRole sets the role of the member. Only owners may grant the owner role or change the role of owners,
+// and the last owner can't be demoted.
+func (s *S) ChangeMemberRole(organisationID int, userID, memberID, role string) error {
+	if !IsValidRole(role) {
+		return errors.Wrap(ErrInvalidRole, role)
+	}
+	var current string
+	err := s.WithTransaction(func(tx *sqlx.Tx) error {
+		var err error
+		current, err = memberRole(tx, organisationID, memberID)
+		if err != nil {
+			return err
+		}
+		if current == role {
+			return nil
+		}
+		if current == RoleOwner || role == RoleOwner {
+			if err := authorize(tx, organisationID, userID, PermissionOwnersManage); err != nil {
+				return err
+			}
+		}
+		if current == RoleOwner {
+			if err := ensureOtherOwner(tx, organisationID, memberID); err != nil {
+				return err
+			}
+		}
+		query := `UPDATE organisation_members SET role = $1 WHERE organisation_id = $2 AND user_id = $3`
+		if _, err := tx.Exec(query, role, organisationID, memberID); err != nil {
+			return fmt.Errorf("unable to change role of member: %w", err)
+		}
+		return nil
+	})
+	if err != nil || current == role {
+		return err
+	}
+	s.audit(organisationID, AuditActionMemberRoleChange, memberID, map[string]any{"role": current}, map[string]any{"role": role})
+	return nil
+}
+
+// ensureOtherOwner returns ErrLastOwner if the member is the only owner of the organisation.
+func ensureOtherOwner(tx *sqlx.Tx, organisationID int, memberID string) error {
+	var owners int
+	query := `SELECT COUNT(*) FROM organisation_members WHERE organisation_id = $1 AND role = $2 AND user_id <> $3`
+	if err := tx.Get(&owners, query, organisationID, RoleOwner, memberID); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// canRemoveMember returns an error if the user isn't allowed to remove the member from the organisation.
+func canRemoveMember(tx *sqlx.Tx, organisationID int, userID, memberID string) error {
+	role, err := memberRole(tx, organisationID, memberID)
+	if err != nil {
+		return err
+	}
+	if role != RoleOwner {
+		return nil
+	}
+	if err := authorize(tx, organisationID, userID, PermissionOwnersManage); err != nil {
+		return err
+	}
+	return ensureOtherOwner(tx, organisationID, memberID)
+}
@@ -0,0 +1,50 @@
+package services
+
+// PlannedService is a service as it would be deployed, with the env vars it would get. Secret values and the values
+// referencing them are masked.
+type PlannedService struct {
+	Name  string            `json:"name"`
+	Usn   string            `json:"usn"`
+	Image string            `json:"image"`
+	Env   map[string]string `json:"env"`
+}
+
+// Plan shows how a project would be deployed without deploying it.
+type Plan struct {
+	Services []PlannedService `json:"services"`
+}
+
+// PlanProject validates the project like deployments do and resolves the env vars of its services, see resolveEnv.
+// Values of "${random:<length>}" are generated once the project is saved, so they're masked.
+func (s *S) PlanProject(p *Project) (*Plan, error) {
+	if err := s.restoreMaskedSecrets(p); err != nil {
+		return nil, err
+	}
+	dc, err := s.GenerateDockerCompose(p)
+	if err != nil {
+		return nil, err
+	}
+	env, err := s.resolveEnv(p)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Services: make([]PlannedService, 0, len(p.Services))}
+	for _, service := range p.Services {
+		planned := PlannedService{
+			Name:  service.Name,
+			Usn:   service.Usn,
+			Image: dc.Services[service.Usn].Image,
+			Env:   make(map[string]string, len(env[service.Usn])),
+		}
+		for _, v := range env[service.Usn] {
+			if v.Secret {
+				planned.Env[v.Key] = SecretMask
+			} else {
+				planned.Env[v.Key] = v.Value
+			}
+		}
+		plan.Services = append(plan.Services, planned)
+	}
+	return plan, nil
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/config"
+)
+
+// maxPreviewSlugLen keeps hostnames of previews within the limit of a DNS label
+const maxPreviewSlugLen = 40
+
+var previewSlugInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Preview is a throwaway copy of a project, e.g. for a branch or pull request. It runs as project
+// of its own, derived from the services of its parent project.
+type Preview struct {
+	ID        int       `json:"id" db:"id"`
+	Branch    string    `json:"branch" db:"branch"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ParentID  int       `json:"-" db:"parent_id"`
+	ProjectID int       `json:"project_id" db:"project_id"`
+	UPN       UPN       `json:"upn" db:"unique_name"`
+
+	// Ignored in DB operations - populated separately
+	// Hosts are the hostnames of the public services by service name
+	Hosts map[string]string `json:"hosts,omitempty" db:"-"`
+}
+
+type PreviewRequest struct {
+	// Branch is the name of the branch or pull request, e.g. "feature/login" or "pr-42"
+	Branch string `json:"branch" binding:"required"`
+	// Tags override the image tags of services by service name
+	Tags map[string]string `json:"tags"`
+	// TTL is the duration the preview is kept after its last deployment, e.g. "48h"
+	TTL string `json:"ttl"`
+}
+
+// PreviewSlug turns a branch into the name used in UPNs and hostnames of previews, e.g. "feature/Login"
+// becomes "feature-login".
+func PreviewSlug(branch string) string {
+	slug := previewSlugInvalid.ReplaceAllString(strings.ToLower(branch), "-")
+	if len(slug) > maxPreviewSlugLen {
+		slug = slug[:maxPreviewSlugLen]
+	}
+	return strings.Trim(slug, "-")
+}
+
+func (r PreviewRequest) ttl() (time.Duration, error) {
+	if r.TTL == "" {
+		return config.GetConfig().PreviewTTL, nil
+	}
+	ttl, err := time.ParseDuration(r.TTL)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", r.TTL)
+	}
+	return ttl, nil
+}
+
+const selectPreviews = `
+	SELECT pe.id, pe.branch, pe.expires_at, pe.created_at, pe.updated_at, pe.parent_id, pe.project_id, p.unique_name
+	FROM preview_environments pe
+	JOIN projects p ON p.id = pe.project_id
+`
+
+// SelectPreviews returns the previews of a project.
+func (s *S) SelectPreviews(parentID int) ([]Preview, error) {
+	previews := make([]Preview, 0)
+	if err := s.dbService.GetConn().Select(&previews, selectPreviews+`WHERE pe.parent_id = $1 ORDER BY pe.id`, parentID); err != nil {
+		return nil, err
+	}
+	return previews, nil
+}
+
+// SelectPreview returns the preview of a project for a branch.
+func (s *S) SelectPreview(parentID int, branch string) (*Preview, error) {
+	var preview Preview
+	err := s.dbService.GetConn().Get(&preview, selectPreviews+`WHERE pe.parent_id = $1 AND pe.branch = $2`, parentID, PreviewSlug(branch))
+	if err != nil {
+		return nil, err
+	}
+	return &preview, nil
+}
+
+// SelectExpiredPreviews returns the previews which weren't deployed within their TTL.
+func (s *S) SelectExpiredPreviews() ([]Preview, error) {
+	var previews []Preview
+	if err := s.dbService.GetConn().Select(&previews, selectPreviews+`WHERE pe.expires_at <= $1`, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return previews, nil
+}
+
+// PreviewProject derives the project of the preview for the branch from its parent, see deriveProject.
+// Services get the tags of the request. The preview is new if its ID is 0, neither the project nor the preview
+// are saved.
+func (s *S) PreviewProject(parent *Project, req PreviewRequest) (*Project, *Preview, error) {
+	slug := PreviewSlug(req.Branch)
+	if slug == "" {
+		return nil, nil, fmt.Errorf("invalid branch %q", req.Branch)
+	}
+	ttl, err := req.ttl()
+	if err != nil {
+		return nil, nil, err
+	}
+	if derived, err := s.isDerivedProject(parent.ID); err != nil {
+		return nil, nil, err
+	} else if derived {
+		return nil, nil, fmt.Errorf("previews and environments can't have previews")
+	}
+	for name := range req.Tags {
+		if !parent.hasService(name) {
+			return nil, nil, fmt.Errorf("project has no service %q", name)
+		}
+	}
+
+	preview, err := s.SelectPreview(parent.ID, slug)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if taken, err := s.derivedNameTaken(parent.ID, slug); err != nil {
+			return nil, nil, err
+		} else if taken {
+			return nil, nil, fmt.Errorf("project has an environment %q", slug)
+		}
+		preview = &Preview{Branch: slug, ParentID: parent.ID}
+	case err != nil:
+		return nil, nil, err
+	}
+
+	p, err := s.deriveProject(parent, slug, preview.ProjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, service := range p.Services {
+		if tag, ok := req.Tags[service.Name]; ok {
+			service.ImageTag = tag
+		}
+	}
+	preview.UPN = p.UPN
+	preview.ExpiresAt = time.Now().UTC().Add(ttl)
+	preview.Hosts = p.publicHosts()
+	return p, preview, nil
+}
+
+// SavePreview saves a new preview with its project, the project of existing previews is saved on deployment.
+// Their expiry is extended.
+func (s *S) SavePreview(p *Project, preview *Preview) error {
+	now := time.Now().UTC()
+	preview.UpdatedAt = now
+	if preview.ID != 0 {
+		query := `UPDATE preview_environments SET expires_at = $2, updated_at = $3 WHERE id = $1`
+		if _, err := s.dbService.GetConn().Exec(query, preview.ID, preview.ExpiresAt, now); err != nil {
+			return err
+		}
+		s.auditProject(p, AuditActionPreviewSave, preview.Branch, nil, map[string]any{"expires_at": preview.ExpiresAt})
+		return nil
+	}
+
+	if err := s.saveProjectWithUsns(p); err != nil {
+		return err
+	}
+	preview.ProjectID = p.ID
+	preview.CreatedAt = now
+	query := `
+		INSERT INTO preview_environments (branch, expires_at, created_at, updated_at, parent_id, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	err := s.dbService.GetConn().Get(&preview.ID, query, preview.Branch, preview.ExpiresAt, now, now, preview.ParentID, preview.ProjectID)
+	if err != nil {
+		// Don't leave a project behind which isn't known as preview
+		_ = s.DeleteProjectByIDAndOrganisationID(p.ID, p.OrganisationID)
+		return err
+	}
+	return nil
+}
+
+// TeardownFunc stops the containers of a preview and deletes it with its project.
+type TeardownFunc func(preview Preview) error
+
+// TeardownExpiredPreviews tears down all previews which weren't deployed within their TTL.
+func (s *S) TeardownExpiredPreviews(teardown TeardownFunc) error {
+	previews, err := s.SelectExpiredPreviews()
+	if err != nil {
+		return err
+	}
+	for _, preview := range previews {
+		slog.Info("tearing down expired preview", "upn", preview.UPN, "branch", preview.Branch)
+		if err := teardown(preview); err != nil {
+			slog.Error("unable to tear down preview", "upn", preview.UPN, "err", err)
+		}
+	}
+	return nil
+}
+
+// StartPreviewReaper tears down expired previews periodically until the context is canceled.
+func (s *S) StartPreviewReaper(ctx context.Context, teardown TeardownFunc) {
+	cfg := config.GetConfig()
+
+	go func() {
+		ticker := time.NewTicker(cfg.PreviewCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.TeardownExpiredPreviews(teardown); err != nil {
+					slog.Error("unable to tear down expired previews", "err", err)
+				}
+			}
+		}
+	}()
+}
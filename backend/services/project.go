@@ -6,6 +6,7 @@ import (
 	"path"
 	"path/filepath"
 	"log/slog"
+	"slices"
 
 	"github.com/devs-group/sloth/backend/config"
 	"github.com/devs-group/sloth/backend/pkg/compose"
@@ -14,18 +15,24 @@ import (
 	"github.com/pkg/errors"
 )
 
+var ErrUnknownService = errors.New("unknown service")
+
 type Project struct {
 	ID             int    `json:"id" db:"id"`
 	UPN            UPN    `json:"upn" db:"unique_name"`
-	AccessToken    string `json:"access_token" db:"access_token"`
+	HookSecret     string `json:"-" db:"hook_secret"`
 	Name           string `json:"name" binding:"required" db:"name"`
 	OrganisationID string `json:"-" db:"organisation_id"`
 	Path           string `json:"-" db:"path"`
 	Organisation   string `json:"organisation_name" db:"organisation_name"`
+	// RegistryCredentials are the names of the registry credentials of the organisation the project uses
+	RegistryCredentials StringList `json:"registry_credentials" db:"registry_credentials"`
 	// Ignored in DB operations - populated separately
 	Hook              string             `json:"hook"`
 	Services          []*Service         `json:"services"`
-	DockerCredentials []DockerCredential `json:"docker_credentials"`
+	// DockerCredentials are the logins of the registry credentials
+	DockerCredentials []DockerCredential `json:"-"`
+	SharedVolumes     []SharedVolume     `json:"shared_volumes"`
 
 	//Ignore in both - populated internal
 	ComposeServices compose.Services `json:"-"`
@@ -45,20 +52,51 @@ func (s *S) PrepareProject(p *Project) error {
 		return err
 	}
 	p.ComposeServices = dc.Services
+	if err := s.SaveEnvFiles(p); err != nil {
+		return err
+	}
 	return s.SaveDockerComposeFile(p.UPN, *dc)
 }
 
 func (s *S) GenerateDockerCompose(p *Project) (*compose.DockerCompose, error) {
-	services := make(map[string]*compose.Container)
+	if err := p.validateSharedVolumes(); err != nil {
+		return nil, err
+	}
+
 	for _, service := range p.Services {
 		if service.Usn == "" {
 			service.Usn = utils.GenerateRandomName()
 		}
+	}
+	env, err := s.resolveEnv(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests map[string]ImageDigest
+	services := make(map[string]*compose.Container)
+	volumes := make(map[string]*compose.Volume)
+	for _, service := range p.Services {
 		container, _, err := generateServiceCompose(service)
 		if err != nil {
 			return nil, err
 		}
+		// Pinned services keep the digest of their last deployment until their tag changes or is updated
+		if service.PinDigest && !service.repin {
+			if digests == nil {
+				if digests, err = s.selectImageDigests(p.ID); err != nil {
+					return nil, err
+				}
+			}
+			if d, ok := digests[service.Usn]; ok && d.Image == container.Image {
+				container.Image = fmt.Sprintf("%s@%s", container.Image, d.Digest)
+			}
+		}
+		service.useEnvFile(container, env[service.Usn])
 		services[service.Usn] = container
+		for name, v := range container.VolumeDefinitions {
+			volumes[name] = v
+		}
 	}
 
 	networks := map[string]*compose.Network{
@@ -75,6 +113,9 @@ func (s *S) GenerateDockerCompose(p *Project) (*compose.DockerCompose, error) {
 		Networks: networks,
 		Services: services,
 	}
+	if len(volumes) > 0 {
+		dc.Volumes = volumes
+	}
 	return dc, nil
 }
 
@@ -108,26 +149,38 @@ func (s *S) CreateProjectServiceDirectories(p *Project) error {
 			}
 		}
 	}
+
+	for _, v := range p.SharedVolumes {
+		if _, err := utils.CreateFolderIfNotExists(path.Join(p.UPN.GetProjectPath(), sharedVolumePath(v.Name))); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (s *S) HasVolumesInRequest(p *Project) bool {
 	hasVolumes := false
 	for i := range p.Services {
-		if len(p.Services[i].Volumes) > 0 {
+		if p.Services[i].hasVolumes() {
 			hasVolumes = true
 		}
 	}
 	return hasVolumes
 }
 
+// ListProjects returns the projects of the organisation and the ones the user is granted access to as project member.
 func (s *S) ListProjects(userID, organisationID string) ([]Project, error) {
 	projects := make([]Project, 0)
 	query := `
-		SELECT DISTINCT p.id, p.unique_name, p.access_token, p.name, p.organisation_id
+		SELECT DISTINCT p.id, p.unique_name, p.name, p.organisation_id
 		FROM projects p
-		JOIN organisation_members om ON om.user_id = $1
-		WHERE p.organisation_id = $2
+		WHERE (
+			p.organisation_id = $2
+			OR p.id IN (SELECT project_id FROM project_members WHERE user_id = $1)
+		)
+			-- Previews and environments are listed by their projects
+			AND p.id NOT IN (SELECT project_id FROM preview_environments)
+			AND p.id NOT IN (SELECT project_id FROM project_environments)
 	`
 
 	err := s.dbService.GetConn().Select(&projects, query, userID, organisationID)
@@ -136,7 +189,7 @@ func (s *S) ListProjects(userID, organisationID string) ([]Project, error) {
 	}
 
 	for i := range projects {
-		err := s.SelectProjectByUPNOrAccessToken(&projects[i])
+		err := s.SelectProjectByUPN(&projects[i])
 		if err != nil {
 			return nil, err
 		}
@@ -147,7 +200,7 @@ func (s *S) ListProjects(userID, organisationID string) ([]Project, error) {
 
 func (s *S) SelectProjectByIDAndOrganisationID(projectID int, currentOrganisationID string) (*Project, error) {
 	q := `
-		SELECT p.id, p.unique_name, p.access_token, p.name, p.organisation_id, p.path
+		SELECT p.id, p.unique_name, p.hook_secret, p.name, p.organisation_id, p.path, p.registry_credentials
 		FROM projects AS p
 		WHERE p.id = $1 AND p.organisation_id = $2
 	`
@@ -158,7 +211,7 @@ func (s *S) SelectProjectByIDAndOrganisationID(projectID int, currentOrganisatio
 		return nil, err
 	}
 
-	project.DockerCredentials, err = s.SelectDockerCredentials(project.OrganisationID)
+	project.DockerCredentials, err = s.selectProjectDockerCredentials(&project)
 	if err != nil {
 		return nil, err
 	}
@@ -168,68 +221,82 @@ func (s *S) SelectProjectByIDAndOrganisationID(projectID int, currentOrganisatio
 		return nil, err
 	}
 
+	project.SharedVolumes, err = s.SelectSharedVolumes(project.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &project, nil
 }
 
-func (s *S) SelectProjectByIDAndAccessToken(projectID int, accessToken string) (*Project, error) {
-	query := `
-		SELECT p.id, p.unique_name, p.access_token, p.name, p.organisation_id, p.path
+// SelectProjectByID selects a project without checking its organisation, only use it for internal jobs.
+func (s *S) SelectProjectByID(projectID int) (*Project, error) {
+	q := `
+		SELECT p.id, p.unique_name, p.hook_secret, p.name, p.organisation_id, p.path, p.registry_credentials
 		FROM projects AS p
-		WHERE p.id = $1 AND p.access_token = $2
+		WHERE p.id = $1
 	`
 
 	var project Project
-	err := s.dbService.GetConn().Get(&project, query, projectID, accessToken)
+	err := s.dbService.GetConn().Get(&project, q, projectID)
 	if err != nil {
 		return nil, err
 	}
 
-	project.DockerCredentials, err = s.SelectDockerCredentials(project.OrganisationID)
+	project.DockerCredentials, err = s.selectProjectDockerCredentials(&project)
 	if err != nil {
 		return nil, err
 	}
 
-	project.Services, _ = s.SelectServices(project.ID)
+	project.Services, err = s.SelectServices(project.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	project.SharedVolumes, err = s.SelectSharedVolumes(project.ID)
+	if err != nil {
+		return nil, err
+	}
 
 	return &project, nil
 }
 
-func (s *S) SelectProjectByUPNOrAccessToken(p *Project) error {
+// SelectProjectByUPN selects the project with the UPN of p within the organisation of p.
+func (s *S) SelectProjectByUPN(p *Project) error {
 	query := `
 	SELECT
 		p.id,
 		p.unique_name,
-		p.access_token,
+		p.hook_secret,
 		p.name,
 		p.organisation_id,
 		p.path,
+		p.registry_credentials,
 		COALESCE(o.name, '') AS organisation_name
 FROM
 		projects p
 		LEFT JOIN organisations o ON o.id = p.organisation_id
 WHERE
     	p.unique_name = $1
-		AND (
-		    p.access_token = $2
-    		OR p.organisation_id = $3
-		)
+		AND p.organisation_id = $2
 GROUP BY
 		p.id,
 		p.unique_name,
-		p.access_token,
+		p.hook_secret,
 		p.name,
 		p.organisation_id,
 		p.path,
+		p.registry_credentials,
 		o.name
 		`
 
-	slog.Debug("Query Params", "unique_name", string(p.UPN), "access_token", p.AccessToken, "organisation_id", p.OrganisationID)
-	err := s.dbService.GetConn().Get(p, query, string(p.UPN), p.AccessToken, p.OrganisationID)
+	slog.Debug("Query Params", "unique_name", string(p.UPN), "organisation_id", p.OrganisationID)
+	err := s.dbService.GetConn().Get(p, query, string(p.UPN), p.OrganisationID)
 	if err != nil {
 		return err
 	}
 
-	p.DockerCredentials, err = s.SelectDockerCredentials(p.OrganisationID)
+	p.DockerCredentials, err = s.selectProjectDockerCredentials(p)
 	if err != nil {
 		return err
 	}
@@ -237,16 +304,44 @@ GROUP BY
 	if err != nil {
 		return err
 	}
+	p.SharedVolumes, err = s.SelectSharedVolumes(p.ID)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func (s *S) SaveProject(p *Project, currentOrganisationID string) error {
+	if err := s.saveProject(p, currentOrganisationID); err != nil {
+		return err
+	}
+	s.auditProject(p, AuditActionProjectCreate, string(p.UPN), nil, p)
+	return nil
+}
+
+func (s *S) saveProject(p *Project, currentOrganisationID string) error {
+	if err := s.validateRegistryCredentials(currentOrganisationID, p.RegistryCredentials); err != nil {
+		return err
+	}
 	q1 := `
-	INSERT INTO projects (name, unique_name, access_token, organisation_id, path)
-	VALUES ($1, $2, $3, $4, $5)
+	INSERT INTO projects (name, unique_name, hook_secret, organisation_id, path, registry_credentials)
+	VALUES ($1, $2, $3, $4, $5, $6)
 	RETURNING id
 	`
-	err := s.dbService.GetConn().Get(&p.ID, q1, p.Name, p.UPN, p.AccessToken, currentOrganisationID, p.Path)
+	err := s.dbService.GetConn().Get(&p.ID, q1, p.Name, p.UPN, p.HookSecret, currentOrganisationID, p.Path, p.RegistryCredentials)
+	if err != nil {
+		return err
+	}
+	p.OrganisationID = currentOrganisationID
+	if p.DockerCredentials, err = s.selectProjectDockerCredentials(p); err != nil {
+		return err
+	}
+
+	// New projects have no shared volumes which could be removed
+	err = s.WithTransaction(func(tx *sqlx.Tx) error {
+		_, err := s.saveSharedVolumes(tx, p)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -257,46 +352,63 @@ func (s *S) SaveProject(p *Project, currentOrganisationID string) error {
 		}
 	}
 
-	for _, dc := range p.DockerCredentials {
-		q2 := `
-        INSERT INTO docker_credentials (username, password, registry, project_id)
-        VALUES ($1, $2, $3, $4)
-    	`
-		_, err = s.dbService.GetConn().Exec(q2, dc.Username, dc.Password, dc.Registry, p.ID)
-		if err != nil {
-			return err
+	return nil
+}
+
+// AssignServiceUsns generates the usns of the new services of a project submitted by a client. Any other usn has to
+// be the one of a service of the stored project, so that a client can't pick one, e.g. the one of another project.
+func (p *Project) AssignServiceUsns(stored *Project) error {
+	for _, service := range p.Services {
+		if service.Usn == "" {
+			service.Usn = utils.GenerateRandomName()
+			continue
+		}
+		if !slices.ContainsFunc(stored.Services, func(s *Service) bool { return s.Usn == service.Usn }) {
+			return errors.Wrapf(ErrUnknownService, "usn %q", service.Usn)
 		}
 	}
-
 	return nil
 }
 
 func (s *S) UpdateProject(p *Project) error {
-	return s.WithTransaction(func(tx *sqlx.Tx) error {
+	if err := s.restoreMaskedSecrets(p); err != nil {
+		return err
+	}
+	// Env vars with invalid references are rejected before anything is stored, new services need their usn for it
+	for _, svc := range p.Services {
+		if svc.Usn == "" {
+			svc.Usn = utils.GenerateRandomName()
+		}
+	}
+	if _, err := s.resolveEnv(p); err != nil {
+		return err
+	}
+	if err := s.validateRegistryCredentials(p.OrganisationID, p.RegistryCredentials); err != nil {
+		return err
+	}
+	var err error
+	if p.DockerCredentials, err = s.selectProjectDockerCredentials(p); err != nil {
+		return err
+	}
+	before, err := s.SelectProjectByID(p.ID)
+	if err != nil {
+		return err
+	}
+	var removedFolders []string
+	err = s.WithTransaction(func(tx *sqlx.Tx) error {
 		q1 := `
 			UPDATE projects
-			SET name = $3
+			SET name = $3, registry_credentials = $4
 			WHERE organisation_id = $1 AND unique_name = $2;
 		`
-		_, err := tx.Exec(q1, p.OrganisationID, p.UPN, p.Name)
+		_, err := tx.Exec(q1, p.OrganisationID, p.UPN, p.Name, p.RegistryCredentials)
 		if err != nil {
 			return err
 		}
-		q2 := `DELETE FROM docker_credentials WHERE project_id = $1`
-		_, err = tx.Exec(q2, p.ID)
-		if err != nil {
+
+		if removedFolders, err = s.saveSharedVolumes(tx, p); err != nil {
 			return err
 		}
-		for _, dc := range p.DockerCredentials {
-			q3 := `
-				INSERT INTO docker_credentials (username, password, registry, project_id)
-				VALUES ($1, $2, $3, $4)
-				`
-			_, err = tx.Exec(q3, dc.Username, dc.Password, dc.Registry, p.ID)
-			if err != nil {
-				return err
-			}
-		}
 
 		// Get existing services from database
 		existingServices, err := s.SelectServices(p.ID)
@@ -332,16 +444,12 @@ func (s *S) UpdateProject(p *Project) error {
 
 		// Update or insert services
 		for _, svc := range p.Services {
-			if svc.Usn == "" {
-				// Insert new service
-				svc.Usn = utils.GenerateRandomName()
-				query := `INSERT INTO services (name, usn, project_id, dcj) VALUES ($1, $2, $3, $4)`
-				_, serviceJson, err := generateServiceCompose(svc)
-				if err != nil {
-					return errors.Wrap(err, "unable to generate service for compose")
+			if _, exists := existingServiceMap[svc.Usn]; !exists {
+				// Insert new service, its USN might be assigned already, e.g. by previews
+				if svc.Usn == "" {
+					svc.Usn = utils.GenerateRandomName()
 				}
-				_, err = tx.Exec(query, svc.Name, svc.Usn, p.ID, serviceJson)
-				if err != nil {
+				if err := s.insertService(tx, svc, p.ID); err != nil {
 					return errors.Wrap(err, "unable to save a new service")
 				}
 				slog.Info("Added new service", "name", svc.Name, "usn", svc.Usn, "projectID", p.ID)
@@ -356,9 +464,27 @@ func (s *S) UpdateProject(p *Project) error {
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	deleteSharedVolumeFolders(removedFolders)
+	s.auditProject(p, AuditActionProjectUpdate, string(p.UPN), before, p)
+	return nil
 }
 
 func (s *S) DeleteProjectByIDAndOrganisationID(projectID int, organisationID string) error {
+	before, err := s.SelectProjectByIDAndOrganisationID(projectID, organisationID)
+	if err != nil {
+		return fmt.Errorf("can't remove project! Verify that this project isn't used by any organisation: %w", err)
+	}
+	if err := s.deleteProject(projectID, organisationID); err != nil {
+		return err
+	}
+	s.auditProject(before, AuditActionProjectDelete, string(before.UPN), before, nil)
+	return nil
+}
+
+func (s *S) deleteProject(projectID int, organisationID string) error {
 	q := `
 	DELETE FROM projects
 	WHERE
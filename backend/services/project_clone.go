@@ -0,0 +1,94 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+type CloneRequest struct {
+	// Name of the clone, "<name> (copy)" when empty
+	Name string `json:"name"`
+	// Data copies the data of bind mounted and shared volumes, named docker volumes aren't copied
+	Data bool `json:"data"`
+}
+
+// CloneProject saves a copy of the project with the UPN and hook secret. Services get new usns and public services
+// the default hostnames of their usn, as the hostnames of the project are routed to it already. Env vars, registry
+// credentials and shared volumes are copied. The usns of the clone are returned by usn of the project.
+func (s *S) CloneProject(source *Project, req CloneRequest, upn UPN, hookSecret string) (*Project, map[string]string, error) {
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("%s (copy)", source.Name)
+	}
+	p := &Project{
+		Name:                name,
+		UPN:                 upn,
+		HookSecret:          hookSecret,
+		Path:                upn.GetProjectPath(),
+		OrganisationID:      source.OrganisationID,
+		RegistryCredentials: source.RegistryCredentials,
+		DockerCredentials:   source.DockerCredentials,
+	}
+	for _, v := range source.SharedVolumes {
+		p.SharedVolumes = append(p.SharedVolumes, SharedVolume{Name: v.Name})
+	}
+
+	usns := make(map[string]string, len(source.Services))
+	for _, service := range source.Services {
+		usns[service.Usn] = utils.GenerateRandomName()
+	}
+	for _, sourceService := range source.Services {
+		service := sourceService.copyWithUsns(usns)
+		service.Public.Hosts = nil
+		p.Services = append(p.Services, service)
+	}
+
+	if err := s.saveProjectWithUsns(p); err != nil {
+		return nil, nil, err
+	}
+	return p, usns, nil
+}
+
+// CopyProjectData copies the data of the bind mounted volumes of the services and the shared volumes of the project
+// to its clone, see CloneProject. The data is copied while the containers of the project keep running.
+func CopyProjectData(source, clone *Project, usns map[string]string) error {
+	cfg := config.GetConfig()
+
+	dirs := map[string]string{
+		path.Join(source.UPN.GetProjectPath(), cfg.SharedVolumeDirectoryName): path.Join(clone.UPN.GetProjectPath(), cfg.SharedVolumeDirectoryName),
+	}
+	for usn, cloneUsn := range usns {
+		src := path.Join(source.UPN.GetProjectPath(), cfg.PersistentVolumeDirectoryName, sanitizeName(usn))
+		dirs[src] = path.Join(clone.UPN.GetProjectPath(), cfg.PersistentVolumeDirectoryName, sanitizeName(cloneUsn))
+	}
+
+	for src, dst := range dirs {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyDir(src, dst); err != nil {
+			return errors.Wrapf(err, "unable to copy %s", src)
+		}
+	}
+	return nil
+}
+
+func copyDir(src, dst string) error {
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		w.CloseWithError(backup.Archive(src, w))
+	}()
+	if _, err := utils.CreateFolderIfNotExists(dst); err != nil {
+		return err
+	}
+	return backup.Extract(r, dst)
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"database/sql"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Roles of users which are granted access to single projects, see the check of project_members.role.
+const (
+	ProjectRoleViewer     = "viewer"
+	ProjectRoleDeployer   = "deployer"
+	ProjectRoleMaintainer = "maintainer"
+)
+
+// projectRolePermissions is the matrix of what each project role is allowed to do in its project. The permissions
+// are added to the ones of the user's role in the organisation of the project, if any.
+var projectRolePermissions = map[string][]Permission{
+	ProjectRoleViewer:     {PermissionProjectView},
+	ProjectRoleDeployer:   {PermissionProjectView, PermissionProjectDeploy},
+	ProjectRoleMaintainer: {PermissionProjectView, PermissionProjectDeploy, PermissionProjectManage, PermissionProjectShell},
+}
+
+var ErrInvalidProjectRole = errors.New("invalid project role")
+
+// ProjectMember is a user who is granted access to a project, independent of the organisation of the project.
+type ProjectMember struct {
+	UserID    int       `json:"user_id" db:"user_id"`
+	Email     string    `json:"email" db:"email"`
+	Username  *string   `json:"username" db:"username"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ProjectID int       `json:"-" db:"project_id"`
+}
+
+// IsValidProjectRole reports whether the role is one of the roles of project members.
+func IsValidProjectRole(role string) bool {
+	_, ok := projectRolePermissions[role]
+	return ok
+}
+
+// ProjectRoleAllows reports whether project members with the role have the permission in their project.
+func ProjectRoleAllows(role string, p Permission) bool {
+	return slices.Contains(projectRolePermissions[role], p)
+}
+
+// AuthorizeProject returns the organisation of the project if the user has the permission in the project, either by
+// their role in the organisation or by their role in the project. Previews and environments are derived from a project,
+// the role in that project applies to them. ErrForbidden is returned if neither has it, sql.ErrNoRows if the user has
+// no access to the project at all.
+func (s *S) AuthorizeProject(projectID int, userID string, p Permission) (int, error) {
+	var access struct {
+		OrganisationID   int    `db:"organisation_id"`
+		OrganisationRole string `db:"organisation_role"`
+		ProjectRole      string `db:"project_role"`
+	}
+	query := `
+		SELECT p.organisation_id, COALESCE(om.role, '') AS organisation_role, COALESCE(pm.role, '') AS project_role
+		FROM projects p
+		LEFT JOIN organisation_members om ON om.organisation_id = p.organisation_id AND om.user_id = $2
+		LEFT JOIN preview_environments pe ON pe.project_id = p.id
+		LEFT JOIN project_environments pen ON pen.project_id = p.id
+		LEFT JOIN project_members pm ON pm.project_id = COALESCE(pe.parent_id, pen.parent_id, p.id) AND pm.user_id = $2
+		WHERE p.id = $1
+	`
+	if err := s.dbService.GetConn().Get(&access, query, projectID, userID); err != nil {
+		return 0, err
+	}
+	if access.OrganisationRole == "" && access.ProjectRole == "" {
+		return 0, sql.ErrNoRows
+	}
+	if !RoleAllows(access.OrganisationRole, p) && !ProjectRoleAllows(access.ProjectRole, p) {
+		return 0, errors.Wrap(ErrForbidden, string(p))
+	}
+	return access.OrganisationID, nil
+}
+
+// SelectProjectIDByUPN returns the ID of the project with the unique name.
+func (s *S) SelectProjectIDByUPN(upn UPN) (int, error) {
+	var id int
+	if err := s.dbService.GetConn().Get(&id, `SELECT id FROM projects WHERE unique_name = $1`, upn); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+const selectProjectMembers = `
+	SELECT pm.project_id, pm.user_id, pm.role, pm.created_at, u.email, u.username
+	FROM project_members pm
+	JOIN users u ON u.user_id = pm.user_id
+`
+
+func (s *S) SelectProjectMembers(projectID int) ([]ProjectMember, error) {
+	members := make([]ProjectMember, 0)
+	query := selectProjectMembers + `WHERE pm.project_id = $1 ORDER BY pm.id`
+	if err := s.dbService.GetConn().Select(&members, query, projectID); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SaveProjectMember grants the user with the email the role in the project, or changes the role of an existing
+// grant. sql.ErrNoRows is returned if there is no such user.
+func (s *S) SaveProjectMember(projectID int, email, role string) (*ProjectMember, error) {
+	if !IsValidProjectRole(role) {
+		return nil, errors.Wrap(ErrInvalidProjectRole, role)
+	}
+	var userID int
+	query := `SELECT user_id FROM users WHERE lower(email) = lower($1) AND is_service_account = FALSE`
+	if err := s.dbService.GetConn().Get(&userID, query, email); err != nil {
+		return nil, err
+	}
+	query = `
+		INSERT INTO project_members (project_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (project_id, user_id) DO UPDATE SET role = excluded.role
+	`
+	if _, err := s.dbService.GetConn().Exec(query, projectID, userID, role); err != nil {
+		return nil, errors.Wrap(err, "unable to save project member")
+	}
+	var member ProjectMember
+	query = selectProjectMembers + `WHERE pm.project_id = $1 AND pm.user_id = $2`
+	if err := s.dbService.GetConn().Get(&member, query, projectID, userID); err != nil {
+		return nil, err
+	}
+	s.auditProjectByID(projectID, AuditActionProjectMemberSave, email, nil, map[string]any{"role": role})
+	return &member, nil
+}
+
+func (s *S) DeleteProjectMember(projectID int, userID string) error {
+	var member ProjectMember
+	query := selectProjectMembers + `WHERE pm.project_id = $1 AND pm.user_id = $2`
+	if err := s.dbService.GetConn().Get(&member, query, projectID, userID); err != nil {
+		return err
+	}
+	query = `DELETE FROM project_members WHERE project_id = $1 AND user_id = $2`
+	res, err := s.dbService.GetConn().Exec(query, projectID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	s.auditProjectByID(projectID, AuditActionProjectMemberDelete, member.Email, map[string]any{"role": member.Role}, nil)
+	return nil
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/utils"
+)
+
+// Scopes of project tokens
+const (
+	ProjectTokenScopeDeploy    = "deploy"
+	ProjectTokenScopeExec      = "exec"
+	ProjectTokenScopeReadState = "read-state"
+)
+
+const (
+	projectTokenPrefix = "slp_"
+	tokenLen           = 40
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+var ErrMissingScope = errors.New("token is missing the required scope")
+
+type ProjectToken struct {
+	ID         int        `json:"id" db:"id"`
+	Name       string     `json:"name" binding:"required" db:"name"`
+	Scopes     StringList `json:"scopes" binding:"required" db:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	ProjectID  int        `json:"-" db:"project_id"`
+	TokenHash  string     `json:"-" db:"token_hash"`
+
+	// Token is only set when it got created or rotated
+	Token string `json:"token,omitempty" db:"-"`
+}
+
+func (t *ProjectToken) Validate() error {
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range t.Scopes {
+		switch scope {
+		case ProjectTokenScopeDeploy, ProjectTokenScopeExec, ProjectTokenScopeReadState:
+		default:
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()) {
+		return fmt.Errorf("expiry must be in the future")
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateToken returns a random token with the prefix and its hash.
+func generateToken(prefix string) (token, hash string, err error) {
+	random, err := utils.RandStringRunes(tokenLen)
+	if err != nil {
+		return "", "", err
+	}
+	token = prefix + random
+	return token, hashToken(token), nil
+}
+
+func (t *ProjectToken) generate() (err error) {
+	t.Token, t.TokenHash, err = generateToken(projectTokenPrefix)
+	return err
+}
+
+func (s *S) SelectProjectTokens(projectID int) ([]ProjectToken, error) {
+	tokens := make([]ProjectToken, 0)
+	query := `
+		SELECT id, name, scopes, expires_at, last_used_at, created_at, project_id, token_hash
+		FROM project_tokens
+		WHERE project_id = $1
+		ORDER BY id
+	`
+	if err := s.dbService.GetConn().Select(&tokens, query, projectID); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// SaveProjectToken generates a new token, which is only returned in t.Token.
+func (s *S) SaveProjectToken(t *ProjectToken) error {
+	if err := t.generate(); err != nil {
+		return err
+	}
+	if err := s.insertProjectToken(s.dbService.GetConn(), t); err != nil {
+		return err
+	}
+	s.auditProjectByID(t.ProjectID, AuditActionProjectTokenCreate, t.Name, nil, t)
+	return nil
+}
+
+func (s *S) insertProjectToken(db sqlx.Queryer, t *ProjectToken) error {
+	t.CreatedAt = time.Now().UTC()
+	query := `
+		INSERT INTO project_tokens (name, token_hash, scopes, expires_at, created_at, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	return sqlx.Get(db, &t.ID, query, t.Name, t.TokenHash, t.Scopes, t.ExpiresAt, t.CreatedAt, t.ProjectID)
+}
+
+// RotateProjectToken replaces the secret of a token and keeps its name, scopes and expiry.
+func (s *S) RotateProjectToken(projectID, tokenID int) (*ProjectToken, error) {
+	var t ProjectToken
+	query := `
+		SELECT id, name, scopes, expires_at, last_used_at, created_at, project_id, token_hash
+		FROM project_tokens
+		WHERE id = $1 AND project_id = $2
+	`
+	if err := s.dbService.GetConn().Get(&t, query, tokenID, projectID); err != nil {
+		return nil, err
+	}
+	if err := t.generate(); err != nil {
+		return nil, err
+	}
+	t.LastUsedAt = nil
+
+	query = `UPDATE project_tokens SET token_hash = $1, last_used_at = NULL WHERE id = $2`
+	if _, err := s.dbService.GetConn().Exec(query, t.TokenHash, t.ID); err != nil {
+		return nil, err
+	}
+	s.auditProjectByID(projectID, AuditActionProjectTokenRotate, t.Name, nil, nil)
+	return &t, nil
+}
+
+func (s *S) DeleteProjectToken(projectID, tokenID int) error {
+	var name string
+	query := `SELECT name FROM project_tokens WHERE id = $1 AND project_id = $2`
+	if err := s.dbService.GetConn().Get(&name, query, tokenID, projectID); err != nil {
+		return err
+	}
+	query = `DELETE FROM project_tokens WHERE id = $1 AND project_id = $2`
+	res, err := s.dbService.GetConn().Exec(query, tokenID, projectID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	s.auditProjectByID(projectID, AuditActionProjectTokenDelete, name, nil, nil)
+	return nil
+}
+
+// SelectProjectByIDAndToken selects the project if the token belongs to it, isn't expired and has the scope.
+// The last use of the token is recorded.
+func (s *S) SelectProjectByIDAndToken(projectID int, token, scope string) (*Project, error) {
+	if _, err := s.AuthenticateProjectToken(projectID, token, scope); err != nil {
+		return nil, err
+	}
+	return s.SelectProjectByID(projectID)
+}
+
+// AuthenticateProjectToken returns the token if it belongs to the project, isn't expired and has the scope.
+// The last use of the token is recorded.
+func (s *S) AuthenticateProjectToken(projectID int, token, scope string) (*ProjectToken, error) {
+	var t ProjectToken
+	query := `
+		SELECT id, name, scopes, expires_at, last_used_at, created_at, project_id, token_hash
+		FROM project_tokens
+		WHERE project_id = $1 AND token_hash = $2
+	`
+	err := s.dbService.GetConn().Get(&t, query, projectID, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(now) {
+		return nil, ErrInvalidToken
+	}
+	if !slices.Contains(t.Scopes, scope) {
+		return nil, errors.Wrap(ErrMissingScope, scope)
+	}
+
+	query = `UPDATE project_tokens SET last_used_at = $1 WHERE id = $2`
+	if _, err := s.dbService.GetConn().Exec(query, now, t.ID); err != nil {
+		slog.Error("unable to update last use of project token", "err", err)
+	}
+	return &t, nil
+}
+
+// MigrateProjectAccessTokens moves the plaintext access tokens of projects into hashed deploy tokens,
+// so existing hooks keep working.
+func (s *S) MigrateProjectAccessTokens() error {
+	return s.WithTransaction(func(tx *sqlx.Tx) error {
+		var projects []struct {
+			ID          int    `db:"project_id"`
+			AccessToken string `db:"access_token"`
+		}
+		if err := tx.Select(&projects, `SELECT project_id, access_token FROM legacy_project_access_tokens`); err != nil {
+			return err
+		}
+
+		for _, p := range projects {
+			t := ProjectToken{
+				Name:      "Access token",
+				Scopes:    StringList{ProjectTokenScopeDeploy},
+				ProjectID: p.ID,
+				TokenHash: hashToken(p.AccessToken),
+			}
+			if err := s.insertProjectToken(tx, &t); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM legacy_project_access_tokens WHERE project_id = $1`, p.ID); err != nil {
+				return err
+			}
+		}
+		if len(projects) > 0 {
+			slog.Info("migrated project access tokens", "count", len(projects))
+		}
+		return nil
+	})
+}
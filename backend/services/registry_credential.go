@@ -0,0 +1,356 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/models"
+	"github.com/devs-group/sloth/backend/pkg/registry"
+)
+
+const (
+	// RegistryAuthBasic authenticates with username and password
+	RegistryAuthBasic = "basic"
+	// RegistryAuthToken authenticates with a token like a GHCR personal access token, registries like GHCR accept
+	// any username with it
+	RegistryAuthToken = "token"
+	// RegistryAuthHelper gets short-lived credentials from a credential helper, see registry.LookupHelper
+	RegistryAuthHelper = "helper"
+)
+
+// tokenUsername is the username of token credentials without one.
+const tokenUsername = "token"
+
+// helperLoginTTL is how long the credentials of helpers are reused, tokens of helpers like "ecr-login" are valid
+// for hours.
+const helperLoginTTL = 10 * time.Minute
+
+var (
+	// ErrRegistryCredentialInUse is returned when deleting a registry credential which is used by projects.
+	ErrRegistryCredentialInUse = errors.New("registry credential is in use")
+	// ErrInvalidRegistryCredentials is returned for projects using unknown registry credentials.
+	ErrInvalidRegistryCredentials = errors.New("invalid registry credentials")
+)
+
+// DockerCredential is the login of a registry images of a project are pulled and pushed with, see RegistryCredential.
+type DockerCredential struct {
+	Username string
+	Password string
+	Registry string
+}
+
+// RegistryCredential is a named login of a registry of an organisation, which projects use by name. Passwords and
+// tokens are encrypted and masked like secret env vars.
+type RegistryCredential struct {
+	ID       int    `json:"id" db:"id"`
+	Name     string `json:"name" db:"name"`
+	Registry string `json:"registry" db:"registry"`
+	AuthType string `json:"auth_type" db:"auth_type"`
+	Username string `json:"username" db:"username"`
+	// Password is the password of basic credentials or the token of token credentials
+	Password string `json:"password" db:"password"`
+	// Helper is the credential helper of helper credentials, e.g. "ecr-login"
+	Helper         string    `json:"helper" db:"helper"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+	OrganisationID int       `json:"-" db:"organisation_id"`
+}
+
+// Validate validates the credential, credentials without auth type use basic auth. Helpers need to be allowed by
+// REGISTRY_CREDENTIAL_HELPERS.
+func (c *RegistryCredential) Validate() error {
+	if !resourceNameRegex.MatchString(c.Name) || len(c.Name) > 63 {
+		return fmt.Errorf("invalid registry credential name %q, only lowercase letters, digits, '-' and '_' are allowed", c.Name)
+	}
+	if strings.TrimSpace(c.Registry) == "" {
+		return fmt.Errorf("registry is required")
+	}
+	switch c.AuthType {
+	case "", RegistryAuthBasic:
+		c.AuthType = RegistryAuthBasic
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("basic credentials require a username and password")
+		}
+	case RegistryAuthToken:
+		if c.Password == "" {
+			return fmt.Errorf("token credentials require a token as password")
+		}
+	case RegistryAuthHelper:
+		if !helperAllowed(c.Helper) {
+			return fmt.Errorf("credential helper %q isn't allowed, see REGISTRY_CREDENTIAL_HELPERS", c.Helper)
+		}
+		c.Username, c.Password = "", ""
+	default:
+		return fmt.Errorf("invalid auth type %q, use %s, %s or %s", c.AuthType, RegistryAuthBasic, RegistryAuthToken, RegistryAuthHelper)
+	}
+	return nil
+}
+
+func helperAllowed(helper string) bool {
+	if helper == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(config.GetConfig().RegistryCredentialHelpers, ",") {
+		if strings.TrimSpace(allowed) == helper {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskSecrets replaces the password before the credential is sent to a client.
+func (c *RegistryCredential) MaskSecrets() {
+	if c.Password != "" {
+		c.Password = SecretMask
+	}
+}
+
+func (s *S) SelectRegistryCredentials(organisationID int) ([]RegistryCredential, error) {
+	credentials := make([]RegistryCredential, 0)
+	query := `SELECT * FROM registry_credentials WHERE organisation_id = $1 ORDER BY name`
+	if err := s.dbService.GetConn().Select(&credentials, query, organisationID); err != nil {
+		return nil, err
+	}
+	for i := range credentials {
+		if err := credentials[i].decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	return credentials, nil
+}
+
+func (s *S) SelectRegistryCredential(organisationID int, name string) (*RegistryCredential, error) {
+	var c RegistryCredential
+	query := `SELECT * FROM registry_credentials WHERE organisation_id = $1 AND name = $2`
+	if err := s.dbService.GetConn().Get(&c, query, organisationID, name); err != nil {
+		return nil, err
+	}
+	if err := c.decrypt(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *RegistryCredential) decrypt() error {
+	password, err := decryptSecret(c.Password)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt registry credential %s: %w", c.Name, err)
+	}
+	c.Password = password
+	return nil
+}
+
+// SaveRegistryCredential creates or replaces the registry credential of the organisation. A masked password keeps
+// the stored one.
+func (s *S) SaveRegistryCredential(c *RegistryCredential) error {
+	existing, err := s.SelectRegistryCredential(c.OrganisationID, c.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if c.Password == SecretMask {
+		if existing == nil {
+			return fmt.Errorf("registry credential %s has no stored password", c.Name)
+		}
+		c.Password = existing.Password
+	}
+	password, err := encryptSecret(c.Password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	c.UpdatedAt = now
+	query := `
+		INSERT INTO registry_credentials (name, registry, auth_type, username, password, helper, created_at, updated_at, organisation_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8)
+		ON CONFLICT (organisation_id, name) DO UPDATE
+		SET registry = excluded.registry, auth_type = excluded.auth_type, username = excluded.username,
+			password = excluded.password, helper = excluded.helper, updated_at = excluded.updated_at
+		RETURNING id, created_at
+	`
+	row := s.dbService.GetConn().QueryRowx(query, c.Name, c.Registry, c.AuthType, c.Username, password, c.Helper, now, c.OrganisationID)
+	if err := row.Scan(&c.ID, &c.CreatedAt); err != nil {
+		return err
+	}
+	s.audit(c.OrganisationID, AuditActionRegistryCredSave, c.Name, existing, c)
+	return nil
+}
+
+// DeleteRegistryCredential deletes the registry credential, credentials which are used by projects return
+// ErrRegistryCredentialInUse.
+func (s *S) DeleteRegistryCredential(organisationID int, name string) error {
+	projects, err := s.SelectRegistryCredentialProjects(organisationID, name)
+	if err != nil {
+		return err
+	}
+	if len(projects) > 0 {
+		return ErrRegistryCredentialInUse
+	}
+	existing, err := s.SelectRegistryCredential(organisationID, name)
+	if err != nil {
+		return err
+	}
+	res, err := s.dbService.GetConn().Exec(`DELETE FROM registry_credentials WHERE organisation_id = $1 AND name = $2`, organisationID, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	s.audit(organisationID, AuditActionRegistryCredDelete, name, existing, nil)
+	return nil
+}
+
+// SelectRegistryCredentialProjects returns the projects of the organisation using the registry credential.
+func (s *S) SelectRegistryCredentialProjects(organisationID int, name string) ([]models.OrganisationProjects, error) {
+	projects := make([]models.OrganisationProjects, 0)
+	query := `
+		SELECT DISTINCT p.unique_name, p.name, p.id
+		FROM projects p, json_each(p.registry_credentials) c
+		WHERE p.organisation_id = $1 AND c.value = $2
+		ORDER BY p.id
+	`
+	if err := s.dbService.GetConn().Select(&projects, query, organisationID, name); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// TestRegistryCredential logs in to the registry with the credential like "docker login" without storing the login.
+func (s *S) TestRegistryCredential(ctx context.Context, c *RegistryCredential) error {
+	dc, err := c.login(ctx, false)
+	if err != nil {
+		return err
+	}
+	client := registry.NewClient(registryCredentials([]DockerCredential{dc}))
+	return client.Ping(ctx, c.Registry)
+}
+
+type helperLogin struct {
+	credentials registry.Credentials
+	expires     time.Time
+}
+
+var (
+	helperLoginsMu sync.Mutex
+	// helperLogins are the credentials of helpers by organisation, helper and registry, so that organisations
+	// never share logins
+	helperLogins = make(map[string]helperLogin)
+)
+
+// login returns the docker login of the credential. Helpers are asked for credentials unless cached ones of
+// them are still valid.
+func (c *RegistryCredential) login(ctx context.Context, cached bool) (DockerCredential, error) {
+	switch c.AuthType {
+	case RegistryAuthHelper:
+		if !helperAllowed(c.Helper) {
+			return DockerCredential{}, fmt.Errorf("credential helper %q isn't allowed", c.Helper)
+		}
+		key := fmt.Sprintf("%d\x00%s\x00%s", c.OrganisationID, c.Helper, c.Registry)
+		helperLoginsMu.Lock()
+		l, ok := helperLogins[key]
+		helperLoginsMu.Unlock()
+		if !cached || !ok || time.Now().After(l.expires) {
+			helper, err := registry.LookupHelper(c.Helper)
+			if err != nil {
+				return DockerCredential{}, err
+			}
+			creds, err := helper.Get(ctx, c.Registry)
+			if err != nil {
+				return DockerCredential{}, errors.Wrapf(err, "unable to get credentials of %s from helper %s", c.Registry, c.Helper)
+			}
+			l = helperLogin{credentials: creds, expires: time.Now().Add(helperLoginTTL)}
+			helperLoginsMu.Lock()
+			helperLogins[key] = l
+			helperLoginsMu.Unlock()
+		}
+		return DockerCredential{Username: l.credentials.Username, Password: l.credentials.Password, Registry: c.Registry}, nil
+	case RegistryAuthToken:
+		username := c.Username
+		if username == "" {
+			username = tokenUsername
+		}
+		return DockerCredential{Username: username, Password: c.Password, Registry: c.Registry}, nil
+	default:
+		return DockerCredential{Username: c.Username, Password: c.Password, Registry: c.Registry}, nil
+	}
+}
+
+func (s *S) selectOrganisationRegistryCredentials(organisationID string) (map[string]*RegistryCredential, error) {
+	id, err := strconv.Atoi(organisationID)
+	if err != nil {
+		return nil, fmt.Errorf("registry credentials require the project to belong to an organisation")
+	}
+	credentials, err := s.SelectRegistryCredentials(id)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*RegistryCredential, len(credentials))
+	for i := range credentials {
+		byName[credentials[i].Name] = &credentials[i]
+	}
+	return byName, nil
+}
+
+// validateRegistryCredentials checks that the registry credentials a project uses exist in its organisation, at
+// most one per registry.
+func (s *S) validateRegistryCredentials(organisationID string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	byName, err := s.selectOrganisationRegistryCredentials(organisationID)
+	if err != nil {
+		return err
+	}
+	registries := make(map[string]string, len(names))
+	for _, name := range names {
+		c, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%w: unknown registry credential %q", ErrInvalidRegistryCredentials, name)
+		}
+		domain := registry.NormalizeDomain(c.Registry)
+		if other, ok := registries[domain]; ok {
+			return fmt.Errorf("%w: %s and %s are both credentials of %s", ErrInvalidRegistryCredentials, other, name, domain)
+		}
+		registries[domain] = name
+	}
+	return nil
+}
+
+// selectProjectDockerCredentials returns the logins of the registry credentials the project uses. Credentials
+// which fail to log in, e.g. as their helper fails, are skipped, pulls from their registry fail then.
+func (s *S) selectProjectDockerCredentials(p *Project) ([]DockerCredential, error) {
+	dcs := make([]DockerCredential, 0, len(p.RegistryCredentials))
+	if len(p.RegistryCredentials) == 0 {
+		return dcs, nil
+	}
+	byName, err := s.selectOrganisationRegistryCredentials(p.OrganisationID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range p.RegistryCredentials {
+		c, ok := byName[name]
+		if !ok {
+			slog.Warn("project uses unknown registry credential", "upn", p.UPN, "name", name)
+			continue
+		}
+		dc, err := c.login(context.Background(), true)
+		if err != nil {
+			slog.Warn("unable to log in with registry credential", "upn", p.UPN, "name", name, "err", err)
+			continue
+		}
+		dcs = append(dcs, dc)
+	}
+	return dcs, nil
+}
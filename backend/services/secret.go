@@ -0,0 +1,503 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/pkg/dotenv"
+	"github.com/devs-group/sloth/backend/pkg/secrets"
+)
+
+// SecretMask replaces secret values in API responses. Updates which send it keep the stored value.
+const SecretMask = "********"
+
+// secretEnvKey matches keys of env vars which are always treated as secrets, e.g. DB_PASSWORD
+var secretEnvKey = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|PRIVATE_KEY|CREDENTIAL)`)
+
+// ErrNoSecretKeys is returned when secrets are stored or read without SECRET_KEYS, they are never stored as plaintext.
+var ErrNoSecretKeys = errors.New("SECRET_KEYS isn't set, secrets can't be encrypted")
+
+func secretKeyring() (*secrets.Keyring, error) {
+	keyring, err := secrets.NewKeyring(config.GetConfig().SecretKeys)
+	if err != nil {
+		return nil, err
+	}
+	if keyring == nil {
+		return nil, ErrNoSecretKeys
+	}
+	return keyring, nil
+}
+
+func encryptSecret(value string) (string, error) {
+	keyring, err := secretKeyring()
+	if err != nil {
+		return "", err
+	}
+	return keyring.Encrypt(value)
+}
+
+func decryptSecret(value string) (string, error) {
+	keyring, err := secretKeyring()
+	if err != nil {
+		return "", err
+	}
+	return keyring.Decrypt(value)
+}
+
+func (s *Service) isSecretEnv(key string) bool {
+	return slices.Contains(s.SecretEnvVars, key)
+}
+
+// detectSecretEnv marks env vars whose keys look like secrets as secret, so that they are encrypted even if the
+// client didn't mark them.
+func (s *Service) detectSecretEnv() {
+	for _, ev := range s.EnvVars {
+		if len(ev) == 2 && secretEnvKey.MatchString(ev[0]) && !s.isSecretEnv(ev[0]) {
+			s.SecretEnvVars = append(s.SecretEnvVars, ev[0])
+		}
+	}
+}
+
+// secretEnv returns the values of the secret env vars by key.
+func (s *Service) secretEnv() map[string]string {
+	env := make(map[string]string, len(s.SecretEnvVars))
+	for key, value := range s.EnvMap() {
+		if s.isSecretEnv(key) {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// encryptedSecretEnv returns the JSON object of the encrypted secret env vars by key, as stored in the database.
+func (s *Service) encryptedSecretEnv() (string, error) {
+	keyring, err := secretKeyring()
+	if err != nil {
+		return "", err
+	}
+	env := s.secretEnv()
+	for key, value := range env {
+		if env[key], err = keyring.Encrypt(value); err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(env)
+	return string(b), err
+}
+
+// addSecretEnv decrypts the secret env vars stored in the database and adds them to the env vars.
+func (s *Service) addSecretEnv(encrypted string) error {
+	if encrypted == "" {
+		return nil
+	}
+	var env map[string]string
+	if err := json.Unmarshal([]byte(encrypted), &env); err != nil {
+		return err
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	keyring, err := secretKeyring()
+	if err != nil {
+		return err
+	}
+
+	// Services without env vars get an empty one for the frontend, see ReadServiceFromDCJ
+	if len(s.EnvVars) == 1 && s.EnvVars[0][0] == "" {
+		s.EnvVars = nil
+	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := keyring.Decrypt(env[key])
+		if err != nil {
+			return fmt.Errorf("unable to decrypt env var %s: %w", key, err)
+		}
+		s.EnvVars = append(s.EnvVars, []string{key, value})
+	}
+	s.SecretEnvVars = keys
+	return nil
+}
+
+// MaskSecrets replaces the values of secret env vars and removes the credentials of build sources before the
+// project is sent to a client.
+func (p *Project) MaskSecrets() {
+	for _, service := range p.Services {
+		if service.Build != nil {
+			service.Build.DeployKey, service.Build.Token = "", ""
+		}
+		for i, ev := range service.EnvVars {
+			if len(ev) == 2 && service.isSecretEnv(ev[0]) {
+				service.EnvVars[i] = []string{ev[0], SecretMask}
+			}
+		}
+	}
+}
+
+// restoreMaskedSecrets replaces masked secrets of the project with the stored ones, see MaskSecrets. Env vars which
+// are stored as secret stay secret, whether or not the client sent them as such. Build sources without credentials
+// keep the stored ones as long as their repository doesn't change.
+func (s *S) restoreMaskedSecrets(p *Project) error {
+	existing, err := s.SelectServices(p.ID)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]map[string]string, len(existing))
+	builds := make(map[string]*BuildSource, len(existing))
+	for _, service := range existing {
+		stored[service.Usn] = service.secretEnv()
+		builds[service.Usn] = service.Build
+	}
+	for _, service := range p.Services {
+		if b, build := builds[service.Usn], service.Build; b != nil && build != nil && build.DeployKey == "" &&
+			build.Token == "" && build.Repository == b.Repository {
+			build.DeployKey, build.Token = b.DeployKey, b.Token
+		}
+		for i, ev := range service.EnvVars {
+			if len(ev) != 2 {
+				continue
+			}
+			value, ok := stored[service.Usn][ev[0]]
+			if ok && !service.isSecretEnv(ev[0]) {
+				service.SecretEnvVars = append(service.SecretEnvVars, ev[0])
+			}
+			if ev[1] != SecretMask {
+				continue
+			}
+			if !ok {
+				return fmt.Errorf("service %s has no stored value for the masked env var %s", service.Name, ev[0])
+			}
+			service.EnvVars[i] = []string{ev[0], value}
+		}
+	}
+	return nil
+}
+
+// envFilePath is the path of the env file of a service relative to its project.
+func envFilePath(usn string) string {
+	cfg := config.GetConfig()
+	return fmt.Sprintf("./%s/%s.env", cfg.EnvFileDirectoryName, sanitizeName(usn))
+}
+
+// envFile returns the content of an env file of the env vars, see dotenv.Format.
+func envFile(env []envVar) []byte {
+	vars := make([]dotenv.Var, 0, len(env))
+	for _, ev := range env {
+		if ev.Key != "" && ev.Value != "" {
+			vars = append(vars, dotenv.Var{Key: ev.Key, Value: ev.Value})
+		}
+	}
+	return dotenv.Format(vars)
+}
+
+// useEnvFile moves the env vars of the container to the env file of the service, so that secrets aren't part of the
+// compose file.
+func (s *Service) useEnvFile(c *compose.Container, env []envVar) {
+	c.Environment = nil
+	if len(envFile(env)) > 0 {
+		c.EnvFile = []string{envFilePath(s.Usn)}
+	}
+}
+
+// SaveEnvFiles writes the env files of the services of the project, readable by the owner only. Env files of
+// services which were removed are deleted.
+func (s *S) SaveEnvFiles(p *Project) error {
+	cfg := config.GetConfig()
+
+	env, err := s.resolveEnv(p)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(p.UPN.GetProjectPath(), cfg.EnvFileDirectoryName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	files := make(map[string]bool, len(p.Services))
+	for _, service := range p.Services {
+		content := envFile(env[service.Usn])
+		if len(content) == 0 {
+			continue
+		}
+		name := path.Base(envFilePath(service.Usn))
+		files[name] = true
+		if err := os.WriteFile(path.Join(dir, name), content, 0o600); err != nil {
+			return err
+		}
+		// WriteFile keeps the permissions of existing files
+		if err := os.Chmod(path.Join(dir, name), 0o600); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !files[entry.Name()] {
+			if err := os.Remove(path.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateSecrets encrypts secrets which are stored as plaintext and reencrypts the ones of other keys than the
+// primary one, e.g. after a key rotation. Env vars of existing services whose keys look like secrets, e.g.
+// DB_PASSWORD, are marked as secret. It fails with ErrNoSecretKeys without SECRET_KEYS.
+func (s *S) MigrateSecrets() error {
+	keyring, err := secretKeyring()
+	if err != nil {
+		return err
+	}
+
+	return s.WithTransaction(func(tx *sqlx.Tx) error {
+		var credentials []RegistryCredential
+		if err := tx.Select(&credentials, `SELECT * FROM registry_credentials`); err != nil {
+			return err
+		}
+		migrated := 0
+		for _, c := range credentials {
+			password, changed, err := keyring.Rotate(c.Password)
+			if err != nil {
+				return fmt.Errorf("unable to migrate registry credential %d: %w", c.ID, err)
+			}
+			if !changed {
+				continue
+			}
+			if _, err := tx.Exec(`UPDATE registry_credentials SET password = $2 WHERE id = $1`, c.ID, password); err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		var rows []struct {
+			ID        int    `db:"id"`
+			DCJ       string `db:"dcj"`
+			SecretEnv string `db:"secret_env"`
+		}
+		if err := tx.Select(&rows, `SELECT id, dcj, secret_env FROM services`); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			dcj, secretEnv, changed, err := migrateServiceSecrets(keyring, row.DCJ, row.SecretEnv)
+			if err != nil {
+				return fmt.Errorf("unable to migrate secrets of service %d: %w", row.ID, err)
+			}
+			if !changed {
+				continue
+			}
+			if _, err := tx.Exec(`UPDATE services SET dcj = $2, secret_env = $3 WHERE id = $1`, row.ID, dcj, secretEnv); err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		var builds []struct {
+			ID          int    `db:"id"`
+			BuildSource string `db:"build_source"`
+		}
+		if err := tx.Select(&builds, `SELECT id, build_source FROM services WHERE build_source IS NOT NULL`); err != nil {
+			return err
+		}
+		for _, row := range builds {
+			var b BuildSource
+			if err := json.Unmarshal([]byte(row.BuildSource), &b); err != nil {
+				return fmt.Errorf("unable to migrate build source of service %d: %w", row.ID, err)
+			}
+			changed, err := rotateSecrets(keyring, &b.DeployKey, &b.Token)
+			if err != nil {
+				return fmt.Errorf("unable to migrate build source of service %d: %w", row.ID, err)
+			}
+			if !changed {
+				continue
+			}
+			j, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE services SET build_source = $2 WHERE id = $1`, row.ID, string(j)); err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		var sources []struct {
+			ID        int    `db:"id"`
+			DeployKey string `db:"deploy_key"`
+			Token     string `db:"token"`
+		}
+		if err := tx.Select(&sources, `SELECT id, deploy_key, token FROM gitops_sources`); err != nil {
+			return err
+		}
+		for _, g := range sources {
+			changed, err := rotateSecrets(keyring, &g.DeployKey, &g.Token)
+			if err != nil {
+				return fmt.Errorf("unable to migrate gitops source %d: %w", g.ID, err)
+			}
+			if !changed {
+				continue
+			}
+			query := `UPDATE gitops_sources SET deploy_key = $2, token = $3 WHERE id = $1`
+			if _, err := tx.Exec(query, g.ID, g.DeployKey, g.Token); err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		var environments []struct {
+			ID        int    `db:"id"`
+			Overrides string `db:"overrides"`
+		}
+		if err := tx.Select(&environments, `SELECT id, overrides FROM project_environments`); err != nil {
+			return err
+		}
+		for _, e := range environments {
+			overrides := make(map[string]ServiceOverride)
+			if err := json.Unmarshal([]byte(e.Overrides), &overrides); err != nil {
+				return fmt.Errorf("unable to migrate overrides of environment %d: %w", e.ID, err)
+			}
+			changed := false
+			for _, override := range overrides {
+				for key, value := range override.EnvVars {
+					rotated, rotatedChanged, err := keyring.Rotate(value)
+					if err != nil {
+						return fmt.Errorf("unable to migrate overrides of environment %d: %w", e.ID, err)
+					}
+					override.EnvVars[key] = rotated
+					changed = changed || rotatedChanged
+				}
+			}
+			if !changed {
+				continue
+			}
+			j, err := json.Marshal(overrides)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE project_environments SET overrides = $2 WHERE id = $1`, e.ID, string(j)); err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		var schedules []struct {
+			ID           int    `db:"id"`
+			TargetConfig string `db:"target_config"`
+		}
+		if err := tx.Select(&schedules, `SELECT id, target_config FROM backup_schedules`); err != nil {
+			return err
+		}
+		for _, bs := range schedules {
+			var c backup.TargetConfig
+			if err := json.Unmarshal([]byte(bs.TargetConfig), &c); err != nil {
+				return fmt.Errorf("unable to migrate target config of backup schedule %d: %w", bs.ID, err)
+			}
+			changed, err := rotateSecrets(keyring, &c.SecretKey)
+			if err != nil {
+				return fmt.Errorf("unable to migrate target config of backup schedule %d: %w", bs.ID, err)
+			}
+			if !changed {
+				continue
+			}
+			j, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE backup_schedules SET target_config = $2 WHERE id = $1`, bs.ID, string(j)); err != nil {
+				return err
+			}
+			migrated++
+		}
+
+		if migrated > 0 {
+			slog.Info("migrated secrets", "count", migrated)
+		}
+		return nil
+	})
+}
+
+// rotateSecrets rotates the non-empty values and reports whether one of them changed.
+func rotateSecrets(keyring *secrets.Keyring, values ...*string) (bool, error) {
+	changed := false
+	for _, value := range values {
+		if *value == "" {
+			continue
+		}
+		rotated, rotatedChanged, err := keyring.Rotate(*value)
+		if err != nil {
+			return false, err
+		}
+		*value = rotated
+		changed = changed || rotatedChanged
+	}
+	return changed, nil
+}
+
+// migrateServiceSecrets moves env vars which look like secrets from the DCJ to the secret env vars and rotates
+// the secret env vars.
+func migrateServiceSecrets(keyring *secrets.Keyring, dcj, secretEnv string) (string, string, bool, error) {
+	env := make(map[string]string)
+	if secretEnv != "" {
+		if err := json.Unmarshal([]byte(secretEnv), &env); err != nil {
+			return "", "", false, err
+		}
+	}
+	containers := make(map[string]*compose.Container)
+	if err := json.Unmarshal([]byte(dcj), &containers); err != nil {
+		return "", "", false, err
+	}
+
+	changed := false
+	for _, c := range containers {
+		environment := make([]string, 0, len(c.Environment))
+		for _, e := range c.Environment {
+			key, value, _ := strings.Cut(e, "=")
+			if !secretEnvKey.MatchString(key) {
+				environment = append(environment, e)
+				continue
+			}
+			env[key] = value
+			changed = true
+		}
+		c.Environment = environment
+	}
+	for key, value := range env {
+		rotated, rotatedChanged, err := keyring.Rotate(value)
+		if err != nil {
+			return "", "", false, err
+		}
+		env[key] = rotated
+		changed = changed || rotatedChanged
+	}
+	if !changed {
+		return dcj, secretEnv, false, nil
+	}
+
+	dcjBytes, err := json.Marshal(containers)
+	if err != nil {
+		return "", "", false, err
+	}
+	envBytes, err := json.Marshal(env)
+	if err != nil {
+		return "", "", false, err
+	}
+	return string(dcjBytes), string(envBytes), true, nil
+}
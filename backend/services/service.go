@@ -11,6 +11,7 @@ import (
 
 	"github.com/devs-group/sloth/backend/config"
 	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/pkg/registry"
 	"github.com/devs-group/sloth/backend/utils"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
@@ -27,12 +28,12 @@ type Public struct {
 type Service struct {
 	ID          int                          `json:"id" db:"id"`
 	Ports       []string                     `json:"ports" binding:"gt=0"`
-	Image       string                       `json:"image" binding:"required"`
-	ImageTag    string                       `json:"image_tag" binding:"required"`
+	Image       string                       `json:"image" binding:"required_without=Build"`
+	ImageTag    string                       `json:"image_tag" binding:"required_without=Build"`
 	Command     string                       `json:"command"`
 	Public      Public                       `json:"public"`
 	EnvVars     [][]string                   `json:"env_vars"`
-	Volumes     []string                     `json:"volumes" binding:"dive,dirpath"`
+	Volumes     []Volume                     `json:"volumes"`
 	Name        string                       `json:"name" binding:"required" db:"name"`
 	HealthCheck *compose.HealthCheck         `json:"healthcheck,omitempty" `
 	Depends     map[string]compose.Condition `json:"depends_on,omitempty"`
@@ -40,6 +41,31 @@ type Service struct {
 	Usn         string                       `json:"usn" db:"usn"`
 	ProjectID   int                          `json:"-" db:"project_id"`
 	DCJ         string                       `json:"-" db:"dcj"`
+	// 0 when the volumes of the service are unlimited
+	VolumeLimitBytes     int64 `json:"volume_limit_bytes" db:"volume_limit_bytes"`
+	BlockDeployOverLimit bool  `json:"block_deploy_over_limit" db:"block_deploy_over_limit"`
+	// '' when the image isn't updated automatically, see registry.Policy
+	UpdatePolicy     string `json:"update_policy" db:"update_policy"`
+	UpdateConstraint string `json:"update_constraint" db:"update_constraint"`
+	// Deploy the digest the tag resolved to at the last deployment, see ImageDigest
+	PinDigest bool `json:"pin_digest" db:"pin_digest"`
+	// The next deployment pulls the tag instead of the pinned digest, e.g. when the tag points to a new image
+	repin bool
+	// The repository the image is built from, nil for prebuilt images
+	Build *BuildSource `json:"build,omitempty" db:"build_source"`
+	// Keys of the env vars which are stored encrypted and masked in responses, see MaskSecrets
+	SecretEnvVars []string `json:"secret_env_vars" db:"-"`
+	// The encrypted secret env vars as stored in the database
+	SecretEnv string `json:"-" db:"secret_env"`
+	// Names of the env groups of the organisation whose env vars the service gets, see EnvGroup
+	EnvGroups StringList `json:"env_groups" db:"env_groups"`
+
+	// Ignored in DB operations - populated separately
+	DiskUsage *DiskUsage `json:"disk_usage,omitempty" db:"-"`
+	// The last check for a new image of the update policy
+	ImageUpdate *ImageUpdateCheck `json:"image_update,omitempty" db:"-"`
+	// The image digest of the last deployment
+	ImageDigest *ImageDigest `json:"image_digest,omitempty" db:"-"`
 }
 
 func (s *S) DeleteMissingServices(upn UPN, projectID int, services []Service, tx *sqlx.Tx) error {
@@ -88,7 +114,9 @@ func (s *S) DeleteMissingServices(upn UPN, projectID int, services []Service, tx
 func (s *S) SelectServices(projectID int) ([]*Service, error) {
 	services := make([]*Service, 0)
 	query := `
-	SELECT json_extract(dcj, '$."' || key || '"') AS dcj, key as usn, project_id, name, services.id
+	SELECT json_extract(dcj, '$."' || key || '"') AS dcj, key as usn, project_id, name, services.id,
+		volume_limit_bytes, block_deploy_over_limit, update_policy, update_constraint, pin_digest, build_source,
+		secret_env, env_groups
 	FROM services,
 		 json_each(json_extract(dcj, '$'))
 	WHERE project_id = $1
@@ -108,9 +136,42 @@ func (s *S) SelectServices(projectID int) ([]*Service, error) {
 			slog.Error("error read service from dcj", "err", err)
 			continue
 		}
-		rowID := dbService.ID
+		service.ID = dbService.ID
+		service.VolumeLimitBytes = dbService.VolumeLimitBytes
+		service.BlockDeployOverLimit = dbService.BlockDeployOverLimit
+		service.UpdatePolicy = dbService.UpdatePolicy
+		service.UpdateConstraint = dbService.UpdateConstraint
+		service.PinDigest = dbService.PinDigest
+		service.Build = dbService.Build
+		service.EnvGroups = dbService.EnvGroups
+		if err := service.addSecretEnv(dbService.SecretEnv); err != nil {
+			return nil, err
+		}
 		services[id] = service
-		services[id].ID = rowID
+	}
+
+	usage, err := s.selectDiskUsage(projectID)
+	if err != nil {
+		return nil, err
+	}
+	checks, err := s.selectLatestImageUpdateChecks(projectID)
+	if err != nil {
+		return nil, err
+	}
+	digests, err := s.selectImageDigests(projectID)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if u, ok := usage[service.Usn]; ok {
+			service.DiskUsage = &u
+		}
+		if c, ok := checks[service.Usn]; ok {
+			service.ImageUpdate = &c
+		}
+		if d, ok := digests[service.Usn]; ok {
+			service.ImageDigest = &d
+		}
 	}
 
 	return services, nil
@@ -133,8 +194,9 @@ func (s *S) ReadServiceFromDCJ(service Service) (*Service, error) {
 		hosts = []string{""}
 	}
 
-	image := strings.Split(sc.Image, ":")
-	if len(image) < 2 {
+	// Registries can have a port, so only a colon after the last slash separates the tag
+	imageName, imageTag, _ := registry.SplitReference(sc.Image)
+	if imageTag == "" {
 		return nil, fmt.Errorf("unsuported image, expected 'image:tag' format got: %s", service.Image)
 	}
 
@@ -153,14 +215,11 @@ func (s *S) ReadServiceFromDCJ(service Service) (*Service, error) {
 		envVars = [][]string{{"", ""}}
 	}
 
-	volumes := make([]string, len(sc.Volumes))
-	for i, v := range sc.Volumes {
-		volumes[i] = strings.Split(v, ":")[1]
-	}
+	volumes := volumesFromCompose(service.Usn, sc.Volumes, sc.VolumeDefinitions)
 
 	// When no volumes are set, response with empty string
-	if len(sc.Volumes) == 0 {
-		volumes = []string{""}
+	if len(volumes) == 0 {
+		volumes = []Volume{{Type: compose.VolumeTypeBind}}
 	}
 
 	port, err := sc.Labels.GetPort()
@@ -173,8 +232,8 @@ func (s *S) ReadServiceFromDCJ(service Service) (*Service, error) {
 		Usn:         service.Usn,
 		Ports:       sc.Ports,
 		Command:     sc.Command,
-		Image:       image[0],
-		ImageTag:    image[1],
+		Image:       imageName,
+		ImageTag:    imageTag,
 		EnvVars:     envVars,
 		Volumes:     volumes,
 		HealthCheck: sc.HealthCheck,
@@ -204,7 +263,7 @@ func (s *S) UpdateService(tx *sqlx.Tx, service *Service, upn UPN, projectID int)
 		return err
 	}
 
-	var volumes []string
+	var volumes []compose.VolumeMount
 	if v != "" {
 		if err := json.Unmarshal([]byte(v), &volumes); err != nil {
 			slog.Error("can't unmarshal volumes", "err", err)
@@ -212,28 +271,52 @@ func (s *S) UpdateService(tx *sqlx.Tx, service *Service, upn UPN, projectID int)
 		}
 	}
 
-	_, serviceJSON, err := generateServiceCompose(service)
+	if err := service.generateEnvValues(); err != nil {
+		return err
+	}
+	service.detectSecretEnv()
+	container, serviceJSON, err := generateServiceCompose(service)
+	if err != nil {
+		return err
+	}
+	secretEnv, err := service.encryptedSecretEnv()
 	if err != nil {
 		return err
 	}
 	query = `
-    		UPDATE services SET dcj = $3, name = $2
+    		UPDATE services SET dcj = $3, name = $2, volume_limit_bytes = $5, block_deploy_over_limit = $6,
+    			update_policy = $7, update_constraint = $8, pin_digest = $9, build_source = $10, secret_env = $11,
+    			env_groups = $12
     			WHERE project_id = $1 AND json_extract(dcj, ('$."' || $4 || '"')) IS NOT NULL;
 	`
-	_, err = tx.Exec(query, projectID, service.Name, serviceJSON, service.Usn)
+	_, err = tx.Exec(
+		query, projectID, service.Name, serviceJSON, service.Usn, service.VolumeLimitBytes, service.BlockDeployOverLimit,
+		service.UpdatePolicy, service.UpdateConstraint, service.PinDigest, service.Build, secretEnv, service.EnvGroups,
+	)
 	if err != nil {
 		slog.Error("error updating services", "err", err)
 		return err
 	}
 
-	//volumeName := fmt.Sprintf("%s-%s", strings.ToLower(service.Name), strings.ToLower(service.Usn))
+	// Delete the data of bind mounts which are not used anymore.
+	// Named volumes are kept, they are managed by docker.
+	servicePath := path.Clean(service.getServicePath())
 	newVolumesMap := make(map[string]bool)
-	for _, vol := range service.Volumes {
-		newVolumesMap["./"+path.Join(service.getServicePath(), vol)] = true
+	for _, vol := range container.Volumes {
+		if vol.Type == compose.VolumeTypeBind {
+			newVolumesMap[path.Clean(vol.Source)] = true
+		}
 	}
 
 	for _, origVolume := range volumes {
-		vPath := strings.Split(origVolume, ":")[0]
+		if origVolume.Type != compose.VolumeTypeBind {
+			continue
+		}
+		// Shared volumes are managed by the project
+		vPath := path.Clean(origVolume.Source)
+		if !strings.HasPrefix(vPath, servicePath+"/") {
+			continue
+		}
 		if _, exists := newVolumesMap[vPath]; !exists {
 			err := utils.DeleteFolder(path.Join(upn.GetProjectPath(), vPath))
 			if err != nil {
@@ -253,13 +336,32 @@ func (s *S) SaveService(service *Service, upn UPN, projectID int) error {
 
 	service.Usn = utils.GenerateRandomName()
 
+	return s.insertService(s.dbService.GetConn(), service, projectID)
+}
+
+// insertService inserts a service which already got its USN.
+func (s *S) insertService(db sqlx.Execer, service *Service, projectID int) error {
+	if err := service.generateEnvValues(); err != nil {
+		return err
+	}
+	service.detectSecretEnv()
 	_, serviceJSON, err := generateServiceCompose(service)
 	if err != nil {
 		return errors.Wrap(err, "unable to generate service compose")
 	}
+	secretEnv, err := service.encryptedSecretEnv()
+	if err != nil {
+		return err
+	}
 
-	query := `INSERT INTO services (name, project_id, dcj)	VALUES ($1, $2, $3)`
-	_, err = s.dbService.GetConn().Exec(query, service.Name, projectID, serviceJSON)
+	query := `
+		INSERT INTO services (name, usn, project_id, dcj, volume_limit_bytes, block_deploy_over_limit, update_policy, update_constraint, pin_digest, build_source, secret_env, env_groups)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+	_, err = db.Exec(
+		query, service.Name, service.Usn, projectID, serviceJSON, service.VolumeLimitBytes, service.BlockDeployOverLimit,
+		service.UpdatePolicy, service.UpdateConstraint, service.PinDigest, service.Build, secretEnv, service.EnvGroups,
+	)
 	if err != nil {
 		return err
 	}
@@ -267,6 +369,17 @@ func (s *S) SaveService(service *Service, upn UPN, projectID int) error {
 	return nil
 }
 
+// EnvMap returns the environment variables of the service as a map.
+func (s *Service) EnvMap() map[string]string {
+	env := make(map[string]string, len(s.EnvVars))
+	for _, ev := range s.EnvVars {
+		if len(ev) == 2 && ev[0] != "" {
+			env[ev[0]] = ev[1]
+		}
+	}
+	return env
+}
+
 func (s *Service) getServicePath() string {
 	cfg := config.GetConfig()
 	return fmt.Sprintf("./%s/%s", cfg.PersistentVolumeDirectoryName, sanitizeName(s.Usn))
@@ -275,12 +388,28 @@ func (s *Service) getServicePath() string {
 func generateServiceCompose(service *Service) (*compose.Container, string, error) {
 	cfg := config.GetConfig()
 
+	// Services built from a repository use their build repository until the first build
+	if service.Build != nil {
+		if err := service.Build.Validate(); err != nil {
+			return nil, "", errors.Wrap(err, "invalid build source")
+		}
+		if service.Image == "" {
+			service.Image = buildRepository(service.Usn)
+		}
+		if service.ImageTag == "" {
+			service.ImageTag = "latest"
+		}
+	}
+
 	c := &compose.Container{
 		Image:    fmt.Sprintf("%s:%s", service.Image, service.ImageTag),
 		Restart:  "always",
 		Networks: []string{"traefik", "default"},
 		Ports:    service.Ports,
 	}
+	if isLocalBuild(service.Image) {
+		c.PullPolicy = compose.PullPolicyNever
+	}
 
 	if service.Depends != nil {
 		c.Depends = service.Depends
@@ -318,23 +447,26 @@ func generateServiceCompose(service *Service) (*compose.Container, string, error
 	}
 	c.Deploy.Replicas = &cfg.DockerContainerReplicas
 
+	// Secret env vars are stored encrypted, see encryptedSecretEnv
 	for _, ev := range service.EnvVars {
-		if len(ev) == 2 && ev[0] != "" && ev[1] != "" {
+		if len(ev) == 2 && ev[0] != "" && ev[1] != "" && !service.isSecretEnv(ev[0]) {
 			c.Environment = append(c.Environment, fmt.Sprintf("%s=%s", ev[0], ev[1]))
 		}
 	}
 
-	if len(service.Volumes) > 0 && service.Volumes[0] != "" {
-		for _, v := range service.Volumes {
-			dataPath := v
-
-			if strings.HasPrefix(v, "/") {
-				dataPath, _ = strings.CutPrefix(v, "/")
-			}
-			c.Volumes = append(c.Volumes, fmt.Sprintf("%s/%s:%s", service.getServicePath(), dataPath, v))
+	if service.UpdatePolicy != "" {
+		if err := service.updatePolicy().Validate(); err != nil {
+			return nil, "", errors.Wrap(err, "invalid update policy")
 		}
 	}
 
+	volumes, volumeDefinitions, err := service.composeVolumes()
+	if err != nil {
+		return nil, "", err
+	}
+	c.Volumes = volumes
+	c.VolumeDefinitions = volumeDefinitions
+
 	usn := sanitizeName(service.Usn)
 	if service.Public.Enabled {
 		hosts := []string{fmt.Sprintf("Host(`%s.%s`)", usn, cfg.BackendHost)}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+// SharedVolume is a directory of a project which can be mounted into several of its services.
+// Its data is kept until the volume is removed from the project, independent of the services using it.
+type SharedVolume struct {
+	ID        int    `json:"id" db:"id"`
+	Name      string `json:"name" binding:"required" db:"name"`
+	ProjectID int    `json:"-" db:"project_id"`
+}
+
+func (v SharedVolume) validate() error {
+	if !volumeNameRegex.MatchString(v.Name) {
+		return fmt.Errorf("invalid shared volume name %q, only lowercase letters, digits, '_', '.' and '-' are allowed", v.Name)
+	}
+	return nil
+}
+
+func sharedVolumePath(name string) string {
+	cfg := config.GetConfig()
+	return fmt.Sprintf("./%s/%s", cfg.SharedVolumeDirectoryName, name)
+}
+
+func (s *S) SelectSharedVolumes(projectID int) ([]SharedVolume, error) {
+	volumes := make([]SharedVolume, 0)
+	query := `SELECT id, name, project_id FROM shared_volumes WHERE project_id = $1 ORDER BY name`
+	if err := s.dbService.GetConn().Select(&volumes, query, projectID); err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// validateSharedVolumes checks the shared volumes of the project and that services only mount existing ones.
+func (p *Project) validateSharedVolumes() error {
+	names := make(map[string]bool, len(p.SharedVolumes))
+	for _, v := range p.SharedVolumes {
+		if err := v.validate(); err != nil {
+			return err
+		}
+		if names[v.Name] {
+			return fmt.Errorf("shared volume %q is defined twice", v.Name)
+		}
+		names[v.Name] = true
+	}
+
+	for _, service := range p.Services {
+		for _, v := range service.Volumes {
+			if v.Type == VolumeTypeShared && !names[v.Name] {
+				return fmt.Errorf("service %s mounts the unknown shared volume %q", service.Name, v.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// saveSharedVolumes replaces the shared volumes of the project and returns the folders of the removed ones. Those
+// are deleted by the caller with deleteSharedVolumeFolders once the transaction is committed.
+// A nil slice keeps the stored volumes, so clients which don't know about shared volumes can't remove them by accident.
+func (s *S) saveSharedVolumes(tx *sqlx.Tx, p *Project) ([]string, error) {
+	if p.SharedVolumes == nil {
+		p.SharedVolumes = make([]SharedVolume, 0)
+		query := `SELECT id, name, project_id FROM shared_volumes WHERE project_id = $1 ORDER BY name`
+		if err := tx.Select(&p.SharedVolumes, query, p.ID); err != nil {
+			return nil, err
+		}
+		return nil, p.validateSharedVolumes()
+	}
+
+	if err := p.validateSharedVolumes(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(p.SharedVolumes))
+	for i, v := range p.SharedVolumes {
+		names[i] = v.Name
+	}
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	query := `
+		DELETE FROM shared_volumes
+		WHERE project_id = $1 AND name NOT IN (SELECT value FROM json_each($2))
+		RETURNING name
+	`
+	if err := tx.Select(&removed, query, p.ID, string(namesJSON)); err != nil {
+		return nil, err
+	}
+
+	for i := range p.SharedVolumes {
+		query := `
+			INSERT INTO shared_volumes (name, project_id) VALUES ($1, $2)
+			ON CONFLICT (project_id, name) DO UPDATE SET name = excluded.name
+			RETURNING id
+		`
+		if err := tx.Get(&p.SharedVolumes[i].ID, query, p.SharedVolumes[i].Name, p.ID); err != nil {
+			return nil, err
+		}
+		p.SharedVolumes[i].ProjectID = p.ID
+	}
+
+	folders := make([]string, len(removed))
+	for i, name := range removed {
+		folders[i] = path.Join(p.UPN.GetProjectPath(), sharedVolumePath(name))
+	}
+	return folders, nil
+}
+
+// deleteSharedVolumeFolders deletes the data of removed shared volumes. The volumes are already gone from the
+// database at this point, so failures are only logged.
+func deleteSharedVolumeFolders(folders []string) {
+	for _, folder := range folders {
+		if err := utils.DeleteFolder(folder); err != nil {
+			slog.Error("unable to delete folder of removed shared volume", "path", folder, "err", err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
@@ -8,11 +9,10 @@ import (
 	"path/filepath"
 	"sync"
 
-	"github.com/pkg/errors"
-
 	"github.com/devs-group/sloth/backend/config"
 	"github.com/devs-group/sloth/backend/pkg/compose"
 	"github.com/devs-group/sloth/backend/pkg/docker"
+	"github.com/devs-group/sloth/backend/pkg/registry"
 	"github.com/devs-group/sloth/backend/utils"
 )
 
@@ -20,6 +20,13 @@ type UPN string
 type ContainerState struct {
 	State  string `json:"state"`
 	Status string `json:"status"`
+	Image  string `json:"image"`
+	// Digest of the running image
+	Digest string `json:"digest,omitempty"`
+	// TagDigest is the digest the tag of the service currently points to in the registry
+	TagDigest string `json:"tag_digest,omitempty"`
+	// Drift is set when the tag points to another image than the running one
+	Drift bool `json:"drift"`
 }
 
 func (upn *UPN) GetProjectPath() string {
@@ -27,25 +34,15 @@ func (upn *UPN) GetProjectPath() string {
 	return path.Join(filepath.Clean(cfg.ProjectsDir), string(*upn))
 }
 
-func (upn *UPN) RunDockerLogin(credentials []DockerCredential) error {
-	slog.Debug("running docker login")
-	if len(credentials) == 0 {
-		return nil
-	}
-	for _, dc := range credentials {
-		err := docker.Login(dc.Username, dc.Password, dc.Registry, upn.GetProjectPath())
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func (upn *UPN) GetContainersState() (map[string]ContainerState, error) {
 	containers, err := docker.GetContainersByDirectory(upn.GetProjectPath())
 	if err != nil {
 		return nil, err
 	}
+	digests, err := docker.ContainerRepoDigests(context.Background(), containers)
+	if err != nil {
+		return nil, err
+	}
 	state := make(map[string]ContainerState)
 	for i := range containers {
 		c := containers[i]
@@ -53,6 +50,8 @@ func (upn *UPN) GetContainersState() (map[string]ContainerState, error) {
 		state[sn] = ContainerState{
 			State:  c.State,
 			Status: c.Status,
+			Image:  c.Image,
+			Digest: digests[c.ID],
 		}
 	}
 	return state, nil
@@ -60,50 +59,84 @@ func (upn *UPN) GetContainersState() (map[string]ContainerState, error) {
 
 func (upn *UPN) StartContainers(services compose.Services, credentials []DockerCredential) error {
 	slog.Debug("starting containers")
-	err := upn.RunDockerLogin(credentials)
-	if err != nil {
-		slog.Error("unable to run docker login", "path", upn.GetProjectPath(), "err", err)
+	if err := upn.PullImages(services, credentials); err != nil {
 		return err
 	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(services))
-	for _, s := range services {
-		wg.Add(1)
-		go func(service *compose.Container) {
-			defer wg.Done()
-			slog.Debug("pulling", "service.name", service.Name)
-			err := docker.Pull(service.Image, upn.GetProjectPath())
-			if err != nil {
-				errCh <- err
-			}
-		}(s)
+	if err := compose.Up(upn.GetProjectPath()); err != nil {
+		return fmt.Errorf("unable to start containers: %v", err)
 	}
 
-	go func() {
-		wg.Wait()
-		close(errCh)
-	}()
+	return nil
+}
 
-	var errs []error
-	for err := range errCh {
-		errs = append(errs, err)
+// StartServices pulls and recreates only the services with the given usns,
+// the other containers of the project keep running.
+func (upn *UPN) StartServices(services compose.Services, credentials []DockerCredential, usns ...string) error {
+	slog.Debug("starting services", "usns", usns)
+	selected := make(compose.Services, len(usns))
+	for _, usn := range usns {
+		if s, ok := services[usn]; ok {
+			selected[usn] = s
+		}
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("unable to pull containers: %v", errs)
+	if err := upn.PullImages(selected, credentials); err != nil {
+		return err
 	}
 
-	for _, dc := range credentials {
-		err = docker.Logout(upn.GetProjectPath(), dc.Registry)
-		if err != nil {
-			return fmt.Errorf("unable to run docker logout for registry %s: %v", dc.Registry, err)
+	if err := compose.UpServices(upn.GetProjectPath(), usns...); err != nil {
+		return fmt.Errorf("unable to start services: %v", err)
+	}
+
+	return nil
+}
+
+// legacyDockerConfigFiles were written by earlier versions, which logged in to registries with a docker config in
+// the project directory.
+var legacyDockerConfigFiles = []string{"config.json", "config.json.tmp"}
+
+// PullImages pulls the images of the services, each image once. Credentials are passed with the pulls of their
+// registry only. At most IMAGE_PULL_CONCURRENCY images are pulled at once, failed pulls are retried.
+func (upn *UPN) PullImages(services compose.Services, credentials []DockerCredential) error {
+	cfg := config.GetConfig()
+	for _, name := range legacyDockerConfigFiles {
+		if err := os.Remove(path.Join(upn.GetProjectPath(), name)); err != nil && !os.IsNotExist(err) {
+			return err
 		}
 	}
 
-	if err := compose.Up(upn.GetProjectPath()); err != nil {
-		return fmt.Errorf("unable to start containers: %v", err)
+	images := make(map[string]bool, len(services))
+	for _, s := range services {
+		// Images built by sloth only exist locally
+		if s.PullPolicy != compose.PullPolicyNever {
+			images[s.Image] = true
+		}
 	}
+	creds := registryCredentials(credentials)
+	sem := make(chan struct{}, max(cfg.ImagePullConcurrency, 1))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for image := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			slog.Debug("pulling", "image", image)
+			c := creds[registry.NormalizeDomain(registry.Domain(image))]
+			if err := docker.Pull(context.Background(), image, c.Username, c.Password, cfg.ImagePullRetries); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
 
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to pull containers: %v", errs)
+	}
 	return nil
 }
 
@@ -134,9 +167,6 @@ func (upn *UPN) DeleteBackupFiles() {
 	if err := utils.DeleteFile(fmt.Sprintf("%s.tmp", cfg.DockerComposeFileName), upn.GetProjectPath()); err != nil {
 		slog.Error("unable to delete temp docker-compose file", "upn", upn, "err", err)
 	}
-	if err := utils.DeleteFile(fmt.Sprintf("%s.tmp", cfg.DockerConfigFileName), upn.GetProjectPath()); err != nil {
-		slog.Error("unable to delete temp docker-compose file", "upn", upn, "err", err)
-	}
 }
 
 func (upn *UPN) BackupCurrentFiles() error {
@@ -144,13 +174,6 @@ func (upn *UPN) BackupCurrentFiles() error {
 
 	slog.Debug("backing up current files")
 	if err := upn.CreateTempFile(cfg.DockerComposeFileName); err != nil {
-		return err
-	}
-	if err := upn.CreateTempFile(cfg.DockerConfigFileName); err != nil {
-		err2 := upn.RollbackFromTempFile(cfg.DockerComposeFileName)
-		if err2 != nil {
-			err = errors.Wrap(err, err2.Error())
-		}
 		slog.Error("unable to backup current files", "err", err)
 		return err
 	}
@@ -179,10 +202,6 @@ func (upn *UPN) RollbackToPreviousState() {
 	if err != nil {
 		slog.Error("unable to rollback docker compose file", "err", err)
 	}
-	err = upn.RollbackFromTempFile(cfg.DockerConfigFileName)
-	if err != nil {
-		slog.Error("unable to rollback docker config file", "err", err)
-	}
 	err = upn.StartContainers(nil, nil)
 	if err != nil {
 		slog.Error("unable to start containers after rollback", "err", err)
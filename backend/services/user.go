@@ -16,6 +16,7 @@ type User struct {
 	EmailVerified         bool      `json:"email_verified" db:"email_verified"`
 	CurrentOrganisationID int       `json:"current_organisation_id" db:"current_organisation_id"`
 	CreatedAt             time.Time `json:"created_at" db:"created_at"`
+	IsServiceAccount      bool      `json:"is_service_account" db:"is_service_account"`
 
 	// populated internal
 	GothUser *goth.User `json:"-"`
@@ -47,7 +48,7 @@ func (g *User) GetUserWithSocialID(socialID string, tx *sqlx.Tx) (bool, error) {
 }
 
 func GetUserByMail(email string, tx *sqlx.Tx) (*User, error) {
-	query := "SELECT u.* FROM users u JOIN auth_methods a ON a.user_id = u.user_id WHERE u.email=$1 LIMIT 1"
+	query := "SELECT u.* FROM users u JOIN auth_methods a ON a.user_id = u.user_id WHERE lower(u.email)=lower($1) LIMIT 1"
 	var user User
 	if err := tx.Get(&user, query, email); err != nil {
 		return nil, err
@@ -88,42 +89,22 @@ func UpsertUserBySocialIDAndMethod(methodType string, user *goth.User, tx *sqlx.
 
 	// Only create the user if we can't find an entry
 	if existingUser == nil {
-		// Create a default organisation for the user and assign it
-		var organisationID int
-		query = `INSERT INTO organisations (name, is_default) VALUES( $1, $2 ) RETURNING id;`
-		err = tx.Get(&organisationID, query, "My Organisation", true)
+		ids, err := createUser(email, user.NickName, emailIsVerified, tx)
 		if err != nil {
-			return nil, errors.Wrap(err, "can't create organisation for user")
-		}
-
-		// Create the user
-		query = `
-			INSERT INTO users (email, username, email_verified, current_organisation_id)
-			VALUES( $1, $2, $3, $4 )
-			RETURNING user_id, current_organisation_id;
-		`
-		err = tx.Get(&sessionIDs, query, email, user.NickName, emailIsVerified, organisationID)
-		if err != nil {
-			return nil, errors.Wrap(err, "can't insert new user")
-		}
-
-		// Finally add the user as the owner to the new organisation
-		query = `INSERT INTO organisation_members (organisation_id, user_id, role) VALUES ( $1, $2, $3 )`
-		res, err := tx.Exec(query, sessionIDs.CurrentOrganisationID, sessionIDs.UserID, "owner")
-		if err != nil {
-			return nil, errors.Wrap(err, "unable to add member to organisation")
-		}
-		affected, err := res.RowsAffected()
-		if err != nil {
-			return nil, errors.New("unable to add member to organisation")
-		}
-		if affected == 0 {
-			return nil, errors.New("unable to add member to organisation")
+			return nil, err
 		}
+		sessionIDs = *ids
 	} else {
 		// Otherwise make sure we set the existing user ID
 		sessionIDs.UserID = existingUser.UserID
 		sessionIDs.CurrentOrganisationID = existingUser.CurrentOrganisationID
+
+		// A password of an unverified email wasn't necessarily set by the owner of the email
+		if !existingUser.EmailVerified && emailIsVerified {
+			if err := dropUnverifiedPassword(existingUser.UserID, tx); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// We always insert the auth_method which happens only once per user and method
@@ -134,3 +115,41 @@ func UpsertUserBySocialIDAndMethod(methodType string, user *goth.User, tx *sqlx.
 
 	return &sessionIDs, nil
 }
+
+// createUser creates a user with a default organisation it owns.
+func createUser(email, username string, emailVerified bool, tx *sqlx.Tx) (*SessionIDs, error) {
+	// Create a default organisation for the user and assign it
+	var organisationID int
+	query := `INSERT INTO organisations (name, is_default) VALUES( $1, $2 ) RETURNING id;`
+	err := tx.Get(&organisationID, query, "My Organisation", true)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create organisation for user")
+	}
+
+	// Create the user
+	var sessionIDs SessionIDs
+	query = `
+		INSERT INTO users (email, username, email_verified, current_organisation_id)
+		VALUES( $1, $2, $3, $4 )
+		RETURNING user_id, current_organisation_id;
+	`
+	err = tx.Get(&sessionIDs, query, email, username, emailVerified, organisationID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't insert new user")
+	}
+
+	// Finally add the user as the owner to the new organisation
+	query = `INSERT INTO organisation_members (organisation_id, user_id, role) VALUES ( $1, $2, $3 )`
+	res, err := tx.Exec(query, sessionIDs.CurrentOrganisationID, sessionIDs.UserID, "owner")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to add member to organisation")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, errors.New("unable to add member to organisation")
+	}
+	if affected == 0 {
+		return nil, errors.New("unable to add member to organisation")
+	}
+	return &sessionIDs, nil
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/devs-group/sloth/backend/pkg/compose"
+)
+
+// VolumeTypeShared mounts a shared volume of the project, see SharedVolume
+const VolumeTypeShared = "shared"
+
+var volumeNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// Volume is a volume of a service. Bind mounts are stored below the data directory of the service,
+// shared volumes below the one of the project, named volumes are managed by docker and tmpfs mounts
+// live in memory only.
+//
+// Like in docker compose, a plain string is the short syntax of a writable bind mount, e.g. "/data".
+type Volume struct {
+	Type string `json:"type"`
+	// Target is the path inside of the container
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only"`
+	// Name of a named or shared volume, Driver and DriverOpts are only used by named volumes
+	Name       string            `json:"name,omitempty"`
+	Driver     string            `json:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty"`
+	// Size of a tmpfs mount in bytes, 0 is unlimited
+	Size int64 `json:"size,omitempty"`
+}
+
+func (v Volume) MarshalJSON() ([]byte, error) {
+	if v.isShort() {
+		return json.Marshal(v.Target)
+	}
+	// Alias to avoid recursion
+	type volume Volume
+	return json.Marshal(volume(v))
+}
+
+func (v *Volume) UnmarshalJSON(b []byte) error {
+	var target string
+	if err := json.Unmarshal(b, &target); err == nil {
+		*v = Volume{Type: compose.VolumeTypeBind, Target: target}
+		return nil
+	}
+
+	type volume Volume
+	var long volume
+	if err := json.Unmarshal(b, &long); err != nil {
+		return err
+	}
+	*v = Volume(long)
+	if v.Type == "" {
+		v.Type = compose.VolumeTypeBind
+	}
+	return nil
+}
+
+func (v Volume) isShort() bool {
+	return (v.Type == "" || v.Type == compose.VolumeTypeBind) && !v.ReadOnly
+}
+
+func (v Volume) validate() error {
+	if !path.IsAbs(v.Target) {
+		return fmt.Errorf("volume target %q must be an absolute path", v.Target)
+	}
+	if strings.ContainsAny(v.Target, ": ") {
+		return fmt.Errorf("volume target %q must not contain colons or spaces", v.Target)
+	}
+	// Bind mounts are stored below the folder of the project by their target, which must not lead out of it
+	if path.Clean(v.Target) != v.Target || slices.Contains(strings.Split(v.Target, "/"), "..") {
+		return fmt.Errorf("volume target %q must be a clean path without '..'", v.Target)
+	}
+
+	switch v.Type {
+	case compose.VolumeTypeBind:
+		if path.Clean(v.Target) == "/" {
+			return fmt.Errorf("unable to bind mount the root directory")
+		}
+	case compose.VolumeTypeVolume, VolumeTypeShared:
+		if !volumeNameRegex.MatchString(v.Name) {
+			return fmt.Errorf("invalid volume name %q, only lowercase letters, digits, '_', '.' and '-' are allowed", v.Name)
+		}
+	case compose.VolumeTypeTmpfs:
+		if v.Size < 0 {
+			return fmt.Errorf("tmpfs size must not be negative")
+		}
+	default:
+		return fmt.Errorf("unsupported volume type %q", v.Type)
+	}
+	return nil
+}
+
+// volumeKey is the name of a named volume in the compose file, which is unique within the project.
+func volumeKey(usn, name string) string {
+	return fmt.Sprintf("%s-%s", sanitizeName(usn), name)
+}
+
+// hasVolumes returns false for the empty placeholder volume sent by the frontend.
+func (s *Service) hasVolumes() bool {
+	for _, v := range s.Volumes {
+		if v.Target != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// composeVolumes returns the volume mounts of the service and the definitions of its named volumes.
+func (s *Service) composeVolumes() ([]compose.VolumeMount, map[string]*compose.Volume, error) {
+	var mounts []compose.VolumeMount
+	definitions := make(map[string]*compose.Volume)
+
+	for _, v := range s.Volumes {
+		if v.Target == "" {
+			continue
+		}
+		if v.Type == "" {
+			v.Type = compose.VolumeTypeBind
+		}
+		if err := v.validate(); err != nil {
+			return nil, nil, err
+		}
+
+		mount := compose.VolumeMount{Type: v.Type, Target: v.Target, ReadOnly: v.ReadOnly}
+		switch v.Type {
+		case compose.VolumeTypeBind:
+			dataPath, _ := strings.CutPrefix(v.Target, "/")
+			mount.Source = fmt.Sprintf("%s/%s", s.getServicePath(), dataPath)
+		case compose.VolumeTypeVolume:
+			mount.Source = volumeKey(s.Usn, v.Name)
+			definitions[mount.Source] = &compose.Volume{Driver: v.Driver, DriverOpts: v.DriverOpts}
+		case VolumeTypeShared:
+			mount.Type = compose.VolumeTypeBind
+			mount.Source = sharedVolumePath(v.Name)
+		case compose.VolumeTypeTmpfs:
+			if v.Size > 0 {
+				mount.Tmpfs = &compose.TmpfsOptions{Size: v.Size}
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+
+	if len(definitions) == 0 {
+		definitions = nil
+	}
+	return mounts, definitions, nil
+}
+
+// volumesFromCompose is the inverse of composeVolumes.
+func volumesFromCompose(usn string, mounts []compose.VolumeMount, definitions map[string]*compose.Volume) []Volume {
+	volumes := make([]Volume, 0, len(mounts))
+	for _, m := range mounts {
+		v := Volume{Type: m.Type, Target: m.Target, ReadOnly: m.ReadOnly}
+		switch m.Type {
+		case compose.VolumeTypeBind:
+			if name, ok := strings.CutPrefix(m.Source, sharedVolumePath("")); ok {
+				v.Type = VolumeTypeShared
+				v.Name = name
+			}
+		case compose.VolumeTypeVolume:
+			v.Name = strings.TrimPrefix(m.Source, sanitizeName(usn)+"-")
+			if d, ok := definitions[m.Source]; ok && d != nil {
+				v.Driver = d.Driver
+				v.DriverOpts = d.DriverOpts
+			}
+		case compose.VolumeTypeTmpfs:
+			if m.Tmpfs != nil {
+				v.Size = m.Tmpfs.Size
+			}
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes
+}
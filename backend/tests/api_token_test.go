@@ -0,0 +1,110 @@
+package main_tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestAPITokens(t *testing.T) {
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('personal')`,
+		`INSERT INTO organisations (name) VALUES ('team')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('dev@example.com', 1)`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+
+	assert.Equal(t, services.APITokenScopeRead, services.ScopeForMethod(http.MethodGet))
+	assert.Equal(t, services.APITokenScopeWrite, services.ScopeForMethod(http.MethodDelete))
+
+	// Personal tokens act as their user
+	personal := services.APIToken{Name: "cli", Scopes: services.StringList{services.APITokenScopeRead}, UserID: 1}
+	require.NoError(t, personal.Validate())
+	require.NoError(t, s.SavePersonalAPIToken(&personal))
+
+	identity, err := s.AuthenticateAPIToken(personal.Token, services.APITokenScopeRead)
+	require.NoError(t, err)
+	assert.Equal(t, 1, identity.UserID)
+	assert.Equal(t, 1, identity.OrganisationID)
+	_, err = s.AuthenticateAPIToken(personal.Token, services.APITokenScopeWrite)
+	assert.ErrorIs(t, err, services.ErrMissingScope)
+	_, err = s.AuthenticateAPIToken("sla_unknown", services.APITokenScopeRead)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+
+	// Personal tokens stay in the organisation they were created for
+	_, err = conn.Exec(`UPDATE users SET current_organisation_id = 2 WHERE user_id = 1`)
+	require.NoError(t, err)
+	identity, err = s.AuthenticateAPIToken(personal.Token, services.APITokenScopeRead)
+	require.NoError(t, err)
+	assert.Equal(t, 1, identity.OrganisationID)
+	orgTokens, err := s.SelectOrganisationAPITokens(1)
+	require.NoError(t, err)
+	assert.Empty(t, orgTokens)
+
+	tokens, err := s.SelectPersonalAPITokens("1")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].LastUsedAt)
+	assert.Empty(t, tokens[0].Token)
+
+	// Organisation tokens act as a service account of the organisation
+	team := services.APIToken{Name: "ci", Scopes: services.StringList{services.APITokenScopeRead, services.APITokenScopeWrite}}
+	require.NoError(t, s.SaveOrganisationAPIToken(&team, 2))
+	identity, err = s.AuthenticateAPIToken(team.Token, services.APITokenScopeWrite)
+	require.NoError(t, err)
+	assert.NotEqual(t, 1, identity.UserID)
+	assert.Equal(t, 2, identity.OrganisationID)
+	role, err := s.OrganisationRole(2, "2")
+	require.NoError(t, err)
+	assert.Equal(t, "member", role)
+
+	tokens, err = s.SelectOrganisationAPITokens(2)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	tokens, err = s.SelectPersonalAPITokens("1")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+
+	// Expired tokens
+	_, err = conn.Exec(`UPDATE api_tokens SET expires_at = $1 WHERE id = $2`, time.Now().Add(-time.Minute).UTC(), personal.ID)
+	require.NoError(t, err)
+	_, err = s.AuthenticateAPIToken(personal.Token, services.APITokenScopeRead)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+
+	// Revoking an organisation token removes its service account
+	assert.Error(t, s.DeleteOrganisationAPIToken(1, team.ID))
+	require.NoError(t, s.DeleteOrganisationAPIToken(2, team.ID))
+	_, err = s.AuthenticateAPIToken(team.Token, services.APITokenScopeRead)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+	var users int
+	require.NoError(t, conn.Get(&users, `SELECT count(*) FROM users`))
+	assert.Equal(t, 1, users)
+
+	require.NoError(t, s.DeletePersonalAPIToken("1", personal.ID))
+	assert.Error(t, s.DeletePersonalAPIToken("1", personal.ID))
+
+	// Personal tokens are audited in the organisation they act in
+	events, err := s.SelectAuditEvents(1, services.AuditFilter{Action: "api_token"})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, services.AuditActionAPITokenDelete, events[0].Action)
+	assert.Equal(t, services.AuditActionAPITokenCreate, events[1].Action)
+	assert.Equal(t, "cli", events[1].Target)
+	assert.NotContains(t, string(events[1].After), personal.Token)
+
+	assert.Error(t, (&services.APIToken{Name: "x", Scopes: services.StringList{"admin"}}).Validate())
+}
@@ -0,0 +1,227 @@
+package main_tests
+
+import (
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestAuditEvents(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("SECRET_KEYS", testKey("primary", 1))
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('team')`,
+		`INSERT INTO organisations (name) VALUES ('others')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('owner@example.com', 1)`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('member@example.com', 1)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner')`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 2, 'member')`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	// Mutations without an actor are recorded as caused by the system
+	s := services.New(dbService)
+	p := &services.Project{
+		Name:       "shop",
+		UPN:        "shop-upn",
+		HookSecret: "hook-secret",
+		Services: []*services.Service{{
+			Name:          "api",
+			Image:         "acme/api",
+			ImageTag:      "1.0.0",
+			EnvVars:       [][]string{{"DB_PASSWORD", "db-pass"}, {"LOG_LEVEL", "info"}},
+			SecretEnvVars: services.StringList{"DB_PASSWORD"},
+		}},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+	other := &services.Project{Name: "other", UPN: "other-upn"}
+	require.NoError(t, s.SaveProject(other, "2"))
+
+	events, err := s.SelectAuditEvents(1, services.AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	created := events[0]
+	assert.Equal(t, services.AuditActionProjectCreate, created.Action)
+	assert.Equal(t, services.ActorTypeSystem, created.ActorType)
+	require.NotNil(t, created.ProjectID)
+	assert.Equal(t, p.ID, *created.ProjectID)
+	assert.Equal(t, "shop", created.ProjectName)
+	assert.Nil(t, created.Before)
+	// Secrets are redacted
+	after := string(created.After)
+	assert.Contains(t, after, "LOG_LEVEL")
+	assert.NotContains(t, after, "db-pass")
+	assert.NotContains(t, after, "hook-secret")
+	assert.Contains(t, after, services.SecretMask)
+
+	// Actors are recorded with their request
+	actor := s.As(services.Actor{Type: services.ActorTypeUser, UserID: 1, IP: "10.0.0.1", UserAgent: "cli"})
+	c := &services.RegistryCredential{Name: "hub", Registry: "docker.io", Username: "ci", Password: "hub-pass", OrganisationID: 1}
+	require.NoError(t, actor.SaveRegistryCredential(c))
+	c.Password = "rotated-pass"
+	require.NoError(t, actor.SaveRegistryCredential(c))
+	events, err = s.SelectAuditEvents(1, services.AuditFilter{Action: "registry_credential"})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, services.AuditActionRegistryCredSave, events[0].Action)
+	assert.Equal(t, "owner@example.com", events[0].ActorName)
+	assert.Equal(t, "10.0.0.1", events[0].IP)
+	assert.Equal(t, "cli", events[0].UserAgent)
+	require.NotNil(t, events[0].ActorUserID)
+	assert.Equal(t, 1, *events[0].ActorUserID)
+	assert.NotNil(t, events[0].Before)
+	assert.Nil(t, events[1].Before)
+	for _, e := range events {
+		assert.NotContains(t, string(e.Before)+string(e.After), "hub-pass")
+		assert.NotContains(t, string(e.After), "rotated-pass")
+		assert.Contains(t, string(e.After), services.SecretMask)
+	}
+
+	// Keys of secrets are redacted in nested objects too
+	bs := &services.BackupSchedule{
+		Cron:         "@daily",
+		Mode:         services.BackupModeVolume,
+		TargetType:   backup.TargetTypeS3,
+		TargetConfig: backup.TargetConfig{Bucket: "backups", AccessKey: "s3-access", SecretKey: "s3-secret"},
+		ProjectID:    other.ID,
+	}
+	require.NoError(t, s.SaveBackupSchedule(bs))
+	events, err = s.SelectAuditEvents(2, services.AuditFilter{Action: "backup_schedule"})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Contains(t, string(events[0].After), "backups")
+	assert.NotContains(t, string(events[0].After), "s3-access")
+	assert.NotContains(t, string(events[0].After), "s3-secret")
+
+	tokens := make(map[string]string)
+	for userID, name := range []string{"owner", "member"} {
+		token := services.APIToken{
+			Name:   name,
+			Scopes: services.StringList{services.APITokenScopeRead, services.APITokenScopeWrite},
+			UserID: userID + 1,
+		}
+		require.NoError(t, s.SavePersonalAPIToken(&token))
+		tokens[name] = token.Token
+	}
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+	request := func(user, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens[user])
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "audit-test")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := `{"vars": [{"key": "SMTP_PASSWORD", "value": "mail-pass", "secret": true}]}`
+	require.Equal(t, http.StatusOK, request("owner", http.MethodPut, "organisation/1/env-groups/smtp", body).Code)
+	require.Equal(t, http.StatusOK, request("owner", http.MethodPut, "organisation/1/members/2/role", `{"role": "admin"}`).Code)
+	require.Equal(t, http.StatusOK, request("owner", http.MethodPut, "organisation/1/members/2/role", `{"role": "member"}`).Code)
+
+	// Only owners and admins can read the audit log
+	assert.Equal(t, http.StatusForbidden, request("member", http.MethodGet, "organisation/1/audit", "").Code)
+	rec := request("owner", http.MethodGet, "organisation/1/audit", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	require.Len(t, events, 8)
+	assert.Equal(t, services.AuditActionMemberRoleChange, events[0].Action)
+	assert.JSONEq(t, `{"role": "admin"}`, string(events[0].Before))
+	assert.JSONEq(t, `{"role": "member"}`, string(events[0].After))
+	group := events[2]
+	assert.Equal(t, services.AuditActionEnvGroupSave, group.Action)
+	assert.Equal(t, "smtp", group.Target)
+	assert.Equal(t, services.ActorTypeAPIToken, group.ActorType)
+	assert.Equal(t, "owner", group.ActorName)
+	assert.Equal(t, "audit-test", group.UserAgent)
+	assert.NotContains(t, string(group.After), "mail-pass")
+	token := events[3]
+	assert.Equal(t, services.AuditActionAPITokenCreate, token.Action)
+	assert.Equal(t, "member", token.Target)
+	assert.NotContains(t, string(token.After), tokens["member"])
+
+	// Events are filtered
+	for query, n := range map[string]int{
+		"?action=member":                    2,
+		"?action=member.role_change":        2,
+		"?action=member.role":               0,
+		"?action=%25":                       0,
+		"?action=_ember":                    0,
+		"?actor_type=system":                3,
+		"?actor_type=api_token":             3,
+		"?actor_user_id=1":                  5,
+		fmt.Sprintf("?project_id=%d", p.ID): 1,
+		"?limit=2":                          2,
+		"?offset=5":                         3,
+		"?from=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339): 8,
+		"?to=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339):   0,
+	} {
+		rec := request("owner", http.MethodGet, "organisation/1/audit"+query, "")
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+		assert.Len(t, events, n, query)
+	}
+	assert.Equal(t, http.StatusBadRequest, request("owner", http.MethodGet, "organisation/1/audit?from=yesterday", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request("owner", http.MethodGet, "organisation/1/audit?format=xml", "").Code)
+
+	// Events are exported
+	rec = request("owner", http.MethodGet, "organisation/1/audit?format=csv&action=env_group", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/csv")
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "attachment")
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "action", records[0][6])
+	assert.Equal(t, services.AuditActionEnvGroupSave, records[1][6])
+	assert.Equal(t, "1", records[1][3])
+
+	rec = request("owner", http.MethodGet, "organisation/1/audit?format=json", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), ".json")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	assert.Len(t, events, 8)
+
+	// Events outlive what they refer to
+	require.NoError(t, s.DeleteProjectByIDAndOrganisationID(p.ID, "1"))
+	events, err = s.SelectAuditEvents(1, services.AuditFilter{ProjectID: p.ID})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, services.AuditActionProjectDelete, events[0].Action)
+	assert.Nil(t, events[0].After)
+	assert.NotContains(t, string(events[0].Before), "db-pass")
+
+	// Text starting like a formula is exported as text
+	actor = s.As(services.Actor{Type: services.ActorTypeUser, UserID: 1, UserAgent: "=HYPERLINK(\"https://example.com\")"})
+	require.NoError(t, actor.SaveRegistryCredential(c))
+	rec = request("owner", http.MethodGet, "organisation/1/audit?format=csv&action=registry_credential", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	records, err = csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, `'=HYPERLINK("https://example.com")`, records[1][13])
+	assert.Equal(t, "cli", records[2][13])
+}
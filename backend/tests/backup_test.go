@@ -0,0 +1,265 @@
+package main_tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/pkg/cron"
+	"github.com/devs-group/sloth/backend/pkg/dump"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	start := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC) // Friday
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 5, 10, 12, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 5, 11, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 5, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1", time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},
+		{"30 2 1 * *", time.Date(2024, 6, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 8-10/2 * * 6,7", time.Date(2024, 5, 11, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := cron.Parse(c.expr)
+		require.NoError(t, err, c.expr)
+		assert.Equal(t, c.expected, s.Next(start), c.expr)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *"} {
+		_, err := cron.Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestRetentionExpired(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2024, 5, d, h, 0, 0, 0, time.UTC)
+	}
+	// Two backups per day for the 1st to the 14th of May
+	var times []time.Time
+	for d := 1; d <= 14; d++ {
+		times = append(times, day(d, 1), day(d, 13))
+	}
+
+	expired := backup.Retention{KeepDaily: 3, KeepWeekly: 2}.Expired(times)
+
+	kept := make(map[time.Time]bool)
+	for i := range times {
+		kept[times[i]] = true
+	}
+	for _, idx := range expired {
+		delete(kept, times[idx])
+	}
+
+	// Newest of the last 3 days, plus the newest of the previous ISO week (Sunday the 12th is part of week 19)
+	assert.Equal(t, map[time.Time]bool{
+		day(14, 13): true,
+		day(13, 13): true,
+		day(12, 13): true,
+	}, kept)
+
+	assert.Empty(t, backup.Retention{}.Expired(times))
+}
+
+func TestArchiveRoundTripWithLocalTarget(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(src, "nested"), 0o750))
+	require.NoError(t, os.WriteFile(path.Join(src, "nested", "file.txt"), []byte("hello"), 0o600))
+
+	var buf bytes.Buffer
+	require.NoError(t, backup.Archive(src, &buf))
+
+	target := backup.NewLocalTarget(t.TempDir())
+	ctx := context.Background()
+	require.NoError(t, target.Put(ctx, "upn/usn/1.tar.gz", bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	assert.Error(t, target.Put(ctx, "../escape.tar.gz", bytes.NewReader(nil), 0))
+
+	r, err := target.Get(ctx, "upn/usn/1.tar.gz")
+	require.NoError(t, err)
+	defer r.Close()
+
+	dst := t.TempDir()
+	require.NoError(t, backup.Extract(r, dst))
+	content, err := os.ReadFile(path.Join(dst, "nested", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+}
+
+func TestRunBackupSchedule(t *testing.T) {
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	cfg := config.GetConfig()
+	projectsDir := t.TempDir()
+	t.Setenv("PROJECTS_DIR", projectsDir)
+	backupsDir := t.TempDir()
+	t.Setenv("BACKUPS_DIR", backupsDir)
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('backup')`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`
+		INSERT INTO projects (name, path, unique_name, organisation_id)
+		VALUES ('backup', 'p', 'backup-upn', 1)
+	`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`
+		INSERT INTO services (name, usn, dcj, project_id)
+		VALUES ('db', 'quiet-db', '{"quiet-db":{"image":"postgres:16","restart":"always"}}', 1)
+	`)
+	require.NoError(t, err)
+
+	dataDir := path.Join(projectsDir, "backup-upn", cfg.PersistentVolumeDirectoryName, "quiet-db")
+	require.NoError(t, os.MkdirAll(dataDir, 0o750))
+	require.NoError(t, os.WriteFile(path.Join(dataDir, "data.txt"), []byte("state"), 0o600))
+
+	s := services.New(dbService)
+	bs := services.BackupSchedule{
+		Cron:         "@daily",
+		Retention:    backup.Retention{KeepDaily: 1},
+		TargetType:   backup.TargetTypeLocal,
+		TargetConfig: backup.TargetConfig{Path: "nightly"},
+		Enabled:      true,
+		ProjectID:    1,
+	}
+	p, err := s.SelectProjectByID(1)
+	require.NoError(t, err)
+	require.NoError(t, bs.Validate(p))
+	require.NoError(t, s.SaveBackupSchedule(&bs))
+	require.NotNil(t, bs.NextRunAt)
+
+	require.NoError(t, s.RunBackupSchedule(context.Background(), &bs))
+
+	runs, err := s.SelectBackupRuns(1)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, services.BackupRunStatusSucceeded, runs[0].Status)
+	assert.Equal(t, "quiet-db", runs[0].Usn)
+
+	target, err := bs.Target()
+	require.NoError(t, err)
+	r, err := target.Get(context.Background(), runs[0].ObjectKey)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.FileExists(t, path.Join(backupsDir, "nightly", runs[0].ObjectKey))
+
+	// Local targets are confined to the backups directory
+	for _, dir := range []string{"../escape", t.TempDir(), "/etc"} {
+		invalid := bs
+		invalid.TargetConfig = backup.TargetConfig{Path: dir}
+		assert.Error(t, invalid.Validate(p), dir)
+	}
+	valid := bs
+	valid.TargetConfig = backup.TargetConfig{Path: path.Join(backupsDir, "weekly")}
+	assert.NoError(t, valid.Validate(p))
+
+	// Schedules back up services of their project only
+	valid.Usn = "quiet-db"
+	assert.NoError(t, valid.Validate(p))
+	invalid := valid
+	invalid.Usn = "other-db"
+	assert.ErrorIs(t, invalid.Validate(p), services.ErrUnknownService)
+
+	// Only one backup of a schedule runs at a time, the schedule of another service doesn't back up anything here
+	idle := bs
+	idle.Usn = "idle-db"
+	require.NoError(t, s.StartBackupSchedule(context.Background(), &idle))
+	assert.ErrorIs(t, s.StartBackupSchedule(context.Background(), &idle), services.ErrBackupRunning)
+	assert.Eventually(t, func() bool {
+		return s.StartBackupSchedule(context.Background(), &idle) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Deleting the schedule deletes its backups
+	require.NoError(t, s.DeleteBackupSchedule(context.Background(), 1, bs.ID))
+	assert.NoFileExists(t, path.Join(backupsDir, "nightly", runs[0].ObjectKey))
+	runs, err = s.SelectBackupRuns(1)
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+}
+
+func TestDumpEngineFromServiceEnv(t *testing.T) {
+	assert.Nil(t, dump.EngineForImage("nginx"))
+	assert.Equal(t, "postgres", dump.EngineForImage("registry.example.com/library/postgres:16").Name())
+	assert.Equal(t, "mariadb", dump.EngineForImage("bitnami/mariadb").Name())
+	assert.Equal(t, "mongo", dump.EngineForImage("mongo").Name())
+	assert.Equal(t, "postgres", dump.EngineForImage("bitnami/postgresql:16@sha256:abc").Name())
+	assert.Equal(t, "redis", dump.EngineForImage("localhost:5000/redis:7").Name())
+	for _, image := range []string{"acme/postgres-exporter", "postgres-exporter", "prometheuscommunity/postgres-exporter", "mongo-express", "redis/redisinsight"} {
+		assert.Nil(t, dump.EngineForImage(image), image)
+	}
+
+	pg := dump.EngineForImage("postgres")
+	env := map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "secret"}
+	assert.Equal(t, []string{"pg_dump", "--username", "app", "--dbname", "app", "--clean", "--if-exists", "--no-owner"}, pg.DumpCommand(env))
+	assert.Equal(t, []string{"PGPASSWORD=secret"}, pg.ExecEnv(env))
+
+	mysql := dump.EngineForImage("mysql:8")
+	env = map[string]string{"MYSQL_ROOT_PASSWORD": "root-secret", "MYSQL_DATABASE": "shop"}
+	assert.Equal(t, []string{"mysqldump", "--user=root", "--single-transaction", "--routines", "--triggers", "--events", "--databases", "shop"}, mysql.DumpCommand(env))
+	assert.Equal(t, []string{"MYSQL_PWD=root-secret"}, mysql.ExecEnv(env))
+
+	// Passwords of mongo are passed by a config file instead of the command line
+	mongo := dump.EngineForImage("mongo:7")
+	env = map[string]string{"MONGO_INITDB_ROOT_USERNAME": "root", "MONGO_INITDB_ROOT_PASSWORD": `it's "secret"`}
+	cmd := mongo.DumpCommand(env)
+	assert.NotContains(t, strings.Join(cmd, " "), "secret")
+	assert.Equal(t, []string{"mongodump", "--archive", "--gzip", "--quiet", "--username", "root", "--authenticationDatabase", "admin"}, cmd[4:])
+	script := exec.Command(cmd[0], cmd[1], cmd[2], cmd[3], "sh", "-c", `cat "$2"`, "sh")
+	script.Env = append(os.Environ(), mongo.ExecEnv(env)...)
+	config, err := script.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "password: 'it''s \"secret\"'\n", string(config))
+	assert.Equal(t, []string{"mongodump", "--archive", "--gzip", "--quiet"}, mongo.DumpCommand(nil))
+}
+
+func TestDumpEnvFromEnvGroup(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("SECRET_KEYS", testKey("primary", 1))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('dumps')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	require.NoError(t, s.SaveEnvGroup(&services.EnvGroup{Name: "db", OrganisationID: 1, Vars: services.EnvGroupVars{
+		{Key: "POSTGRES_PASSWORD", Value: "group-secret", Secret: true},
+	}}))
+
+	db := &services.Service{
+		Name:      "db",
+		Usn:       "quiet-db",
+		Image:     "postgres",
+		ImageTag:  "16",
+		EnvVars:   [][]string{{"POSTGRES_USER", "shop"}},
+		EnvGroups: services.StringList{"db"},
+	}
+	p := &services.Project{Name: "shop", UPN: "shop-upn", OrganisationID: "1", Services: []*services.Service{db}}
+
+	env, err := s.ResolveServiceEnv(p, db)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"POSTGRES_PASSWORD": "group-secret", "POSTGRES_USER": "shop"}, env)
+	assert.Equal(t, []string{"PGPASSWORD=group-secret"}, dump.EngineForImage(db.Image).ExecEnv(env))
+}
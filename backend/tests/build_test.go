@@ -0,0 +1,219 @@
+package main_tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/pkg/git"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// serveRepository serves the bare repository over HTTP, as local repositories can't be cloned. It returns its URL.
+func serveRepository(t *testing.T, bare string) string {
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	require.NoError(t, err)
+	server := httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + filepath.Dir(bare), "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(bare)
+}
+
+// gitRepository creates a bare repository with two commits on main, the first one tagged v1.
+// It returns the URL of the repository and both commits.
+func gitRepository(t *testing.T) (string, []string) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	bare := filepath.Join(dir, "repo.git")
+
+	run := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=sloth", "-c", "user.email=sloth@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	require.NoError(t, os.MkdirAll(work, 0o755))
+	run(work, "init", "--quiet", "-b", "main")
+	var commits []string
+	for _, version := range []string{"1", "2"} {
+		require.NoError(t, os.WriteFile(filepath.Join(work, "VERSION"), []byte(version), 0o644))
+		run(work, "add", "VERSION")
+		run(work, "commit", "--quiet", "-m", "version "+version)
+		commits = append(commits, run(work, "rev-parse", "HEAD"))
+	}
+	run(work, "tag", "v1", commits[0])
+	run(dir, "clone", "--quiet", "--bare", work, bare)
+	return serveRepository(t, bare), commits
+}
+
+func TestCloneRepository(t *testing.T) {
+	repository, commits := gitRepository(t)
+
+	cases := []struct {
+		ref     string
+		commit  string
+		version string
+	}{
+		{"", commits[1], "2"},
+		{"main", commits[1], "2"},
+		{"v1", commits[0], "1"},
+		{commits[0], commits[0], "1"},
+	}
+	for _, c := range cases {
+		dir := filepath.Join(t.TempDir(), "src")
+		var out bytes.Buffer
+		commit, err := git.Clone(context.Background(), repository, c.ref, dir, git.Auth{}, &out)
+		require.NoError(t, err, out.String())
+		assert.Equal(t, c.commit, commit, c.ref)
+		version, err := os.ReadFile(filepath.Join(dir, "VERSION"))
+		require.NoError(t, err)
+		assert.Equal(t, c.version, string(version), c.ref)
+	}
+
+	_, err := git.Clone(context.Background(), repository, "unknown", filepath.Join(t.TempDir(), "src"), git.Auth{}, &bytes.Buffer{})
+	assert.Error(t, err)
+
+	// Refs can't be passed as options and local repositories can't be cloned
+	marker := filepath.Join(t.TempDir(), "injected")
+	_, err = git.Clone(context.Background(), repository, "--upload-pack=touch "+marker+";", filepath.Join(t.TempDir(), "src"), git.Auth{}, &bytes.Buffer{})
+	assert.Error(t, err)
+	assert.NoFileExists(t, marker)
+	for _, r := range []string{"file:///tmp/repo.git", "/tmp/repo.git", "./repo", "ext::sh -c touch% /tmp/pwned", "-u.git"} {
+		assert.Error(t, git.ValidateRepository(r), r)
+	}
+	for _, r := range []string{"https://github.com/org/repo.git", "ssh://git@github.com/org/repo.git", "git@github.com:org/repo.git"} {
+		assert.NoError(t, git.ValidateRepository(r), r)
+	}
+}
+
+func TestServiceBuild(t *testing.T) {
+	repository, commits := gitRepository(t)
+	t.Setenv("BUILDS_DIR", t.TempDir())
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('builds')`,
+		`INSERT INTO projects (name, path, unique_name, organisation_id) VALUES ('builds', 'p', 'builds-upn', 1)`,
+		fmt.Sprintf(`INSERT INTO services (name, usn, dcj, project_id, build_source)
+		 VALUES ('api', 'api-usn', '{"api-usn":{"image":"sloth/api-usn:latest","restart":"always"}}', 1, '{"repository":"%s","ref":"v1"}')`, repository),
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	p, err := s.SelectProjectByID(1)
+	require.NoError(t, err)
+	require.Len(t, p.Services, 1)
+	service := p.Services[0]
+	require.NotNil(t, service.Build)
+	assert.Equal(t, "v1", service.Build.Ref)
+
+	// Images built locally aren't pulled
+	dc, err := s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	assert.Equal(t, "sloth/api-usn:latest", dc.Services["api-usn"].Image)
+	assert.Equal(t, compose.PullPolicyNever, dc.Services["api-usn"].PullPolicy)
+
+	deployed := false
+	deploy := func(p *services.Project, usns []string) error {
+		deployed = true
+		return nil
+	}
+	b, err := s.StartBuild(p, service, deploy)
+	require.NoError(t, err)
+	assert.Equal(t, services.BuildStatusRunning, b.Status)
+
+	// The repository has no Dockerfile, so the build fails after cloning
+	var build *services.ServiceBuild
+	require.Eventually(t, func() bool {
+		build, err = s.SelectServiceBuild(p.ID, b.ID)
+		require.NoError(t, err)
+		return build.Status != services.BuildStatusRunning
+	}, 30*time.Second, 50*time.Millisecond)
+	assert.Equal(t, services.BuildStatusFailed, build.Status)
+	assert.Equal(t, commits[0], build.Commit)
+	assert.Contains(t, build.Message, "unable to build image")
+	assert.Contains(t, build.Log, "Cloning "+repository)
+	assert.NotNil(t, build.FinishedAt)
+	assert.False(t, deployed)
+
+	var log bytes.Buffer
+	require.NoError(t, s.StreamBuildLog(context.Background(), build, &log))
+	assert.Equal(t, build.Log, log.String())
+
+	builds, err := s.SelectServiceBuilds(p.ID, "api-usn")
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+	assert.Empty(t, builds[0].Log)
+
+	// Services without a repository can't be built
+	_, err = s.StartBuild(p, &services.Service{Usn: "worker-usn"}, deploy)
+	assert.ErrorIs(t, err, services.ErrNoBuildSource)
+	assert.Error(t, (&services.BuildSource{Repository: repository, BuildContext: compose.BuildContext{Context: "../"}}).Validate())
+	assert.Error(t, (&services.BuildSource{Repository: repository, Ref: "--upload-pack=id"}).Validate())
+	assert.Error(t, (&services.BuildSource{Repository: "file:///tmp/repo.git"}).Validate())
+}
+
+func TestBuildSourceCredentials(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("SECRET_KEYS", testKey("primary", 1))
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('builds')`)
+	require.NoError(t, err)
+	s := services.New(dbService)
+	p := &services.Project{Name: "builds", UPN: "builds-upn", Services: []*services.Service{{
+		Name:  "api",
+		Build: &services.BuildSource{Repository: "https://example.com/api.git", Token: "build-token"},
+	}}}
+	require.NoError(t, s.SaveProject(p, "1"))
+
+	// Credentials are stored encrypted and never returned
+	var stored string
+	require.NoError(t, conn.Get(&stored, `SELECT build_source FROM services`))
+	assert.NotContains(t, stored, "build-token")
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "build-token", p.Services[0].Build.Token)
+	p.MaskSecrets()
+	assert.Empty(t, p.Services[0].Build.Token)
+
+	// Updates without credentials keep the stored ones, unless the repository changes
+	p.Services[0].Build.Ref = "main"
+	require.NoError(t, s.UpdateProject(p))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "main", p.Services[0].Build.Ref)
+	assert.Equal(t, "build-token", p.Services[0].Build.Token)
+
+	p.MaskSecrets()
+	p.Services[0].Build.Repository = "https://example.com/other.git"
+	require.NoError(t, s.UpdateProject(p))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Empty(t, p.Services[0].Build.Token)
+}
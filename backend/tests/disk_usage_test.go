@@ -0,0 +1,115 @@
+package main_tests
+
+import (
+	"context"
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/config"
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestScanDiskUsageNotifiesOnceOverLimit(t *testing.T) {
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	cfg := config.GetConfig()
+	projectsDir := t.TempDir()
+	t.Setenv("PROJECTS_DIR", projectsDir)
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('usage'), ('other')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('jane@doe.com', 1), ('john@doe.com', 2)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner'), (2, 2, 'owner')`,
+		// Projects which can't be scanned don't stop the scan of the others
+		`INSERT INTO projects (id, name, path, unique_name, organisation_id) VALUES (0, 'broken', 'b', 'broken-upn', 2)`,
+		`INSERT INTO services (name, usn, dcj, project_id) VALUES ('broken', 'broken-usn', 'not json', 0)`,
+		`INSERT INTO projects (name, path, unique_name, organisation_id) VALUES ('usage', 'p', 'usage-upn', 1)`,
+		`INSERT INTO services (name, usn, dcj, project_id, volume_limit_bytes, block_deploy_over_limit)
+		 VALUES ('files', 'big-files', '{"big-files":{"image":"nginx:latest","restart":"always"}}', 1, 10, TRUE)`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	dataDir := path.Join(projectsDir, "usage-upn", cfg.PersistentVolumeDirectoryName, "big-files")
+	require.NoError(t, os.MkdirAll(dataDir, 0o750))
+	require.NoError(t, os.WriteFile(path.Join(dataDir, "blob"), make([]byte, 64), 0o600))
+
+	s := services.New(dbService)
+	require.NoError(t, s.ScanDiskUsage(context.Background()))
+	require.NoError(t, s.ScanDiskUsage(context.Background()))
+
+	p, err := s.SelectProjectByID(1)
+	require.NoError(t, err)
+	require.Len(t, p.Services, 1)
+	require.NotNil(t, p.Services[0].DiskUsage)
+	assert.Equal(t, int64(64), p.Services[0].DiskUsage.SizeBytes)
+	assert.True(t, p.Services[0].DiskUsage.OverLimit)
+
+	overLimit, err := s.ServicesOverVolumeLimit(p)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"files"}, overLimit)
+
+	var notifications int
+	require.NoError(t, conn.Get(&notifications, `SELECT COUNT(*) FROM notifications WHERE user_id = 1`))
+	assert.Equal(t, 1, notifications)
+
+	usage, err := s.SelectOrganisationDiskUsage(1, "1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(64), usage.TotalBytes)
+
+	// Deployments keep the configuration of services over their limit and deploy the others
+	p.Services[0].ImageTag = "1.27"
+	p.Services = append(p.Services, &services.Service{Name: "web", Usn: "web-usn", Image: "nginx", ImageTag: "1.27"})
+	held, err := s.HoldServicesOverVolumeLimit(p)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"big-files"}, held)
+	require.Len(t, p.Services, 2)
+	assert.Equal(t, "latest", p.Services[0].ImageTag)
+	assert.Equal(t, "1.27", p.Services[1].ImageTag)
+
+	// Only members get the usage of an organisation
+	tokens := make(map[int]string)
+	for _, userID := range []int{1, 2} {
+		token := services.APIToken{Name: "usage", Scopes: services.StringList{services.APITokenScopeRead}, UserID: userID}
+		require.NoError(t, s.SavePersonalAPIToken(&token))
+		tokens[userID] = token.Token
+	}
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+	for userID, status := range map[int]int{1: http.StatusOK, 2: http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/organisation/1/usage", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[userID])
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, userID)
+	}
+
+	// Imports into held services are neither applied nor recorded as successful deployments
+	token := services.APIToken{Name: "deploy", Scopes: services.StringList{services.APITokenScopeWrite}, UserID: 1}
+	require.NoError(t, s.SavePersonalAPIToken(&token))
+	req := httptest.NewRequest(http.MethodPost, "/v1/project/1/services/big-files/env?confirm=true", strings.NewReader("LOG_LEVEL=debug\n"))
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "applied")
+	deployments, err := s.SelectDeployments(1)
+	require.NoError(t, err)
+	require.Len(t, deployments, 1)
+	assert.Equal(t, services.DeploymentStatusFailed, deployments[0].Status)
+}
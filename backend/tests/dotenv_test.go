@@ -0,0 +1,158 @@
+package main_tests
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/pkg/dotenv"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestParseDotenv(t *testing.T) {
+	vars, err := dotenv.Parse(`# SMTP settings
+SMTP_HOST=smtp.example.com # the relay
+export SMTP_PORT = 587
+SMTP_FROM="Shop <shop@example.com>"
+GREETING='Hello $USER, # not a comment'
+ESCAPED="tab\there\n\"quoted\" \$HOME"
+CERT="-----BEGIN CERTIFICATE-----
+MIIB
+-----END CERTIFICATE-----" # multiline
+
+URL=https://example.com/#anchor
+EMPTY=
+SMTP_PORT=2525
+`)
+	require.NoError(t, err)
+	assert.Equal(t, []dotenv.Var{
+		{Key: "SMTP_HOST", Value: "smtp.example.com"},
+		{Key: "SMTP_PORT", Value: "2525"},
+		{Key: "SMTP_FROM", Value: "Shop <shop@example.com>"},
+		{Key: "GREETING", Value: "Hello $USER, # not a comment"},
+		{Key: "ESCAPED", Value: "tab\there\n\"quoted\" $HOME"},
+		{Key: "CERT", Value: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"},
+		{Key: "URL", Value: "https://example.com/#anchor"},
+		{Key: "EMPTY", Value: ""},
+	}, vars)
+
+	// Formatted files are parsed to the same env vars
+	formatted, err := dotenv.Parse(string(dotenv.Format(vars)))
+	require.NoError(t, err)
+	assert.Equal(t, vars, formatted)
+
+	_, err = dotenv.Parse("A=1\nnot a variable\n")
+	assert.ErrorContains(t, err, "line 2")
+	_, err = dotenv.Parse("A=1\nB=\"open\n\nC=3\n")
+	assert.ErrorContains(t, err, "line 2: missing closing quote")
+	_, err = dotenv.Parse("A='x' y\n")
+	assert.ErrorContains(t, err, "line 1")
+	_, err = dotenv.Parse("A=\"x\n\" y\n")
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestImportServiceEnv(t *testing.T) {
+	service := &services.Service{
+		Name:          "api",
+		EnvVars:       [][]string{{"LOG_LEVEL", "info"}, {"DB_PASSWORD", "hunter2"}, {"API_TOKEN", "abc"}, {"REGION", "eu"}},
+		SecretEnvVars: []string{"DB_PASSWORD", "API_TOKEN"},
+	}
+
+	// Exported files mask secrets, importing them again keeps the stored values
+	exported := service.ExportEnv()
+	assert.Equal(t, "LOG_LEVEL='info'\nDB_PASSWORD='********'\nAPI_TOKEN='********'\nREGION='eu'\n", string(exported))
+	result, err := service.ImportEnv(string(exported), false)
+	require.NoError(t, err)
+	assert.Equal(t, services.EnvImport{Added: []string{}, Changed: []string{}, Removed: []string{}}, result)
+	assert.Equal(t, "hunter2", service.EnvMap()["DB_PASSWORD"])
+
+	result, err = service.ImportEnv("LOG_LEVEL=debug\nDB_PASSWORD='********'\nSENTRY_DSN=https://sentry.example.com/1\n", false)
+	require.NoError(t, err)
+	assert.Equal(t, services.EnvImport{
+		Added:   []string{"SENTRY_DSN"},
+		Changed: []string{"LOG_LEVEL"},
+		Removed: []string{"API_TOKEN", "REGION"},
+	}, result)
+	assert.Equal(t, [][]string{
+		{"LOG_LEVEL", "debug"}, {"DB_PASSWORD", "hunter2"}, {"SENTRY_DSN", "https://sentry.example.com/1"},
+	}, service.EnvVars)
+	assert.Equal(t, []string{"DB_PASSWORD"}, service.SecretEnvVars)
+
+	// Merges keep the env vars which aren't part of the file
+	result, err = service.ImportEnv("DB_PASSWORD=changed\nREGION=us\n", true)
+	require.NoError(t, err)
+	assert.Equal(t, services.EnvImport{Added: []string{"REGION"}, Changed: []string{"DB_PASSWORD"}, Removed: []string{}}, result)
+	assert.Equal(t, map[string]string{
+		"LOG_LEVEL":   "debug",
+		"DB_PASSWORD": "changed",
+		"SENTRY_DSN":  "https://sentry.example.com/1",
+		"REGION":      "us",
+	}, service.EnvMap())
+
+	_, err = service.ImportEnv("=1\n", false)
+	assert.Error(t, err)
+}
+
+func TestImportServiceEnvNeedsConfirmation(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('dotenv')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('owner@example.com', 1)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner')`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	p := &services.Project{
+		Name:     "shop",
+		UPN:      "shop-upn",
+		Services: []*services.Service{{Name: "api", Image: "acme/api", ImageTag: "1.0.0", EnvVars: [][]string{{"LOG_LEVEL", "info"}}}},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+	token := services.APIToken{Name: "cli", Scopes: services.StringList{services.APITokenScopeWrite}, UserID: 1}
+	require.NoError(t, s.SavePersonalAPIToken(&token))
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+
+	// Without confirmation only the changes are listed
+	target := fmt.Sprintf("/v1/project/%d/services/%s/env", p.ID, p.Services[0].Usn)
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("LOG_LEVEL=debug\n"))
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result services.EnvImport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, []string{"LOG_LEVEL"}, result.Changed)
+	assert.False(t, result.Applied)
+
+	stored, err := s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "info", stored.Services[0].EnvMap()["LOG_LEVEL"])
+
+	// Oversized files are rejected instead of being truncated
+	oversized := "LOG_LEVEL=debug\n" + strings.Repeat("#", 1<<20)
+	req = httptest.NewRequest(http.MethodPost, target+"?confirm=true", strings.NewReader(oversized))
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
@@ -0,0 +1,134 @@
+package main_tests
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestEnvGroups(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("SECRET_KEYS", testKey("primary", 1))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('groups')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	smtp := &services.EnvGroup{Name: "smtp", OrganisationID: 1, Vars: services.EnvGroupVars{
+		{Key: "SMTP_HOST", Value: "smtp.example.com"},
+		{Key: "SMTP_PORT", Value: "587"},
+		{Key: "SMTP_PASSWORD", Value: "mail-pass", Secret: true},
+	}}
+	require.NoError(t, smtp.Validate())
+	require.NoError(t, s.SaveEnvGroup(smtp))
+	sentry := &services.EnvGroup{Name: "sentry", OrganisationID: 1, Vars: services.EnvGroupVars{
+		{Key: "SENTRY_DSN", Value: "https://sentry.example.com/1"},
+		{Key: "SMTP_PORT", Value: "2525"},
+	}}
+	require.NoError(t, s.SaveEnvGroup(sentry))
+	unused := &services.EnvGroup{Name: "s3", OrganisationID: 1}
+	require.NoError(t, s.SaveEnvGroup(unused))
+
+	var vars string
+	require.NoError(t, conn.QueryRow(`SELECT vars FROM env_groups WHERE name = 'smtp'`).Scan(&vars))
+	assert.Contains(t, vars, "smtp.example.com")
+	assert.NotContains(t, vars, "mail-pass")
+
+	assert.Error(t, (&services.EnvGroup{Name: "Not Valid"}).Validate())
+	assert.Error(t, (&services.EnvGroup{Name: "dup", Vars: services.EnvGroupVars{{Key: "A"}, {Key: "A"}}}).Validate())
+
+	p := &services.Project{
+		Name: "shop",
+		UPN:  "shop-upn",
+		Services: []*services.Service{
+			{
+				Name:      "api",
+				Image:     "acme/api",
+				ImageTag:  "1.0.0",
+				EnvVars:   [][]string{{"SMTP_HOST", "mail.internal"}},
+				EnvGroups: services.StringList{"smtp", "sentry"},
+			},
+			{Name: "worker", Image: "acme/worker", ImageTag: "1.0.0"},
+		},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+
+	projects, err := s.SelectEnvGroupProjects(1, "smtp")
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	assert.Equal(t, "shop-upn", projects[0].UniqueName)
+	projects, err = s.SelectEnvGroupProjects(1, "s3")
+	require.NoError(t, err)
+	assert.Empty(t, projects)
+
+	// Env vars of the service take precedence over the ones of its groups, later groups over earlier ones
+	require.NoError(t, s.PrepareProject(p))
+	var api *services.Service
+	for _, service := range p.Services {
+		if service.Name == "api" {
+			api = service
+		}
+	}
+	require.NotNil(t, api)
+	assert.Equal(t, services.StringList{"smtp", "sentry"}, api.EnvGroups)
+	env, err := os.ReadFile(path.Join(p.UPN.GetProjectPath(), "env", api.Usn+".env"))
+	require.NoError(t, err)
+	assert.Equal(t, "SMTP_HOST='mail.internal'\nSMTP_PORT='2525'\nSMTP_PASSWORD='mail-pass'\nSENTRY_DSN='https://sentry.example.com/1'\n", string(env))
+
+	// Masked secrets keep their stored values
+	groups, err := s.SelectEnvGroups(1)
+	require.NoError(t, err)
+	require.Len(t, groups, 3)
+	g, err := s.SelectEnvGroup(1, "smtp")
+	require.NoError(t, err)
+	g.MaskSecrets()
+	assert.Equal(t, services.SecretMask, g.Vars[2].Value)
+	g.Vars[0].Value = "smtp2.example.com"
+	require.NoError(t, s.SaveEnvGroup(g))
+	g, err = s.SelectEnvGroup(1, "smtp")
+	require.NoError(t, err)
+	assert.Equal(t, "mail-pass", g.Vars[2].Value)
+	assert.Equal(t, "smtp2.example.com", g.Vars[0].Value)
+
+	// Groups in use can't be deleted
+	assert.ErrorIs(t, s.DeleteEnvGroup(1, "smtp"), services.ErrEnvGroupInUse)
+	require.NoError(t, s.DeleteEnvGroup(1, "s3"))
+	assert.ErrorIs(t, s.DeleteEnvGroup(1, "s3"), sql.ErrNoRows)
+
+	api.EnvGroups = append(api.EnvGroups, "s3")
+	_, err = s.GenerateDockerCompose(p)
+	assert.ErrorContains(t, err, `unknown env group "s3"`)
+
+	// Vars whose keys look like secrets are encrypted without the mark and stay secret
+	ci := &services.EnvGroup{Name: "ci", OrganisationID: 1, Vars: services.EnvGroupVars{
+		{Key: "CI_AUTH_TOKEN", Value: "ci-token"},
+		{Key: "CI_URL", Value: "https://ci.example.com"},
+	}}
+	require.NoError(t, s.SaveEnvGroup(ci))
+	assert.True(t, ci.Vars[0].Secret)
+	assert.False(t, ci.Vars[1].Secret)
+	require.NoError(t, conn.QueryRow(`SELECT vars FROM env_groups WHERE name = 'ci'`).Scan(&vars))
+	assert.NotContains(t, vars, "ci-token")
+	ci.MaskSecrets()
+	ci.Vars[0].Secret = false
+	require.NoError(t, s.SaveEnvGroup(ci))
+	stored, err := s.SelectEnvGroup(1, "ci")
+	require.NoError(t, err)
+	assert.Equal(t, services.EnvGroupVars{
+		{Key: "CI_AUTH_TOKEN", Value: "ci-token", Secret: true},
+		{Key: "CI_URL", Value: "https://ci.example.com"},
+	}, stored.Vars)
+}
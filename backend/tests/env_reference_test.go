@@ -0,0 +1,118 @@
+package main_tests
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestEnvReferences(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('references')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	p := &services.Project{
+		Name: "shop",
+		UPN:  "shop-upn",
+		Services: []*services.Service{
+			{
+				Name:     "db",
+				Image:    "postgres",
+				ImageTag: "16",
+				EnvVars:  [][]string{{"POSTGRES_USER", "app"}, {"POSTGRES_PASSWORD", "${random:32}"}},
+			},
+			{
+				Name:     "api",
+				Image:    "acme/api",
+				ImageTag: "1.0.0",
+				EnvVars: [][]string{
+					{"DATABASE_URL", "postgres://${services.db.env.POSTGRES_USER}:${services.db.env.POSTGRES_PASSWORD}@${services.db.hostname}:5432/app"},
+					{"DB_HOST", "${services.db.hostname}"},
+					{"PRICE", "$$5"},
+					{"GREETING", "Hello ${USER}"},
+				},
+			},
+		},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+
+	// Generated values are stored as secrets once
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	db := p.Services[0]
+	password := db.EnvMap()["POSTGRES_PASSWORD"]
+	assert.Len(t, password, 32)
+	assert.Equal(t, []string{"POSTGRES_PASSWORD"}, db.SecretEnvVars)
+	require.NoError(t, s.UpdateProject(p))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	byName := make(map[string]*services.Service)
+	for _, service := range p.Services {
+		byName[service.Name] = service
+	}
+	assert.Equal(t, password, byName["db"].EnvMap()["POSTGRES_PASSWORD"])
+
+	// Values referencing secrets are masked in plans
+	plan, err := s.PlanProject(p)
+	require.NoError(t, err)
+	require.Len(t, plan.Services, 2)
+	for _, planned := range plan.Services {
+		switch planned.Name {
+		case "db":
+			assert.Equal(t, map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "********"}, planned.Env)
+		case "api":
+			assert.Equal(t, map[string]string{
+				"DATABASE_URL": "********",
+				"DB_HOST":      byName["db"].Usn,
+				"PRICE":        "$5",
+				"GREETING":     "Hello ${USER}",
+			}, planned.Env)
+		}
+	}
+
+	require.NoError(t, s.PrepareProject(p))
+	env, err := os.ReadFile(path.Join(p.UPN.GetProjectPath(), "env", byName["api"].Usn+".env"))
+	require.NoError(t, err)
+	assert.Contains(t, string(env), "DATABASE_URL='postgres://app:"+password+"@"+byName["db"].Usn+":5432/app'\n")
+	assert.Contains(t, string(env), "PRICE='$5'\n")
+
+	// Invalid references are rejected before the project is stored
+	for _, value := range []string{
+		"${services.cache.hostname}",
+		"${services.db.env.MISSING}",
+		"${services.db.port}",
+		"${random:0}",
+	} {
+		byName["api"].EnvVars = [][]string{{"VALUE", value}}
+		_, err := s.PlanProject(p)
+		assert.ErrorIs(t, err, services.ErrInvalidEnvReference, value)
+		assert.ErrorIs(t, s.UpdateProject(p), services.ErrInvalidEnvReference, value)
+	}
+
+	byName["api"].EnvVars = [][]string{{"A", "${services.api.env.B}"}, {"B", "x${services.db.env.C}"}}
+	byName["db"].EnvVars = [][]string{{"C", "${services.api.env.A}"}}
+	err = s.UpdateProject(p)
+	assert.ErrorIs(t, err, services.ErrInvalidEnvReference)
+	assert.ErrorContains(t, err, "cyclic reference")
+	assert.ErrorContains(t, err, "api.A -> api.B -> db.C")
+
+	stored, err := s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	for _, service := range stored.Services {
+		if service.Name == "db" {
+			assert.Equal(t, password, service.EnvMap()["POSTGRES_PASSWORD"])
+		}
+	}
+}
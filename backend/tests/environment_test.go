@@ -0,0 +1,133 @@
+package main_tests
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestEnvironmentsAndPromotion(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("BACKEND_HOST", "sloth.example.com")
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('environments')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	parent := &services.Project{
+		Name: "shop",
+		UPN:  "shop-upn",
+		Services: []*services.Service{
+			{
+				Name:     "api",
+				Image:    "acme/api",
+				ImageTag: "1.0.0",
+				EnvVars:  [][]string{{"LOG_LEVEL", "debug"}, {"REGION", "eu"}},
+				Public:   services.Public{Enabled: true, Hosts: []string{"api.example.com"}, Port: "8080"},
+			},
+		},
+	}
+	require.NoError(t, s.SaveProject(parent, "1"))
+	parent, err = s.SelectProjectByID(parent.ID)
+	require.NoError(t, err)
+	parentUsn := parent.Services[0].Usn
+
+	staging, environment, err := s.EnvironmentProject(parent, "staging", services.EnvironmentOverrides{
+		"api": {ImageTag: "1.1.0", EnvVars: map[string]string{"LOG_LEVEL": "info", "DEBUG": "false"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, services.UPN("shop-upn-staging"), staging.UPN)
+	host := "staging." + parentUsn + ".sloth.example.com"
+	assert.Equal(t, map[string]string{"api": host}, environment.Hosts)
+
+	dc, err := s.GenerateDockerCompose(staging)
+	require.NoError(t, err)
+	api := dc.Services[staging.Services[0].Usn]
+	assert.Equal(t, "acme/api:1.1.0", api.Image)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info", "REGION": "eu", "DEBUG": "false"}, staging.Services[0].EnvMap())
+	assert.Equal(t, []string{"./env/" + staging.Services[0].Usn + ".env"}, api.EnvFile)
+	assert.Contains(t, strings.Join(api.Labels, " "), "Host(`"+host+"`)")
+	require.NoError(t, s.SaveEnvironmentProject(staging, environment))
+	require.NoError(t, s.SaveEnvironment(staging, environment))
+
+	// Env vars of overrides are secret, clients get them masked and send the mask back to keep them
+	assert.ElementsMatch(t, []string{"LOG_LEVEL", "DEBUG"}, staging.Services[0].SecretEnvVars)
+	environment, err = s.SelectEnvironment(parent.ID, "staging")
+	require.NoError(t, err)
+	environment.MaskSecrets()
+	assert.Equal(t, map[string]string{"LOG_LEVEL": services.SecretMask, "DEBUG": services.SecretMask}, environment.Overrides["api"].EnvVars)
+	redeployed, _, err := s.EnvironmentProject(parent, "staging", environment.Overrides)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info", "REGION": "eu", "DEBUG": "false"}, redeployed.Services[0].EnvMap())
+	_, _, err = s.EnvironmentProject(parent, "staging", services.EnvironmentOverrides{
+		"api": {EnvVars: map[string]string{"TOKEN": services.SecretMask}},
+	})
+	assert.Error(t, err)
+
+	production, environment, err := s.EnvironmentProject(parent, "production", services.EnvironmentOverrides{
+		"api": {Hosts: []string{"shop.example.com"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"api": "shop.example.com"}, environment.Hosts)
+	require.NoError(t, s.SaveEnvironmentProject(production, environment))
+	require.NoError(t, s.SaveEnvironment(production, environment))
+
+	// Environments are only listed by their project and share their names with previews
+	projects, err := s.GetProjectsByOrganisationID(1)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	environments, err := s.SelectEnvironments(parent.ID)
+	require.NoError(t, err)
+	require.Len(t, environments, 2)
+	_, _, err = s.PreviewProject(parent, services.PreviewRequest{Branch: "staging"})
+	assert.Error(t, err)
+	_, _, err = s.EnvironmentProject(staging, "qa", nil)
+	assert.Error(t, err)
+	_, _, err = s.EnvironmentProject(parent, "Not Valid", nil)
+	assert.Error(t, err)
+	_, _, err = s.EnvironmentProject(parent, "qa", services.EnvironmentOverrides{"web": {}})
+	assert.Error(t, err)
+
+	// Promotions deploy the tag and digest staging was deployed with and keep the overrides of production
+	stagingUsn := staging.Services[0].Usn
+	_, err = conn.Exec(
+		`INSERT INTO service_image_digests (usn, image, digest, project_id) VALUES ($1, 'acme/api:1.1.0', 'sha256:staged', $2)`,
+		stagingUsn, staging.ID,
+	)
+	require.NoError(t, err)
+	promoted, environment, err := s.Promote(parent, "staging", "production")
+	require.NoError(t, err)
+	assert.Equal(t, services.ServiceOverride{ImageTag: "1.1.0", Digest: "sha256:staged", Hosts: []string{"shop.example.com"}}, environment.Overrides["api"])
+	require.NoError(t, s.SaveEnvironmentProject(promoted, environment))
+	require.NoError(t, s.SaveEnvironment(promoted, environment))
+	dc, err = s.GenerateDockerCompose(promoted)
+	require.NoError(t, err)
+	assert.Equal(t, "acme/api:1.1.0@sha256:staged", dc.Services[promoted.Services[0].Usn].Image)
+	assert.Equal(t, production.Services[0].Usn, promoted.Services[0].Usn)
+
+	_, _, err = s.Promote(parent, "qa", "production")
+	assert.Error(t, err)
+	_, _, err = s.Promote(parent, "staging", "staging")
+	assert.Error(t, err)
+
+	// Promotions show up in the deployment history with the promoted images
+	d := services.Deployment{Kind: services.DeploymentKindPromotion, Source: "staging", Status: services.DeploymentStatusSucceeded}
+	require.NoError(t, s.SaveDeployment(promoted, &d))
+	deployments, err := s.SelectDeployments(promoted.ID)
+	require.NoError(t, err)
+	require.Len(t, deployments, 1)
+	assert.Equal(t, "staging", deployments[0].Source)
+	assert.True(t, slices.Contains(deployments[0].Images, services.DeployedImage{
+		Service: "api", Usn: promoted.Services[0].Usn, Image: "acme/api:1.1.0", Digest: "sha256:staged",
+	}))
+}
@@ -0,0 +1,230 @@
+package main_tests
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/git"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// manifestRepository creates an empty bare repository on main. Manifests are committed and pushed to it by the
+// returned function, which returns the commit.
+// manifestRepository creates an empty repository and returns its URL, a function which pushes a commit with the
+// manifest at deploy/sloth.yaml and one which pushes a commit replacing the manifest with a symlink to target.
+func manifestRepository(t *testing.T) (string, func(manifest string) string, func(target string) string) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	bare := filepath.Join(dir, "repo.git")
+
+	run := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=sloth", "-c", "user.email=sloth@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	require.NoError(t, os.MkdirAll(work, 0o755))
+	run(work, "init", "--quiet", "-b", "main")
+	run(dir, "init", "--quiet", "--bare", "-b", "main", bare)
+	run(work, "remote", "add", "origin", bare)
+	commit := func() string {
+		run(work, "add", ".")
+		run(work, "commit", "--quiet", "-m", "update manifest")
+		run(work, "push", "--quiet", "origin", "main")
+		return run(work, "rev-parse", "HEAD")
+	}
+	manifest := filepath.Join(work, "deploy", "sloth.yaml")
+	push := func(content string) string {
+		require.NoError(t, os.MkdirAll(filepath.Dir(manifest), 0o755))
+		require.NoError(t, os.WriteFile(manifest, []byte(content), 0o644))
+		return commit()
+	}
+	link := func(target string) string {
+		require.NoError(t, os.Remove(manifest))
+		require.NoError(t, os.Symlink(target, manifest))
+		return commit()
+	}
+	return serveRepository(t, bare), push, link
+}
+
+const shopManifest = `
+name: shop
+shared_volumes: [uploads]
+services:
+  - name: db
+    image: postgres
+    tag: "16"
+    volumes: [/var/lib/postgresql/data]
+  - name: api
+    image: acme/api
+    tag: 1.1.0
+    ports: ["8080"]
+    env:
+      LOG_LEVEL: info
+    depends_on:
+      db:
+        condition: service_started
+    public:
+      enabled: true
+      hosts: [shop.example.com]
+      port: "8080"
+`
+
+func TestGitOpsSync(t *testing.T) {
+	t.Setenv("BUILDS_DIR", t.TempDir())
+	t.Setenv("BACKEND_HOST", "sloth.example.com")
+	repository, push, link := manifestRepository(t)
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('gitops')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	p := &services.Project{
+		Name: "shop",
+		UPN:  "shop-upn",
+		Services: []*services.Service{
+			{Name: "api", Image: "acme/api", ImageTag: "1.0.0", Ports: []string{"8080"}},
+			{Name: "legacy", Image: "acme/legacy", ImageTag: "1"},
+		},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	apiUsn := ""
+	for _, service := range p.Services {
+		if service.Name == "api" {
+			apiUsn = service.Usn
+		}
+	}
+
+	source := services.GitOpsSource{Repository: repository, Ref: "main", Path: "deploy/sloth.yaml", ProjectID: p.ID}
+	require.NoError(t, source.Validate())
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	commit := push(shopManifest)
+
+	remote, err := git.RemoteCommit(context.Background(), repository, "main", git.Auth{})
+	require.NoError(t, err)
+	assert.Equal(t, commit, remote)
+	_, err = git.RemoteCommit(context.Background(), repository, "--upload-pack=id", git.Auth{})
+	assert.Error(t, err)
+	assert.Error(t, (&services.GitOpsSource{Repository: repository, Ref: "--upload-pack=id"}).Validate())
+	assert.Error(t, (&services.GitOpsSource{Repository: "/tmp/repo.git"}).Validate())
+
+	var applied []*services.Project
+	apply := func(p *services.Project) error {
+		applied = append(applied, p)
+		return s.UpdateProject(p)
+	}
+
+	// Dry runs only compute the diff
+	g, err := s.SyncProject(context.Background(), p, apply, services.SyncOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+	assert.Equal(t, services.GitOpsStatusPending, g.Status)
+	assert.Equal(t, []string{"db"}, g.Diff.Added)
+	assert.Equal(t, []string{"legacy"}, g.Diff.Removed)
+	assert.Equal(t, []string{"api"}, g.Diff.Changed)
+	assert.Equal(t, []string{"shared_volumes"}, g.Diff.Project)
+
+	s.SyncChangedSources(context.Background(), apply)
+	require.Len(t, applied, 1)
+	g, err = s.SelectGitOpsSource(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, services.GitOpsStatusSynced, g.Status, g.Message)
+	assert.Equal(t, commit, g.Commit)
+	assert.NotNil(t, g.SyncedAt)
+
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	require.Len(t, p.Services, 2)
+	usns := make(map[string]string)
+	for _, service := range p.Services {
+		usns[service.Name] = service.Usn
+	}
+	assert.Equal(t, apiUsn, usns["api"])
+	dc, err := s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	api := dc.Services[apiUsn]
+	assert.Equal(t, "acme/api:1.1.0", api.Image)
+	assert.Empty(t, api.Environment)
+	for _, service := range p.Services {
+		if service.Name == "api" {
+			assert.Equal(t, map[string]string{"LOG_LEVEL": "info"}, service.EnvMap())
+		}
+	}
+	assert.Contains(t, api.Depends, usns["db"])
+	assert.Contains(t, strings.Join(api.Labels, " "), "Host(`shop.example.com`)")
+
+	// Commits which were synced aren't applied again, nor are manifests without changes
+	s.SyncChangedSources(context.Background(), apply)
+	require.Len(t, applied, 1)
+	g, err = s.SyncProject(context.Background(), p, apply, services.SyncOptions{})
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+	assert.True(t, g.Diff.Empty())
+
+	// Invalid manifests are rejected and leave the project unchanged
+	invalid := push(strings.Replace(shopManifest, "tag: 1.1.0", "tags: 1.2.0", 1))
+	g, err = s.SyncProject(context.Background(), p, apply, services.SyncOptions{})
+	assert.ErrorIs(t, err, services.ErrInvalidManifest)
+	require.Len(t, applied, 1)
+	assert.Equal(t, services.GitOpsStatusInvalid, g.Status)
+	assert.Equal(t, invalid, g.Commit)
+	assert.Contains(t, g.Message, "tags")
+
+	push(strings.Replace(shopManifest, "db:\n        condition", "cache:\n        condition", 1))
+	g, err = s.SyncProject(context.Background(), p, apply, services.SyncOptions{})
+	assert.ErrorIs(t, err, services.ErrInvalidManifest)
+	assert.Contains(t, g.Message, `unknown service "cache"`)
+
+	// Manifests can't link to files outside of the repository
+	outside := filepath.Join(t.TempDir(), "outside.yaml")
+	require.NoError(t, os.WriteFile(outside, []byte(shopManifest), 0o644))
+	link(outside)
+	g, err = s.SyncProject(context.Background(), p, apply, services.SyncOptions{})
+	assert.ErrorIs(t, err, services.ErrInvalidManifest)
+	assert.Contains(t, g.Message, "outside of the repository")
+	assert.NotContains(t, g.Message, outside)
+
+	// Stored credentials are kept when updating the source without them
+	source = services.GitOpsSource{Repository: repository, Token: "secret", ProjectID: p.ID}
+	require.NoError(t, source.Validate())
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	source = services.GitOpsSource{Repository: repository, Ref: "main", ProjectID: p.ID}
+	require.NoError(t, source.Validate())
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	g, err = s.SelectGitOpsSource(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", g.Token)
+	assert.Equal(t, services.GitOpsStatusPending, g.Status)
+	assert.Equal(t, "sloth.yaml", g.Path)
+
+	// They are removed on request or when the repository changes
+	source = services.GitOpsSource{Repository: repository, ClearCredentials: true, ProjectID: p.ID}
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	g, err = s.SelectGitOpsSource(p.ID)
+	require.NoError(t, err)
+	assert.Empty(t, g.Token)
+
+	source = services.GitOpsSource{Repository: repository, Token: "secret", ProjectID: p.ID}
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	source = services.GitOpsSource{Repository: "https://example.com/other.git", ProjectID: p.ID}
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	g, err = s.SelectGitOpsSource(p.ID)
+	require.NoError(t, err)
+	assert.Empty(t, g.Token)
+}
@@ -0,0 +1,203 @@
+package main_tests
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/pkg/registry"
+	"github.com/devs-group/sloth/backend/pkg/webhook"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestVerifyHookDeliveries(t *testing.T) {
+	body := []byte(`{"image": "nginx", "tag": "1.27"}`)
+	secret := "hook-secret"
+
+	cases := []struct {
+		header   http.Header
+		provider string
+		err      error
+	}{
+		{http.Header{"X-Hub-Signature-256": {webhook.Sign(body, secret)}}, webhook.ProviderGitHub, nil},
+		{http.Header{"X-Hub-Signature-256": {webhook.Sign(body, "other")}}, webhook.ProviderGitHub, webhook.ErrInvalidSignature},
+		{http.Header{"X-Signature-256": {webhook.Sign(body, secret)}}, webhook.ProviderGeneric, nil},
+		{http.Header{"X-Gitlab-Token": {secret}}, webhook.ProviderGitLab, nil},
+		{http.Header{"Authorization": {"Bearer " + secret}}, webhook.ProviderAuthorization, nil},
+		{http.Header{"Authorization": {"Bearer wrong"}}, webhook.ProviderAuthorization, webhook.ErrInvalidSignature},
+		{http.Header{}, "", webhook.ErrUnauthenticated},
+	}
+	for _, c := range cases {
+		provider, err := webhook.Verify(c.header, body, secret)
+		assert.Equal(t, c.provider, provider)
+		assert.Equal(t, c.err, err)
+	}
+}
+
+func TestParseRegistryPushes(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   http.Header
+		body     string
+		expected []webhook.Push
+	}{
+		{
+			"docker hub", http.Header{},
+			`{"push_data": {"tag": "v2"}, "repository": {"repo_name": "acme/api", "namespace": "acme"}}`,
+			[]webhook.Push{{Image: "acme/api", Tag: "v2"}},
+		},
+		{
+			"ghcr", http.Header{"X-Github-Event": {"package"}},
+			`{"action": "published", "package": {"name": "api", "namespace": "acme", "package_type": "container",
+				"package_version": {"package_url": "ghcr.io/acme/api:v2", "container_metadata": {"tag": {"name": "v2"}}}}}`,
+			[]webhook.Push{{Image: "ghcr.io/acme/api", Tag: "v2"}},
+		},
+		{
+			"github ping", http.Header{"X-Github-Event": {"ping"}}, `{"zen": "Design for failure."}`, nil,
+		},
+		{
+			"gitlab registry", http.Header{},
+			`{"events": [
+				{"action": "push", "target": {"repository": "acme/api", "tag": "v2"}, "request": {"host": "registry.gitlab.com"}},
+				{"action": "pull", "target": {"repository": "acme/api", "tag": "v1"}, "request": {"host": "registry.gitlab.com"}}
+			]}`,
+			[]webhook.Push{{Image: "registry.gitlab.com/acme/api", Tag: "v2"}},
+		},
+		{
+			"harbor", http.Header{},
+			`{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"tag": "v2", "resource_url": "harbor.example.com:8443/acme/api:v2"}]}}`,
+			[]webhook.Push{{Image: "harbor.example.com:8443/acme/api", Tag: "v2"}},
+		},
+		{
+			"generic", http.Header{}, `{"image": "acme/api:v2"}`, []webhook.Push{{Image: "acme/api", Tag: "v2"}},
+		},
+	}
+	for _, c := range cases {
+		pushes, err := webhook.ParsePushes(c.header, []byte(c.body))
+		require.NoError(t, err, c.name)
+		assert.Equal(t, c.expected, pushes, c.name)
+	}
+
+	_, err := webhook.ParsePushes(http.Header{}, []byte(`{"unknown": true}`))
+	assert.Error(t, err)
+}
+
+func TestApplyPushesOnlyChangesServicesUsingTheImage(t *testing.T) {
+	assert.Equal(t, "docker.io/library/nginx", registry.Repository("nginx:1.27"))
+	assert.Equal(t, "docker.io/acme/api", registry.Repository("index.docker.io/Acme/api@sha256:abc"))
+	assert.Equal(t, "localhost:5000/api", registry.Repository("localhost:5000/api:v1"))
+
+	api := &services.Service{Usn: "api", Image: "docker.io/acme/api", ImageTag: "v1", UpdatePolicy: registry.PolicySemver, UpdateConstraint: "^1"}
+	worker := &services.Service{Usn: "worker", Image: "acme/api", ImageTag: "v1"}
+	web := &services.Service{Usn: "web", Image: "nginx", ImageTag: "latest"}
+	p := &services.Project{Services: []*services.Service{api, worker, web}}
+
+	// Other tags are only followed by services with a policy selecting them
+	usns := p.ApplyPushes([]webhook.Push{{Image: "acme/api", Tag: "v1.1.0"}})
+	assert.Equal(t, []string{"api"}, usns)
+	assert.Equal(t, "v1.1.0", api.ImageTag)
+	assert.Equal(t, "v1", worker.ImageTag)
+	assert.Empty(t, p.ApplyPushes([]webhook.Push{{Image: "acme/api", Tag: "v2.0.0"}}))
+	assert.Equal(t, "v1.1.0", api.ImageTag)
+
+	// Pushes of the running tag redeploy the services, lower tags matching a policy don't downgrade them
+	usns = p.ApplyPushes([]webhook.Push{{Image: "acme/api", Tag: "v1"}, {Image: "nginx", Tag: "latest"}})
+	assert.Equal(t, []string{"worker", "web"}, usns)
+	assert.Equal(t, "v1.1.0", api.ImageTag)
+	assert.Equal(t, "latest", web.ImageTag)
+}
+
+func TestHookSecret(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('hooks')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('owner@example.com', 1)`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('viewer@example.com', 1)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner')`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+	s := services.New(dbService)
+	p := &services.Project{Name: "shop", UPN: "shop-upn", HookSecret: "hook-secret"}
+	require.NoError(t, s.SaveProject(p, "1"))
+	_, err := s.SaveProjectMember(p.ID, "viewer@example.com", services.ProjectRoleViewer)
+	require.NoError(t, err)
+
+	tokens := make(map[string]string)
+	for userID, name := range []string{"owner", "viewer"} {
+		token := services.APIToken{
+			Name:   name,
+			Scopes: services.StringList{services.APITokenScopeRead, services.APITokenScopeWrite},
+			UserID: userID + 1,
+		}
+		require.NoError(t, s.SavePersonalAPIToken(&token))
+		tokens[name] = token.Token
+	}
+
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+	request := func(header http.Header, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/"+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	as := func(user string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + tokens[user]}}
+	}
+	projectPath := fmt.Sprintf("project/%d", p.ID)
+
+	// The secret isn't part of the project, only maintainers can reveal and rotate it
+	rec := request(as("viewer"), http.MethodGet, projectPath, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "hook-secret")
+	assert.Equal(t, http.StatusForbidden, request(as("viewer"), http.MethodGet, projectPath+"/hook-secret", "").Code)
+	assert.Equal(t, http.StatusForbidden, request(as("viewer"), http.MethodPost, projectPath+"/hook-secret/rotate", "").Code)
+	rec = request(as("owner"), http.MethodGet, projectPath+"/hook-secret", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"hook_secret": "hook-secret"}`, rec.Body.String())
+
+	rec = request(as("owner"), http.MethodPost, projectPath+"/hook-secret/rotate", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var rotated struct {
+		HookSecret string `json:"hook_secret"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rotated))
+	assert.Len(t, rotated.HookSecret, 32)
+	assert.NotEqual(t, "hook-secret", rotated.HookSecret)
+
+	// Secrets are only accepted in headers and unverified deliveries aren't saved
+	body := `{"image": "nginx", "tag": "1.27"}`
+	hookPath := fmt.Sprintf("hook/%d", p.ID)
+	assert.Equal(t, http.StatusUnauthorized, request(nil, http.MethodPost, hookPath+"?secret="+rotated.HookSecret, body).Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.Header{"Authorization": {"Bearer hook-secret"}}, http.MethodPost, hookPath, body).Code)
+	deliveries, err := s.SelectHookDeliveries(p.ID)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	rec = request(http.Header{"Authorization": {"Bearer " + rotated.HookSecret}}, http.MethodPost, hookPath, body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	deliveries, err = s.SelectHookDeliveries(p.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, services.HookDeliveryStatusIgnored, deliveries[0].Status)
+}
@@ -0,0 +1,101 @@
+package main_tests
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/registry"
+	"github.com/devs-group/sloth/backend/pkg/webhook"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestPinnedImageDigestsAndDrift(t *testing.T) {
+	fake := &fakeRegistry{
+		tags:    []string{"1.4.1", "latest"},
+		digests: map[string]string{"1.4.1": "sha256:141", "latest": "sha256:bbb"},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('digests')`,
+		`INSERT INTO projects (name, path, unique_name, organisation_id, registry_credentials) VALUES ('digests', 'p', 'digests-upn', 1, '["ci"]')`,
+		fmt.Sprintf(`INSERT INTO services (name, usn, dcj, project_id, pin_digest)
+		 VALUES ('api', 'api-usn', '{"api-usn":{"image":"%s/acme/api:latest","restart":"always"}}', 1, TRUE)`, host),
+		fmt.Sprintf(`INSERT INTO services (name, usn, dcj, project_id)
+		 VALUES ('worker', 'worker-usn', '{"worker-usn":{"image":"%s/acme/api:1.4.1","restart":"always"}}', 1)`, host),
+		fmt.Sprintf(`INSERT INTO service_image_digests (usn, image, digest, project_id) VALUES ('api-usn', '%s/acme/api:latest', 'sha256:aaa', 1)`, host),
+		fmt.Sprintf(`INSERT INTO service_image_digests (usn, image, digest, project_id) VALUES ('worker-usn', '%s/acme/api:1.4.1', 'sha256:141', 1)`, host),
+		fmt.Sprintf(`INSERT INTO registry_credentials (name, username, password, registry, organisation_id) VALUES ('ci', 'ci', 'secret', '%s', 1)`, server.URL),
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	p, err := s.SelectProjectByID(1)
+	require.NoError(t, err)
+	require.Len(t, p.Services, 2)
+	for _, service := range p.Services {
+		require.NotNil(t, service.ImageDigest, service.Usn)
+	}
+
+	// Only services pinning their digest deploy the recorded digest
+	dc, err := s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/acme/api:latest@sha256:aaa", dc.Services["api-usn"].Image)
+	assert.Equal(t, host+"/acme/api:1.4.1", dc.Services["worker-usn"].Image)
+
+	state := map[string]services.ContainerState{
+		"api-usn":    {State: "running", Digest: "sha256:aaa"},
+		"worker-usn": {State: "running", Digest: "sha256:141"},
+	}
+	s.AddImageDrift(context.Background(), p, state)
+	assert.True(t, state["api-usn"].Drift)
+	assert.Equal(t, "sha256:bbb", state["api-usn"].TagDigest)
+	assert.False(t, state["worker-usn"].Drift)
+
+	// Pushes of the pinned tag and digest policy updates deploy the image the tag points to now
+	assert.Equal(t, []string{"api-usn"}, p.ApplyPushes([]webhook.Push{{Image: host + "/acme/api", Tag: "latest"}}))
+	dc, err = s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/acme/api:latest", dc.Services["api-usn"].Image)
+
+	p, err = s.SelectProjectByID(1)
+	require.NoError(t, err)
+	_, err = conn.Exec(`
+		INSERT INTO image_update_checks (usn, image, policy, current_tag, selected_tag, digest, status, checked_at, project_id)
+		VALUES ('api-usn', 'acme/api', 'digest', 'latest', 'latest', 'sha256:aaa', 'up-to-date', CURRENT_TIMESTAMP, 1)
+	`)
+	require.NoError(t, err)
+	for _, service := range p.Services {
+		if service.Usn == "api-usn" {
+			service.UpdatePolicy = registry.PolicyDigest
+		}
+	}
+	_, usns := s.CheckImageUpdates(context.Background(), p)
+	assert.Equal(t, []string{"api-usn"}, usns)
+	dc, err = s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/acme/api:latest", dc.Services["api-usn"].Image)
+
+	// A new tag isn't pinned to the digest of the previous one
+	for _, service := range p.Services {
+		service.ImageTag = "1.4.1"
+	}
+	dc, err = s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	assert.Equal(t, host+"/acme/api:1.4.1", dc.Services["api-usn"].Image)
+}
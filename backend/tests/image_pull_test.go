@@ -0,0 +1,138 @@
+package main_tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dockerregistry "github.com/docker/docker/api/types/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// fakeDaemon answers image pulls like the API of the docker daemon.
+type fakeDaemon struct {
+	mu        sync.Mutex
+	active    int
+	maxActive int
+	pulls     map[string]int
+	// usernames of the credentials pulls were sent with by image
+	usernames map[string]string
+	// failures are the number of pulls of an image which fail before it's pulled
+	failures map[string]int
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/_ping") {
+		w.Header().Set("API-Version", "1.45")
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/images/create") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+	auth, err := dockerregistry.DecodeAuthConfig(r.Header.Get(dockerregistry.AuthHeader))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d.mu.Lock()
+	d.active++
+	d.maxActive = max(d.maxActive, d.active)
+	d.pulls[image]++
+	d.usernames[image] = auth.Username
+	failing := d.failures[image] > 0
+	if failing {
+		d.failures[image]--
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.active--
+		d.mu.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Contains(image, "missing") {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "manifest unknown"})
+		return
+	}
+	if failing {
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "connection reset", "errorDetail": map[string]string{"message": "connection reset"}})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "Downloaded newer image for " + image})
+}
+
+func TestPullImages(t *testing.T) {
+	daemon := &fakeDaemon{
+		pulls:     make(map[string]int),
+		usernames: make(map[string]string),
+		failures:  map[string]int{"registry.example.com/acme/worker:1": 1},
+	}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	t.Setenv("DOCKER_HOST", "tcp://"+strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("IMAGE_PULL_CONCURRENCY", "2")
+	t.Setenv("IMAGE_PULL_RETRIES", "1")
+
+	upn := services.UPN("pull-upn")
+	require.NoError(t, os.MkdirAll(upn.GetProjectPath(), 0o750))
+	legacyConfig := path.Join(upn.GetProjectPath(), "config.json")
+	require.NoError(t, os.WriteFile(legacyConfig, []byte(`{"auths":{}}`), 0o600))
+
+	credentials := []services.DockerCredential{{Username: "ci", Password: "secret", Registry: "https://registry.example.com"}}
+	containers := compose.Services{
+		"api":     {Image: "registry.example.com/acme/api:1"},
+		"api-2":   {Image: "registry.example.com/acme/api:1"},
+		"worker":  {Image: "registry.example.com/acme/worker:1"},
+		"db":      {Image: "postgres:16"},
+		"cache":   {Image: "redis:7"},
+		"proxy":   {Image: "nginx:1.27"},
+		"builder": {Image: "sloth/built:abc", PullPolicy: compose.PullPolicyNever},
+	}
+	require.NoError(t, upn.PullImages(containers, credentials))
+
+	// Images are pulled once, failed pulls are retried
+	assert.Equal(t, map[string]int{
+		"registry.example.com/acme/api:1":    1,
+		"registry.example.com/acme/worker:1": 2,
+		"postgres:16":                        1,
+		"redis:7":                            1,
+		"nginx:1.27":                         1,
+	}, daemon.pulls)
+	assert.LessOrEqual(t, daemon.maxActive, 2)
+	// Credentials are only sent to their registry and never written to the project
+	assert.Equal(t, "ci", daemon.usernames["registry.example.com/acme/api:1"])
+	assert.Empty(t, daemon.usernames["postgres:16"])
+	assert.NoFileExists(t, legacyConfig)
+	entries, err := os.ReadDir(upn.GetProjectPath())
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Missing images aren't retried, pulls failing more often than retried fail
+	daemon.failures["redis:7"] = 2
+	err = upn.PullImages(compose.Services{
+		"db":    {Image: "acme/missing:1"},
+		"cache": {Image: "redis:7"},
+	}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "acme/missing:1")
+	assert.Contains(t, err.Error(), "connection reset")
+	assert.Equal(t, 1, daemon.pulls["acme/missing:1"])
+	assert.Equal(t, 3, daemon.pulls["redis:7"])
+}
@@ -0,0 +1,232 @@
+package main_tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/registry"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+// fakeRegistry behaves like a "registry:2" container behind token authentication.
+type fakeRegistry struct {
+	tags    []string
+	digests map[string]string
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		// Logins request tokens without scope
+		user, pass, _ := r.BasicAuth()
+		scope := r.URL.Query().Get("scope")
+		if user != "ci" || pass != "secret" || (scope != "" && scope != "repository:acme/api:pull") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "registry-token"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer registry-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v2/":
+	case r.URL.Path == "/v2/acme/api/tags/list":
+		// Two tags per page
+		tags := f.tags
+		if last := r.URL.Query().Get("last"); last != "" {
+			for i, tag := range tags {
+				if tag == last {
+					tags = tags[i+1:]
+					break
+				}
+			}
+		}
+		if len(tags) > 2 {
+			tags = tags[:2]
+			w.Header().Set("Link", fmt.Sprintf(`</v2/acme/api/tags/list?n=2&last=%s>; rel="next"`, tags[1]))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": "acme/api", "tags": tags})
+	case strings.HasPrefix(r.URL.Path, "/v2/acme/api/manifests/"):
+		digest, ok := f.digests[strings.TrimPrefix(r.URL.Path, "/v2/acme/api/manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSemverConstraints(t *testing.T) {
+	cases := []struct {
+		constraint string
+		version    string
+		matches    bool
+	}{
+		{"~1.4", "1.4.0", true},
+		{"~1.4", "1.4.9", true},
+		{"~1.4", "1.5.0", false},
+		{"^1.4", "1.9.0", true},
+		{"^1.4", "2.0.0", false},
+		{"^0.3.1", "0.3.9", true},
+		{"^0.3.1", "0.4.0", false},
+		{"1.x", "1.7.2", true},
+		{"1.x", "2.0.0", false},
+		{">=1.2 <1.5", "1.4.2", true},
+		{">=1.2, <1.5", "1.5.0", false},
+		{">1.4", "1.4.9", false},
+		{"1.x || 3.x", "3.1.0", true},
+		{"~1.4", "1.4.1-rc.1", false},
+		{">=1.4.0-rc.1", "1.4.0-rc.2", true},
+	}
+	for _, c := range cases {
+		constraint, err := registry.ParseConstraint(c.constraint)
+		require.NoError(t, err, c.constraint)
+		v, err := registry.ParseVersion(c.version)
+		require.NoError(t, err, c.version)
+		assert.Equal(t, c.matches, constraint.Matches(v), "%s matches %s", c.constraint, c.version)
+	}
+
+	_, err := registry.ParseConstraint("~one")
+	assert.Error(t, err)
+}
+
+func TestTagPolicies(t *testing.T) {
+	tags := []string{"latest", "v1.3.9", "v1.4.2", "v1.4.10", "v1.5.0", "build-9", "build-10"}
+	cases := []struct {
+		policy   registry.Policy
+		selected string
+	}{
+		{registry.Policy{Type: registry.PolicySemver, Constraint: "~1.4"}, "v1.4.10"},
+		{registry.Policy{Type: registry.PolicySemver, Constraint: "^2"}, ""},
+		{registry.Policy{Type: registry.PolicyRegex, Constraint: `^build-\d+$`}, "build-10"},
+		{registry.Policy{Type: registry.PolicyExact, Constraint: "v1.5.0"}, "v1.5.0"},
+		{registry.Policy{Type: registry.PolicyExact, Constraint: "v2.0.0"}, ""},
+		{registry.Policy{Type: registry.PolicyDigest}, "latest"},
+	}
+	for _, c := range cases {
+		require.NoError(t, c.policy.Validate())
+		selected, err := c.policy.SelectTag("latest", tags)
+		require.NoError(t, err)
+		assert.Equal(t, c.selected, selected, c.policy)
+	}
+
+	// Policies only select tags greater than the current one
+	semver := registry.Policy{Type: registry.PolicySemver, Constraint: "^1"}
+	regex := registry.Policy{Type: registry.PolicyRegex, Constraint: `^build-\d+$`}
+	for _, c := range []struct {
+		policy   registry.Policy
+		current  string
+		selected string
+	}{
+		{semver, "v1.4.2", "v1.5.0"},
+		{semver, "v1.6.0", "v1.6.0"},
+		{semver, "1.5.0", "1.5.0"},
+		{regex, "build-9", "build-10"},
+		{regex, "build-11", "build-11"},
+	} {
+		selected, err := c.policy.SelectTag(c.current, tags)
+		require.NoError(t, err)
+		assert.Equal(t, c.selected, selected, c.current)
+	}
+
+	assert.Error(t, registry.Policy{Type: registry.PolicyRegex, Constraint: "("}.Validate())
+	assert.Error(t, registry.Policy{Type: "newest"}.Validate())
+}
+
+func TestImageUpdatesFromRegistry(t *testing.T) {
+	fake := &fakeRegistry{
+		tags:    []string{"1.3.0", "1.4.0", "1.4.1", "latest"},
+		digests: map[string]string{"1.4.1": "sha256:141", "latest": "sha256:aaa"},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	assert.Equal(t, host, registry.NormalizeDomain(server.URL+"/"))
+	assert.Equal(t, "docker.io", registry.NormalizeDomain("https://index.docker.io/v1/"))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('updates')`,
+		`INSERT INTO projects (name, path, unique_name, organisation_id, registry_credentials) VALUES ('updates', 'p', 'updates-upn', 1, '["ci"]')`,
+		fmt.Sprintf(`INSERT INTO services (name, usn, dcj, project_id, update_policy, update_constraint)
+		 VALUES ('api', 'api-usn', '{"api-usn":{"image":"%s/acme/api:1.3.0","restart":"always"}}', 1, 'semver', '~1.4')`, host),
+		fmt.Sprintf(`INSERT INTO services (name, usn, dcj, project_id, update_policy)
+		 VALUES ('worker', 'worker-usn', '{"worker-usn":{"image":"%s/acme/api:latest","restart":"always"}}', 1, 'digest')`, host),
+		fmt.Sprintf(`INSERT INTO registry_credentials (name, username, password, registry, organisation_id) VALUES ('ci', 'ci', 'secret', '%s', 1)`, server.URL),
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	var deployed [][]string
+	deploy := func(p *services.Project, usns []string) error {
+		deployed = append(deployed, usns)
+		return nil
+	}
+
+	p, err := s.SelectProjectByID(1)
+	require.NoError(t, err)
+	checks, err := s.UpdateProjectImages(context.Background(), p, deploy)
+	require.NoError(t, err)
+	require.Len(t, checks, 2)
+	for _, c := range checks {
+		require.Empty(t, c.Message)
+	}
+	// The newer version is deployed, the digest of latest is only recorded
+	assert.Equal(t, [][]string{{"api-usn"}}, deployed)
+	for _, service := range p.Services {
+		if service.Usn == "api-usn" {
+			assert.Equal(t, "1.4.1", service.ImageTag)
+		}
+	}
+
+	// The tag latest points to a new image
+	fake.digests["latest"] = "sha256:bbb"
+	_, err = s.UpdateProjectImages(context.Background(), p, deploy)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"api-usn"}, {"worker-usn"}}, deployed)
+
+	history, err := s.SelectImageUpdateChecks(1, "worker-usn")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, services.ImageUpdateStatusUpdated, history[0].Status)
+	assert.Equal(t, services.ImageUpdateStatusUpToDate, history[1].Status)
+
+	p, err = s.SelectProjectByID(1)
+	require.NoError(t, err)
+	for _, service := range p.Services {
+		require.NotNil(t, service.ImageUpdate, service.Usn)
+	}
+
+	// Registry errors are recorded with the check
+	_, err = conn.Exec(`UPDATE registry_credentials SET password = 'wrong'`)
+	require.NoError(t, err)
+	p, err = s.SelectProjectByID(1)
+	require.NoError(t, err)
+	checks, err = s.UpdateProjectImages(context.Background(), p, deploy)
+	require.NoError(t, err)
+	for _, c := range checks {
+		assert.Equal(t, services.ImageUpdateStatusFailed, c.Status)
+		assert.NotEmpty(t, c.Message)
+	}
+}
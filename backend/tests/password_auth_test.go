@@ -0,0 +1,139 @@
+package main_tests
+
+import (
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestPasswordAuthentication(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("LOGIN_MAX_ATTEMPTS", "3")
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	// Sign-ups are validated
+	tx := conn.MustBegin()
+	_, _, err := services.SignUpWithPassword("not an email", "jane", "correct horse", tx)
+	assert.ErrorIs(t, err, services.ErrInvalidEmail)
+	_, _, err = services.SignUpWithPassword("jane@example.com", "jane", "short", tx)
+	assert.ErrorIs(t, err, services.ErrInvalidPassword)
+
+	user, verificationToken, err := services.SignUpWithPassword(" Jane@Example.com", "jane", "correct horse", tx)
+	require.NoError(t, err)
+	require.NotEmpty(t, verificationToken)
+	assert.Equal(t, "jane@example.com", *user.Email)
+	assert.False(t, user.EmailVerified)
+	assert.NotZero(t, user.CurrentOrganisationID)
+	_, _, err = services.SignUpWithPassword("JANE@example.com", "jane", "correct horse", tx)
+	assert.ErrorIs(t, err, services.ErrEmailTaken)
+
+	var hash string
+	require.NoError(t, tx.Get(&hash, `SELECT password_hash FROM auth_methods WHERE user_id = $1`, user.UserID))
+	assert.NotContains(t, hash, "correct horse")
+
+	// Emails need to be verified before logging in, tokens can only be used once
+	_, err = services.AuthenticatePassword("jane@example.com", "correct horse", "10.0.0.1", tx)
+	assert.ErrorIs(t, err, services.ErrEmailNotVerified)
+	verified, err := services.VerifyEmail(verificationToken, tx)
+	require.NoError(t, err)
+	assert.True(t, verified.EmailVerified)
+	_, err = services.VerifyEmail(verificationToken, tx)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+	authenticated, err := services.AuthenticatePassword("JANE@example.com", "correct horse", "10.0.0.1", tx)
+	require.NoError(t, err)
+	assert.Equal(t, user.UserID, authenticated.UserID)
+
+	// Users of providers set a password with a reset, which doesn't work with expired tokens
+	_, err = services.UpsertUserBySocialIDAndMethod("github", &goth.User{
+		Provider: "github",
+		Email:    "john@example.com",
+		UserID:   "48172313",
+	}, tx)
+	require.NoError(t, err)
+	found, err := services.GetUserByMail("John@Example.com", tx)
+	require.NoError(t, err)
+	assert.Equal(t, "john@example.com", *found.Email)
+	_, token, err := services.CreatePasswordReset("john@example.com", tx)
+	require.NoError(t, err)
+	_, err = tx.Exec(`UPDATE auth_tokens SET valid_until = '2000-01-01 00:00:00'`)
+	require.NoError(t, err)
+	_, err = services.ResetPassword(token, "new password", tx)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+
+	_, token, err = services.CreatePasswordReset("john@example.com", tx)
+	require.NoError(t, err)
+	_, err = services.ResetPassword(token, "short", tx)
+	assert.ErrorIs(t, err, services.ErrInvalidPassword)
+	_, err = services.ResetPassword(token, "new password", tx)
+	require.NoError(t, err)
+	_, err = services.AuthenticatePassword("john@example.com", "new password", "10.0.0.1", tx)
+	require.NoError(t, err)
+
+	unknown, token, err := services.CreatePasswordReset("nobody@example.com", tx)
+	require.NoError(t, err)
+	assert.Nil(t, unknown)
+	assert.Empty(t, token)
+
+	// Unverified passwords are dropped once the owner of the email logs in with a provider
+	_, _, err = services.SignUpWithPassword("victim@example.com", "", "attacker password", tx)
+	require.NoError(t, err)
+	_, err = services.UpsertUserBySocialIDAndMethod("google", &goth.User{
+		Provider: "google",
+		Email:    "victim@example.com",
+		UserID:   "1234",
+	}, tx)
+	require.NoError(t, err)
+	_, err = services.AuthenticatePassword("victim@example.com", "attacker password", "10.0.0.2", tx)
+	assert.ErrorIs(t, err, services.ErrInvalidCredentials)
+	require.NoError(t, tx.Commit())
+
+	// Logins through the email provider start a session
+	gothic.Store = cookie.NewStore([]byte("test-secret"))
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+	login := func(email, password string) *httptest.ResponseRecorder {
+		body := `{"email": "` + email + `", "password": "` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/email/callback", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := login("jane@example.com", "correct horse")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "jane@example.com")
+	req := httptest.NewRequest(http.MethodGet, "/v1/auth/verify-session", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Failed logins are limited per email
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login("john@example.com", "wrong password").Code)
+	}
+	rec = login("john@example.com", "new password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, login("jane@example.com", "correct horse").Code)
+	assert.Equal(t, http.StatusBadRequest, login("", "").Code)
+}
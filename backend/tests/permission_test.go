@@ -0,0 +1,172 @@
+package main_tests
+
+import (
+	"embed"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestRolePermissions(t *testing.T) {
+	matrix := map[services.Permission][]string{
+		services.PermissionOrganisationView:   {services.RoleOwner, services.RoleAdmin, services.RoleMember},
+		services.PermissionOrganisationDelete: {services.RoleOwner},
+		services.PermissionMembersManage:      {services.RoleOwner, services.RoleAdmin},
+		services.PermissionOwnersManage:       {services.RoleOwner},
+		services.PermissionAuditView:          {services.RoleOwner, services.RoleAdmin},
+		services.PermissionSettingsManage:     {services.RoleOwner, services.RoleAdmin},
+		services.PermissionProjectCreate:      {services.RoleOwner, services.RoleAdmin},
+		services.PermissionProjectView:        {services.RoleOwner, services.RoleAdmin, services.RoleMember},
+		services.PermissionProjectDeploy:      {services.RoleOwner, services.RoleAdmin, services.RoleMember},
+		services.PermissionProjectManage:      {services.RoleOwner, services.RoleAdmin},
+		services.PermissionProjectShell:       {services.RoleOwner, services.RoleAdmin},
+	}
+	for permission, allowed := range matrix {
+		for _, role := range []string{services.RoleOwner, services.RoleAdmin, services.RoleMember, "guest"} {
+			assert.Equal(t, slices.Contains(allowed, role), services.RoleAllows(role, permission), "%s %s", role, permission)
+		}
+	}
+	assert.False(t, services.IsValidRole("guest"))
+}
+
+func TestRoutePermissions(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('team')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('owner@example.com', 1)`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('admin@example.com', 1)`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('member@example.com', 1)`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('outsider@example.com', 1)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner')`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 2, 'admin')`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 3, 'member')`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	p := &services.Project{Name: "shop", UPN: "shop-upn"}
+	require.NoError(t, s.SaveProject(p, "1"))
+
+	tokens := make(map[string]string)
+	for userID, name := range []string{"owner", "admin", "member", "outsider"} {
+		token := services.APIToken{
+			Name:   name,
+			Scopes: services.StringList{services.APITokenScopeRead, services.APITokenScopeWrite},
+			UserID: userID + 1,
+		}
+		require.NoError(t, s.SavePersonalAPIToken(&token))
+		tokens[name] = token.Token
+	}
+
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+	request := func(user, method, path, body string) int {
+		req := httptest.NewRequest(method, "/v1/"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens[user])
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	projectPath := fmt.Sprintf("project/%d", p.ID)
+	for _, c := range []struct {
+		user, method, path, body string
+		status                   int
+	}{
+		// Members can read the organisation and its projects, others can't
+		{"member", http.MethodGet, "organisation/1", "", http.StatusOK},
+		{"outsider", http.MethodGet, "organisation/1", "", http.StatusNotFound},
+		{"member", http.MethodGet, projectPath, "", http.StatusOK},
+		{"outsider", http.MethodGet, projectPath, "", http.StatusNotFound},
+		{"outsider", http.MethodGet, "projects", "", http.StatusNotFound},
+		{"member", http.MethodGet, projectPath + "/tokens", "", http.StatusOK},
+		// Members can't manage projects, settings or members
+		{"member", http.MethodDelete, projectPath, "", http.StatusForbidden},
+		{"member", http.MethodPost, "project", `{"name": "new"}`, http.StatusForbidden},
+		{"member", http.MethodPost, projectPath + "/tokens", `{"name": "ci", "scopes": ["deploy"]}`, http.StatusForbidden},
+		{"member", http.MethodGet, fmt.Sprintf("ws/project/shell/api/%d", p.ID), "", http.StatusForbidden},
+		{"member", http.MethodPut, "organisation/1/env-groups/shared", `{"vars": []}`, http.StatusForbidden},
+		{"member", http.MethodPut, "organisation/member", `{"email": "new@example.com", "organisation_id": 1}`, http.StatusForbidden},
+		{"member", http.MethodDelete, "organisation/withdraw_invitation", `{"email": "new@example.com", "organisation_id": 1}`, http.StatusForbidden},
+		{"member", http.MethodDelete, "organisation/project", `{"upn": "shop-upn", "organisation_id": 1}`, http.StatusForbidden},
+		{"member", http.MethodDelete, "organisation/member/1/2", "", http.StatusForbidden},
+		// Admins can, but not delete the organisation
+		{"admin", http.MethodPost, projectPath + "/tokens", `{"name": "ci", "scopes": ["deploy"]}`, http.StatusCreated},
+		{"admin", http.MethodPut, "organisation/1/env-groups/shared", `{"vars": []}`, http.StatusOK},
+		{"admin", http.MethodDelete, "organisation/1", "", http.StatusForbidden},
+		{"outsider", http.MethodDelete, "organisation/1", "", http.StatusNotFound},
+	} {
+		assert.Equal(t, c.status, request(c.user, c.method, c.path, c.body), "%s %s %s", c.user, c.method, c.path)
+	}
+
+	// Roles can be changed by admins, owners only by owners
+	rolePath := func(memberID int) string { return fmt.Sprintf("organisation/1/members/%d/role", memberID) }
+	assert.Equal(t, http.StatusForbidden, request("member", http.MethodPut, rolePath(3), `{"role": "admin"}`))
+	assert.Equal(t, http.StatusBadRequest, request("admin", http.MethodPut, rolePath(3), `{"role": "guest"}`))
+	assert.Equal(t, http.StatusForbidden, request("admin", http.MethodPut, rolePath(3), `{"role": "owner"}`))
+	assert.Equal(t, http.StatusForbidden, request("admin", http.MethodPut, rolePath(1), `{"role": "member"}`))
+	assert.Equal(t, http.StatusForbidden, request("admin", http.MethodDelete, "organisation/member/1/1", ""))
+	assert.Equal(t, http.StatusNotFound, request("admin", http.MethodPut, rolePath(4), `{"role": "member"}`))
+	assert.Equal(t, http.StatusOK, request("admin", http.MethodPut, rolePath(3), `{"role": "admin"}`))
+	role, err := s.OrganisationRole(1, "3")
+	require.NoError(t, err)
+	assert.Equal(t, services.RoleAdmin, role)
+	assert.Equal(t, http.StatusCreated, request("member", http.MethodPost, projectPath+"/tokens", `{"name": "ci", "scopes": ["deploy"]}`))
+
+	// The last owner can't be demoted
+	assert.Equal(t, http.StatusConflict, request("owner", http.MethodPut, rolePath(1), `{"role": "admin"}`))
+	assert.Equal(t, http.StatusOK, request("owner", http.MethodPut, rolePath(2), `{"role": "owner"}`))
+	assert.Equal(t, http.StatusOK, request("owner", http.MethodPut, rolePath(1), `{"role": "admin"}`))
+	assert.Equal(t, http.StatusForbidden, request("owner", http.MethodDelete, "organisation/1", ""))
+
+	organisations, err := s.SelectOrganisations("2")
+	require.NoError(t, err)
+	require.Len(t, organisations, 1)
+	assert.True(t, organisations[0].IsOwner)
+	organisation, err := s.GetOrganisation(1, "1")
+	require.NoError(t, err)
+	assert.False(t, organisation.IsOwner)
+
+	// Users join organisations only with a valid invitation for their email
+	assert.Equal(t, http.StatusNotFound, request("outsider", http.MethodPut, "organisation/member/1/4", ""))
+	_, err = conn.Exec(`
+		INSERT INTO organisation_invitations (email, invitation_token, valid_until, organisation_id)
+		VALUES ('Outsider@example.com', 'token', $1, 1)
+	`, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, request("outsider", http.MethodPut, "organisation/member/1/3", ""))
+	assert.Equal(t, http.StatusOK, request("outsider", http.MethodPut, "organisation/member/1/4", ""))
+	role, err = s.OrganisationRole(1, "4")
+	require.NoError(t, err)
+	assert.Equal(t, services.RoleMember, role)
+	assert.Equal(t, http.StatusNotFound, request("outsider", http.MethodPut, "organisation/member/1/4", ""))
+
+	// Members can leave, but not the last owner
+	assert.Equal(t, http.StatusConflict, request("admin", http.MethodPost, "organisation/1/leave", ""))
+	assert.Equal(t, http.StatusOK, request("outsider", http.MethodPost, "organisation/1/leave", ""))
+	assert.Equal(t, http.StatusNotFound, request("outsider", http.MethodGet, "organisation/1", ""))
+
+	// Only owners can delete the organisation
+	assert.Error(t, s.DeleteOrganisation("1", 1))
+	assert.Equal(t, http.StatusNoContent, request("admin", http.MethodDelete, "organisation/1", ""))
+}
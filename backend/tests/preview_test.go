@@ -0,0 +1,150 @@
+package main_tests
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/pkg/webhook"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestPreviewEnvironments(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("BACKEND_HOST", "sloth.example.com")
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('previews')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	parent := &services.Project{
+		Name: "shop",
+		UPN:  "shop-upn",
+		Services: []*services.Service{
+			{Name: "db", Image: "postgres", ImageTag: "16"},
+			{
+				Name:     "api",
+				Image:    "acme/api",
+				ImageTag: "1.0.0",
+				Public:   services.Public{Enabled: true, Hosts: []string{"api.example.com"}, Port: "8080"},
+			},
+		},
+	}
+	require.NoError(t, s.SaveProject(parent, "1"))
+	parent, err = s.SelectProjectByID(parent.ID)
+	require.NoError(t, err)
+	usns := make(map[string]string)
+	for _, service := range parent.Services {
+		usns[service.Name] = service.Usn
+	}
+	// The api depends on the db of its project
+	for _, service := range parent.Services {
+		if service.Name == "api" {
+			service.Depends = map[string]compose.Condition{usns["db"]: {Condition: "service_started"}}
+		}
+	}
+
+	p, preview, err := s.PreviewProject(parent, services.PreviewRequest{Branch: "feature/Login", Tags: map[string]string{"api": "pr-42"}})
+	require.NoError(t, err)
+	assert.Zero(t, preview.ID)
+	assert.Equal(t, "feature-login", preview.Branch)
+	assert.Equal(t, services.UPN("shop-upn-feature-login"), p.UPN)
+	host := "feature-login." + usns["api"] + ".sloth.example.com"
+	assert.Equal(t, map[string]string{"api": host}, preview.Hosts)
+
+	previewUsns := make(map[string]string)
+	for _, service := range p.Services {
+		previewUsns[service.Name] = service.Usn
+		assert.NotEqual(t, usns[service.Name], service.Usn)
+	}
+	dc, err := s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	api := dc.Services[previewUsns["api"]]
+	assert.Equal(t, "acme/api:pr-42", api.Image)
+	assert.Contains(t, api.Depends, previewUsns["db"])
+	assert.Contains(t, strings.Join(api.Labels, " "), "Host(`"+host+"`)")
+	assert.Equal(t, "postgres:16", dc.Services[previewUsns["db"]].Image)
+
+	require.NoError(t, s.SavePreview(p, preview))
+	assert.NotZero(t, preview.ID)
+	saved, err := s.SelectProjectByID(preview.ProjectID)
+	require.NoError(t, err)
+	require.Len(t, saved.Services, 2)
+	for _, service := range saved.Services {
+		assert.Equal(t, previewUsns[service.Name], service.Usn)
+	}
+
+	// Previews are only listed by their project
+	projects, err := s.GetProjectsByOrganisationID(1)
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	previews, err := s.SelectPreviews(parent.ID)
+	require.NoError(t, err)
+	require.Len(t, previews, 1)
+	assert.Equal(t, p.UPN, previews[0].UPN)
+
+	// Updating a preview keeps its services, tags which aren't overridden are the ones of the parent
+	p, updated, err := s.PreviewProject(parent, services.PreviewRequest{Branch: "feature/login", TTL: "1h"})
+	require.NoError(t, err)
+	assert.Equal(t, preview.ID, updated.ID)
+	for _, service := range p.Services {
+		assert.Equal(t, previewUsns[service.Name], service.Usn)
+		if service.Name == "api" {
+			assert.Equal(t, "1.0.0", service.ImageTag)
+		}
+	}
+	assert.True(t, updated.ExpiresAt.Before(preview.ExpiresAt))
+
+	_, _, err = s.PreviewProject(parent, services.PreviewRequest{Branch: "x", Tags: map[string]string{"web": "1"}})
+	assert.Error(t, err)
+	_, _, err = s.PreviewProject(parent, services.PreviewRequest{Branch: "x", TTL: "soon"})
+	assert.Error(t, err)
+	_, _, err = s.PreviewProject(saved, services.PreviewRequest{Branch: "x"})
+	assert.Error(t, err)
+
+	// Expired previews are torn down
+	_, err = conn.Exec(`UPDATE preview_environments SET expires_at = '2000-01-01 00:00:00'`)
+	require.NoError(t, err)
+	var tornDown []string
+	err = s.TeardownExpiredPreviews(func(preview services.Preview) error {
+		tornDown = append(tornDown, preview.Branch)
+		return s.DeleteProjectByIDAndOrganisationID(preview.ProjectID, "1")
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"feature-login"}, tornDown)
+	previews, err = s.SelectPreviews(parent.ID)
+	require.NoError(t, err)
+	assert.Empty(t, previews)
+}
+
+func TestClosedPullRequests(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "pull_request")
+	branch, err := webhook.ClosedPullRequest(header, []byte(`{"action": "closed", "pull_request": {"head": {"ref": "feature/login"}}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "feature/login", branch)
+
+	branch, err = webhook.ClosedPullRequest(header, []byte(`{"action": "synchronize", "pull_request": {"head": {"ref": "feature/login"}}}`))
+	require.NoError(t, err)
+	assert.Empty(t, branch)
+
+	header = http.Header{}
+	header.Set("X-Gitlab-Event", "Merge Request Hook")
+	branch, err = webhook.ClosedPullRequest(header, []byte(`{"object_attributes": {"action": "merge", "source_branch": "fix-1"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "fix-1", branch)
+
+	// Registry pushes aren't pull requests
+	branch, err = webhook.ClosedPullRequest(http.Header{}, []byte(`{"image": "acme/api", "tag": "1"}`))
+	require.NoError(t, err)
+	assert.Empty(t, branch)
+}
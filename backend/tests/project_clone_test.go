@@ -0,0 +1,158 @@
+package main_tests
+
+import (
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestCloneProject(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("BACKEND_HOST", "sloth.example.com")
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('clones')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	require.NoError(t, s.SaveRegistryCredential(&services.RegistryCredential{
+		Name: "ci", Registry: "registry.example.com", AuthType: services.RegistryAuthBasic, Username: "ci", Password: "secret", OrganisationID: 1,
+	}))
+	source := &services.Project{
+		Name:                "shop",
+		UPN:                 "shop-upn",
+		RegistryCredentials: services.StringList{"ci"},
+		SharedVolumes:       []services.SharedVolume{{Name: "uploads"}},
+		Services: []*services.Service{
+			{Name: "db", Image: "postgres", ImageTag: "16", Volumes: []services.Volume{{Target: "/var/lib/postgresql/data"}}},
+			{
+				Name:     "api",
+				Image:    "acme/api",
+				ImageTag: "1.0.0",
+				EnvVars:  [][]string{{"LOG_LEVEL", "debug"}},
+				Public:   services.Public{Enabled: true, Hosts: []string{"api.example.com"}, Port: "8080"},
+			},
+		},
+	}
+	require.NoError(t, s.SaveProject(source, "1"))
+	source, err = s.SelectProjectByID(source.ID)
+	require.NoError(t, err)
+	sourceUsns := make(map[string]string)
+	for _, service := range source.Services {
+		sourceUsns[service.Name] = service.Usn
+	}
+	for _, service := range source.Services {
+		if service.Name == "api" {
+			service.Depends = map[string]compose.Condition{sourceUsns["db"]: {Condition: "service_started"}}
+		}
+	}
+
+	dataFile := path.Join(source.UPN.GetProjectPath(), "data", sourceUsns["db"], "var/lib/postgresql/data/PG_VERSION")
+	require.NoError(t, os.MkdirAll(path.Dir(dataFile), 0o750))
+	require.NoError(t, os.WriteFile(dataFile, []byte("16"), 0o600))
+	sharedFile := path.Join(source.UPN.GetProjectPath(), "shared", "uploads", "logo.png")
+	require.NoError(t, os.MkdirAll(path.Dir(sharedFile), 0o750))
+	require.NoError(t, os.WriteFile(sharedFile, []byte("png"), 0o600))
+
+	p, usns, err := s.CloneProject(source, services.CloneRequest{Data: true}, "clone-upn", "secret")
+	require.NoError(t, err)
+	require.NoError(t, services.CopyProjectData(source, p, usns))
+
+	clone, err := s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "shop (copy)", clone.Name)
+	assert.Equal(t, services.UPN("clone-upn"), clone.UPN)
+	assert.Equal(t, services.StringList{"ci"}, clone.RegistryCredentials)
+	require.Len(t, clone.DockerCredentials, 1)
+	assert.Equal(t, "ci", clone.DockerCredentials[0].Username)
+	require.Len(t, clone.SharedVolumes, 1)
+	require.Len(t, clone.Services, 2)
+	cloneUsns := make(map[string]string)
+	for _, service := range clone.Services {
+		cloneUsns[service.Name] = service.Usn
+		assert.Equal(t, usns[sourceUsns[service.Name]], service.Usn)
+		assert.NotEqual(t, sourceUsns[service.Name], service.Usn)
+		if service.Name == "api" {
+			assert.Equal(t, map[string]string{"LOG_LEVEL": "debug"}, service.EnvMap())
+		}
+	}
+
+	dc, err := s.GenerateDockerCompose(p)
+	require.NoError(t, err)
+	api := dc.Services[cloneUsns["api"]]
+	assert.Equal(t, []string{"./env/" + cloneUsns["api"] + ".env"}, api.EnvFile)
+	assert.Contains(t, api.Depends, cloneUsns["db"])
+	labels := strings.Join(api.Labels, " ")
+	assert.Contains(t, labels, "Host(`"+cloneUsns["api"]+".sloth.example.com`)")
+	assert.NotContains(t, labels, "api.example.com")
+
+	data, err := os.ReadFile(path.Join(clone.UPN.GetProjectPath(), "data", cloneUsns["db"], "var/lib/postgresql/data/PG_VERSION"))
+	require.NoError(t, err)
+	assert.Equal(t, "16", string(data))
+	data, err = os.ReadFile(path.Join(clone.UPN.GetProjectPath(), "shared", "uploads", "logo.png"))
+	require.NoError(t, err)
+	assert.Equal(t, "png", string(data))
+
+	// The source keeps its services
+	source, err = s.SelectProjectByID(source.ID)
+	require.NoError(t, err)
+	for _, service := range source.Services {
+		assert.Equal(t, sourceUsns[service.Name], service.Usn)
+	}
+}
+
+func TestFailedCloneIsDeleted(t *testing.T) {
+	// The data of the source can't be read below a file
+	file := path.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	t.Setenv("PROJECTS_DIR", path.Join(file, "projects"))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('clones')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('owner@example.com', 1)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner')`,
+		`INSERT INTO projects (name, path, unique_name, organisation_id) VALUES ('shop', 'p', 'shop-upn', 1)`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	token := services.APIToken{Name: "cli", Scopes: services.StringList{services.APITokenScopeWrite}, UserID: 1}
+	require.NoError(t, s.SavePersonalAPIToken(&token))
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/project/1/clone", strings.NewReader(`{"data": true}`))
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	var projects int
+	require.NoError(t, conn.Get(&projects, `SELECT count(*) FROM projects`))
+	assert.Equal(t, 1, projects)
+}
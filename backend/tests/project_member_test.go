@@ -0,0 +1,164 @@
+package main_tests
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/handlers"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestProjectRolePermissions(t *testing.T) {
+	matrix := map[services.Permission][]string{
+		services.PermissionProjectView:   {services.ProjectRoleViewer, services.ProjectRoleDeployer, services.ProjectRoleMaintainer},
+		services.PermissionProjectDeploy: {services.ProjectRoleDeployer, services.ProjectRoleMaintainer},
+		services.PermissionProjectManage: {services.ProjectRoleMaintainer},
+		services.PermissionProjectShell:  {services.ProjectRoleMaintainer},
+		services.PermissionProjectCreate: {},
+		services.PermissionMembersManage: {},
+	}
+	for permission, allowed := range matrix {
+		for _, role := range []string{services.ProjectRoleViewer, services.ProjectRoleDeployer, services.ProjectRoleMaintainer, services.RoleOwner} {
+			assert.Equal(t, slices.Contains(allowed, role), services.ProjectRoleAllows(role, permission), "%s %s", role, permission)
+		}
+	}
+}
+
+func TestProjectMembers(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('agency')`,
+		`INSERT INTO organisations (name) VALUES ('freelancer')`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('owner@example.com', 1)`,
+		`INSERT INTO users (email, current_organisation_id) VALUES ('freelancer@example.com', 2)`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (1, 1, 'owner')`,
+		`INSERT INTO organisation_members (organisation_id, user_id, role) VALUES (2, 2, 'owner')`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+	shop := &services.Project{Name: "shop", UPN: "shop-upn"}
+	require.NoError(t, s.SaveProject(shop, "1"))
+	blog := &services.Project{Name: "blog", UPN: "blog-upn"}
+	require.NoError(t, s.SaveProject(blog, "1"))
+	// Previews and environments derived from the projects
+	derived := make(map[string]int)
+	for _, d := range []struct{ name, query string }{
+		{"shop-preview", `INSERT INTO preview_environments (branch, expires_at, parent_id, project_id) VALUES ('feature', CURRENT_TIMESTAMP, $1, $2)`},
+		{"shop-staging", `INSERT INTO project_environments (name, parent_id, project_id) VALUES ('staging', $1, $2)`},
+		{"blog-preview", `INSERT INTO preview_environments (branch, expires_at, parent_id, project_id) VALUES ('feature', CURRENT_TIMESTAMP, $1, $2)`},
+	} {
+		p := &services.Project{Name: d.name, UPN: services.UPN(d.name + "-upn")}
+		require.NoError(t, s.SaveProject(p, "1"))
+		parentID := shop.ID
+		if strings.HasPrefix(d.name, "blog") {
+			parentID = blog.ID
+		}
+		_, err := conn.Exec(d.query, parentID, p.ID)
+		require.NoError(t, err)
+		derived[d.name] = p.ID
+	}
+
+	tokens := make(map[string]string)
+	for userID, name := range []string{"owner", "freelancer"} {
+		token := services.APIToken{
+			Name:   name,
+			Scopes: services.StringList{services.APITokenScopeRead, services.APITokenScopeWrite},
+			UserID: userID + 1,
+		}
+		require.NoError(t, s.SavePersonalAPIToken(&token))
+		tokens[name] = token.Token
+	}
+
+	h := handlers.New(dbService, embed.FS{})
+	router := gin.New()
+	h.RegisterEndpoints(router.Group("v1"))
+	request := func(user, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens[user])
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	shopPath := fmt.Sprintf("project/%d", shop.ID)
+	blogPath := fmt.Sprintf("project/%d", blog.ID)
+
+	// Without a grant the freelancer has no access to projects of the agency
+	assert.Equal(t, http.StatusNotFound, request("freelancer", http.MethodGet, shopPath, "").Code)
+
+	// Grants are managed by members of the organisation who can manage members
+	assert.Equal(t, http.StatusBadRequest, request("owner", http.MethodPut, shopPath+"/members", `{"email": "freelancer@example.com", "role": "owner"}`).Code)
+	assert.Equal(t, http.StatusNotFound, request("owner", http.MethodPut, shopPath+"/members", `{"email": "unknown@example.com", "role": "viewer"}`).Code)
+	rec := request("owner", http.MethodPut, shopPath+"/members", `{"email": "freelancer@example.com", "role": "deployer"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var member services.ProjectMember
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &member))
+	assert.Equal(t, 2, member.UserID)
+	assert.Equal(t, services.ProjectRoleDeployer, member.Role)
+
+	// Deployers can read and deploy the project, but nothing else of the organisation
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, shopPath, "", http.StatusOK},
+		{http.MethodGet, shopPath + "/tokens", "", http.StatusOK},
+		{http.MethodGet, shopPath + "/members", "", http.StatusOK},
+		{http.MethodGet, blogPath, "", http.StatusNotFound},
+		{http.MethodGet, fmt.Sprintf("project/%d", derived["shop-preview"]), "", http.StatusOK},
+		{http.MethodGet, fmt.Sprintf("project/%d", derived["shop-staging"]), "", http.StatusOK},
+		{http.MethodGet, fmt.Sprintf("project/%d", derived["blog-preview"]), "", http.StatusNotFound},
+		{http.MethodDelete, fmt.Sprintf("project/%d", derived["shop-preview"]), "", http.StatusForbidden},
+		{http.MethodGet, "ws/project/logs/blog-upn/api", "", http.StatusNotFound},
+		{http.MethodGet, fmt.Sprintf("ws/project/shell/api/%d", shop.ID), "", http.StatusForbidden},
+		{http.MethodPost, shopPath + "/tokens", `{"name": "ci", "scopes": ["deploy"]}`, http.StatusForbidden},
+		{http.MethodPut, shopPath + "/members", `{"email": "freelancer@example.com", "role": "maintainer"}`, http.StatusForbidden},
+		{http.MethodDelete, shopPath, "", http.StatusForbidden},
+		{http.MethodPost, shopPath + "/clone", "", http.StatusForbidden},
+		{http.MethodGet, "organisation/1", "", http.StatusNotFound},
+	} {
+		assert.Equal(t, c.status, request("freelancer", c.method, c.path, c.body).Code, "%s %s", c.method, c.path)
+	}
+
+	// Shared projects are listed besides the ones of the current organisation
+	rec = request("freelancer", http.MethodGet, "projects", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var projects []services.Project
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &projects))
+	require.Len(t, projects, 1)
+	assert.Equal(t, "shop", projects[0].Name)
+
+	// Maintainers can manage the project and open shells in it
+	require.Equal(t, http.StatusOK, request("owner", http.MethodPut, shopPath+"/members", `{"email": "freelancer@example.com", "role": "maintainer"}`).Code)
+	assert.Equal(t, http.StatusCreated, request("freelancer", http.MethodPost, shopPath+"/tokens", `{"name": "ci", "scopes": ["deploy"]}`).Code)
+	// Passing the permission check the request fails to upgrade to a websocket
+	assert.Equal(t, http.StatusBadRequest, request("freelancer", http.MethodGet, fmt.Sprintf("ws/project/shell/api/%d", shop.ID), "").Code)
+	assert.Equal(t, http.StatusForbidden, request("freelancer", http.MethodDelete, shopPath, "").Code)
+	members, err := s.SelectProjectMembers(shop.ID)
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, "freelancer@example.com", members[0].Email)
+
+	// Revoked grants remove the access
+	assert.Equal(t, http.StatusOK, request("owner", http.MethodDelete, shopPath+"/members/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, request("owner", http.MethodDelete, shopPath+"/members/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, request("freelancer", http.MethodGet, shopPath, "").Code)
+}
@@ -0,0 +1,24 @@
+package main_tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestAssignServiceUsns(t *testing.T) {
+	stored := &services.Project{Services: []*services.Service{{Name: "api", Usn: "api-usn"}}}
+
+	p := &services.Project{Services: []*services.Service{{Name: "api", Usn: "api-usn"}, {Name: "worker"}}}
+	require.NoError(t, p.AssignServiceUsns(stored))
+	assert.Equal(t, "api-usn", p.Services[0].Usn)
+	assert.NotEmpty(t, p.Services[1].Usn)
+	assert.NotEqual(t, "api-usn", p.Services[1].Usn)
+
+	// Clients can't pick the usn of a new service, e.g. the one of another project
+	p = &services.Project{Services: []*services.Service{{Name: "api", Usn: "api-usn"}, {Name: "worker", Usn: "other-usn"}}}
+	assert.ErrorIs(t, p.AssignServiceUsns(stored), services.ErrUnknownService)
+}
@@ -0,0 +1,77 @@
+package main_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestProjectTokens(t *testing.T) {
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('tokens')`,
+		`INSERT INTO projects (name, path, unique_name, organisation_id) VALUES ('tokens', 'p', 'tokens-upn', 1)`,
+		`INSERT INTO legacy_project_access_tokens (access_token, project_id) VALUES ('legacy12char', 1)`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	s := services.New(dbService)
+
+	// The legacy access token keeps working as deploy token, but isn't stored in plaintext anymore
+	require.NoError(t, s.MigrateProjectAccessTokens())
+	require.NoError(t, s.MigrateProjectAccessTokens())
+	var legacyTokens int
+	require.NoError(t, conn.Get(&legacyTokens, `SELECT COUNT(*) FROM legacy_project_access_tokens`))
+	assert.Zero(t, legacyTokens)
+
+	p, err := s.SelectProjectByIDAndToken(1, "legacy12char", services.ProjectTokenScopeDeploy)
+	require.NoError(t, err)
+	assert.Equal(t, services.UPN("tokens-upn"), p.UPN)
+	_, err = s.SelectProjectByIDAndToken(1, "legacy12char", services.ProjectTokenScopeExec)
+	assert.ErrorIs(t, err, services.ErrMissingScope)
+
+	tokens, err := s.SelectProjectTokens(1)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].LastUsedAt)
+
+	// Scoped tokens
+	token := services.ProjectToken{Name: "ci", Scopes: services.StringList{services.ProjectTokenScopeReadState}, ProjectID: 1}
+	require.NoError(t, token.Validate())
+	require.NoError(t, s.SaveProjectToken(&token))
+	_, err = s.SelectProjectByIDAndToken(1, token.Token, services.ProjectTokenScopeReadState)
+	assert.NoError(t, err)
+	_, err = s.SelectProjectByIDAndToken(2, token.Token, services.ProjectTokenScopeReadState)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+
+	// Rotating invalidates the old token
+	rotated, err := s.RotateProjectToken(1, token.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, token.Token, rotated.Token)
+	_, err = s.SelectProjectByIDAndToken(1, token.Token, services.ProjectTokenScopeReadState)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+	_, err = s.SelectProjectByIDAndToken(1, rotated.Token, services.ProjectTokenScopeReadState)
+	assert.NoError(t, err)
+
+	// Expired tokens
+	_, err = conn.Exec(`UPDATE project_tokens SET expires_at = $1 WHERE id = $2`, time.Now().Add(-time.Minute).UTC(), token.ID)
+	require.NoError(t, err)
+	_, err = s.SelectProjectByIDAndToken(1, rotated.Token, services.ProjectTokenScopeReadState)
+	assert.ErrorIs(t, err, services.ErrInvalidToken)
+
+	// Revoking
+	require.NoError(t, s.DeleteProjectToken(1, token.ID))
+	assert.Error(t, s.DeleteProjectToken(1, token.ID))
+
+	assert.Error(t, (&services.ProjectToken{Name: "x", Scopes: services.StringList{"admin"}}).Validate())
+}
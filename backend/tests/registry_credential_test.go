@@ -0,0 +1,142 @@
+package main_tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/registry"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestRegistryCredentials(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("REGISTRY_CREDENTIAL_HELPERS", "fake-ecr")
+
+	helperCalls := 0
+	registry.RegisterHelper("fake-ecr", registry.HelperFunc(func(ctx context.Context, address string) (registry.Credentials, error) {
+		helperCalls++
+		return registry.Credentials{Username: "AWS", Password: "short-lived"}, nil
+	}))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	for _, q := range []string{
+		`INSERT INTO organisations (name) VALUES ('registries')`,
+		`INSERT INTO organisations (name) VALUES ('others')`,
+	} {
+		_, err := conn.Exec(q)
+		require.NoError(t, err)
+	}
+
+	for _, c := range []services.RegistryCredential{
+		{Name: "Docker Hub", Registry: "docker.io", Username: "ci", Password: "secret"},
+		{Name: "hub", Username: "ci", Password: "secret"},
+		{Name: "hub", Registry: "docker.io", Username: "ci"},
+		{Name: "ghcr", Registry: "ghcr.io", AuthType: services.RegistryAuthToken},
+		{Name: "ecr", Registry: "1234.dkr.ecr.eu-central-1.amazonaws.com", AuthType: services.RegistryAuthHelper, Helper: "ecr-login"},
+		{Name: "ecr", Registry: "1234.dkr.ecr.eu-central-1.amazonaws.com", AuthType: "oidc"},
+	} {
+		assert.Error(t, c.Validate(), c.Name)
+	}
+
+	s := services.New(dbService)
+	credentials := []*services.RegistryCredential{
+		{Name: "hub", Registry: "https://index.docker.io/v1/", Username: "ci", Password: "hub-pass"},
+		{Name: "ghcr", Registry: "ghcr.io", AuthType: services.RegistryAuthToken, Password: "ghp_token"},
+		{Name: "ecr", Registry: "1234.dkr.ecr.eu-central-1.amazonaws.com", AuthType: services.RegistryAuthHelper, Helper: "fake-ecr", Password: "ignored"},
+		{Name: "hub-readonly", Registry: "docker.io", Username: "reader", Password: "reader-pass"},
+	}
+	for _, c := range credentials {
+		c.OrganisationID = 1
+		require.NoError(t, c.Validate(), c.Name)
+		require.NoError(t, s.SaveRegistryCredential(c))
+	}
+	assert.Equal(t, services.RegistryAuthBasic, credentials[0].AuthType)
+	assert.Empty(t, credentials[2].Password)
+
+	// Masked passwords keep the stored ones
+	stored, err := s.SelectRegistryCredentials(1)
+	require.NoError(t, err)
+	require.Len(t, stored, 4)
+	hub := stored[2]
+	assert.Equal(t, "hub", hub.Name)
+	hub.MaskSecrets()
+	assert.Equal(t, services.SecretMask, hub.Password)
+	hub.Username = "deploy"
+	require.NoError(t, s.SaveRegistryCredential(&hub))
+	updated, err := s.SelectRegistryCredential(1, "hub")
+	require.NoError(t, err)
+	assert.Equal(t, "deploy", updated.Username)
+	assert.Equal(t, "hub-pass", updated.Password)
+
+	// Projects use credentials of their organisation by name, at most one per registry
+	p := &services.Project{
+		Name:                "shop",
+		UPN:                 "shop-upn",
+		RegistryCredentials: services.StringList{"hub", "ghcr", "ecr"},
+		Services:            []*services.Service{{Name: "api", Image: "ghcr.io/acme/api", ImageTag: "1.0.0"}},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+	for _, names := range []services.StringList{{"missing"}, {"hub", "hub-readonly"}} {
+		invalid := &services.Project{Name: "invalid", UPN: "invalid-upn", RegistryCredentials: names}
+		assert.ErrorIs(t, s.SaveProject(invalid, "1"), services.ErrInvalidRegistryCredentials, names)
+	}
+	other := &services.Project{Name: "other", UPN: "other-upn", RegistryCredentials: services.StringList{"hub"}}
+	assert.ErrorIs(t, s.SaveProject(other, "2"), services.ErrInvalidRegistryCredentials)
+
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, services.StringList{"hub", "ghcr", "ecr"}, p.RegistryCredentials)
+	assert.Equal(t, []services.DockerCredential{
+		{Username: "deploy", Password: "hub-pass", Registry: "https://index.docker.io/v1/"},
+		{Username: "token", Password: "ghp_token", Registry: "ghcr.io"},
+		{Username: "AWS", Password: "short-lived", Registry: "1234.dkr.ecr.eu-central-1.amazonaws.com"},
+	}, p.DockerCredentials)
+
+	// Credentials of helpers are reused for a while, but only within the organisation
+	_, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, helperCalls)
+	ecr := &services.RegistryCredential{Name: "ecr", Registry: credentials[2].Registry, AuthType: services.RegistryAuthHelper, Helper: "fake-ecr", OrganisationID: 2}
+	require.NoError(t, s.SaveRegistryCredential(ecr))
+	other = &services.Project{Name: "other", UPN: "other-upn", RegistryCredentials: services.StringList{"ecr"}}
+	require.NoError(t, s.SaveProject(other, "2"))
+	assert.Equal(t, 2, helperCalls)
+
+	// Switching credentials doesn't touch the stored ones
+	p.RegistryCredentials = services.StringList{"hub-readonly"}
+	require.NoError(t, s.UpdateProject(p))
+	assert.Equal(t, []services.DockerCredential{{Username: "reader", Password: "reader-pass", Registry: "docker.io"}}, p.DockerCredentials)
+	p.RegistryCredentials = services.StringList{"unknown"}
+	assert.ErrorIs(t, s.UpdateProject(p), services.ErrInvalidRegistryCredentials)
+	_, err = s.SelectRegistryCredential(1, "hub")
+	require.NoError(t, err)
+
+	// Credentials which are in use can't be deleted
+	projects, err := s.SelectRegistryCredentialProjects(1, "hub-readonly")
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	assert.Equal(t, "shop-upn", projects[0].UniqueName)
+	assert.ErrorIs(t, s.DeleteRegistryCredential(1, "hub-readonly"), services.ErrRegistryCredentialInUse)
+	require.NoError(t, s.DeleteRegistryCredential(1, "hub"))
+	_, err = s.SelectRegistryCredential(1, "hub")
+	assert.Error(t, err)
+
+	// Test logins authenticate like "docker login" does
+	server := httptest.NewServer(&fakeRegistry{})
+	defer server.Close()
+	login := &services.RegistryCredential{Name: "fake", Registry: server.URL, AuthType: services.RegistryAuthBasic, Username: "ci", Password: "secret"}
+	require.NoError(t, s.TestRegistryCredential(context.Background(), login))
+	login.Password = "wrong"
+	assert.Error(t, s.TestRegistryCredential(context.Background(), login))
+	helperLogin := &services.RegistryCredential{Name: "fake", Registry: server.URL, AuthType: services.RegistryAuthHelper, Helper: "fake-ecr"}
+	assert.Error(t, s.TestRegistryCredential(context.Background(), helperLogin))
+	assert.Equal(t, 3, helperCalls)
+}
@@ -0,0 +1,276 @@
+package main_tests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/backup"
+	"github.com/devs-group/sloth/backend/pkg/secrets"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestKeyring(t *testing.T) {
+	old, err := secrets.NewKeyring(testKey("old", 1))
+	require.NoError(t, err)
+	encrypted, err := old.Encrypt("hunter2")
+	require.NoError(t, err)
+	assert.True(t, secrets.IsEncrypted(encrypted))
+	assert.NotContains(t, encrypted, "hunter2")
+	decrypted, err := old.Decrypt(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", decrypted)
+
+	// Values of the old key are rewrapped by the new primary key
+	rotated, err := secrets.NewKeyring(testKey("new", 2) + "," + testKey("old", 1))
+	require.NoError(t, err)
+	value, changed, err := rotated.Rotate(encrypted)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, value, "enc:v1:new:")
+	_, changed, err = rotated.Rotate(value)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	current, err := secrets.NewKeyring(testKey("new", 2))
+	require.NoError(t, err)
+	decrypted, err = current.Decrypt(value)
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", decrypted)
+	_, err = current.Decrypt(encrypted)
+	assert.Error(t, err)
+
+	// Plaintext is passed through without keys
+	none, err := secrets.NewKeyring("")
+	require.NoError(t, err)
+	value, err = none.Encrypt("hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+	_, err = none.Decrypt(encrypted)
+	assert.Error(t, err)
+
+	_, err = secrets.NewKeyring("short:" + base64.StdEncoding.EncodeToString([]byte("key")))
+	assert.Error(t, err)
+}
+
+func TestSecretsAtRest(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("SECRET_KEYS", testKey("old", 1))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('secrets')`)
+	require.NoError(t, err)
+
+	s := services.New(dbService)
+	credential := &services.RegistryCredential{
+		Name: "ci", Registry: "registry.example.com", AuthType: services.RegistryAuthBasic, Username: "ci", Password: "registry-pass", OrganisationID: 1,
+	}
+	require.NoError(t, s.SaveRegistryCredential(credential))
+	p := &services.Project{
+		Name:                "shop",
+		UPN:                 "shop-upn",
+		RegistryCredentials: services.StringList{"ci"},
+		Services: []*services.Service{{
+			Name:          "api",
+			Image:         "acme/api",
+			ImageTag:      "1.0.0",
+			EnvVars:       [][]string{{"LOG_LEVEL", "info"}, {"DB_PASSWORD", "it's $ecret"}},
+			SecretEnvVars: []string{"DB_PASSWORD"},
+		}},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+
+	// Secrets are neither stored as plaintext nor part of the DCJ
+	var dcj, secretEnv, password string
+	require.NoError(t, conn.QueryRow(`SELECT dcj, secret_env FROM services WHERE project_id = $1`, p.ID).Scan(&dcj, &secretEnv))
+	assert.Contains(t, dcj, "LOG_LEVEL=info")
+	assert.NotContains(t, dcj, "DB_PASSWORD")
+	assert.Contains(t, secretEnv, "enc:v1:old:")
+	assert.NotContains(t, secretEnv, "ecret")
+	require.NoError(t, conn.QueryRow(`SELECT password FROM registry_credentials WHERE id = $1`, credential.ID).Scan(&password))
+	assert.True(t, secrets.IsEncrypted(password))
+
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	require.Len(t, p.Services, 1)
+	api := p.Services[0]
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info", "DB_PASSWORD": "it's $ecret"}, api.EnvMap())
+	assert.Equal(t, []string{"DB_PASSWORD"}, api.SecretEnvVars)
+
+	// Masked secrets sent back by clients keep their stored values
+	p.MaskSecrets()
+	assert.Equal(t, services.SecretMask, api.EnvMap()["DB_PASSWORD"])
+	assert.Equal(t, "info", api.EnvMap()["LOG_LEVEL"])
+	require.NoError(t, s.UpdateProject(p))
+	assert.Equal(t, "it's $ecret", api.EnvMap()["DB_PASSWORD"])
+	require.Len(t, p.DockerCredentials, 1)
+	assert.Equal(t, "registry-pass", p.DockerCredentials[0].Password)
+
+	// Env vars are passed by an env file only the owner can read
+	require.NoError(t, s.PrepareProject(p))
+	compose, err := os.ReadFile(path.Join(p.UPN.GetProjectPath(), "docker-compose.yml"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(compose), "ecret")
+	assert.Contains(t, string(compose), "./env/"+api.Usn+".env")
+	envFile := path.Join(p.UPN.GetProjectPath(), "env", api.Usn+".env")
+	info, err := os.Stat(envFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	env, err := os.ReadFile(envFile)
+	require.NoError(t, err)
+	assert.Equal(t, "LOG_LEVEL='info'\nDB_PASSWORD=\"it's \\$ecret\"\n", string(env))
+
+	// Plaintext secrets of older versions are encrypted, the ones of rotated keys are reencrypted
+	_, err = conn.Exec(`UPDATE registry_credentials SET password = 'registry-pass' WHERE id = $1`, credential.ID)
+	require.NoError(t, err)
+	_, err = conn.Exec(
+		`INSERT INTO services (name, usn, project_id, dcj) VALUES ('legacy', 'legacy-usn', $1, $2)`,
+		p.ID, `{"legacy-usn":{"image":"acme/legacy:1","environment":["API_TOKEN=abc","MODE=prod"]}}`,
+	)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO gitops_sources (repository, token, project_id) VALUES ('https://example.com/shop.git', 'gitops-token', $1)`, p.ID)
+	require.NoError(t, err)
+	_, err = conn.Exec(`UPDATE services SET build_source = '{"repository":"https://example.com/legacy.git","token":"build-token"}' WHERE usn = 'legacy-usn'`)
+	require.NoError(t, err)
+	_, err = conn.Exec(
+		`INSERT INTO backup_schedules (cron, mode, target_type, target_config, project_id) VALUES ('@daily', 'volume', 's3', $1, $2)`,
+		`{"bucket":"backups","access_key":"s3-access","secret_key":"s3-secret"}`, p.ID,
+	)
+	require.NoError(t, err)
+	t.Setenv("SECRET_KEYS", testKey("new", 2)+","+testKey("old", 1))
+	require.NoError(t, s.MigrateSecrets())
+
+	require.NoError(t, conn.QueryRow(`SELECT password FROM registry_credentials WHERE id = $1`, credential.ID).Scan(&password))
+	assert.Contains(t, password, "enc:v1:new:")
+	require.NoError(t, conn.QueryRow(`SELECT secret_env FROM services WHERE usn = 'legacy-usn'`).Scan(&secretEnv))
+	assert.Contains(t, secretEnv, "enc:v1:new:")
+	require.NoError(t, conn.QueryRow(`SELECT secret_env FROM services WHERE usn = $1`, api.Usn).Scan(&secretEnv))
+	assert.Contains(t, secretEnv, "enc:v1:new:")
+	var token, build string
+	require.NoError(t, conn.QueryRow(`SELECT token FROM gitops_sources WHERE project_id = $1`, p.ID).Scan(&token))
+	assert.Contains(t, token, "enc:v1:new:")
+	require.NoError(t, conn.QueryRow(`SELECT build_source FROM services WHERE usn = 'legacy-usn'`).Scan(&build))
+	assert.NotContains(t, build, "build-token")
+	var targetConfig string
+	require.NoError(t, conn.QueryRow(`SELECT target_config FROM backup_schedules WHERE project_id = $1`, p.ID).Scan(&targetConfig))
+	assert.NotContains(t, targetConfig, "s3-secret")
+	assert.Contains(t, targetConfig, "enc:v1:new:")
+
+	// The old key isn't needed anymore
+	t.Setenv("SECRET_KEYS", testKey("new", 2))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	require.Len(t, p.Services, 2)
+	for _, service := range p.Services {
+		switch service.Name {
+		case "api":
+			assert.Equal(t, "it's $ecret", service.EnvMap()["DB_PASSWORD"])
+		case "legacy":
+			assert.Equal(t, map[string]string{"API_TOKEN": "abc", "MODE": "prod"}, service.EnvMap())
+			assert.Equal(t, []string{"API_TOKEN"}, service.SecretEnvVars)
+			assert.Equal(t, "build-token", service.Build.Token)
+		}
+	}
+}
+
+func TestSecretsWithoutClientHints(t *testing.T) {
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	t.Setenv("SECRET_KEYS", testKey("primary", 1))
+
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('secrets')`)
+	require.NoError(t, err)
+
+	// Env vars which look like secrets are encrypted, even if the client didn't mark them
+	s := services.New(dbService)
+	p := &services.Project{
+		Name: "shop",
+		UPN:  "shop-upn",
+		Services: []*services.Service{{
+			Name:     "api",
+			Image:    "acme/api",
+			ImageTag: "1.0.0",
+			EnvVars:  [][]string{{"API_TOKEN", "abc"}, {"SIGNING", "xyz"}, {"MODE", "prod"}},
+		}},
+	}
+	require.NoError(t, s.SaveProject(p, "1"))
+	var dcj string
+	require.NoError(t, conn.Get(&dcj, `SELECT dcj FROM services WHERE project_id = $1`, p.ID))
+	assert.NotContains(t, dcj, "abc")
+	assert.Contains(t, dcj, "SIGNING=xyz")
+
+	// Env vars marked once stay secret when clients send them back without the mark
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	p.Services[0].SecretEnvVars = append(p.Services[0].SecretEnvVars, "SIGNING")
+	require.NoError(t, s.UpdateProject(p))
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	p.MaskSecrets()
+	p.Services[0].SecretEnvVars = nil
+	require.NoError(t, s.UpdateProject(p))
+	require.NoError(t, conn.Get(&dcj, `SELECT dcj FROM services WHERE project_id = $1`, p.ID))
+	assert.NotContains(t, dcj, "xyz")
+	assert.Contains(t, dcj, "MODE=prod")
+	p, err = s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"API_TOKEN": "abc", "SIGNING": "xyz", "MODE": "prod"}, p.Services[0].EnvMap())
+
+	// Credentials of gitops sources and env vars of environments are encrypted as well
+	source := services.GitOpsSource{Repository: "https://example.com/shop.git", Token: "gitops-token", ProjectID: p.ID}
+	require.NoError(t, s.SaveGitOpsSource(&source))
+	var token string
+	require.NoError(t, conn.Get(&token, `SELECT token FROM gitops_sources WHERE project_id = $1`, p.ID))
+	assert.True(t, secrets.IsEncrypted(token))
+	g, err := s.SelectGitOpsSource(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "gitops-token", g.Token)
+
+	overrides := services.EnvironmentOverrides{"api": {EnvVars: map[string]string{"DB_PASSWORD": "staging-pass"}}}
+	value, err := overrides.Value()
+	require.NoError(t, err)
+	assert.NotContains(t, value, "staging-pass")
+	var scanned services.EnvironmentOverrides
+	require.NoError(t, scanned.Scan(value))
+	assert.Equal(t, overrides, scanned)
+
+	bs := &services.BackupSchedule{
+		Cron:         "@daily",
+		Mode:         services.BackupModeVolume,
+		TargetType:   backup.TargetTypeS3,
+		TargetConfig: backup.TargetConfig{Bucket: "backups", AccessKey: "s3-access", SecretKey: "s3-secret"},
+		ProjectID:    p.ID,
+	}
+	require.NoError(t, s.SaveBackupSchedule(bs))
+	var targetConfig string
+	require.NoError(t, conn.Get(&targetConfig, `SELECT target_config FROM backup_schedules WHERE id = $1`, bs.ID))
+	assert.NotContains(t, targetConfig, "s3-secret")
+	assert.Contains(t, targetConfig, "s3-access")
+	bs.TargetConfig.SecretKey = ""
+	require.NoError(t, s.UpdateBackupSchedule(bs))
+	bs, err = s.SelectBackupSchedule(p.ID, bs.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "s3-secret", bs.TargetConfig.SecretKey)
+
+	// Secrets are never stored as plaintext, the backend doesn't start without keys
+	t.Setenv("SECRET_KEYS", "")
+	assert.ErrorIs(t, s.MigrateSecrets(), services.ErrNoSecretKeys)
+	_, err = overrides.Value()
+	assert.ErrorIs(t, err, services.ErrNoSecretKeys)
+}
@@ -0,0 +1,146 @@
+package main_tests
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/devs-group/sloth/backend/pkg/compose"
+	"github.com/devs-group/sloth/backend/services"
+)
+
+func TestTypedVolumesRoundTripThroughDCJ(t *testing.T) {
+	var volumes []services.Volume
+	require.NoError(t, json.Unmarshal([]byte(`[
+		"/data",
+		{"type": "bind", "target": "/config", "read_only": true},
+		{"type": "volume", "target": "/cache", "name": "cache", "driver": "local", "driver_opts": {"type": "nfs", "device": ":/exports"}},
+		{"type": "tmpfs", "target": "/tmp", "size": 1048576}
+	]`), &volumes))
+
+	service := &services.Service{
+		Name:     "app",
+		Usn:      "brave-app",
+		Image:    "nginx",
+		ImageTag: "latest",
+		Volumes:  volumes,
+	}
+	s := services.New(nil)
+	dc, err := s.GenerateDockerCompose(&services.Project{UPN: "upn", Services: []*services.Service{service}})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]*compose.Volume{
+		"brave-app-cache": {Driver: "local", DriverOpts: map[string]string{"type": "nfs", "device": ":/exports"}},
+	}, dc.Volumes)
+	assert.Equal(t, []compose.VolumeMount{
+		{Type: compose.VolumeTypeBind, Source: "./data/brave-app/data", Target: "/data"},
+		{Type: compose.VolumeTypeBind, Source: "./data/brave-app/config", Target: "/config", ReadOnly: true},
+		{Type: compose.VolumeTypeVolume, Source: "brave-app-cache", Target: "/cache"},
+		{Type: compose.VolumeTypeTmpfs, Target: "/tmp", Tmpfs: &compose.TmpfsOptions{Size: 1048576}},
+	}, dc.Services["brave-app"].Volumes)
+
+	dcj, err := json.Marshal(dc.Services["brave-app"])
+	require.NoError(t, err)
+	read, err := s.ReadServiceFromDCJ(services.Service{Name: "app", Usn: "brave-app", DCJ: string(dcj)})
+	require.NoError(t, err)
+	assert.Equal(t, volumes, read.Volumes)
+
+	b, err := json.Marshal(read.Volumes[:2])
+	require.NoError(t, err)
+	assert.JSONEq(t, `["/data", {"type": "bind", "target": "/config", "read_only": true}]`, string(b))
+}
+
+func TestReadServiceFromDCJWithShortSyntaxVolumes(t *testing.T) {
+	dcj := `{"image": "nginx:latest", "restart": "always", "volumes": ["./data/brave-app/data:/data", "cache:/cache:ro", "/anonymous"]}`
+
+	read, err := services.New(nil).ReadServiceFromDCJ(services.Service{Usn: "brave-app", DCJ: dcj})
+	require.NoError(t, err)
+	assert.Equal(t, []services.Volume{
+		{Type: compose.VolumeTypeBind, Target: "/data"},
+		{Type: compose.VolumeTypeVolume, Target: "/cache", Name: "cache", ReadOnly: true},
+		{Type: compose.VolumeTypeVolume, Target: "/anonymous"},
+	}, read.Volumes)
+
+	_, err = services.New(nil).ReadServiceFromDCJ(services.Service{DCJ: `{"image": "nginx:latest", "volumes": [""]}`})
+	assert.Error(t, err)
+}
+
+func TestInvalidVolumesAreRejected(t *testing.T) {
+	for _, v := range []services.Volume{
+		{Type: compose.VolumeTypeBind, Target: "relative"},
+		{Type: compose.VolumeTypeBind, Target: "/"},
+		{Type: compose.VolumeTypeBind, Target: "/.."},
+		{Type: compose.VolumeTypeBind, Target: "/data/../../etc"},
+		{Type: compose.VolumeTypeBind, Target: "/data//uploads"},
+		{Type: compose.VolumeTypeVolume, Target: "/cache/../..", Name: "cache"},
+		{Type: compose.VolumeTypeVolume, Target: "/cache", Name: "../escape"},
+		{Type: compose.VolumeTypeTmpfs, Target: "/tmp", Size: -1},
+		{Type: "nfs", Target: "/nfs"},
+	} {
+		service := &services.Service{Usn: "brave-app", Image: "nginx", ImageTag: "latest", Volumes: []services.Volume{v}}
+		_, err := services.New(nil).GenerateDockerCompose(&services.Project{Services: []*services.Service{service}})
+		assert.Error(t, err, v)
+	}
+}
+
+func TestSharedVolumesAreManagedByTheProject(t *testing.T) {
+	dbService := SetupTestEnvironment(t)
+	conn := dbService.GetConn()
+	defer conn.Close()
+	defer dbService.Delete()
+
+	t.Setenv("PROJECTS_DIR", t.TempDir())
+	_, err := conn.Exec(`INSERT INTO organisations (name) VALUES ('shared')`)
+	require.NoError(t, err)
+
+	app := &services.Service{
+		Name: "app", Image: "php", ImageTag: "8",
+		Volumes: []services.Volume{{Type: services.VolumeTypeShared, Target: "/var/www/public", Name: "assets"}},
+	}
+	web := &services.Service{
+		Name: "web", Image: "nginx", ImageTag: "latest",
+		Volumes: []services.Volume{{Type: services.VolumeTypeShared, Target: "/usr/share/nginx/html", Name: "assets", ReadOnly: true}},
+	}
+	p := &services.Project{
+		Name:           "shared",
+		UPN:            "shared-upn",
+		OrganisationID: "1",
+		Services:       []*services.Service{app, web},
+		SharedVolumes:  []services.SharedVolume{{Name: "assets"}},
+	}
+
+	s := services.New(dbService)
+	require.NoError(t, s.SaveProject(p, "1"))
+	require.NoError(t, s.PrepareProject(p))
+
+	assert.Equal(t, []compose.VolumeMount{
+		{Type: compose.VolumeTypeBind, Source: "./shared/assets", Target: "/usr/share/nginx/html", ReadOnly: true},
+	}, p.ComposeServices[web.Usn].Volumes)
+	assetsDir := path.Join(p.UPN.GetProjectPath(), "shared", "assets")
+	require.DirExists(t, assetsDir)
+
+	stored, err := s.SelectProjectByID(p.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "assets", stored.SharedVolumes[0].Name)
+	for _, service := range stored.Services {
+		assert.Equal(t, services.VolumeTypeShared, service.Volumes[0].Type)
+	}
+
+	// Unmounting it from a service keeps the data
+	app.Volumes = nil
+	p.SharedVolumes = nil
+	require.NoError(t, s.UpdateProject(p))
+	assert.DirExists(t, assetsDir)
+
+	// It can't be removed while it's still mounted
+	p.SharedVolumes = []services.SharedVolume{}
+	assert.Error(t, s.UpdateProject(p))
+	assert.DirExists(t, assetsDir)
+
+	web.Volumes = nil
+	require.NoError(t, s.UpdateProject(p))
+	assert.NoDirExists(t, assetsDir)
+}
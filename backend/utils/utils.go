@@ -3,6 +3,7 @@ package utils
 import (
 	"crypto/rand"
 	"fmt"
+	"io/fs"
 	"math/big"
 	"os"
 	"path"
@@ -54,6 +55,43 @@ func DeleteFolder(p string) error {
 	return nil
 }
 
+// DirSize returns the summed up size of all files below p. A missing directory has a size of 0.
+func DirSize(p string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// FormatBytes formats a size in bytes for humans, e.g. 1.5 GiB
+func FormatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
 func RandStringRunes(n int) (string, error) {
 	var runes = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
 	b := make([]rune, n)
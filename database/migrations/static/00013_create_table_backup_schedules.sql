@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS backup_schedules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- Empty when all services of the project are backed up
+    usn VARCHAR(255) NOT NULL DEFAULT '',
+    cron VARCHAR(255) NOT NULL,
+    keep_daily INTEGER NOT NULL DEFAULT 7,
+    keep_weekly INTEGER NOT NULL DEFAULT 4,
+    -- e.g. 'local', 's3'
+    target_type VARCHAR(32) NOT NULL,
+    target_config JSON NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    next_run_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_BackupSchedule_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT CK_CronNotEmpty CHECK (cron <> ''),
+    CONSTRAINT CK_TargetTypeValid CHECK (target_type IN ('local', 's3'))
+);
+
+CREATE INDEX IDX_BackupSchedule_ProjectID ON backup_schedules (project_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS backup_schedules;
@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS backup_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    usn VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    object_key VARCHAR(1024) NOT NULL DEFAULT '',
+    size_bytes INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL,
+
+    -- Foreign Keys
+    schedule_id INTEGER NOT NULL,
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_BackupRun_Schedule FOREIGN KEY (schedule_id) REFERENCES backup_schedules(id) ON DELETE CASCADE,
+    CONSTRAINT FK_BackupRun_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT CK_StatusValid CHECK (status IN ('running', 'succeeded', 'failed', 'pruned'))
+);
+
+CREATE INDEX IDX_BackupRun_ProjectID ON backup_runs (project_id);
+CREATE INDEX IDX_BackupRun_ScheduleID ON backup_runs (schedule_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS backup_runs;
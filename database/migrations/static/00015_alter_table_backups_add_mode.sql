@@ -0,0 +1,11 @@
+-- +goose Up
+-- 'volume' archives the data directory of a service, 'dump' uses the native dump tool of a database service
+ALTER TABLE backup_schedules ADD COLUMN mode VARCHAR(32) NOT NULL DEFAULT 'volume' CHECK (mode IN ('volume', 'dump'));
+ALTER TABLE backup_runs ADD COLUMN mode VARCHAR(32) NOT NULL DEFAULT 'volume' CHECK (mode IN ('volume', 'dump'));
+-- Name of the database engine for dumps, e.g. 'postgres'
+ALTER TABLE backup_runs ADD COLUMN engine VARCHAR(32) NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE backup_runs DROP COLUMN engine;
+ALTER TABLE backup_runs DROP COLUMN mode;
+ALTER TABLE backup_schedules DROP COLUMN mode;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- 0 when the volumes of the service are unlimited
+ALTER TABLE services ADD COLUMN volume_limit_bytes INTEGER NOT NULL DEFAULT 0;
+-- Refuse deployments while the volumes of the service exceed the limit
+ALTER TABLE services ADD COLUMN block_deploy_over_limit BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN block_deploy_over_limit;
+ALTER TABLE services DROP COLUMN volume_limit_bytes;
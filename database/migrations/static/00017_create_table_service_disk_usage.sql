@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS service_disk_usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    usn VARCHAR(255) NOT NULL,
+    size_bytes INTEGER NOT NULL DEFAULT 0,
+    -- Set while the size exceeds the limit of the service, so members are only notified once
+    over_limit BOOLEAN NOT NULL DEFAULT FALSE,
+    scanned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ServiceDiskUsage_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Project_Usn UNIQUE(project_id, usn)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS service_disk_usage;
@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS shared_volumes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_SharedVolume_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Project_SharedVolume UNIQUE(project_id, name)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS shared_volumes;
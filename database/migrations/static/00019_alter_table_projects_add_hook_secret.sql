@@ -0,0 +1,7 @@
+-- +goose Up
+-- Secret to verify the signatures of webhook deliveries
+ALTER TABLE projects ADD COLUMN hook_secret VARCHAR(255) NOT NULL DEFAULT '';
+UPDATE projects SET hook_secret = lower(hex(randomblob(16)));
+
+-- +goose Down
+ALTER TABLE projects DROP COLUMN hook_secret;
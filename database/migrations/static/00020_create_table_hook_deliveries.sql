@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS hook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- How the delivery was authenticated, e.g. 'github'
+    provider VARCHAR(32) NOT NULL DEFAULT '',
+    event VARCHAR(255) NOT NULL DEFAULT '',
+    image VARCHAR(1024) NOT NULL DEFAULT '',
+    tag VARCHAR(255) NOT NULL DEFAULT '',
+    -- JSON array of the redeployed usns
+    services TEXT NOT NULL DEFAULT '[]',
+    status VARCHAR(32) NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_HookDelivery_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT CK_StatusValid CHECK (status IN ('succeeded', 'failed', 'ignored', 'rejected'))
+);
+
+CREATE INDEX IDX_HookDelivery_ProjectID ON hook_deliveries (project_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS hook_deliveries;
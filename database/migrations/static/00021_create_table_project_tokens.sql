@@ -0,0 +1,24 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS project_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    -- SHA-256 of the token, the token itself is only shown once
+    token_hash VARCHAR(64) NOT NULL,
+    -- JSON array of scopes, e.g. ["deploy", "read-state"]
+    scopes TEXT NOT NULL DEFAULT '[]',
+    expires_at TIMESTAMP NULL,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ProjectToken_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_ProjectToken_Hash UNIQUE(token_hash)
+);
+
+CREATE INDEX IDX_ProjectToken_ProjectID ON project_tokens (project_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS project_tokens;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- Service accounts are users owning the API tokens of an organisation, nobody can log in with them
+ALTER TABLE users ADD COLUMN is_service_account BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN is_service_account;
@@ -0,0 +1,29 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    -- SHA-256 of the token, the token itself is only shown once
+    token_hash VARCHAR(64) NOT NULL,
+    -- JSON array of scopes, e.g. ["read", "write"]
+    scopes TEXT NOT NULL DEFAULT '[]',
+    expires_at TIMESTAMP NULL,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    -- The user the token authenticates as, the service account for organisation tokens
+    user_id INTEGER NOT NULL,
+    -- NULL for personal tokens
+    organisation_id INTEGER NULL,
+
+    CONSTRAINT FK_APIToken_User FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+    CONSTRAINT FK_APIToken_Organisation FOREIGN KEY (organisation_id) REFERENCES organisations(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_APIToken_Hash UNIQUE(token_hash)
+);
+
+CREATE INDEX IDX_APIToken_UserID ON api_tokens (user_id);
+CREATE INDEX IDX_APIToken_OrganisationID ON api_tokens (organisation_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS api_tokens;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- '' when the image of the service isn't updated automatically, otherwise exact, semver, regex or digest
+ALTER TABLE services ADD COLUMN update_policy VARCHAR(20) NOT NULL DEFAULT '';
+-- The tag, version range or regular expression of the policy
+ALTER TABLE services ADD COLUMN update_constraint VARCHAR(255) NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN update_constraint;
+ALTER TABLE services DROP COLUMN update_policy;
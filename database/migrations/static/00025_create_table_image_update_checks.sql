@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS image_update_checks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    usn VARCHAR(255) NOT NULL,
+    image VARCHAR(1024) NOT NULL DEFAULT '',
+    policy VARCHAR(20) NOT NULL DEFAULT '',
+    current_tag VARCHAR(255) NOT NULL DEFAULT '',
+    -- The tag chosen by the policy, '' if no tag of the registry matches
+    selected_tag VARCHAR(255) NOT NULL DEFAULT '',
+    digest VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(32) NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    checked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ImageUpdateCheck_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT CK_StatusValid CHECK (status IN ('updated', 'up-to-date', 'failed'))
+);
+
+CREATE INDEX IDX_ImageUpdateCheck_ProjectID_Usn ON image_update_checks (project_id, usn);
+
+-- +goose Down
+DROP TABLE IF EXISTS image_update_checks;
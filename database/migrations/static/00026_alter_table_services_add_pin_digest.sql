@@ -0,0 +1,6 @@
+-- +goose Up
+-- Deploy the digest the tag resolved to at the last deployment instead of the tag
+ALTER TABLE services ADD COLUMN pin_digest BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN pin_digest;
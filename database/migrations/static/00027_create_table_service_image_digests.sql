@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS service_image_digests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    usn VARCHAR(255) NOT NULL,
+    -- The image with tag the digest was resolved from, e.g. 'nginx:latest'
+    image VARCHAR(1024) NOT NULL,
+    digest VARCHAR(255) NOT NULL,
+    deployed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ServiceImageDigest_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Project_Usn UNIQUE(project_id, usn)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS service_image_digests;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- The git repository the image of the service is built from as JSON, NULL for prebuilt images
+ALTER TABLE services ADD COLUMN build_source TEXT;
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN build_source;
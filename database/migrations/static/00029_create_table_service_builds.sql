@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS service_builds (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    usn VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    repository VARCHAR(1024) NOT NULL,
+    ref VARCHAR(255) NOT NULL DEFAULT '',
+    -- The commit the ref resolved to, '' until the repository is cloned
+    commit_sha VARCHAR(64) NOT NULL DEFAULT '',
+    -- The built image with tag, '' until the image is built
+    image VARCHAR(1024) NOT NULL DEFAULT '',
+    log TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ServiceBuild_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT CK_StatusValid CHECK (status IN ('running', 'succeeded', 'failed'))
+);
+
+CREATE INDEX IDX_ServiceBuild_ProjectID_Usn ON service_builds (project_id, usn);
+
+-- +goose Down
+DROP TABLE IF EXISTS service_builds;
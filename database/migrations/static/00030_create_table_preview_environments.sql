@@ -0,0 +1,25 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS preview_environments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The branch or pull request, slugged for the use in hostnames
+    branch VARCHAR(63) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    -- The project the preview is derived from
+    parent_id INTEGER NOT NULL,
+    -- The project running the preview
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_PreviewEnvironment_Parent FOREIGN KEY (parent_id) REFERENCES projects(id) ON DELETE CASCADE,
+    CONSTRAINT FK_PreviewEnvironment_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Parent_Branch UNIQUE(parent_id, branch),
+    CONSTRAINT UQ_Project UNIQUE(project_id),
+    CONSTRAINT CK_BranchNotEmpty CHECK (branch <> '')
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS preview_environments;
@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS project_environments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- e.g. staging or production, used in UPNs and hostnames
+    name VARCHAR(63) NOT NULL,
+    -- JSON object of the overrides of the services by service name
+    overrides TEXT NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    -- The project the environment is derived from
+    parent_id INTEGER NOT NULL,
+    -- The project running the environment
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ProjectEnvironment_Parent FOREIGN KEY (parent_id) REFERENCES projects(id) ON DELETE CASCADE,
+    CONSTRAINT FK_ProjectEnvironment_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Parent_Name UNIQUE(parent_id, name),
+    CONSTRAINT UQ_Project UNIQUE(project_id),
+    CONSTRAINT CK_NameNotEmpty CHECK (name <> '')
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS project_environments;
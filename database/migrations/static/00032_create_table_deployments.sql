@@ -0,0 +1,24 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS deployments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- deploy or promotion
+    kind VARCHAR(20) NOT NULL,
+    -- The environment the images were promoted from
+    source VARCHAR(63) NOT NULL DEFAULT '',
+    -- succeeded or failed
+    status VARCHAR(20) NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    -- JSON array of the deployed images of the services
+    images TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_Deployment_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IDX_Deployment_ProjectID ON deployments (project_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS deployments;
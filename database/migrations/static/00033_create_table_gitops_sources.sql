@@ -0,0 +1,31 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS gitops_sources (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    repository TEXT NOT NULL,
+    -- Branch, tag or commit, the default branch when empty
+    ref TEXT NOT NULL DEFAULT '',
+    -- Path of the manifest within the repository
+    path TEXT NOT NULL DEFAULT 'sloth.yaml',
+    deploy_key TEXT NOT NULL DEFAULT '',
+    token TEXT NOT NULL DEFAULT '',
+    -- pending, synced, invalid or failed
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    message TEXT NOT NULL DEFAULT '',
+    -- The commit of the last sync
+    commit_sha VARCHAR(64) NOT NULL DEFAULT '',
+    -- JSON object of the changes applied by the last sync
+    diff TEXT,
+    synced_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_GitOpsSource_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Project UNIQUE(project_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS gitops_sources;
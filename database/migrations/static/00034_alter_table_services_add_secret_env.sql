@@ -0,0 +1,6 @@
+-- +goose Up
+-- The secret env vars of the service by key as JSON, values are encrypted, see MigrateSecrets
+ALTER TABLE services ADD COLUMN secret_env TEXT NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN secret_env;
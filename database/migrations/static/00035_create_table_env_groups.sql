@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS env_groups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(63) NOT NULL,
+    -- JSON array of the env vars, values of secret ones are encrypted
+    vars TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    organisation_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_EnvGroup_Organisation FOREIGN KEY (organisation_id) REFERENCES organisations(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Organisation_Name UNIQUE(organisation_id, name),
+    CONSTRAINT CK_NameNotEmpty CHECK (name <> '')
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS env_groups;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- JSON array of the names of the env groups of the organisation the service uses
+ALTER TABLE services ADD COLUMN env_groups TEXT NOT NULL DEFAULT '[]';
+
+-- +goose Down
+ALTER TABLE services DROP COLUMN env_groups;
@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS registry_credentials (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(63) NOT NULL,
+    registry VARCHAR(255) NOT NULL,
+    -- basic, token or helper
+    auth_type VARCHAR(15) NOT NULL DEFAULT 'basic',
+    username VARCHAR(255) NOT NULL DEFAULT '',
+    -- Password or token, encrypted
+    password TEXT NOT NULL DEFAULT '',
+    -- Credential helper of helper credentials, e.g. "ecr-login"
+    helper VARCHAR(63) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    organisation_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_RegistryCredential_Organisation FOREIGN KEY (organisation_id) REFERENCES organisations(id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Organisation_Name UNIQUE(organisation_id, name),
+    CONSTRAINT CK_NameNotEmpty CHECK (name <> '')
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS registry_credentials;
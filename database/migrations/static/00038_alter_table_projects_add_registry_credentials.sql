@@ -0,0 +1,6 @@
+-- +goose Up
+-- JSON array of the names of the registry credentials of the organisation the project uses
+ALTER TABLE projects ADD COLUMN registry_credentials TEXT NOT NULL DEFAULT '[]';
+
+-- +goose Down
+ALTER TABLE projects DROP COLUMN registry_credentials;
@@ -0,0 +1,34 @@
+-- +goose Up
+-- Docker credentials of projects become registry credentials of their organisation named "project-<project id>-<id>"
+INSERT INTO registry_credentials (name, registry, auth_type, username, password, organisation_id)
+SELECT 'project-' || p.id || '-' || dc.id, COALESCE(dc.registry, ''), 'basic', COALESCE(dc.username, ''), COALESCE(dc.password, ''), p.organisation_id
+FROM docker_credentials dc
+JOIN projects p ON p.id = dc.project_id;
+
+UPDATE projects
+SET registry_credentials = (
+    SELECT json_group_array('project-' || projects.id || '-' || dc.id)
+    FROM docker_credentials dc
+    WHERE dc.project_id = projects.id
+)
+WHERE EXISTS (SELECT 1 FROM docker_credentials dc WHERE dc.project_id = projects.id);
+
+DROP TABLE IF EXISTS docker_credentials;
+
+-- +goose Down
+CREATE TABLE IF NOT EXISTS docker_credentials (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(255),
+    password VARCHAR(255),
+    registry VARCHAR(255),
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_DockerCredential_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+);
+
+INSERT INTO docker_credentials (username, password, registry, project_id)
+SELECT rc.username, rc.password, rc.registry, p.id
+FROM projects p, json_each(p.registry_credentials) j
+JOIN registry_credentials rc ON rc.organisation_id = p.organisation_id AND rc.name = j.value;
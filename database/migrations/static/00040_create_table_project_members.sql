@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS project_members (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    role VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_ProjectMember_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE,
+    CONSTRAINT FK_ProjectMember_User FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_Project_User UNIQUE(project_id, user_id),
+
+    CONSTRAINT CK_RoleValid CHECK (role IN ('viewer', 'deployer', 'maintainer'))
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS project_members;
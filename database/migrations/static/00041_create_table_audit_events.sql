@@ -0,0 +1,26 @@
+-- +goose Up
+-- Events have no foreign keys, they outlive the users, tokens and projects they refer to
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    actor_type VARCHAR(32) NOT NULL,
+    actor_user_id INTEGER,
+    actor_token_id INTEGER,
+    actor_name VARCHAR(255) NOT NULL DEFAULT '',
+    action VARCHAR(64) NOT NULL,
+    target VARCHAR(255) NOT NULL DEFAULT '',
+    organisation_id INTEGER NOT NULL,
+    project_id INTEGER,
+    project_name VARCHAR(255) NOT NULL DEFAULT '',
+    before TEXT,
+    after TEXT,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+
+    CONSTRAINT CK_ActorTypeValid CHECK (actor_type IN ('user', 'api_token', 'project_token', 'hook', 'system'))
+);
+
+CREATE INDEX IDX_AuditEvent_OrganisationID ON audit_events (organisation_id, created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS audit_events;
@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- 'email_verification' or 'password_reset'
+    purpose VARCHAR(32) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL,
+    valid_until TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Foreign Keys
+    user_id INTEGER NOT NULL,
+
+    CONSTRAINT FK_AuthToken_User FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+
+    CONSTRAINT UQ_AuthToken_TokenHash UNIQUE(token_hash),
+
+    CONSTRAINT CK_PurposeValid CHECK (purpose IN ('email_verification', 'password_reset'))
+);
+
+CREATE INDEX IDX_AuthToken_UserID ON auth_tokens (user_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS auth_tokens;
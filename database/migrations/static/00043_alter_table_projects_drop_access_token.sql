@@ -0,0 +1,24 @@
+-- +goose Up
+-- Plaintext access tokens of projects are hashed into project tokens on startup, see MigrateProjectAccessTokens
+CREATE TABLE IF NOT EXISTS legacy_project_access_tokens (
+    access_token VARCHAR(255) NOT NULL,
+
+    -- Foreign Keys
+    project_id INTEGER NOT NULL PRIMARY KEY,
+
+    CONSTRAINT FK_LegacyProjectAccessToken_Project FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+);
+
+INSERT INTO legacy_project_access_tokens (access_token, project_id)
+SELECT access_token, id FROM projects WHERE access_token != '';
+
+ALTER TABLE projects DROP COLUMN access_token;
+
+-- +goose Down
+ALTER TABLE projects ADD COLUMN access_token VARCHAR(255) NOT NULL DEFAULT '';
+
+UPDATE projects SET access_token = COALESCE(
+    (SELECT access_token FROM legacy_project_access_tokens WHERE project_id = projects.id), ''
+);
+
+DROP TABLE IF EXISTS legacy_project_access_tokens;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- Personal tokens act in the organisation they were created for instead of the current one of their user,
+-- existing ones keep the organisation they acted in so far
+UPDATE api_tokens SET organisation_id = (
+    SELECT current_organisation_id FROM users WHERE users.user_id = api_tokens.user_id
+) WHERE organisation_id IS NULL;
+
+-- +goose Down
+UPDATE api_tokens SET organisation_id = NULL
+WHERE user_id IN (SELECT user_id FROM users WHERE NOT is_service_account);
@@ -41,15 +41,11 @@ export function useService(p: Ref<Project | null>) {
   }
 
   function addCredential() {
-    p.value?.docker_credentials.push({
-      username: '',
-      password: '',
-      registry: '',
-    })
+    p.value?.registry_credentials.push('')
   }
 
   function removeCredential(idx: number) {
-    p.value?.docker_credentials.splice(idx, 1)
+    p.value?.registry_credentials.splice(idx, 1)
   }
 
   function addHost(serviceIdx: number) {
@@ -1,8 +1,8 @@
 import type { NotificationType } from './enums'
-import type DockerCredentialsForm from '~/components/docker-credentials-form.vue'
 import type OrganisationInvitationsForm from '~/components/organisation-invitations-form.vue'
 import type OrganisationMembersForm from '~/components/organisation-members-form.vue'
 import type OrganisationProjectList from '~/components/organisation-project-list.vue'
+import type RegistryCredentialsForm from '~/components/registry-credentials-form.vue'
 import type ServicesForm from '~/components/services-form.vue'
 import type { OrganisationProject } from '~/schema/schema'
 
@@ -97,7 +97,7 @@ export interface TabItem {
   command?: () => void
   component?:
     | typeof ServicesForm
-    | typeof DockerCredentialsForm
+    | typeof RegistryCredentialsForm
     | typeof OrganisationInvitationsForm
     | typeof OrganisationMembersForm
     | typeof OrganisationProjectList
@@ -67,6 +67,8 @@ export const serviceSchema = z.object({
       z.string().refine(s => !s.includes(' '), 'Spaces are not allowed'),
     ),
   ),
+  // Keys of env vars which are stored encrypted and masked in responses
+  secret_env_vars: z.array(z.string()).optional(),
   volumes: z.array(
     z.string().refine(s => !s.includes(' '), 'Spaces are not allowed'),
   ),
@@ -84,13 +86,6 @@ export const serviceSchema = z.object({
   post_deploy_actions: z.array(PostDeployActions).optional(),
 })
 
-export const dockerCredentialSchema = z.object({
-  id: z.number().optional().readonly(),
-  username: z.string().trim().min(1, 'Username is required'),
-  password: z.string().trim().min(1, 'Password is required'),
-  registry: z.string().trim().min(1, 'Registry url is required'),
-})
-
 export const createProjectSchema = z.object({
   name: z.string().min(1, 'A project name is required ☝️🤓'),
 })
@@ -115,11 +110,10 @@ export const projectSchema = z.object({
   id: z.number().readonly(),
   upn: z.string().optional().readonly(),
   hook: z.string().readonly(),
-  access_token: z.string().readonly(),
   name: z.string().min(1, 'A project name is required ☝️🤓'),
   organisation: z.string().optional().readonly(),
   services: z.array(serviceSchema),
-  docker_credentials: z.array(dockerCredentialSchema),
+  registry_credentials: z.array(z.string().trim().min(1, 'Credential name is required')),
 })
 
 export const organisationMemberSchema = z.object({
@@ -153,7 +147,6 @@ export const inviteToOrganisationSchema = z.object({
   organisation_id: z.number().min(0),
 })
 
-export type DockerCredentialSchema = z.output<typeof dockerCredentialSchema>
 
 export type CreateProjectType = z.output<typeof createProjectSchema>
 export type ProjectSchema = z.output<typeof projectSchema>
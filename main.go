@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"log"
@@ -91,6 +92,16 @@ func run(port int) error {
 	}
 
 	r := gin.New()
+	// Only proxies in front of sloth may set the client IP, anybody else could spoof X-Forwarded-For
+	var trustedProxies []string
+	for _, proxy := range strings.Split(cfg.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid trusted proxies: ", err)
+	}
 	r.Use(gin.Recovery())
 	r.Use(func(c *gin.Context) {
 		// Filter nuxt calls out of log for less log flooding
@@ -109,6 +120,10 @@ func run(port int) error {
 	}
 
 	h := handlers.New(dbService, VueFiles)
+	if err := h.MigrateData(); err != nil {
+		log.Fatal("Failed to migrate data: ", err)
+	}
+	h.StartBackgroundJobs(context.Background())
 
 	cookieStore := cookie.NewStore([]byte(cfg.SessionSecret))
 	cookieStore.Options(sessions.Options{